@@ -0,0 +1,170 @@
+package railwayimages
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+
+	"golang.org/x/sync/errgroup"
+)
+
+// BatchItemError is the failure of a single key in a batch operation
+type BatchItemError struct {
+	Key string
+	// The HTTP status code of the failed request, or 0 if there was no
+	// response
+	Status  int
+	Message string
+	// The error the failure is from, e.g. ErrNotFound for a 404, so it can
+	// be matched with errors.Is
+	Err error
+}
+
+func (e BatchItemError) Error() string {
+	if e.Status == 0 {
+		return fmt.Sprintf("%s: %s", e.Key, e.Message)
+	}
+	return fmt.Sprintf("%s: status %d: %s", e.Key, e.Status, e.Message)
+}
+
+func (e BatchItemError) Unwrap() error {
+	return e.Err
+}
+
+// BatchError is returned by batch operations when some keys failed. It keeps
+// the keys that succeeded, so callers can retry only the failures.
+type BatchError struct {
+	Succeeded []string
+	Failed    []BatchItemError
+}
+
+func (e *BatchError) Error() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "%d of %d batch operations failed", len(e.Failed), len(e.Failed)+len(e.Succeeded))
+	for _, f := range e.Failed {
+		b.WriteString("\n" + f.Error())
+	}
+	return b.String()
+}
+
+// Unwrap returns the failures of individual keys
+func (e *BatchError) Unwrap() []error {
+	errs := make([]error, len(e.Failed))
+	for n, f := range e.Failed {
+		errs[n] = f
+	}
+	return errs
+}
+
+// FailedKeys returns the keys that failed, in the order they were reported
+func (e *BatchError) FailedKeys() []string {
+	keys := make([]string, len(e.Failed))
+	for n, f := range e.Failed {
+		keys[n] = f.Key
+	}
+	return keys
+}
+
+// FailedWithStatus returns the failures with the given HTTP status code, e.g.
+// http.StatusConflict for keys that were locked by another write
+func (e *BatchError) FailedWithStatus(status int) []BatchItemError {
+	var failed []BatchItemError
+	for _, f := range e.Failed {
+		if f.Status == status {
+			failed = append(failed, f)
+		}
+	}
+	return failed
+}
+
+// batchResults collects the outcomes of a batch operation that runs
+// concurrently
+type batchResults struct {
+	mu  sync.Mutex
+	err BatchError
+}
+
+func (b *batchResults) succeed(key string) {
+	b.mu.Lock()
+	b.err.Succeeded = append(b.err.Succeeded, key)
+	b.mu.Unlock()
+}
+
+func (b *batchResults) fail(failure BatchItemError) {
+	b.mu.Lock()
+	b.err.Failed = append(b.err.Failed, failure)
+	b.mu.Unlock()
+}
+
+// result returns a *BatchError if any key failed, or nil otherwise
+func (b *batchResults) result() error {
+	if len(b.err.Failed) == 0 {
+		return nil
+	}
+	return &b.err
+}
+
+// DeleteMany deletes files from the storage server with up to concurrency
+// requests at a time. If any fail, it returns a *BatchError.
+func (c *Client) DeleteMany(keys []string, concurrency int) error {
+	var (
+		results batchResults
+		g       errgroup.Group
+	)
+	g.SetLimit(max(concurrency, 1))
+	for _, key := range keys {
+		g.Go(func() error {
+			if failure := c.delete(key); failure != nil {
+				results.fail(*failure)
+			} else {
+				results.succeed(key)
+			}
+			return nil
+		})
+	}
+	g.Wait()
+	return results.result()
+}
+
+// delete deletes a file, describing the failure if there is one
+func (c *Client) delete(key string) *BatchItemError {
+	u := *c.URL
+	u.Path = blobPath(key)
+	req, err := http.NewRequest(http.MethodDelete, u.String(), nil)
+	if err != nil {
+		return &BatchItemError{Key: key, Message: err.Error(), Err: err}
+	}
+
+	res, err := c.transport.RoundTrip(req)
+	if err != nil {
+		return &BatchItemError{Key: key, Message: err.Error(), Err: err}
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusNoContent {
+		body, _ := io.ReadAll(io.LimitReader(res.Body, 1024))
+		msg := errorMessage(body)
+		if msg == "" {
+			msg = http.StatusText(res.StatusCode)
+		}
+		return &BatchItemError{Key: key, Status: res.StatusCode, Message: msg, Err: statusError(res.StatusCode, body)}
+	}
+	return nil
+}
+
+// statusError returns the error of a failed response that callers can match
+// with errors.Is, or nil if there is none
+func statusError(status int, body []byte) error {
+	switch status {
+	case http.StatusNotFound:
+		return ErrNotFound
+	case http.StatusConflict:
+		// older servers respond with a bare message
+		if code, message := parseError(body); code == "key_exists" || message == ErrKeyExists.Error() {
+			return ErrKeyExists
+		}
+	}
+	return nil
+}
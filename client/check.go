@@ -0,0 +1,46 @@
+package railwayimages
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+
+	"github.com/jaredLunde/railway-image-service/client/sign"
+)
+
+// IsSignedURLValid reports whether a signed URL is currently valid without
+// performing the operation it grants, e.g. to refresh cached URLs before they
+// expire. If a signature secret key is provided in the client options, the URL
+// is verified locally. Otherwise, the server checks it. Neither tells whether a
+// single-use URL was already used.
+func (c *Client) IsSignedURLValid(signedURL string) (bool, error) {
+	if c.SignatureSecretKey != "" && !c.VerifyServerSignatures {
+		u, err := url.Parse(signedURL)
+		if err != nil {
+			return false, nil
+		}
+		return sign.VerifyURLWithOptions(u, c.SignatureSecretKey, sign.Options{SignServeQuery: c.SignServeQuery}) == nil, nil
+	}
+
+	u := *c.URL
+	u.Path = "/sign/check"
+	u.RawQuery = url.Values{"url": {signedURL}}.Encode()
+	res, err := c.get(u)
+	if err != nil {
+		return false, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(io.LimitReader(res.Body, 1024))
+		return false, fmt.Errorf("unexpected status code %d: %s", res.StatusCode, errorMessage(body))
+	}
+	var body struct {
+		Valid bool `json:"valid"`
+	}
+	if err := json.NewDecoder(res.Body).Decode(&body); err != nil {
+		return false, err
+	}
+	return body.Valid, nil
+}
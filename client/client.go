@@ -1,15 +1,67 @@
 package railwayimages
 
 import (
+	"bytes"
+	"compress/gzip"
+	"crypto/md5"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"net/http"
 	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
 
 	"github.com/jaredLunde/railway-image-service/client/sign"
+	"golang.org/x/sync/errgroup"
 )
 
+var (
+	// ErrUnreachable is returned by Ping when the server can't be reached
+	ErrUnreachable = errors.New("server unreachable")
+	// ErrUnauthorized is returned by Ping when the API key is missing or wrong
+	ErrUnauthorized = errors.New("invalid API key")
+	// ErrUnavailable is returned by Ping when the server is unhealthy
+	ErrUnavailable = errors.New("server unavailable")
+)
+
+// ErrKeyExists is returned by Put when the key is write-once and already
+// has a file
+var ErrKeyExists = errors.New("key already exists")
+
+// errorResponse is the JSON envelope of the server's error responses
+type errorResponse struct {
+	Error struct {
+		Code      string `json:"code"`
+		Message   string `json:"message"`
+		RequestID string `json:"request_id"`
+	} `json:"error"`
+}
+
+// parseError returns the code and message of an error response body. A body
+// that isn't in the error envelope is the message.
+func parseError(body []byte) (code, message string) {
+	var e errorResponse
+	if json.Unmarshal(body, &e) == nil && e.Error.Code != "" {
+		message = e.Error.Message
+		if e.Error.RequestID != "" {
+			message += " (request " + e.Error.RequestID + ")"
+		}
+		return e.Error.Code, message
+	}
+	return "", strings.TrimSpace(string(body))
+}
+
+// errorMessage returns the message of an error response body
+func errorMessage(body []byte) string {
+	_, message := parseError(body)
+	return message
+}
+
 type Options struct {
 	// The URL of your service
 	URL string
@@ -18,6 +70,30 @@ type Options struct {
 	// If a signature secret key is provided, it will be used to sign URLs
 	// locally instead of making a request to the server to sign the request.
 	SignatureSecretKey string
+	// Add a single-use nonce to locally signed /blob URLs. Required when the
+	// server enforces SIGNATURE_NONCE_METHODS.
+	SignatureNonce bool
+	// Sign URLs with the server even when a signature secret key is provided,
+	// and verify the returned signature locally with that key. This catches
+	// clients and servers that disagree on the secret before a broken URL
+	// reaches end users.
+	VerifyServerSignatures bool
+	// Cover the query string of /serve URLs with locally created signatures.
+	// Required by servers with SERVE_SIGN_QUERY enabled.
+	SignServeQuery bool
+	// The maximum number of times a failed request is retried. Defaults to 0,
+	// which disables retries.
+	MaxRetries int
+	// Decides whether a failed attempt is retried. Defaults to
+	// DefaultRetryPolicy.
+	RetryPolicy RetryPolicy
+	// The delay before the first retry, which doubles with every retry up to
+	// RetryMaxDelay. A random jitter of up to half the delay is subtracted.
+	// Defaults to DefaultRetryBaseDelay.
+	RetryBaseDelay time.Duration
+	// The longest delay between retries. A longer Retry-After of the server is
+	// still honored, up to 30 seconds. Defaults to DefaultRetryMaxDelay.
+	RetryMaxDelay time.Duration
 }
 
 // Create a new API client.
@@ -35,11 +111,23 @@ func NewClient(opt Options) (*Client, error) {
 	if opt.SecretKey != "" {
 		transport = &SigningTransport{transport: transport, SecretKey: opt.SecretKey}
 	}
+	if opt.MaxRetries > 0 {
+		transport = &RetryTransport{
+			transport:  transport,
+			MaxRetries: opt.MaxRetries,
+			Policy:     opt.RetryPolicy,
+			BaseDelay:  opt.RetryBaseDelay,
+			MaxDelay:   opt.RetryMaxDelay,
+		}
+	}
 
 	return &Client{
-		URL:                u,
-		SignatureSecretKey: opt.SignatureSecretKey,
-		transport:          transport,
+		URL:                    u,
+		SignatureSecretKey:     opt.SignatureSecretKey,
+		SignatureNonce:         opt.SignatureNonce,
+		VerifyServerSignatures: opt.VerifyServerSignatures,
+		SignServeQuery:         opt.SignServeQuery,
+		transport:              transport,
 	}, nil
 }
 
@@ -55,32 +143,36 @@ func (t *SigningTransport) RoundTrip(req *http.Request) (*http.Response, error)
 }
 
 type Client struct {
-	URL                *url.URL
-	SignatureSecretKey string
-	transport          http.RoundTripper
+	URL                    *url.URL
+	SignatureSecretKey     string
+	SignatureNonce         bool
+	VerifyServerSignatures bool
+	SignServeQuery         bool
+	transport              http.RoundTripper
 }
 
 // Get a signed URL for a given path. If a signature secret key is provided
 // in the client options, the URL will be signed locally. Otherwise, a request
-// will be made to the server to sign the URL.
+// will be made to the server to sign the URL. The path may include a query
+// string, e.g. /serve options.
 func (c *Client) Sign(path string) (string, error) {
 	u := *c.URL
+	path, u.RawQuery, _ = strings.Cut(path, "?")
 
-	if c.SignatureSecretKey != "" {
+	if c.SignatureSecretKey != "" && !c.VerifyServerSignatures {
 		u.Path = path
-		uri, err := sign.SignURL(&u, c.SignatureSecretKey)
+		opts := sign.Options{SignServeQuery: c.SignServeQuery}
+		if c.SignatureNonce {
+			opts.Nonce = sign.NewNonce()
+		}
+		uri, err := sign.SignURLWithOptions(&u, c.SignatureSecretKey, opts)
 		if err != nil {
 			return "", err
 		}
 		return *uri, nil
 	}
 
-	signPath, err := url.JoinPath("/sign", path)
-	if err != nil {
-		return "", err
-	}
-
-	u.Path = signPath
+	u.Path = "/sign/" + strings.TrimPrefix(path, "/")
 	req, err := http.NewRequest(http.MethodGet, u.String(), nil)
 	if err != nil {
 		return "", err
@@ -89,22 +181,162 @@ func (c *Client) Sign(path string) (string, error) {
 	if err != nil {
 		return "", err
 	}
+	defer res.Body.Close()
 	body, err := io.ReadAll(res.Body)
 	if err != nil {
 		return "", err
 	}
+	if res.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("unexpected status code %d: %s", res.StatusCode, errorMessage(body))
+	}
+
+	signedURL := string(body)
+	if c.VerifyServerSignatures && c.SignatureSecretKey != "" {
+		su, err := url.Parse(signedURL)
+		if err != nil {
+			return "", fmt.Errorf("invalid signed URL: %w", err)
+		}
+		if err := sign.VerifyURLWithOptions(su, c.SignatureSecretKey, sign.Options{SignServeQuery: c.SignServeQuery}); err != nil {
+			return "", fmt.Errorf("server signature could not be verified: %w", err)
+		}
+	}
 
-	return string(body), nil
+	return signedURL, nil
 }
 
-// Get a file from the storage server
-func (c *Client) Get(key string) (*http.Response, error) {
+// Get signed URLs for many paths at once. If a signature secret key is
+// provided in the client options, the URLs will be signed locally, and paths
+// that can't be signed are left empty and reported in a *BatchError.
+// Otherwise, a single request will be made to the server to sign all of them.
+func (c *Client) SignMany(paths []string) ([]string, error) {
+	if c.SignatureSecretKey != "" && !c.VerifyServerSignatures {
+		var results batchResults
+		signed := make([]string, len(paths))
+		for n, path := range paths {
+			uri, err := c.Sign(path)
+			if err != nil {
+				results.fail(BatchItemError{Key: path, Message: err.Error(), Err: err})
+				continue
+			}
+			signed[n] = uri
+			results.succeed(path)
+		}
+		return signed, results.result()
+	}
+
+	items := make([]batchItem, len(paths))
+	for n, path := range paths {
+		items[n] = batchItem{Path: path}
+	}
+	return c.signBatch(items)
+}
+
+// batchItem is a path to sign with POST /sign/batch
+type batchItem struct {
+	Path string `json:"path"`
+	// The TTL of a /blob signature in seconds. 0 uses the server default.
+	TTL int `json:"ttl,omitempty"`
+	// The method and max upload size a /blob signature is bound to
+	Method  string `json:"method,omitempty"`
+	MaxSize int64  `json:"max_size,omitempty"`
+}
+
+// MarshalJSON encodes items without options as plain path strings
+func (b batchItem) MarshalJSON() ([]byte, error) {
+	if b.TTL == 0 && b.Method == "" && b.MaxSize == 0 {
+		return json.Marshal(b.Path)
+	}
+	type item batchItem
+	return json.Marshal(item(b))
+}
+
+// signBatch signs paths with the server in a single request
+func (c *Client) signBatch(items []batchItem) ([]string, error) {
+	body, err := json.Marshal(items)
+	if err != nil {
+		return nil, err
+	}
 	u := *c.URL
-	path, err := url.JoinPath("/blob", key)
+	u.Path = "/sign/batch"
+	req, err := http.NewRequest(http.MethodPost, u.String(), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	res, err := c.transport.RoundTrip(req)
 	if err != nil {
 		return nil, err
 	}
-	u.Path = path
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(res.Body)
+		return nil, fmt.Errorf("unexpected status code %d: %s", res.StatusCode, errorMessage(body))
+	}
+
+	var signed []string
+	if err := json.NewDecoder(res.Body).Decode(&signed); err != nil {
+		return nil, err
+	}
+	if len(signed) != len(items) {
+		return nil, fmt.Errorf("expected %d signed URLs, got %d", len(items), len(signed))
+	}
+	if c.VerifyServerSignatures && c.SignatureSecretKey != "" {
+		for _, signedURL := range signed {
+			su, err := url.Parse(signedURL)
+			if err != nil {
+				return nil, fmt.Errorf("invalid signed URL: %w", err)
+			}
+			if err := sign.VerifyURLWithOptions(su, c.SignatureSecretKey, sign.Options{SignServeQuery: c.SignServeQuery}); err != nil {
+				return nil, fmt.Errorf("server signature could not be verified: %w", err)
+			}
+		}
+	}
+	return signed, nil
+}
+
+// Ping checks that the server can be reached and accepts the API key, which is
+// worth doing before a long batch job. The error wraps ErrUnreachable,
+// ErrUnauthorized, or ErrUnavailable.
+func (c *Client) Ping() error {
+	u := *c.URL
+	u.Path = "/ping"
+	req, err := http.NewRequest(http.MethodGet, u.String(), nil)
+	if err != nil {
+		return fmt.Errorf("failed to create request: %w", err)
+	}
+
+	res, err := c.transport.RoundTrip(req)
+	if err != nil {
+		return fmt.Errorf("%w: %w", ErrUnreachable, err)
+	}
+	defer res.Body.Close()
+
+	switch res.StatusCode {
+	case http.StatusOK, http.StatusNoContent:
+		return nil
+	case http.StatusUnauthorized:
+		return ErrUnauthorized
+	case http.StatusServiceUnavailable:
+		return ErrUnavailable
+	}
+	return fmt.Errorf("unexpected status code: %d", res.StatusCode)
+}
+
+// blobPath returns the unescaped path of a key. Keys are never unescaped, so
+// spaces, "+" and "%" are part of the key and are escaped exactly once when the
+// URL is encoded, matching how the server decodes them.
+func blobPath(key string) string {
+	return "/blob/" + strings.TrimPrefix(key, "/")
+}
+
+// Get a file from the storage server
+func (c *Client) Get(key string) (*http.Response, error) {
+	u := *c.URL
+	u.Path = blobPath(key)
+	return c.get(u)
+}
+
+func (c *Client) get(u url.URL) (*http.Response, error) {
 	req, err := http.NewRequest(http.MethodGet, u.String(), nil)
 	if err != nil {
 		return nil, err
@@ -122,13 +354,47 @@ func (c *Client) Get(key string) (*http.Response, error) {
 func (c *Client) Put(key string, r io.Reader) error {
 	// Create URL
 	u := *c.URL
-	u.Path = fmt.Sprintf("/blob/%s", key)
+	u.Path = blobPath(key)
+	return c.put(u, key, r, nil)
+}
+
+// UploadResult describes a file stored by PutWithResult
+type UploadResult struct {
+	Key string `json:"key"`
+	// The MD5 of the content
+	Hash string `json:"hash"`
+	// The size of the content in bytes
+	Size        int64  `json:"size"`
+	ContentType string `json:"content_type"`
+	// A signed URL of the image for image processing operations, relative
+	// to the server unless it has a public URL. Empty for files that aren't
+	// images.
+	ServeURL string `json:"serve_url,omitempty"`
+}
+
+// Put a file to the storage server, returning what was stored. It saves a
+// round trip to sign a /serve URL of an uploaded image.
+func (c *Client) PutWithResult(key string, r io.Reader) (*UploadResult, error) {
+	u := *c.URL
+	u.Path = blobPath(key)
+	var result UploadResult
+	if err := c.put(u, key, r, &result); err != nil {
+		return nil, err
+	}
+	return &result, nil
+}
 
+// put uploads a file to u, naming key in errors. A non-nil result is decoded
+// from a JSON response.
+func (c *Client) put(u url.URL, key string, r io.Reader, result *UploadResult) error {
 	// Create request
 	req, err := http.NewRequest(http.MethodPut, u.String(), r)
 	if err != nil {
 		return fmt.Errorf("failed to create request: %w", err)
 	}
+	if result != nil {
+		req.Header.Set("Accept", "application/json")
+	}
 
 	// Set content type if possible
 	if rc, ok := r.(io.ReadCloser); ok {
@@ -148,20 +414,65 @@ func (c *Client) Put(key string, r io.Reader) error {
 		if err != nil {
 			return fmt.Errorf("unexpected status code %d and failed to read error body: %w", res.StatusCode, err)
 		}
-		return fmt.Errorf("unexpected status code %d: %s", res.StatusCode, string(body))
+		code, message := parseError(body)
+		// older servers respond with a bare message
+		if res.StatusCode == http.StatusConflict && (code == "key_exists" || message == ErrKeyExists.Error()) {
+			return fmt.Errorf("%w: %s", ErrKeyExists, key)
+		}
+		return fmt.Errorf("unexpected status code %d: %s", res.StatusCode, message)
 	}
 
+	if result != nil {
+		if err := json.NewDecoder(res.Body).Decode(result); err != nil {
+			return fmt.Errorf("failed to decode response: %w", err)
+		}
+	}
 	return nil
 }
 
-// Delete a file from the storage server
-func (c *Client) Delete(key string) error {
+// Put a file to the storage server under a key derived from the SHA-256 of its
+// content, returning the key. Uploading identical content again returns the
+// same key without storing it twice.
+func (c *Client) PutContentAddressed(r io.Reader) (string, error) {
 	u := *c.URL
-	path, err := url.JoinPath("/blob", key)
+	u.Path = "/blob"
+	u.RawQuery = url.Values{"key_strategy": {"content-hash"}}.Encode()
+
+	req, err := http.NewRequest(http.MethodPost, u.String(), r)
 	if err != nil {
-		return err
+		return "", fmt.Errorf("failed to create request: %w", err)
+	}
+	if rc, ok := r.(io.ReadCloser); ok {
+		defer rc.Close()
+	}
+
+	res, err := c.transport.RoundTrip(req)
+	if err != nil {
+		return "", fmt.Errorf("failed to send request: %w", err)
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusCreated && res.StatusCode != http.StatusOK {
+		body, err := io.ReadAll(res.Body)
+		if err != nil {
+			return "", fmt.Errorf("unexpected status code %d and failed to read error body: %w", res.StatusCode, err)
+		}
+		return "", fmt.Errorf("unexpected status code %d: %s", res.StatusCode, errorMessage(body))
 	}
-	u.Path = path
+
+	var result struct {
+		Key string `json:"key"`
+	}
+	if err := json.NewDecoder(res.Body).Decode(&result); err != nil {
+		return "", fmt.Errorf("failed to decode response: %w", err)
+	}
+	return result.Key, nil
+}
+
+// Delete a file from the storage server
+func (c *Client) Delete(key string) error {
+	u := *c.URL
+	u.Path = blobPath(key)
 	req, err := http.NewRequest(http.MethodDelete, u.String(), nil)
 	if err != nil {
 		return err
@@ -232,14 +543,178 @@ func (c *Client) List(opts ListOptions) (*ListResult, error) {
 	// Handle non-200 responses
 	if res.StatusCode != http.StatusOK {
 		body, _ := io.ReadAll(res.Body)
-		return nil, fmt.Errorf("unexpected status code %d: %s", res.StatusCode, string(body))
+		return nil, fmt.Errorf("unexpected status code %d: %s", res.StatusCode, errorMessage(body))
+	}
+
+	// Listings are gzipped for clients that accept it. http.Transport
+	// decompresses them transparently unless compression is disabled.
+	body := io.Reader(res.Body)
+	if res.Header.Get("Content-Encoding") == "gzip" {
+		gz, err := gzip.NewReader(res.Body)
+		if err != nil {
+			return nil, fmt.Errorf("failed to decompress response: %w", err)
+		}
+		defer gz.Close()
+		body = gz
 	}
 
 	// Parse response
 	var result ListResult
-	if err := json.NewDecoder(res.Body).Decode(&result); err != nil {
+	if err := json.NewDecoder(body).Decode(&result); err != nil {
 		return nil, fmt.Errorf("failed to decode response: %w", err)
 	}
 
 	return &result, nil
 }
+
+// MirrorResult describes the outcome of mirroring a single key
+type MirrorResult struct {
+	// The key that was mirrored
+	Key string
+	// The local path the key was written to
+	Path string
+	// True if the local file already matched the remote file
+	Skipped bool
+	// The error that occurred while mirroring the key, if any
+	Err error
+}
+
+// Mirror downloads every file under a prefix to a local directory, preserving
+// the key path. Files whose local MD5 already matches the remote Content-Md5
+// are skipped without being downloaded. The optional progress callbacks are
+// called once per key and may be called concurrently. Errors for individual
+// keys do not stop the mirror, they are returned as a *BatchError once every
+// key has been processed. Errors listing the keys are joined with it.
+func (c *Client) Mirror(prefix, localDir string, concurrency int, onProgress ...func(MirrorResult)) error {
+	if concurrency < 1 {
+		concurrency = 1
+	}
+
+	var (
+		results batchResults
+		g       errgroup.Group
+	)
+	g.SetLimit(concurrency)
+	report := func(res MirrorResult) {
+		if res.Err != nil {
+			failure := BatchItemError{Key: res.Key, Message: res.Err.Error(), Err: res.Err}
+			var statusErr BatchItemError
+			if errors.As(res.Err, &statusErr) {
+				failure = statusErr
+			}
+			results.fail(failure)
+		} else {
+			results.succeed(res.Key)
+		}
+		for _, fn := range onProgress {
+			fn(res)
+		}
+	}
+
+	opts := ListOptions{Prefix: prefix, Limit: maxListLimit}
+	for {
+		page, err := c.List(opts)
+		if err != nil {
+			g.Wait()
+			return errors.Join(results.result(), err)
+		}
+		for _, key := range page.Keys {
+			g.Go(func() error {
+				res := MirrorResult{Key: key}
+				res.Path, res.Skipped, res.Err = c.mirrorKey(key, localDir)
+				report(res)
+				return nil
+			})
+		}
+		if !page.HasMore || page.NextPage == "" {
+			break
+		}
+		next, err := url.Parse(page.NextPage)
+		if err != nil {
+			g.Wait()
+			return errors.Join(results.result(), fmt.Errorf("invalid next page URL: %w", err))
+		}
+		opts.StartingAt = next.Query().Get("starting_at")
+		if opts.StartingAt == "" {
+			break
+		}
+	}
+
+	g.Wait()
+	return results.result()
+}
+
+// The maximum number of keys the server returns in a single list request
+const maxListLimit = 1000
+
+func (c *Client) mirrorKey(key, localDir string) (string, bool, error) {
+	root, err := filepath.Abs(localDir)
+	if err != nil {
+		return "", false, err
+	}
+	fp := filepath.Join(root, filepath.FromSlash(key))
+	if !strings.HasPrefix(fp, root+string(filepath.Separator)) {
+		return "", false, fmt.Errorf("key escapes the mirror directory")
+	}
+
+	// a HEAD is enough to tell whether an existing copy is up to date
+	if localHash, err := fileMD5(fp); err == nil {
+		u := *c.URL
+		u.Path = blobPath(key)
+		req, err := http.NewRequest(http.MethodHead, u.String(), nil)
+		if err != nil {
+			return fp, false, err
+		}
+		res, err := c.transport.RoundTrip(req)
+		if err != nil {
+			return fp, false, err
+		}
+		res.Body.Close()
+		if res.StatusCode == http.StatusOK && res.Header.Get("Content-Md5") == localHash {
+			return fp, true, nil
+		}
+	}
+
+	res, err := c.Get(key)
+	if err != nil {
+		return fp, false, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(io.LimitReader(res.Body, 1024))
+		return fp, false, BatchItemError{Key: key, Status: res.StatusCode, Message: fmt.Sprintf("unexpected status code %d", res.StatusCode), Err: statusError(res.StatusCode, body)}
+	}
+
+	if err := os.MkdirAll(filepath.Dir(fp), 0755); err != nil {
+		return fp, false, err
+	}
+	tmpFile, err := os.CreateTemp(filepath.Dir(fp), ".mirror-*")
+	if err != nil {
+		return fp, false, err
+	}
+	defer os.Remove(tmpFile.Name())
+	defer tmpFile.Close()
+	if _, err := io.Copy(tmpFile, res.Body); err != nil {
+		return fp, false, err
+	}
+	if err := tmpFile.Close(); err != nil {
+		return fp, false, err
+	}
+	if err := os.Rename(tmpFile.Name(), fp); err != nil {
+		return fp, false, err
+	}
+	return fp, false, nil
+}
+
+func fileMD5(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := md5.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
@@ -2,15 +2,29 @@ package railwayimages
 
 import (
 	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/md5"
 	"crypto/subtle"
+	"crypto/tls"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"io"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
+	"os"
+	"path/filepath"
 	"reflect"
+	"slices"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
+
+	"github.com/jaredLunde/railway-image-service/client/sign"
 )
 
 func TestNewClient(t *testing.T) {
@@ -264,6 +278,29 @@ func TestClient_Put(t *testing.T) {
 				w.Write([]byte("internal server error"))
 			},
 		},
+		{
+			name:          "write-once key exists",
+			key:           "test.jpg",
+			content:       []byte("test content"),
+			wantErr:       true,
+			errorContains: "key already exists: test.jpg",
+			serverHandler: func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(http.StatusConflict)
+				w.Write([]byte("key already exists"))
+			},
+		},
+		{
+			name:          "write-once key exists error envelope",
+			key:           "test.jpg",
+			content:       []byte("test content"),
+			wantErr:       true,
+			errorContains: "key already exists: test.jpg",
+			serverHandler: func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Type", "application/json")
+				w.WriteHeader(http.StatusConflict)
+				w.Write([]byte(`{"error":{"code":"key_exists","message":"key already exists","request_id":"abc"}}`))
+			},
+		},
 		{
 			name:          "server error no message",
 			key:           "test.jpg",
@@ -356,6 +393,31 @@ func (t *testReadCloser) Close() error {
 	return nil
 }
 
+func TestClient_PutWithResult(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPut || r.URL.Path != "/blob/test.png" {
+			t.Errorf("unexpected request %s %s", r.Method, r.URL.Path)
+		}
+		if accept := r.Header.Get("Accept"); accept != "application/json" {
+			t.Errorf("expected a JSON response to be requested, got %q", accept)
+		}
+		w.WriteHeader(http.StatusCreated)
+		w.Write([]byte(`{"key":"test.png","hash":"abc","size":12,"content_type":"image/png","serve_url":"http://x/serve/blob/test.png?x-signature=s"}`))
+	}))
+	defer server.Close()
+
+	serverURL, _ := url.Parse(server.URL)
+	client := &Client{URL: serverURL, transport: http.DefaultTransport}
+	result, err := client.PutWithResult("test.png", bytes.NewReader([]byte("test content")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := UploadResult{Key: "test.png", Hash: "abc", Size: 12, ContentType: "image/png", ServeURL: "http://x/serve/blob/test.png?x-signature=s"}
+	if *result != want {
+		t.Errorf("expected %+v, got %+v", want, *result)
+	}
+}
+
 func TestClient_Put_ReaderClose(t *testing.T) {
 	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		w.WriteHeader(http.StatusCreated)
@@ -406,6 +468,173 @@ func TestClient_Delete(t *testing.T) {
 		t.Fatal(err)
 	}
 }
+
+func TestClient_EncodedKeys(t *testing.T) {
+	var paths []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		paths = append(paths, r.URL.Path)
+		switch r.Method {
+		case http.MethodPut:
+			w.WriteHeader(http.StatusCreated)
+		case http.MethodDelete:
+			w.WriteHeader(http.StatusNoContent)
+		}
+	}))
+	defer server.Close()
+
+	serverURL, _ := url.Parse(server.URL)
+	client := &Client{
+		URL:       serverURL,
+		transport: http.DefaultTransport,
+	}
+
+	// the server decodes the path once, so it must get the key back as-is
+	for _, key := range []string{"a b.png", "a+b.png", "100%.png", "a%20b.png", "été/café.png"} {
+		paths = nil
+		if err := client.Put(key, strings.NewReader("content")); err != nil {
+			t.Fatalf("Put(%q): %v", key, err)
+		}
+		res, err := client.Get(key)
+		if err != nil {
+			t.Fatalf("Get(%q): %v", key, err)
+		}
+		res.Body.Close()
+		if err := client.Delete(key); err != nil {
+			t.Fatalf("Delete(%q): %v", key, err)
+		}
+		for _, path := range paths {
+			if path != "/blob/"+key {
+				t.Errorf("%q: expected path /blob/%s, got %s", key, key, path)
+			}
+		}
+	}
+}
+
+func TestClient_Variants(t *testing.T) {
+	var requests []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests = append(requests, r.Method+" "+r.URL.Path+"?"+r.URL.RawQuery)
+		switch r.Method {
+		case http.MethodPut:
+			w.WriteHeader(http.StatusCreated)
+		case http.MethodGet:
+			if r.URL.Query().Has("variants") {
+				w.Write([]byte(`{"key":"hero.png","variants":["1x","2x"]}`))
+			}
+		}
+	}))
+	defer server.Close()
+
+	serverURL, _ := url.Parse(server.URL)
+	client := &Client{
+		URL:       serverURL,
+		transport: http.DefaultTransport,
+	}
+
+	if err := client.PutVariant("hero.png", "2x", strings.NewReader("content")); err != nil {
+		t.Fatal(err)
+	}
+	res, err := client.GetVariant("hero.png", "2x")
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	variants, err := client.Variants("hero.png")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(variants, []string{"1x", "2x"}) {
+		t.Errorf("unexpected variants %v", variants)
+	}
+	want := []string{"PUT /blob/hero.png?variant=2x", "GET /blob/hero.png?variant=2x", "GET /blob/hero.png?variants"}
+	if !slices.Equal(requests, want) {
+		t.Errorf("expected requests %v, got %v", want, requests)
+	}
+}
+
+func TestClient_DeleteMany(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/blob/locked.jpg":
+			w.WriteHeader(http.StatusConflict)
+		case "/blob/missing.jpg":
+			w.WriteHeader(http.StatusNotFound)
+		default:
+			w.WriteHeader(http.StatusNoContent)
+		}
+	}))
+	defer server.Close()
+
+	serverURL, _ := url.Parse(server.URL)
+	client := &Client{
+		URL:       serverURL,
+		transport: http.DefaultTransport,
+	}
+
+	if err := client.DeleteMany([]string{"a.jpg", "b.jpg"}, 2); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+
+	err := client.DeleteMany([]string{"a.jpg", "locked.jpg", "b.jpg", "missing.jpg"}, 2)
+	var batchErr *BatchError
+	if !errors.As(err, &batchErr) {
+		t.Fatalf("expected a *BatchError, got %v", err)
+	}
+	succeeded := slices.Sorted(slices.Values(batchErr.Succeeded))
+	if !slices.Equal(succeeded, []string{"a.jpg", "b.jpg"}) {
+		t.Errorf("expected a.jpg and b.jpg to succeed, got %v", succeeded)
+	}
+	if failed := slices.Sorted(slices.Values(batchErr.FailedKeys())); !slices.Equal(failed, []string{"locked.jpg", "missing.jpg"}) {
+		t.Errorf("expected locked.jpg and missing.jpg to fail, got %v", failed)
+	}
+	if conflicts := batchErr.FailedWithStatus(http.StatusConflict); len(conflicts) != 1 || conflicts[0].Key != "locked.jpg" {
+		t.Errorf("expected locked.jpg to fail with a conflict, got %v", conflicts)
+	}
+	if !errors.Is(err, ErrNotFound) {
+		t.Errorf("expected the error to match ErrNotFound, got %v", err)
+	}
+	if errors.Is(err, ErrKeyExists) {
+		t.Errorf("expected a locked key not to match ErrKeyExists, got %v", err)
+	}
+}
+
+func TestClient_Ping(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/ping" {
+			t.Errorf("expected path /ping, got %s", r.URL.Path)
+		}
+		switch r.Header.Get("x-api-key") {
+		case "valid":
+			w.WriteHeader(http.StatusNoContent)
+		case "unhealthy":
+			w.WriteHeader(http.StatusServiceUnavailable)
+		default:
+			w.WriteHeader(http.StatusUnauthorized)
+		}
+	}))
+	defer server.Close()
+
+	tests := []struct {
+		url     string
+		key     string
+		wantErr error
+	}{
+		{server.URL, "valid", nil},
+		{server.URL, "invalid", ErrUnauthorized},
+		{server.URL, "unhealthy", ErrUnavailable},
+		{"http://127.0.0.1:1", "valid", ErrUnreachable},
+	}
+	for _, tt := range tests {
+		client, err := NewClient(Options{URL: tt.url, SecretKey: tt.key})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := client.Ping(); !errors.Is(err, tt.wantErr) {
+			t.Errorf("%s: expected error %v, got %v", tt.key, tt.wantErr, err)
+		}
+	}
+}
+
 func TestClient_List(t *testing.T) {
 	expectedResult := &ListResult{
 		Keys:     []string{"test1.jpg", "test2.jpg"},
@@ -456,3 +685,603 @@ func TestClient_List(t *testing.T) {
 		t.Errorf("expected %+v, got %+v", expectedResult, result)
 	}
 }
+
+func TestClient_List_Gzip(t *testing.T) {
+	expectedResult := &ListResult{Keys: []string{"test1.jpg", "test2.jpg"}}
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Encoding", "gzip")
+		gz := gzip.NewWriter(w)
+		json.NewEncoder(gz).Encode(expectedResult)
+		gz.Close()
+	}))
+	defer server.Close()
+	serverURL, _ := url.Parse(server.URL)
+
+	tests := []struct {
+		name      string
+		transport http.RoundTripper
+	}{
+		{"decompressed by the transport", &http.Transport{}},
+		{"decompressed by the client", &http.Transport{DisableCompression: true}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client := &Client{URL: serverURL, transport: tt.transport}
+			result, err := client.List(ListOptions{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(result, expectedResult) {
+				t.Errorf("expected %+v, got %+v", expectedResult, result)
+			}
+		})
+	}
+}
+
+func TestClient_Mirror(t *testing.T) {
+	files := map[string]string{
+		"images/a.jpg":        "a content",
+		"images/nested/b.jpg": "b content",
+		"images/c.jpg":        "c content",
+	}
+	var gets sync.Map
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/blob" {
+			if prefix := r.URL.Query().Get("prefix"); prefix != "images/" {
+				t.Errorf("expected prefix images/, got %s", prefix)
+			}
+			if r.URL.Query().Get("starting_at") == "" {
+				json.NewEncoder(w).Encode(ListResult{
+					Keys:     []string{"images/a.jpg", "images/c.jpg"},
+					HasMore:  true,
+					NextPage: "http://" + r.Host + "/blob?prefix=images/&starting_at=images/nested/b.jpg",
+				})
+				return
+			}
+			json.NewEncoder(w).Encode(ListResult{Keys: []string{"images/nested/b.jpg"}})
+			return
+		}
+		content, ok := files[strings.TrimPrefix(r.URL.Path, "/blob/")]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Md5", fmt.Sprintf("%x", md5.Sum([]byte(content))))
+		if r.Method == http.MethodHead {
+			return
+		}
+		gets.Store(r.URL.Path, true)
+		w.Write([]byte(content))
+	}))
+	defer server.Close()
+
+	dir := t.TempDir()
+	// An unchanged file should be skipped
+	if err := os.MkdirAll(filepath.Join(dir, "images"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "images", "a.jpg"), []byte("a content"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	// A changed file should be downloaded again
+	if err := os.WriteFile(filepath.Join(dir, "images", "c.jpg"), []byte("stale"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	serverURL, _ := url.Parse(server.URL)
+	client := &Client{
+		URL:       serverURL,
+		transport: http.DefaultTransport,
+	}
+
+	var mu sync.Mutex
+	results := map[string]MirrorResult{}
+	err := client.Mirror("images/", dir, 2, func(res MirrorResult) {
+		mu.Lock()
+		results[res.Key] = res
+		mu.Unlock()
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(results) != len(files) {
+		t.Fatalf("expected %d results, got %d", len(files), len(results))
+	}
+	if !results["images/a.jpg"].Skipped {
+		t.Error("expected images/a.jpg to be skipped")
+	}
+	if _, ok := gets.Load("/blob/images/a.jpg"); ok {
+		t.Error("expected images/a.jpg not to be downloaded")
+	}
+	if results["images/c.jpg"].Skipped {
+		t.Error("expected the stale images/c.jpg to be downloaded")
+	}
+	for key, content := range files {
+		got, err := os.ReadFile(filepath.Join(dir, filepath.FromSlash(key)))
+		if err != nil {
+			t.Fatalf("failed to read mirrored file %s: %v", key, err)
+		}
+		if string(got) != content {
+			t.Errorf("expected %s to contain %q, got %q", key, content, got)
+		}
+	}
+}
+
+func TestClient_Mirror_Errors(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/blob" {
+			json.NewEncoder(w).Encode(ListResult{Keys: []string{"ok.jpg", "missing.jpg", "../escape.jpg"}})
+			return
+		}
+		if r.URL.Path == "/blob/ok.jpg" {
+			w.Write([]byte("ok"))
+			return
+		}
+		w.WriteHeader(http.StatusNotFound)
+	}))
+	defer server.Close()
+
+	serverURL, _ := url.Parse(server.URL)
+	client := &Client{
+		URL:       serverURL,
+		transport: http.DefaultTransport,
+	}
+
+	var failed int32
+	err := client.Mirror("", t.TempDir(), 1, func(res MirrorResult) {
+		if res.Err != nil {
+			atomic.AddInt32(&failed, 1)
+		}
+	})
+	if err == nil {
+		t.Fatal("expected error, got nil")
+	}
+	if failed != 2 {
+		t.Errorf("expected 2 failed keys, got %d", failed)
+	}
+	if !strings.Contains(err.Error(), "missing.jpg") || !strings.Contains(err.Error(), "../escape.jpg") {
+		t.Errorf("expected error to name the failed keys, got %v", err)
+	}
+	if !errors.Is(err, ErrNotFound) {
+		t.Errorf("expected the error to match ErrNotFound, got %v", err)
+	}
+}
+
+func TestClient_Sign_VerifyServerSignatures(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		u := *r.URL
+		u.Scheme = "http"
+		u.Host = r.Host
+		signed, err := sign.SignURL(&u, "server-secret")
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		w.Write([]byte(*signed))
+	}))
+	defer server.Close()
+
+	tests := []struct {
+		name    string
+		path    string
+		secret  string
+		wantErr bool
+	}{
+		{name: "matching blob secret", path: "/blob/test.jpg", secret: "server-secret"},
+		{name: "matching serve secret", path: "/serve/300x300/blob/test.jpg", secret: "server-secret"},
+		{name: "mismatched secret", path: "/blob/test.jpg", secret: "client-secret", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client, err := NewClient(Options{
+				URL:                    server.URL,
+				SignatureSecretKey:     tt.secret,
+				VerifyServerSignatures: true,
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			_, err = client.Sign(tt.path)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("Client.Sign() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr && !errors.Is(err, sign.ErrSignatureMismatch) {
+				t.Errorf("expected signature mismatch, got %v", err)
+			}
+		})
+	}
+}
+
+func TestClient_Retry(t *testing.T) {
+	t.Run("retries 5xx with the default policy", func(t *testing.T) {
+		var attempts atomic.Int32
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if attempts.Add(1) < 3 {
+				w.WriteHeader(http.StatusServiceUnavailable)
+				return
+			}
+			w.Write([]byte("ok"))
+		}))
+		defer server.Close()
+
+		client, _ := NewClient(Options{URL: server.URL, MaxRetries: 3})
+		res, err := client.Get("test.jpg")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer res.Body.Close()
+		if res.StatusCode != http.StatusOK {
+			t.Errorf("expected status 200, got %d", res.StatusCode)
+		}
+		if n := attempts.Load(); n != 3 {
+			t.Errorf("expected 3 attempts, got %d", n)
+		}
+	})
+
+	t.Run("waits for Retry-After", func(t *testing.T) {
+		var attempts atomic.Int32
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if attempts.Add(1) == 1 {
+				w.Header().Set("Retry-After", "1")
+				w.WriteHeader(http.StatusServiceUnavailable)
+				return
+			}
+			w.Write([]byte("ok"))
+		}))
+		defer server.Close()
+
+		client, _ := NewClient(Options{URL: server.URL, MaxRetries: 1})
+		start := time.Now()
+		res, err := client.Get("test.jpg")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer res.Body.Close()
+		if res.StatusCode != http.StatusOK {
+			t.Errorf("expected status 200, got %d", res.StatusCode)
+		}
+		if elapsed := time.Since(start); elapsed < time.Second {
+			t.Errorf("expected to wait at least 1s, waited %s", elapsed)
+		}
+	})
+
+	t.Run("replays the body of locked keys", func(t *testing.T) {
+		var attempts atomic.Int32
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			body, _ := io.ReadAll(r.Body)
+			if string(body) != "test content" {
+				t.Errorf("expected body to be replayed, got %q", body)
+			}
+			if attempts.Add(1) == 1 {
+				w.WriteHeader(http.StatusConflict)
+				return
+			}
+			w.WriteHeader(http.StatusCreated)
+		}))
+		defer server.Close()
+
+		client, _ := NewClient(Options{URL: server.URL, MaxRetries: 3})
+		if err := client.Put("test.jpg", strings.NewReader("test content")); err != nil {
+			t.Fatal(err)
+		}
+		if n := attempts.Load(); n != 2 {
+			t.Errorf("expected 2 attempts, got %d", n)
+		}
+	})
+
+	t.Run("doesn't retry keys that exist", func(t *testing.T) {
+		var attempts atomic.Int32
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			attempts.Add(1)
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusConflict)
+			w.Write([]byte(`{"error":{"code":"key_exists","message":"key already exists"}}`))
+		}))
+		defer server.Close()
+
+		client, _ := NewClient(Options{URL: server.URL, MaxRetries: 3, RetryBaseDelay: time.Millisecond})
+		if err := client.Put("test.jpg", strings.NewReader("test content")); !errors.Is(err, ErrKeyExists) {
+			t.Fatalf("expected ErrKeyExists, got %v", err)
+		}
+		if n := attempts.Load(); n != 1 {
+			t.Errorf("expected 1 attempt, got %d", n)
+		}
+	})
+
+	t.Run("custom policy", func(t *testing.T) {
+		var attempts atomic.Int32
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			attempts.Add(1)
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}))
+		defer server.Close()
+
+		var calls atomic.Int32
+		client, _ := NewClient(Options{
+			URL:        server.URL,
+			MaxRetries: 3,
+			RetryPolicy: func(req *http.Request, res *http.Response, err error) bool {
+				calls.Add(1)
+				return false
+			},
+		})
+		res, err := client.Get("test.jpg")
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+		if n := attempts.Load(); n != 1 {
+			t.Errorf("expected 1 attempt, got %d", n)
+		}
+		if n := calls.Load(); n != 1 {
+			t.Errorf("expected the policy to be called once, got %d", n)
+		}
+	})
+}
+
+func TestDefaultRetryPolicy(t *testing.T) {
+	tests := []struct {
+		method string
+		status int
+		err    error
+		want   bool
+	}{
+		{http.MethodGet, http.StatusServiceUnavailable, nil, true},
+		{http.MethodPut, http.StatusConflict, nil, true},
+		{http.MethodDelete, http.StatusInternalServerError, nil, true},
+		{http.MethodGet, http.StatusNotImplemented, nil, false},
+		{http.MethodGet, http.StatusNotFound, nil, false},
+		{http.MethodPost, http.StatusServiceUnavailable, nil, false},
+		{http.MethodGet, 0, errors.New("connection refused"), true},
+		{http.MethodGet, 0, context.Canceled, false},
+		{http.MethodGet, http.StatusTooManyRequests, nil, true},
+		{http.MethodGet, 0, &tls.CertificateVerificationError{Err: errors.New("expired")}, false},
+	}
+
+	for _, tt := range tests {
+		req := httptest.NewRequest(tt.method, "/blob/test.jpg", nil)
+		var res *http.Response
+		if tt.err == nil {
+			res = &http.Response{StatusCode: tt.status}
+		}
+		if got := DefaultRetryPolicy(req, res, tt.err); got != tt.want {
+			t.Errorf("DefaultRetryPolicy(%s, %d, %v) = %v, want %v", tt.method, tt.status, tt.err, got, tt.want)
+		}
+	}
+}
+
+func TestClient_SignMany(t *testing.T) {
+	paths := []string{"/blob/a.jpg", "/serve/100x100/blob/b.jpg"}
+
+	t.Run("server", func(t *testing.T) {
+		var requests atomic.Int32
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			requests.Add(1)
+			if r.Method != http.MethodPost || r.URL.Path != "/sign/batch" {
+				t.Errorf("unexpected request %s %s", r.Method, r.URL.Path)
+			}
+			var got []string
+			if err := json.NewDecoder(r.Body).Decode(&got); err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, paths) {
+				t.Errorf("expected paths %v, got %v", paths, got)
+			}
+			signed := make([]string, len(got))
+			for n, p := range got {
+				signed[n] = "http://example.com" + p + "?x-signature=sig"
+			}
+			json.NewEncoder(w).Encode(signed)
+		}))
+		defer server.Close()
+
+		client, _ := NewClient(Options{URL: server.URL, SecretKey: "secret"})
+		signed, err := client.SignMany(paths)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(signed) != len(paths) || signed[1] != "http://example.com/serve/100x100/blob/b.jpg?x-signature=sig" {
+			t.Errorf("unexpected signed URLs %v", signed)
+		}
+		if n := requests.Load(); n != 1 {
+			t.Errorf("expected a single request, got %d", n)
+		}
+	})
+
+	t.Run("local", func(t *testing.T) {
+		client, _ := NewClient(Options{URL: "http://example.com", SignatureSecretKey: "secret"})
+		signed, err := client.SignMany(paths)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for n, s := range signed {
+			u, err := url.Parse(s)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if u.Path != paths[n] {
+				t.Errorf("expected path %s, got %s", paths[n], u.Path)
+			}
+			if err := sign.VerifyURL(u, "secret"); err != nil {
+				t.Errorf("expected a valid signature for %s: %v", s, err)
+			}
+		}
+	})
+}
+
+func TestClient_PresignPost(t *testing.T) {
+	t.Run("local", func(t *testing.T) {
+		client, _ := NewClient(Options{URL: "http://example.com", SignatureSecretKey: "secret"})
+		upload, err := client.PresignPost("uploads/a.png", PresignOptions{TTL: 10 * time.Minute, ContentType: "image/png", MaxSize: 1 << 20})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if upload.Method != http.MethodPut {
+			t.Errorf("expected method PUT, got %s", upload.Method)
+		}
+		if upload.Headers["Content-Type"] != "image/png" {
+			t.Errorf("expected a Content-Type header, got %v", upload.Headers)
+		}
+		u, err := url.Parse(upload.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if u.Path != "/blob/uploads/a.png" {
+			t.Errorf("expected path /blob/uploads/a.png, got %s", u.Path)
+		}
+		if err := sign.VerifyURL(u, "secret"); err != nil {
+			t.Errorf("expected a valid signature: %v", err)
+		}
+		if upload.Query["x-signature"] == "" || upload.Query["x-expire"] == "" || upload.Query["x-method"] != "PUT" || upload.Query["x-max-size"] != "1048576" {
+			t.Errorf("expected signature query parameters, got %v", upload.Query)
+		}
+		if d := time.Until(upload.ExpiresAt); d <= 9*time.Minute || d > 10*time.Minute {
+			t.Errorf("expected the upload to expire in 10 minutes, got %s", d)
+		}
+	})
+
+	t.Run("server", func(t *testing.T) {
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.Method != http.MethodPost || r.URL.Path != "/sign/batch" {
+				t.Errorf("unexpected request %s %s", r.Method, r.URL.Path)
+			}
+			var got []batchItem
+			if err := json.NewDecoder(r.Body).Decode(&got); err != nil {
+				t.Fatal(err)
+			}
+			if len(got) != 1 || got[0].Path != "/blob/a.png" || got[0].TTL != 60 || got[0].Method != http.MethodPut {
+				t.Errorf("unexpected batch %v", got)
+			}
+			json.NewEncoder(w).Encode([]string{"http://example.com/blob/a.png?x-expire=1700000000000&x-signature=sig"})
+		}))
+		defer server.Close()
+
+		client, _ := NewClient(Options{URL: server.URL, SecretKey: "secret"})
+		upload, err := client.PresignPost("a.png", PresignOptions{TTL: time.Minute})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if upload.Query["x-signature"] != "sig" {
+			t.Errorf("expected the server signature, got %v", upload.Query)
+		}
+		if !upload.ExpiresAt.Equal(time.UnixMilli(1700000000000)) {
+			t.Errorf("unexpected expiry %s", upload.ExpiresAt)
+		}
+		if len(upload.Headers) != 0 {
+			t.Errorf("expected no headers, got %v", upload.Headers)
+		}
+	})
+}
+
+func TestClient_PutContentAddressed(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost || r.URL.Path != "/blob" {
+			t.Errorf("unexpected request %s %s", r.Method, r.URL.Path)
+		}
+		if strategy := r.URL.Query().Get("key_strategy"); strategy != "content-hash" {
+			t.Errorf("expected key_strategy=content-hash, got %s", strategy)
+		}
+		body, _ := io.ReadAll(r.Body)
+		key := fmt.Sprintf("%x.png", md5.Sum(body))
+		w.Header().Set("Location", "/blob/"+key)
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(map[string]string{"key": key})
+	}))
+	defer server.Close()
+
+	client, _ := NewClient(Options{URL: server.URL, SecretKey: "secret"})
+	key, err := client.PutContentAddressed(strings.NewReader("test content"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := fmt.Sprintf("%x.png", md5.Sum([]byte("test content"))); key != want {
+		t.Errorf("expected key %s, got %s", want, key)
+	}
+}
+
+func TestClient_IsSignedURLValid(t *testing.T) {
+	var checked string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/sign/check" {
+			t.Errorf("expected path /sign/check, got %s", r.URL.Path)
+		}
+		checked = r.URL.Query().Get("url")
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"valid":false,"reason":"expired"}`))
+	}))
+	defer server.Close()
+
+	serverURL, _ := url.Parse(server.URL)
+	client := &Client{URL: serverURL, transport: http.DefaultTransport}
+	signedURL := "/blob/a.png?x-expire=1&x-signature=abc"
+	valid, err := client.IsSignedURLValid(signedURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if valid || checked != signedURL {
+		t.Errorf("expected the server to check %s, got valid %v for %s", signedURL, valid, checked)
+	}
+
+	client.SignatureSecretKey = "secret"
+	signed, err := client.Sign("/blob/a.png")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for u, want := range map[string]bool{signed: true, strings.Replace(signed, "a.png", "b.png", 1): false} {
+		valid, err := client.IsSignedURLValid(u)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if valid != want {
+			t.Errorf("%s: expected valid %v, got %v", u, want, valid)
+		}
+	}
+}
+
+func TestClient_Stat(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/blob/a.png":
+			if r.Method == http.MethodHead {
+				return
+			}
+			if r.URL.RawQuery != "stat" {
+				t.Errorf("expected a stat query, got %q", r.URL.RawQuery)
+			}
+			w.Write([]byte(`{"key":"a.png","size":12,"md5":"abc","content_type":"image/png","dominant_color":"#1a2b3c","modified_at":"2024-01-02T03:04:05Z","deleted":false}`))
+		case "/blob/deleted.png":
+			w.Write([]byte(`{"key":"deleted.png","size":12,"md5":"abc","modified_at":"2024-01-02T03:04:05Z","deleted":true}`))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+
+	client, _ := NewClient(Options{URL: server.URL})
+	info, err := client.Stat("a.png")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Size != 12 || info.MD5 != "abc" || info.ContentType != "image/png" || info.DominantColor != "#1a2b3c" {
+		t.Errorf("unexpected file info %+v", info)
+	}
+	for _, key := range []string{"deleted.png", "missing.png"} {
+		if _, err := client.Stat(key); !errors.Is(err, ErrNotFound) {
+			t.Errorf("%s: expected ErrNotFound, got %v", key, err)
+		}
+	}
+
+	for key, want := range map[string]bool{"a.png": true, "missing.png": false} {
+		exists, err := client.Exists(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if exists != want {
+			t.Errorf("%s: expected exists %v, got %v", key, want, exists)
+		}
+	}
+}
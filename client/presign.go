@@ -0,0 +1,102 @@
+package railwayimages
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/jaredLunde/railway-image-service/client/sign"
+)
+
+type PresignOptions struct {
+	// How long the upload URL is valid for. Defaults to sign.DefaultTTL when
+	// signing locally, or to the server's SIGNATURE_DEFAULT_TTL.
+	TTL time.Duration
+	// The content type the file is uploaded with, e.g. "image/png". It is
+	// returned as a header to send, but isn't part of the signature. The server
+	// checks the content of every upload against its allowed types regardless.
+	ContentType string
+	// The max size of the upload in bytes, which is bound into the signature.
+	// 0 leaves it to the server's max upload size.
+	MaxSize int64
+}
+
+// PresignedUpload describes a request that uploads a file directly, e.g. from
+// a browser, without knowing the API key or the signing scheme. It serializes
+// to JSON for a frontend to consume:
+//
+//	fetch(upload.url, {method: upload.method, headers: upload.headers, body: file})
+type PresignedUpload struct {
+	// The URL to upload to, including the Query parameters
+	URL string `json:"url"`
+	// The HTTP method of the upload
+	Method string `json:"method"`
+	// The headers to send with the upload
+	Headers map[string]string `json:"headers"`
+	// The signature query parameters of the URL
+	Query map[string]string `json:"query"`
+	// When the URL stops being valid
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// Get a presigned upload for a key. The signature only authorizes a PUT of the
+// key. If a signature secret key is provided in the client options, the URL
+// will be signed locally. Otherwise, a request will be made to the server to
+// sign the URL.
+func (c *Client) PresignPost(key string, opts PresignOptions) (*PresignedUpload, error) {
+	path := blobPath(key)
+	if opts.TTL < 0 {
+		return nil, fmt.Errorf("invalid TTL %s", opts.TTL)
+	}
+	if opts.MaxSize < 0 {
+		return nil, fmt.Errorf("invalid max size %d", opts.MaxSize)
+	}
+
+	var signedURL string
+	if c.SignatureSecretKey != "" && !c.VerifyServerSignatures {
+		u := *c.URL
+		u.Path = path
+		signOpts := sign.Options{TTL: opts.TTL, Method: http.MethodPut, MaxSize: opts.MaxSize}
+		if c.SignatureNonce {
+			signOpts.Nonce = sign.NewNonce()
+		}
+		uri, err := sign.SignURLWithOptions(&u, c.SignatureSecretKey, signOpts)
+		if err != nil {
+			return nil, err
+		}
+		signedURL = *uri
+	} else {
+		// the TTL is rounded up, so the URL is never valid for less than asked
+		ttl := int((opts.TTL + time.Second - 1) / time.Second)
+		// batch paths are URLs, so the key is escaped
+		escaped := (&url.URL{Path: path}).EscapedPath()
+		signed, err := c.signBatch([]batchItem{{Path: escaped, TTL: ttl, Method: http.MethodPut, MaxSize: opts.MaxSize}})
+		if err != nil {
+			return nil, err
+		}
+		signedURL = signed[0]
+	}
+
+	su, err := url.Parse(signedURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid signed URL: %w", err)
+	}
+	upload := &PresignedUpload{
+		URL:     signedURL,
+		Method:  http.MethodPut,
+		Headers: map[string]string{},
+		Query:   map[string]string{},
+	}
+	for name := range su.Query() {
+		upload.Query[name] = su.Query().Get(name)
+	}
+	if opts.ContentType != "" {
+		upload.Headers["Content-Type"] = opts.ContentType
+	}
+	if expireAt, err := strconv.ParseInt(upload.Query["x-expire"], 10, 64); err == nil {
+		upload.ExpiresAt = time.UnixMilli(expireAt).UTC()
+	}
+	return upload, nil
+}
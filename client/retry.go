@@ -0,0 +1,148 @@
+package railwayimages
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"io"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// RetryPolicy decides whether a request should be retried after an attempt.
+// Exactly one of res and err is non-nil.
+type RetryPolicy func(req *http.Request, res *http.Response, err error) bool
+
+// DefaultRetryPolicy retries idempotent requests that failed with a transient
+// connection error, a 5xx or 429 status code, or a 409 status code, which the
+// server returns while another request holds the lock on a key. 409s of
+// write-once keys that already have a file aren't retried.
+func DefaultRetryPolicy(req *http.Request, res *http.Response, err error) bool {
+	switch req.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodPut, http.MethodDelete:
+	default:
+		return false
+	}
+	if err != nil {
+		return transientError(err)
+	}
+	if res.StatusCode == http.StatusConflict {
+		return !keyExists(res)
+	}
+	return res.StatusCode == http.StatusTooManyRequests ||
+		(res.StatusCode >= 500 && res.StatusCode != http.StatusNotImplemented)
+}
+
+// transientError reports whether a request error could go away on its own.
+// Cancellations and certificate errors won't.
+func transientError(err error) bool {
+	var certErr *tls.CertificateVerificationError
+	var authorityErr x509.UnknownAuthorityError
+	var hostnameErr x509.HostnameError
+	return !errors.Is(err, context.Canceled) && !errors.Is(err, context.DeadlineExceeded) &&
+		!errors.As(err, &certErr) && !errors.As(err, &authorityErr) && !errors.As(err, &hostnameErr)
+}
+
+// keyExists reports whether a 409 is for a write-once key that already has a
+// file, which retrying can't fix. The body of the response is left unread.
+func keyExists(res *http.Response) bool {
+	if res.Body == nil {
+		return false
+	}
+	body, _ := io.ReadAll(io.LimitReader(res.Body, 4096))
+	res.Body = struct {
+		io.Reader
+		io.Closer
+	}{io.MultiReader(bytes.NewReader(body), res.Body), res.Body}
+	code, message := parseError(body)
+	// older servers respond with a bare message
+	return code == "key_exists" || message == ErrKeyExists.Error()
+}
+
+const (
+	DefaultRetryBaseDelay = 100 * time.Millisecond
+	DefaultRetryMaxDelay  = 2 * time.Second
+	// The longest Retry-After of a response that is waited for
+	retryMaxAfter = 30 * time.Second
+)
+
+// RetryTransport retries requests with exponential backoff and jitter
+type RetryTransport struct {
+	transport  http.RoundTripper
+	MaxRetries int
+	Policy     RetryPolicy
+	// The delay before the first retry, which doubles with every retry.
+	// Defaults to DefaultRetryBaseDelay.
+	BaseDelay time.Duration
+	// The longest delay between retries, not counting Retry-After. Defaults to
+	// DefaultRetryMaxDelay.
+	MaxDelay time.Duration
+}
+
+func (t *RetryTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	policy := t.Policy
+	if policy == nil {
+		policy = DefaultRetryPolicy
+	}
+
+	for attempt := 0; ; attempt++ {
+		res, err := t.transport.RoundTrip(req)
+		if attempt >= t.MaxRetries || !policy(req, res, err) {
+			return res, err
+		}
+		// a request body that was consumed can only be replayed with GetBody
+		if req.Body != nil && req.Body != http.NoBody {
+			if req.GetBody == nil {
+				return res, err
+			}
+			body, bodyErr := req.GetBody()
+			if bodyErr != nil {
+				return res, err
+			}
+			req = req.Clone(req.Context())
+			req.Body = body
+		}
+		delay := t.retryDelay(attempt)
+		if res != nil {
+			delay = max(delay, retryAfter(res))
+			_, _ = io.Copy(io.Discard, res.Body)
+			res.Body.Close()
+		}
+
+		select {
+		case <-req.Context().Done():
+			return nil, req.Context().Err()
+		case <-time.After(delay):
+		}
+	}
+}
+
+func (t *RetryTransport) retryDelay(attempt int) time.Duration {
+	base, maxDelay := t.BaseDelay, t.MaxDelay
+	if base <= 0 {
+		base = DefaultRetryBaseDelay
+	}
+	if maxDelay <= 0 {
+		maxDelay = DefaultRetryMaxDelay
+	}
+	delay := base << attempt
+	if delay > maxDelay || delay <= 0 {
+		delay = maxDelay
+	}
+	// full jitter over the upper half of the delay
+	return delay/2 + time.Duration(rand.Int63n(int64(delay/2)+1))
+}
+
+// retryAfter returns the delay requested by the Retry-After header of a
+// response, e.g. a 503 from /serve when the process queue is full
+func retryAfter(res *http.Response) time.Duration {
+	seconds, err := strconv.Atoi(res.Header.Get("Retry-After"))
+	if err != nil || seconds <= 0 {
+		return 0
+	}
+	return min(time.Duration(seconds)*time.Second, retryMaxAfter)
+}
@@ -0,0 +1,84 @@
+package sign
+
+import (
+	"fmt"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+const (
+	// ForceFormatParam pins the output format of a serve request, overriding
+	// automatic WebP/AVIF negotiation
+	ForceFormatParam = "force_format"
+	// NoCacheParam skips reading the result cache for a serve request, so the
+	// image is processed again. The fresh result still replaces the cached one.
+	NoCacheParam = "no_cache"
+)
+
+var formatRegex = regexp.MustCompile(`^[a-z0-9]+$`)
+
+// CanonicalServePath returns the image processing path that is signed and
+// served for a /serve request. Serve options passed as query parameters are
+// folded into the path as filters so they are covered by the signature and the
+// result cache key.
+func CanonicalServePath(path string, query url.Values) (string, error) {
+	path = strings.TrimPrefix(path, "/serve")
+	var filters []string
+	if format := query.Get(ForceFormatParam); format != "" {
+		format = strings.ToLower(format)
+		if !formatRegex.MatchString(format) {
+			return "", fmt.Errorf("invalid %s: %q", ForceFormatParam, format)
+		}
+		filters = append(filters, fmt.Sprintf("format(%s)", format))
+	}
+	if noCache := query.Get(NoCacheParam); noCache != "" {
+		v, err := strconv.ParseBool(noCache)
+		if err != nil {
+			return "", fmt.Errorf("invalid %s: %q", NoCacheParam, noCache)
+		}
+		if v {
+			filters = append(filters, "no_cache()")
+		}
+	}
+	if len(filters) == 0 {
+		return path, nil
+	}
+	return addFilters(path, filters...), nil
+}
+
+// addFilters appends filters to the filters segment of an image processing
+// path, creating the segment if it doesn't exist.
+func addFilters(path string, filters ...string) string {
+	segments := strings.Split(strings.TrimPrefix(path, "/"), "/")
+	image := len(segments)
+	for i, seg := range segments {
+		if seg == "blob" || seg == "url" {
+			image = i
+			break
+		}
+	}
+	if image > 0 && strings.HasPrefix(segments[image-1], "filters:") {
+		segments[image-1] += ":" + strings.Join(filters, ":")
+	} else {
+		segments = append(segments[:image], append([]string{"filters:" + strings.Join(filters, ":")}, segments[image:]...)...)
+	}
+	return "/" + strings.Join(segments, "/")
+}
+
+// ServePayload returns the string that is signed for a /serve URL whose query
+// string is covered by the signature: the canonical serve path followed by the
+// query parameters other than x-signature, sorted by key.
+func ServePayload(servePath string, query url.Values) string {
+	q := make(url.Values, len(query))
+	for k, v := range query {
+		if k != "x-signature" {
+			q[k] = v
+		}
+	}
+	if len(q) == 0 {
+		return servePath
+	}
+	return servePath + "?" + q.Encode()
+}
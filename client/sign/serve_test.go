@@ -0,0 +1,77 @@
+package sign
+
+import (
+	"net/url"
+	"testing"
+)
+
+func TestCanonicalServePath(t *testing.T) {
+	tests := []struct {
+		name    string
+		path    string
+		query   url.Values
+		want    string
+		wantErr bool
+	}{
+		{
+			name:  "no options",
+			path:  "/serve/300x300/blob/test.jpg",
+			query: url.Values{},
+			want:  "/300x300/blob/test.jpg",
+		},
+		{
+			name:  "force format without filters",
+			path:  "/serve/300x300/blob/test.jpg",
+			query: url.Values{ForceFormatParam: {"PNG"}},
+			want:  "/300x300/filters:format(png)/blob/test.jpg",
+		},
+		{
+			name:  "force format with existing filters",
+			path:  "/serve/fit-in/filters:blur(2)/url/example.com/test.jpg",
+			query: url.Values{ForceFormatParam: {"jpeg"}},
+			want:  "/fit-in/filters:blur(2):format(jpeg)/url/example.com/test.jpg",
+		},
+		{
+			name:  "force format without operations",
+			path:  "/serve/blob/test.jpg",
+			query: url.Values{ForceFormatParam: {"webp"}},
+			want:  "/filters:format(webp)/blob/test.jpg",
+		},
+		{
+			name:  "no cache",
+			path:  "/serve/300x300/blob/test.jpg",
+			query: url.Values{NoCacheParam: {"1"}, ForceFormatParam: {"png"}},
+			want:  "/300x300/filters:format(png):no_cache()/blob/test.jpg",
+		},
+		{
+			name:  "no cache disabled",
+			path:  "/serve/300x300/blob/test.jpg",
+			query: url.Values{NoCacheParam: {"false"}},
+			want:  "/300x300/blob/test.jpg",
+		},
+		{
+			name:    "invalid no cache",
+			path:    "/serve/300x300/blob/test.jpg",
+			query:   url.Values{NoCacheParam: {"yes please"}},
+			wantErr: true,
+		},
+		{
+			name:    "filter injection",
+			path:    "/serve/blob/test.jpg",
+			query:   url.Values{ForceFormatParam: {"png):blur(100"}},
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := CanonicalServePath(tt.path, tt.query)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("CanonicalServePath() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("expected %q, got %q", tt.want, got)
+			}
+		})
+	}
+}
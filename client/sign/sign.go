@@ -2,10 +2,16 @@ package sign
 
 import (
 	"crypto/hmac"
+	"crypto/rand"
 	"crypto/sha256"
+	"crypto/subtle"
 	"encoding/base64"
+	"errors"
 	"fmt"
+	"net/netip"
 	"net/url"
+	"slices"
+	"strconv"
 	"strings"
 	"time"
 )
@@ -20,23 +26,102 @@ func Sign(key, secret string) string {
 
 // Add a signature to a URL with using the secret key
 func SignURL(url *url.URL, secret string) (*string, error) {
+	return SignURLWithOptions(url, secret, Options{})
+}
+
+type Options struct {
+	// A unique value bound into /blob signatures. When the server requires
+	// nonces, each signed URL can only be used once.
+	Nonce string
+	// How long a /blob signature is valid for. Defaults to DefaultTTL.
+	TTL time.Duration
+	// Only accept a /blob signature from this IP address or CIDR. Defaults to
+	// the x-ip query parameter of the URL, if any.
+	IP string
+	// Only accept a /blob signature for this HTTP method, e.g. PUT for a
+	// browser upload. Defaults to the x-method query parameter of the URL, if
+	// any. Signatures of GET URLs also accept HEAD requests.
+	Method string
+	// The max size in bytes of an upload that a /blob signature bound to PUT
+	// or POST accepts. Defaults to the x-max-size query parameter of the URL,
+	// if any.
+	MaxSize int64
+	// Cover the query string of /serve URLs with the signature. Servers with
+	// SERVE_SIGN_QUERY enabled require it.
+	SignServeQuery bool
+	// Accept /blob signatures for up to ClockSkew after they expire, like
+	// servers with SIGNATURE_CLOCK_SKEW do. Only affects verification.
+	ClockSkew time.Duration
+	// Also accept signatures made with these secrets, e.g. the keys a secret
+	// was rotated from. Only affects verification.
+	PreviousSecrets []string
+}
+
+// DefaultTTL is how long /blob signatures are valid for by default
+const DefaultTTL = time.Hour
+
+// Add a signature to a URL with using the secret key and signing options
+func SignURLWithOptions(url *url.URL, secret string, opts Options) (*string, error) {
 	nextURI := *url
 	path := nextURI.Path
 	p := strings.TrimPrefix(path, "/sign")
 	var signature string
 	if !strings.HasPrefix(p, "/blob") && !strings.HasPrefix(p, "/serve") {
-		return nil, fmt.Errorf("invalid path")
+		return nil, ErrUnsupportedPrefix
 	}
+	query := nextURI.Query()
 	if strings.HasPrefix(p, "/serve") {
-		signature = Sign(strings.TrimPrefix(p, "/serve"), secret)
+		servePath, err := CanonicalServePath(p, query)
+		if err != nil {
+			return nil, err
+		}
+		if opts.SignServeQuery {
+			servePath = ServePayload(servePath, query)
+		}
+		signature = Sign(servePath, secret)
 	}
 
-	query := nextURI.Query()
 	if strings.HasPrefix(p, "/blob") {
-		expireAt := time.Now().Add(time.Hour).UnixMilli()
+		ttl := opts.TTL
+		if ttl <= 0 {
+			ttl = DefaultTTL
+		}
+		expireAt := time.Now().Add(ttl).UnixMilli()
 		query.Set("x-expire", fmt.Sprintf("%d", expireAt))
-		nextURI.RawQuery = query.Encode()
-		signature = Sign(fmt.Sprintf("%s:%d", p, expireAt), secret)
+		if opts.Nonce != "" {
+			query.Set("x-nonce", opts.Nonce)
+		}
+		ip := opts.IP
+		if ip == "" {
+			ip = query.Get("x-ip")
+		}
+		if ip != "" {
+			if !ValidIPScope(ip) {
+				return nil, ErrInvalidIP
+			}
+			query.Set("x-ip", ip)
+		}
+		method := strings.ToUpper(opts.Method)
+		if method == "" {
+			method = strings.ToUpper(query.Get("x-method"))
+		}
+		maxSize := query.Get("x-max-size")
+		if opts.MaxSize != 0 {
+			maxSize = strconv.FormatInt(opts.MaxSize, 10)
+		}
+		if err := ValidBounds(method, maxSize); err != nil {
+			return nil, err
+		}
+		query.Del("x-method")
+		query.Del("x-max-size")
+		if method != "" {
+			query.Set("x-method", method)
+		}
+		if maxSize != "" {
+			query.Set("x-max-size", maxSize)
+		}
+		payload := BoundBlobPayload(p, fmt.Sprintf("%d", expireAt), opts.Nonce, ip, method, maxSize)
+		signature = Sign(ParamsBlobPayload(payload, query), secret)
 	}
 
 	nextURI.Path = p
@@ -45,3 +130,204 @@ func SignURL(url *url.URL, secret string) (*string, error) {
 	nextFullURI := nextURI.String()
 	return &nextFullURI, nil
 }
+
+// BlobPayload returns the string that is signed for a /blob URL
+func BlobPayload(path, expireAt, nonce string) string {
+	payload := fmt.Sprintf("%s:%s", path, expireAt)
+	if nonce != "" {
+		payload += ":" + nonce
+	}
+	return payload
+}
+
+// ScopedBlobPayload returns the string that is signed for a /blob URL that is
+// bound to an IP address or CIDR. The IP comes first, so a payload that is
+// bound to an IP can't be passed off as an unbound one.
+func ScopedBlobPayload(path, expireAt, nonce, ip string) string {
+	payload := BlobPayload(path, expireAt, nonce)
+	if ip == "" {
+		return payload
+	}
+	return "ip=" + ip + ":" + payload
+}
+
+// BoundBlobPayload returns the string that is signed for a /blob URL that is
+// bound to an HTTP method and, for uploads, a max size. The bounds come first,
+// so a bound payload can't be passed off as an unbound one.
+func BoundBlobPayload(path, expireAt, nonce, ip, method, maxSize string) string {
+	payload := ScopedBlobPayload(path, expireAt, nonce, ip)
+	if method == "" {
+		return payload
+	}
+	bounds := "method=" + method
+	if maxSize != "" {
+		bounds += ":max-size=" + maxSize
+	}
+	return bounds + ":" + payload
+}
+
+// BlobParams are the query parameters of /blob URLs that change which keys a
+// request reads or writes, so signatures cover them
+var BlobParams = []string{"original", "transform", "variant", "variants"}
+
+// ParamsBlobPayload returns the string that is signed for a /blob URL with
+// BlobParams in its query, given the payload of the URL without them. The
+// parameters come first, so a payload with them can't be passed off as one
+// without.
+func ParamsBlobPayload(payload string, query url.Values) string {
+	params := url.Values{}
+	for _, name := range BlobParams {
+		if values, ok := query[name]; ok {
+			params[name] = values
+		}
+	}
+	if len(params) == 0 {
+		return payload
+	}
+	// the encoding escapes colons, so it can't run into the rest
+	return "params=" + params.Encode() + ":" + payload
+}
+
+// SignableMethods are the HTTP methods a /blob signature can be bound to
+var SignableMethods = []string{"GET", "HEAD", "PUT", "POST", "DELETE"}
+
+// ValidBounds checks the method and max size a /blob signature is bound to.
+// A max size requires an upload method.
+func ValidBounds(method, maxSize string) error {
+	if method != "" && !slices.Contains(SignableMethods, method) {
+		return ErrInvalidMethod
+	}
+	if maxSize == "" {
+		return nil
+	}
+	if method != "PUT" && method != "POST" {
+		return ErrInvalidMaxSize
+	}
+	if n, err := strconv.ParseInt(maxSize, 10, 64); err != nil || n <= 0 || strconv.FormatInt(n, 10) != maxSize {
+		return ErrInvalidMaxSize
+	}
+	return nil
+}
+
+// MatchMethod reports whether a request with method is allowed by a signature
+// bound to bound. Signatures that aren't bound to a method allow any.
+func MatchMethod(bound, method string) bool {
+	return bound == "" || bound == method || (bound == "GET" && method == "HEAD")
+}
+
+// ValidIPScope reports whether scope is an IP address or CIDR
+func ValidIPScope(scope string) bool {
+	if _, err := netip.ParseAddr(scope); err == nil {
+		return true
+	}
+	_, err := netip.ParsePrefix(scope)
+	return err == nil
+}
+
+// MatchIP reports whether ip is the IP address of scope or in its CIDR
+func MatchIP(scope, ip string) bool {
+	addr, err := netip.ParseAddr(ip)
+	if err != nil {
+		return false
+	}
+	addr = addr.Unmap()
+	if prefix, err := netip.ParsePrefix(scope); err == nil {
+		return prefix.Contains(addr)
+	}
+	scopeAddr, err := netip.ParseAddr(scope)
+	return err == nil && scopeAddr.Unmap() == addr
+}
+
+// NewNonce returns a random nonce for use in Options
+func NewNonce() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+var (
+	ErrSignatureMismatch = errors.New("signature mismatch")
+	ErrSignatureExpired  = errors.New("signature expired")
+	// ErrUnsupportedPrefix is returned for paths that don't start with one of
+	// the SignablePrefixes
+	ErrUnsupportedPrefix = errors.New("unsupported path prefix")
+	// ErrInvalidIP is returned when a signature is bound to something that
+	// isn't an IP address or CIDR
+	ErrInvalidIP = errors.New("invalid IP address or CIDR")
+	// ErrInvalidMethod is returned when a signature is bound to a method that
+	// isn't one of the SignableMethods
+	ErrInvalidMethod = errors.New("invalid method")
+	// ErrInvalidMaxSize is returned when a signature is bound to a max size
+	// that isn't a positive number of bytes, or without an upload method
+	ErrInvalidMaxSize = errors.New("invalid max size")
+)
+
+// SignablePrefixes are the path prefixes that can be signed
+var SignablePrefixes = []string{"/blob", "/serve"}
+
+// VerifyURL checks the signature of a signed /blob or /serve URL. It can't
+// check the IP address, method, or max size a /blob signature is bound to.
+func VerifyURL(u *url.URL, secret string) error {
+	return VerifyURLWithOptions(u, secret, Options{})
+}
+
+// VerifyURLWithOptions checks the signature of a URL that was signed with
+// opts. Only SignServeQuery and ClockSkew affect verification.
+func VerifyURLWithOptions(u *url.URL, secret string, opts Options) error {
+	query := u.Query()
+	signature := query.Get("x-signature")
+	if signature == "" {
+		return ErrSignatureMismatch
+	}
+
+	var payload string
+	switch {
+	case strings.HasPrefix(u.Path, "/serve"):
+		servePath, err := CanonicalServePath(u.Path, query)
+		if err != nil {
+			return err
+		}
+		payload = servePath
+		if opts.SignServeQuery {
+			payload = ServePayload(servePath, query)
+		}
+	case strings.HasPrefix(u.Path, "/blob"):
+		expireAt := query.Get("x-expire")
+		expireAtMillis, err := strconv.ParseInt(expireAt, 10, 64)
+		if err != nil {
+			return ErrSignatureMismatch
+		}
+		if time.Now().Add(-opts.ClockSkew).UnixMilli() > expireAtMillis {
+			return ErrSignatureExpired
+		}
+		ip := query.Get("x-ip")
+		if ip != "" && !ValidIPScope(ip) {
+			return ErrInvalidIP
+		}
+		method, maxSize := query.Get("x-method"), query.Get("x-max-size")
+		if err := ValidBounds(method, maxSize); err != nil {
+			return err
+		}
+		payload = ParamsBlobPayload(BoundBlobPayload(u.Path, expireAt, query.Get("x-nonce"), ip, method, maxSize), query)
+	default:
+		return ErrUnsupportedPrefix
+	}
+
+	if !MatchSignature(signature, payload, secret) && !MatchSignature(signature, payload, opts.PreviousSecrets...) {
+		return ErrSignatureMismatch
+	}
+	return nil
+}
+
+// MatchSignature reports whether signature is the signature of payload with
+// any of secrets
+func MatchSignature(signature, payload string, secrets ...string) bool {
+	match := false
+	for _, secret := range secrets {
+		// every secret is compared, so the time taken doesn't tell which matched
+		match = subtle.ConstantTimeCompare([]byte(signature), []byte(Sign(payload, secret))) == 1 || match
+	}
+	return match
+}
@@ -0,0 +1,108 @@
+package sign
+
+import (
+	"net/url"
+	"testing"
+)
+
+func TestMatchIP(t *testing.T) {
+	tests := []struct {
+		scope string
+		ip    string
+		want  bool
+	}{
+		{"203.0.113.7", "203.0.113.7", true},
+		{"203.0.113.7", "203.0.113.8", false},
+		{"203.0.113.0/24", "203.0.113.200", true},
+		{"203.0.113.0/24", "203.0.114.1", false},
+		{"203.0.113.7", "::ffff:203.0.113.7", true},
+		{"2001:db8::/32", "2001:db8::1", true},
+		{"2001:db8::/32", "203.0.113.7", false},
+		{"203.0.113.7", "not an ip", false},
+		{"not an ip", "203.0.113.7", false},
+	}
+	for _, tt := range tests {
+		if got := MatchIP(tt.scope, tt.ip); got != tt.want {
+			t.Errorf("MatchIP(%q, %q) = %v, want %v", tt.scope, tt.ip, got, tt.want)
+		}
+	}
+}
+
+func TestSignServeQuery(t *testing.T) {
+	u, _ := url.Parse("https://example.com/serve/fit-in/100x100/blob/cat.png?v=1")
+	opts := Options{SignServeQuery: true}
+	signed, err := SignURLWithOptions(u, "secret", opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	su, _ := url.Parse(*signed)
+	if err := VerifyURLWithOptions(su, "secret", opts); err != nil {
+		t.Fatalf("expected a valid signature, got %v", err)
+	}
+	q := su.Query()
+	q.Set("v", "2")
+	su.RawQuery = q.Encode()
+	if err := VerifyURLWithOptions(su, "secret", opts); err != ErrSignatureMismatch {
+		t.Fatalf("expected a tampered query to invalidate the signature, got %v", err)
+	}
+}
+
+func TestVerifyPreviousSecrets(t *testing.T) {
+	for _, path := range []string{"/blob/cat.png", "/serve/100x100/blob/cat.png"} {
+		signed, err := SignURL(&url.URL{Path: path}, "old")
+		if err != nil {
+			t.Fatal(err)
+		}
+		su, _ := url.Parse(*signed)
+		if err := VerifyURL(su, "new"); err != ErrSignatureMismatch {
+			t.Errorf("%s: expected a mismatch without the old secret, got %v", path, err)
+		}
+		if err := VerifyURLWithOptions(su, "new", Options{PreviousSecrets: []string{"older", "old"}}); err != nil {
+			t.Errorf("%s: expected the old secret to be accepted, got %v", path, err)
+		}
+	}
+}
+
+func TestSignBlobParams(t *testing.T) {
+	signed, err := SignURL(&url.URL{Path: "/blob/result.png", RawQuery: "transform=fit-in/100x100&original=originals/a.png"}, "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	su, _ := url.Parse(*signed)
+	if err := VerifyURL(su, "secret"); err != nil {
+		t.Fatalf("expected a valid signature, got %v", err)
+	}
+	for name, value := range map[string]string{"original": "originals/b.png", "transform": "fit-in/9000x9000"} {
+		q := su.Query()
+		q.Set(name, value)
+		tampered := *su
+		tampered.RawQuery = q.Encode()
+		if err := VerifyURL(&tampered, "secret"); err != ErrSignatureMismatch {
+			t.Errorf("expected a changed %s to invalidate the signature, got %v", name, err)
+		}
+	}
+
+	// params can't be added to a URL that was signed without them
+	unsigned, _ := SignURL(&url.URL{Path: "/blob/result.png"}, "secret")
+	for name, value := range map[string]string{"original": "originals/b.png", "variant": "2x", "variants": ""} {
+		su, _ = url.Parse(*unsigned)
+		q := su.Query()
+		q.Set(name, value)
+		su.RawQuery = q.Encode()
+		if err := VerifyURL(su, "secret"); err != ErrSignatureMismatch {
+			t.Errorf("expected an added %s to invalidate the signature, got %v", name, err)
+		}
+	}
+
+	variant, _ := SignURL(&url.URL{Path: "/blob/a.png", RawQuery: "variant=2x"}, "secret")
+	su, _ = url.Parse(*variant)
+	if err := VerifyURL(su, "secret"); err != nil {
+		t.Fatalf("expected a valid variant signature, got %v", err)
+	}
+	q := su.Query()
+	q.Set("variant", "3x")
+	su.RawQuery = q.Encode()
+	if err := VerifyURL(su, "secret"); err != ErrSignatureMismatch {
+		t.Errorf("expected a changed variant to invalidate the signature, got %v", err)
+	}
+}
@@ -0,0 +1,50 @@
+package sign
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"strconv"
+	"time"
+)
+
+// Webhook deliveries are signed with these headers
+const (
+	HeaderWebhookID        = "X-Webhook-Id"
+	HeaderWebhookTimestamp = "X-Webhook-Timestamp"
+	HeaderWebhookSignature = "X-Webhook-Signature"
+)
+
+// DefaultWebhookTolerance is how old a webhook delivery VerifyWebhook accepts
+// by default
+const DefaultWebhookTolerance = 5 * time.Minute
+
+// SignWebhook returns the signature of a webhook body sent at timestamp, in
+// unix seconds. The timestamp is covered, so old deliveries can't be replayed.
+func SignWebhook(body []byte, timestamp, secret string) string {
+	h := hmac.New(sha256.New, []byte(secret))
+	h.Write([]byte(timestamp + "."))
+	h.Write(body)
+	return "sha256=" + hex.EncodeToString(h.Sum(nil))
+}
+
+// VerifyWebhook checks the signature of a webhook delivery from its
+// X-Webhook-Timestamp and X-Webhook-Signature headers, and that it was sent
+// less than tolerance ago. A tolerance of 0 uses DefaultWebhookTolerance.
+func VerifyWebhook(body []byte, timestamp, signature, secret string, tolerance time.Duration) error {
+	if tolerance <= 0 {
+		tolerance = DefaultWebhookTolerance
+	}
+	sentAt, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return ErrSignatureMismatch
+	}
+	if time.Since(time.Unix(sentAt, 0)).Abs() > tolerance {
+		return ErrSignatureExpired
+	}
+	if subtle.ConstantTimeCompare([]byte(signature), []byte(SignWebhook(body, timestamp, secret))) != 1 {
+		return ErrSignatureMismatch
+	}
+	return nil
+}
@@ -0,0 +1,87 @@
+package railwayimages
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+)
+
+// ErrNotFound is returned by Stat when a key has no file
+var ErrNotFound = errors.New("key not found")
+
+// FileInfo describes a stored file
+type FileInfo struct {
+	Key string `json:"key"`
+	// The size of the content, before any compression at rest
+	Size int64 `json:"size"`
+	// The hex MD5 of the content
+	MD5         string `json:"md5"`
+	ContentType string `json:"content_type"`
+	// The original filename of the upload, if it had one
+	Filename string `json:"filename"`
+	// The color extracted from the image, e.g. #1a2b3c, if the server
+	// extracts colors
+	DominantColor string `json:"dominant_color"`
+	// When the key was first uploaded. Nil for files stored before the server
+	// tracked creation times.
+	CreatedAt *time.Time `json:"created_at"`
+	// When the content of the key was last written
+	ModifiedAt time.Time `json:"modified_at"`
+}
+
+// Stat returns the size, MD5, and content type of a key without downloading
+// its file. Keys without a file, including soft-deleted ones, return an error
+// matching ErrNotFound.
+func (c *Client) Stat(key string) (*FileInfo, error) {
+	u := *c.URL
+	u.Path = blobPath(key)
+	u.RawQuery = "stat"
+	res, err := c.get(u)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode == http.StatusNotFound {
+		return nil, fmt.Errorf("%w: %s", ErrNotFound, key)
+	}
+	if res.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(io.LimitReader(res.Body, 1024))
+		return nil, fmt.Errorf("unexpected status code %d: %s", res.StatusCode, errorMessage(body))
+	}
+	var body struct {
+		FileInfo
+		Deleted bool `json:"deleted"`
+	}
+	if err := json.NewDecoder(res.Body).Decode(&body); err != nil {
+		return nil, err
+	}
+	if body.Deleted {
+		return nil, fmt.Errorf("%w: %s", ErrNotFound, key)
+	}
+	return &body.FileInfo, nil
+}
+
+// Exists reports whether a key has a file, without downloading it
+func (c *Client) Exists(key string) (bool, error) {
+	u := *c.URL
+	u.Path = blobPath(key)
+	req, err := http.NewRequest(http.MethodHead, u.String(), nil)
+	if err != nil {
+		return false, err
+	}
+	res, err := c.transport.RoundTrip(req)
+	if err != nil {
+		return false, err
+	}
+	res.Body.Close()
+	switch res.StatusCode {
+	case http.StatusOK:
+		return true, nil
+	case http.StatusNotFound:
+		return false, nil
+	}
+	return false, fmt.Errorf("unexpected status code %d", res.StatusCode)
+}
@@ -0,0 +1,52 @@
+package railwayimages
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+)
+
+// PutVariant uploads a client-provided variant of a key, e.g. "2x" for a
+// hand-optimized high density version. Variants are stored next to the key,
+// under the key followed by "@" and the variant name, and require a server
+// with BLOB_VARIANTS enabled.
+func (c *Client) PutVariant(key, variant string, r io.Reader) error {
+	return c.put(c.variantURL(key, variant), key+"@"+variant, r, nil)
+}
+
+// GetVariant gets a variant of a key uploaded with PutVariant
+func (c *Client) GetVariant(key, variant string) (*http.Response, error) {
+	return c.get(c.variantURL(key, variant))
+}
+
+// Variants lists the names of the variants stored for a key
+func (c *Client) Variants(key string) ([]string, error) {
+	u := *c.URL
+	u.Path = blobPath(key)
+	u.RawQuery = "variants"
+	res, err := c.get(u)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(io.LimitReader(res.Body, 1024))
+		return nil, fmt.Errorf("unexpected status code %d: %s", res.StatusCode, errorMessage(body))
+	}
+	var body struct {
+		Variants []string `json:"variants"`
+	}
+	if err := json.NewDecoder(res.Body).Decode(&body); err != nil {
+		return nil, err
+	}
+	return body.Variants, nil
+}
+
+func (c *Client) variantURL(key, variant string) url.URL {
+	u := *c.URL
+	u.Path = blobPath(key)
+	u.RawQuery = url.Values{"variant": {variant}}.Encode()
+	return u
+}
@@ -1,47 +1,254 @@
 package main
 
 import (
+	"fmt"
+	"maps"
+	"net/url"
+	"os"
+	"slices"
+	"strings"
 	"time"
 
 	"github.com/caarlos0/env/v11"
+	"github.com/jaredLunde/railway-image-service/internal/app/keyval"
 	"github.com/jaredLunde/railway-image-service/internal/pkg/logger"
+	"github.com/jaredLunde/railway-image-service/internal/pkg/mw"
 )
 
 type Config struct {
-	Host        string `env:"HOST" envDefault:"0.0.0.0"`
-	Port        int    `env:"PORT" envDefault:"3000"`
+	Host string `env:"HOST" envDefault:"0.0.0.0"`
+	Port int    `env:"PORT" envDefault:"3000"`
+	// The scheme and host clients reach the server at, e.g.
+	// https://images.example.com, for the URLs it returns. Empty returns paths.
+	PublicURL   string `env:"PUBLIC_URL" envDefault:""`
 	CertFile    string `env:"CERT_FILE" envDefault:""`
 	CertKeyFile string `env:"CERT_KEY_FILE" envDefault:""`
 	// The maximum duration for reading the entire request, including the body
 	RequestTimeout time.Duration `env:"REQUEST_TIMEOUT" envDefault:"30s"`
+	// Overrides REQUEST_TIMEOUT for uploads to /blob
+	UploadTimeout time.Duration `env:"UPLOAD_TIMEOUT" envDefault:"0"`
+	// Overrides REQUEST_TIMEOUT for /serve
+	ServeTimeout time.Duration `env:"SERVE_TIMEOUT" envDefault:"0"`
+	// Overrides REQUEST_TIMEOUT for /sign
+	SignTimeout time.Duration `env:"SIGN_TIMEOUT" envDefault:"0"`
 	// Allowed origins for CORS
 	CORSAllowedOrigins string `env:"CORS_ALLOWED_ORIGINS" envDefault:"*"`
+	// A comma-separated allowlist of Host headers, e.g. "images.example.com,*.example.com".
+	// Empty allows every host.
+	AllowedHosts string `env:"ALLOWED_HOSTS" envDefault:""`
+	// A comma-separated list of the IPs and CIDRs of reverse proxies whose
+	// client IP headers, e.g. X-Forwarded-For, are trusted. Empty trusts none.
+	TrustedProxies string `env:"TRUSTED_PROXIES" envDefault:""`
+	// Headers added to every response, as a JSON object or comma-separated
+	// name:value pairs, e.g. "X-Content-Type-Options:nosniff,Server:images"
+	ResponseHeaders string `env:"RESPONSE_HEADERS" envDefault:""`
+	// The header request IDs are read from and echoed in
+	RequestIDHeader string `env:"REQUEST_ID_HEADER" envDefault:"X-Request-ID"`
+	// Reuse request IDs sent by an upstream proxy instead of always generating one
+	RequestIDTrustInbound bool `env:"REQUEST_ID_TRUST_INBOUND" envDefault:"true"`
 
 	// The maximum size of a request body in bytes
 	MaxUploadSize int `env:"MAX_UPLOAD_SIZE" envDefault:"10485760"` // 10MB
+	// A comma-separated list of content type prefixes uploads may have
+	AllowedMimeTypes string `env:"ALLOWED_MIME_TYPES" envDefault:"image/"`
+	// Accept uploads whose content type can't be detected, e.g. newer image formats
+	UploadAllowUnknown bool `env:"UPLOAD_ALLOW_UNKNOWN" envDefault:"false"`
+	// The number of leading bytes the content type of an upload is detected from
+	MimeSniffBytes int `env:"MIME_SNIFF_BYTES" envDefault:"512"`
+	// Store zero-byte uploads, bypassing the allowed content types
+	AllowEmptyFiles bool `env:"ALLOW_EMPTY_FILES" envDefault:"false"`
+	// Reject keys without a recognized file extension matching their content
+	RequireFileExtension bool `env:"REQUIRE_FILE_EXTENSION" envDefault:"false"`
+	// Additional recognized file extensions, e.g. ".jfif:image/jpeg"
+	FileExtensionTypes map[string]string `env:"FILE_EXTENSION_TYPES" envDefault:""`
 	// The path to the directory where uploaded files are stored
 	UploadPath string `env:"UPLOAD_PATH" envDefault:"/app/data/uploads"`
+	// Where uploaded files are stored: local for UPLOAD_PATH, or s3 for an
+	// S3-compatible bucket, e.g. AWS S3 or Cloudflare R2
+	StorageBackend string `env:"STORAGE_BACKEND" envDefault:"local"`
+	S3Bucket       string `env:"S3_BUCKET" envDefault:""`
+	// The endpoint of the S3-compatible API, e.g. https://<account>.r2.cloudflarestorage.com.
+	// Defaults to the AWS endpoint of S3_REGION.
+	S3Endpoint        string `env:"S3_ENDPOINT" envDefault:""`
+	S3Region          string `env:"S3_REGION" envDefault:"us-east-1"`
+	S3AccessKeyID     string `env:"S3_ACCESS_KEY_ID" envDefault:""`
+	S3SecretAccessKey string `env:"S3_SECRET_ACCESS_KEY" envDefault:""`
+	// Prefixes the key of every object in the bucket, e.g. "images/"
+	S3Prefix string `env:"S3_PREFIX" envDefault:""`
+	// Per-prefix soft delete overrides, e.g. "tmp/:false,archive/:true". The most specific prefix wins.
+	SoftDeletePrefixes map[string]bool `env:"SOFT_DELETE_PREFIXES" envDefault:""`
+	// How long soft-deleted files are kept before they are removed. 0 keeps them forever.
+	SoftDeleteRetention time.Duration `env:"SOFT_DELETE_RETENTION" envDefault:"0"`
+	// How often soft-deleted files older than SOFT_DELETE_RETENTION are removed
+	SoftDeleteGCInterval time.Duration `env:"SOFT_DELETE_GC_INTERVAL" envDefault:"1h"`
+	// Refuse to overwrite existing files
+	WriteOnce bool `env:"WRITE_ONCE" envDefault:"false"`
+	// Per-prefix write-once overrides, e.g. "avatars/:false,originals/:true"
+	WriteOncePrefixes map[string]bool `env:"WRITE_ONCE_PREFIXES" envDefault:""`
+	// Sync uploads to disk before renaming them into place
+	FsyncOnWrite bool `env:"FSYNC_ON_WRITE" envDefault:"true"`
+	// Gzip compressible, non-image uploads before storing them
+	CompressAtRest bool `env:"COMPRESS_AT_REST" envDefault:"false"`
+	// Store client-provided variants of a key with PUT /blob/:key?variant=2x
+	BlobVariants bool `env:"BLOB_VARIANTS" envDefault:"false"`
+	// Stores the color of uploaded images and sends it in the x-dominant-color
+	// header: average, dominant, or empty to disable it
+	ExtractDominantColor string `env:"EXTRACT_DOMINANT_COLOR" envDefault:""`
+	// A comma-separated allowlist of transforms uploads can be stored with by
+	// POST /blob/:key?transform=, e.g. "fit-in/2000x2000". "*" allows any
+	// transform. Empty disables it.
+	UploadTransforms string `env:"UPLOAD_TRANSFORMS" envDefault:""`
+	// The Content-Disposition type of blob downloads: inline, attachment, or none
+	ContentDisposition string `env:"CONTENT_DISPOSITION" envDefault:"inline"`
+	// Lays out uploaded files by a template, e.g. "{yyyy}/{mm}/{hashfan}/{hexkey}"
+	UploadPathTemplate string `env:"UPLOAD_PATH_TEMPLATE" envDefault:""`
+	// Limits how fast each upload is read, in bytes per second. 0 disables the limit.
+	UploadRateLimitBPS int `env:"UPLOAD_RATE_LIMIT_BPS" envDefault:"0"`
+	// Aborts uploads that send no bytes for this long. 0 disables the timeout.
+	UploadIdleTimeout time.Duration `env:"UPLOAD_IDLE_TIMEOUT" envDefault:"0"`
+	// Limits how fast each file download is sent, in bytes per second. 0 disables the limit.
+	FilesRateLimitBPS int `env:"FILES_RATE_LIMIT_BPS" envDefault:"0"`
+	// Limits how many files are downloaded at once, so bursts can't exhaust file descriptors. 0 disables the limit.
+	FilesServeConcurrency int `env:"FILES_SERVE_CONCURRENCY" envDefault:"0"`
+	// Limits how many requests each API key, signed URL, or IP address makes per second. 0 disables the limit.
+	RateLimitRPS float64 `env:"RATE_LIMIT_RPS" envDefault:"0"`
+	// How many requests a client can make at once before RATE_LIMIT_RPS applies. 0 defaults to RATE_LIMIT_RPS.
+	RateLimitBurst int `env:"RATE_LIMIT_BURST" envDefault:"0"`
+	// Hand file downloads off to a reverse proxy with this header, e.g. X-Accel-Redirect
+	FilesSendfileHeader string `env:"FILES_SENDFILE_HEADER" envDefault:""`
+	// The internal location the reverse proxy serves UPLOAD_PATH from, e.g. /internal/files
+	FilesSendfilePrefix string `env:"FILES_SENDFILE_PREFIX" envDefault:""`
+	// Hash uploads in chunks of this many bytes. 0 disables chunk hashes.
+	ChunkHashSize int `env:"CHUNK_HASH_SIZE" envDefault:"0"`
+	// The fraction of blob and serve reads counted towards per-key access counts. 0 disables counting.
+	AccessStatsSampleRate float64 `env:"ACCESS_STATS_SAMPLE_RATE" envDefault:"0"`
+	// How often counted reads are flushed to the database
+	AccessStatsFlushInterval time.Duration `env:"ACCESS_STATS_FLUSH_INTERVAL" envDefault:"1m"`
+	// Temporary files of interrupted uploads older than this are removed at startup
+	TempFileMaxAge time.Duration `env:"TEMP_FILE_MAX_AGE" envDefault:"24h"`
+	// Collapse duplicate slashes and "." segments of keys, and reject ".." segments
+	CleanKeys bool `env:"CLEAN_KEYS" envDefault:"false"`
 	// The path to the LevelDB database
 	LevelDBPath string `env:"LEVELDB_PATH" envDefault:"/app/data/db"`
-	// Used for securing the key value storage API
+	// Prefixes every LevelDB key. Changing it orphans the existing records.
+	DBKeyNamespace string `env:"DB_KEY_NAMESPACE" envDefault:""`
+	// Attempt to recover the LevelDB database if it fails to open because it is corrupted
+	LevelDBRecover bool `env:"LEVELDB_RECOVER" envDefault:"false"`
+	// Run as a read replica of the primary at this URL. Writes are forwarded to it.
+	ReplicaPrimaryURL string `env:"REPLICA_PRIMARY_URL" envDefault:""`
+	// How often a replica reloads the primary's database
+	ReplicaRefreshInterval time.Duration `env:"REPLICA_REFRESH_INTERVAL" envDefault:"10s"`
+	// A comma-separated list of URLs that upload, delete, and unlink events are POSTed to
+	WebhookURLs string `env:"WEBHOOK_URLS" envDefault:""`
+	// Signs webhook deliveries. Defaults to SIGNATURE_SECRET_KEY.
+	WebhookSecret string `env:"WEBHOOK_SECRET" envDefault:""`
+	// How many times a failed webhook delivery is retried with exponential backoff
+	WebhookMaxRetries int `env:"WEBHOOK_MAX_RETRIES" envDefault:"5"`
+	// How long each webhook delivery attempt may take
+	WebhookTimeout time.Duration `env:"WEBHOOK_TIMEOUT" envDefault:"10s"`
+	// Webhook deliveries that failed for good are appended to this file as JSON lines
+	WebhookDeadLetterPath string `env:"WEBHOOK_DEAD_LETTER_PATH" envDefault:""`
+	// How many webhook deliveries can wait to be sent
+	WebhookQueueSize int `env:"WEBHOOK_QUEUE_SIZE" envDefault:"1024"`
+	// What to do with webhook deliveries once the queue is full: dead-letter,
+	// drop-oldest, or block
+	WebhookQueuePolicy string `env:"WEBHOOK_QUEUE_POLICY" envDefault:"dead-letter"`
+	// Spans are exported over OTLP/HTTP when either endpoint is set. The other
+	// standard OTEL_EXPORTER_OTLP_* variables are read by the exporter.
+	OTLPEndpoint       string `env:"OTEL_EXPORTER_OTLP_ENDPOINT" envDefault:""`
+	OTLPTracesEndpoint string `env:"OTEL_EXPORTER_OTLP_TRACES_ENDPOINT" envDefault:""`
+	// Used for securing the key value storage API. It is granted every scope.
 	SecretKey string `env:"SECRET_KEY" envDefault:"password"`
-	// Used for signing URLs
-	SignatureSecretKey string `env:"SIGNATURE_SECRET_KEY" envDefault:"secret"`
+	// More API keys with scoped permissions, as a JSON object of keys and
+	// their scopes, e.g. {"analytics-key": ["files:read"]}
+	APIKeys string `env:"API_KEYS" envDefault:""`
+	// A JSON file of API keys in the API_KEYS format. Its keys are added to
+	// those of API_KEYS.
+	APIKeysFile string `env:"API_KEYS_FILE" envDefault:""`
+	// Used for signing URLs. A comma-separated list rotates the key: the first
+	// one signs, and the rest are only accepted. LoadConfig splits them into
+	// SignatureSecretKey and SignaturePreviousSecretKeys.
+	SignatureSecretKey          string `env:"SIGNATURE_SECRET_KEY" envDefault:"secret"`
+	SignaturePreviousSecretKeys []string
+	// A comma-separated list of blob storage methods (GET, POST, PUT, DELETE) whose signed URLs can only be used once
+	SignatureNonceMethods string `env:"SIGNATURE_NONCE_METHODS" envDefault:""`
+	// Caps how many signatures are verified at once. 0 disables the cap.
+	SignatureMaxConcurrentVerifications int `env:"SIGNATURE_MAX_CONCURRENT_VERIFICATIONS" envDefault:"0"`
+	// Accept signatures for this long after they expire to tolerate clock skew
+	SignatureClockSkew time.Duration `env:"SIGNATURE_CLOCK_SKEW" envDefault:"0s"`
+	// How long signed /blob URLs are valid for unless /sign is asked for another TTL
+	SignatureDefaultTTL time.Duration `env:"SIGNATURE_DEFAULT_TTL" envDefault:"1h"`
+	// The longest TTL /sign can be asked for with expires_in or a batch ttl
+	SignatureMaxTTL time.Duration `env:"SIGNATURE_MAX_TTL" envDefault:"8760h"`
 
 	// A comma-separated list of allowed URL sources
 	ServeAllowedHTTPSources string `env:"SERVE_ALLOWED_HTTP_SOURCES" envDefault:"*"`
+	// A comma-separated list of the loaders images are loaded from, in the order they are tried
+	ServeLoaderOrder string `env:"SERVE_LOADER_ORDER" envDefault:"blob,http"`
+	// A comma-separated list of the content types accepted from HTTP sources, e.g. "image/*,application/pdf"
+	ServeHTTPAccept string `env:"SERVE_HTTP_ACCEPT" envDefault:"image/*"`
+	// Rasterize SVG sources from HTTP instead of rejecting them
+	ServeAllowSVGSources bool `env:"SERVE_ALLOW_SVG_SOURCES" envDefault:"false"`
+	// The max width and height SVG sources are rasterized at
+	ServeSVGMaxDimension int `env:"SERVE_SVG_MAX_DIMENSION" envDefault:"4096"`
 	// Automatically convert images to WebP
 	ServeAutoWebP bool `env:"SERVE_AUTO_WEBP" envDefault:"true"`
 	// Automatically convert images to AVIF
 	ServeAutoAVIF bool `env:"SERVE_AUTO_AVIF" envDefault:"true"`
+	// Scale the dimensions of images by the device pixel ratio of the
+	// Sec-CH-DPR or DPR client hint
+	ServeClientHints bool `env:"SERVE_CLIENT_HINTS" envDefault:"false"`
+	// The highest device pixel ratio client hints can scale images by
+	ServeMaxDPR float64 `env:"SERVE_MAX_DPR" envDefault:"3"`
 	// The max number of images to process concurrently
 	ServeConcurrency int `env:"SERVE_CONCURRENCY" envDefault:"20"`
+	// The max number of remote sources to fetch concurrently. 0 means unlimited.
+	ServeSourceFetchConcurrency int `env:"SERVE_SOURCE_FETCH_CONCURRENCY" envDefault:"0"`
+	// Queue fetches beyond the fetch concurrency limit instead of returning a 503
+	ServeSourceFetchQueue bool `env:"SERVE_SOURCE_FETCH_QUEUE" envDefault:"true"`
 	// The duration to cache processed images
 	ServeCacheTTL time.Duration `env:"SERVE_RESULT_CACHE_TTL" envDefault:"24h"`
+	// The max TTL a cache(seconds) filter can set for a single transform
+	ServeMaxCacheTTL time.Duration `env:"SERVE_MAX_CACHE_TTL" envDefault:"8760h"`
+	// The age after which result cache entries are always processed again,
+	// regardless of their TTL. Zero disables it.
+	ServeResultMaxAge time.Duration `env:"SERVE_RESULT_MAX_AGE" envDefault:"0"`
+	// Treat cached results as stale when their blob storage source changed: modtime, md5, or empty
+	ServeSourceCheck string `env:"SERVE_SOURCE_CHECK" envDefault:""`
 	// The TTL for the Cache-Control header
 	ServeCacheControlTTL time.Duration `env:"SERVE_CACHE_CONTROL_TTL" envDefault:"8760h"`
 	// The SWR time for the Cache-Control header
 	ServeCacheControlSWR time.Duration `env:"SERVE_CACHE_CONTROL_SWR" envDefault:"24h"`
+	// Never upscale images beyond the dimensions of their source
+	ServeNoUpscale bool `env:"SERVE_NO_UPSCALE" envDefault:"false"`
+	// A comma-separated list of formats images can be served in, e.g. "jpeg,png,webp,avif". Empty allows all formats.
+	ServeAllowedOutputFormats string `env:"SERVE_ALLOWED_OUTPUT_FORMATS" envDefault:""`
+	// Share result cache entries between transforms that only differ in the order of their option filters
+	ServeNormalizeCacheKeys bool `env:"SERVE_NORMALIZE_CACHE_KEYS" envDefault:"false"`
+	// The max number of filters in a single /serve request. 0 means unlimited.
+	ServeMaxFilters int `env:"SERVE_MAX_FILTERS" envDefault:"0"`
+	// Allow unsigned /serve requests. Defaults to true in development and false otherwise.
+	ServeAllowUnsafe *bool `env:"SERVE_ALLOW_UNSAFE" envDefault:""`
+	// Cover the query string of /serve URLs with their signatures
+	ServeSignQuery bool `env:"SERVE_SIGN_QUERY" envDefault:"false"`
+	// A comma-separated allowlist of custom vips filters to enable, e.g. "unsharp,invert"
+	ServeCustomFilters string `env:"SERVE_CUSTOM_FILTERS" envDefault:""`
+	// The blob storage key of an image to serve when processing an image fails
+	ServeErrorImageKey string `env:"SERVE_ERROR_IMAGE_KEY" envDefault:""`
+	// Stream blobs as-is for /serve requests without a transform
+	ServeOriginals bool `env:"SERVE_ORIGINALS" envDefault:"false"`
+	// Serve imagor's native /HASH/path signed URLs at /imagor
+	ServeImagorCompat bool `env:"SERVE_IMAGOR_COMPAT" envDefault:"false"`
+	// The hash of native imagor signatures: sha1, sha256, or sha512
+	ServeImagorSignerType string `env:"SERVE_IMAGOR_SIGNER_TYPE" envDefault:"sha1"`
+	// Truncate native imagor signatures to this many characters. 0 disables it.
+	ServeImagorSignerTruncate int `env:"SERVE_IMAGOR_SIGNER_TRUNCATE" envDefault:"0"`
+	// The secret of native imagor signatures. Defaults to SIGNATURE_SECRET_KEY.
+	ServeImagorSecret string `env:"SERVE_IMAGOR_SECRET" envDefault:""`
+
+	// Enable the /admin/locks endpoint to inspect and force-release key locks.
+	// Defaults to true in development and false otherwise.
+	AdminLocksEnabled *bool `env:"ADMIN_LOCKS_ENABLED" envDefault:""`
 
 	Environment Environment     `env:"ENVIRONMENT" envDefault:"production"`
 	LogLevel    logger.LogLevel `env:"LOG_LEVEL" envDefault:"info"`
@@ -59,6 +266,78 @@ func LoadConfig() (cfg Config, err error) {
 	if err = env.ParseWithOptions(&cfg, env.Options{RequiredIfNoDef: true}); err != nil {
 		return
 	}
+	switch cfg.ContentDisposition {
+	case "inline", "attachment", "none":
+	default:
+		err = fmt.Errorf("invalid CONTENT_DISPOSITION %q: must be inline, attachment, or none", cfg.ContentDisposition)
+	}
+	switch cfg.StorageBackend {
+	case keyval.StorageBackendLocal, keyval.StorageBackendS3:
+	default:
+		err = fmt.Errorf("invalid STORAGE_BACKEND %q: must be local or s3", cfg.StorageBackend)
+	}
+	if keys := strings.Split(cfg.SignatureSecretKey, ","); len(keys) > 1 {
+		for n := range keys {
+			keys[n] = strings.TrimSpace(keys[n])
+		}
+		if slices.Contains(keys, "") {
+			err = fmt.Errorf("invalid SIGNATURE_SECRET_KEY: keys in a list can't be empty")
+		}
+		cfg.SignatureSecretKey, cfg.SignaturePreviousSecretKeys = keys[0], keys[1:]
+	}
+	if cfg.PublicURL != "" {
+		if u, perr := url.Parse(cfg.PublicURL); perr != nil || u.Scheme == "" || u.Host == "" {
+			err = fmt.Errorf("invalid PUBLIC_URL %q: must be an absolute URL", cfg.PublicURL)
+		}
+		cfg.PublicURL = strings.TrimSuffix(cfg.PublicURL, "/")
+	}
+	if cfg.SignatureDefaultTTL <= 0 {
+		err = fmt.Errorf("invalid SIGNATURE_DEFAULT_TTL %s: must be positive", cfg.SignatureDefaultTTL)
+	}
+	if cfg.SignatureMaxTTL < time.Second || cfg.SignatureMaxTTL < cfg.SignatureDefaultTTL {
+		err = fmt.Errorf("invalid SIGNATURE_MAX_TTL %s: must be at least a second and SIGNATURE_DEFAULT_TTL", cfg.SignatureMaxTTL)
+	}
+	if cfg.RateLimitRPS < 0 {
+		err = fmt.Errorf("invalid RATE_LIMIT_RPS %v: must not be negative", cfg.RateLimitRPS)
+	}
+	if cfg.RateLimitBurst < 0 {
+		err = fmt.Errorf("invalid RATE_LIMIT_BURST %d: must not be negative", cfg.RateLimitBurst)
+	}
+	if cfg.WebhookQueueSize < 1 {
+		err = fmt.Errorf("invalid WEBHOOK_QUEUE_SIZE %d: must be positive", cfg.WebhookQueueSize)
+	}
+	if cfg.AccessStatsSampleRate < 0 || cfg.AccessStatsSampleRate > 1 {
+		err = fmt.Errorf("invalid ACCESS_STATS_SAMPLE_RATE %v: must be between 0 and 1", cfg.AccessStatsSampleRate)
+	}
 
 	return
 }
+
+// loadAPIKeys returns the scoped API keys of API_KEYS and API_KEYS_FILE
+func loadAPIKeys(cfg Config) (mw.APIKeys, error) {
+	keys, err := mw.ParseAPIKeys([]byte(cfg.APIKeys))
+	if err != nil {
+		return nil, fmt.Errorf("API_KEYS: %w", err)
+	}
+	if cfg.APIKeysFile == "" {
+		return keys, nil
+	}
+	data, err := os.ReadFile(cfg.APIKeysFile)
+	if err != nil {
+		return nil, fmt.Errorf("API_KEYS_FILE: %w", err)
+	}
+	fileKeys, err := mw.ParseAPIKeys(data)
+	if err != nil {
+		return nil, fmt.Errorf("API_KEYS_FILE: %w", err)
+	}
+	maps.Copy(keys, fileKeys)
+	return keys, nil
+}
+
+// allowUnsafe reports whether unsigned /serve requests are allowed
+func (cfg Config) allowUnsafe() bool {
+	if cfg.ServeAllowUnsafe != nil {
+		return *cfg.ServeAllowUnsafe
+	}
+	return cfg.Environment == EnvironmentDevelopment
+}
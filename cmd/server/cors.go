@@ -0,0 +1,29 @@
+package main
+
+import (
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v3"
+	"github.com/gofiber/fiber/v3/middleware/cors"
+	"github.com/jaredLunde/railway-image-service/internal/app/imagor"
+	"github.com/jaredLunde/railway-image-service/internal/app/keyval"
+)
+
+// newCORS answers browser preflights for every route, including /serve, whose
+// handler is an adapted net/http handler. Preflights never reach the routes, so
+// signed requests that send x-signature or x-expire as headers aren't blocked.
+func newCORS(cfg Config) fiber.Handler {
+	corsAllowedOrigins := strings.Split(cfg.CORSAllowedOrigins, ",")
+	return cors.New(cors.Config{
+		AllowOrigins:        corsAllowedOrigins,
+		AllowMethods:        []string{fiber.MethodGet, fiber.MethodHead, fiber.MethodPost, fiber.MethodPut, fiber.MethodPatch, fiber.MethodDelete, fiber.MethodOptions},
+		AllowHeaders:        []string{"Origin", "Content-Type", "Accept", "Cache-Control", "If-Match", "If-None-Match", "x-api-key", "x-signature", "x-expire", keyval.HeaderRateLimit},
+		ExposeHeaders:       []string{"Content-Disposition", cfg.RequestIDHeader, "Content-Md5", "Content-Range", "Accept-Ranges", "ETag", imagor.HeaderCache},
+		AllowPrivateNetwork: true,
+		// in seconds
+		MaxAge:           int(time.Hour / time.Second),
+		AllowCredentials: !slices.Contains(corsAllowedOrigins, "*"),
+	})
+}
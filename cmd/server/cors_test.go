@@ -0,0 +1,56 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gofiber/fiber/v3"
+	"github.com/gofiber/fiber/v3/middleware/adaptor"
+	"github.com/jaredLunde/railway-image-service/internal/pkg/mw"
+)
+
+func TestCORS_ServePreflight(t *testing.T) {
+	app := fiber.New()
+	app.Use(newCORS(Config{CORSAllowedOrigins: "https://example.com", RequestIDHeader: "X-Request-ID"}))
+	serveHandler := adaptor.HTTPHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.Errorf("expected %s %s to not reach the serve handler", r.Method, r.URL.Path)
+	}))
+	app.Get("/serve/*", serveHandler)
+	app.Head("/serve/*", serveHandler)
+	app.All("/serve/*", mw.NewMethodNotAllowed(fiber.MethodGet, fiber.MethodHead))
+
+	req := httptest.NewRequest(http.MethodOptions, "/serve/300x300/blob/gopher.png", nil)
+	req.Header.Set("Origin", "https://example.com")
+	req.Header.Set("Access-Control-Request-Method", http.MethodGet)
+	req.Header.Set("Access-Control-Request-Headers", "x-signature")
+	res, err := app.Test(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.StatusCode != http.StatusNoContent {
+		t.Fatalf("expected status 204, got %d", res.StatusCode)
+	}
+	if got := res.Header.Get("Access-Control-Allow-Origin"); got != "https://example.com" {
+		t.Errorf("expected the origin to be allowed, got %q", got)
+	}
+	if got := strings.ToLower(res.Header.Get("Access-Control-Allow-Headers")); !strings.Contains(got, "x-signature") {
+		t.Errorf("expected x-signature to be allowed, got %q", got)
+	}
+	if got := res.Header.Get("Access-Control-Max-Age"); got != "3600" {
+		t.Errorf("expected a max age of an hour, got %q", got)
+	}
+
+	// a plain OPTIONS request lists the methods of the route
+	res, err = app.Test(httptest.NewRequest(http.MethodOptions, "/serve/300x300/blob/gopher.png", nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.StatusCode != http.StatusNoContent {
+		t.Fatalf("expected status 204, got %d", res.StatusCode)
+	}
+	if got := res.Header.Get("Allow"); got != "GET, HEAD, OPTIONS" {
+		t.Errorf("unexpected Allow header %q", got)
+	}
+}
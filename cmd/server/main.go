@@ -2,7 +2,6 @@ package main
 
 import (
 	"context"
-	"crypto/subtle"
 	"fmt"
 	"log/slog"
 	"net/http"
@@ -13,21 +12,25 @@ import (
 	"syscall"
 	"time"
 
+	"github.com/cshum/imagor/imagorpath"
 	"github.com/goccy/go-json"
 	"github.com/gofiber/fiber/v3"
 	"github.com/gofiber/fiber/v3/middleware/adaptor"
-	"github.com/gofiber/fiber/v3/middleware/cors"
+	"github.com/gofiber/fiber/v3/middleware/compress"
 	"github.com/gofiber/fiber/v3/middleware/favicon"
 	"github.com/gofiber/fiber/v3/middleware/healthcheck"
 	"github.com/gofiber/fiber/v3/middleware/helmet"
 	fiberrecover "github.com/gofiber/fiber/v3/middleware/recover"
-	"github.com/gofiber/fiber/v3/middleware/requestid"
 	"github.com/jaredLunde/railway-image-service/client/sign"
 	"github.com/jaredLunde/railway-image-service/internal/app/imagor"
 	"github.com/jaredLunde/railway-image-service/internal/app/keyval"
 	"github.com/jaredLunde/railway-image-service/internal/app/signature"
+	"github.com/jaredLunde/railway-image-service/internal/app/webhook"
+	"github.com/jaredLunde/railway-image-service/internal/pkg/httperr"
 	"github.com/jaredLunde/railway-image-service/internal/pkg/logger"
 	"github.com/jaredLunde/railway-image-service/internal/pkg/mw"
+	"github.com/jaredLunde/railway-image-service/internal/pkg/tracing"
+	"go.opentelemetry.io/otel"
 	"golang.org/x/sync/errgroup"
 )
 
@@ -47,44 +50,85 @@ func main() {
 		Pretty:   debug,
 	})
 
-	kvService, err := keyval.New(keyval.Config{
-		BasePath:         "/blob",
-		UploadPath:       cfg.UploadPath,
-		LevelDBPath:      cfg.LevelDBPath,
-		SoftDelete:       true,
-		SignSecret:       cfg.SignatureSecretKey,
-		MaxSize:          cfg.MaxUploadSize,
-		AllowedMimeTypes: []string{"image/"},
-		Logger:           log,
-		Debug:            debug,
-	})
+	if len(os.Args) > 1 && os.Args[1] == "selftest" {
+		if !selftest(ctx, cfg, log) {
+			os.Exit(1)
+		}
+		return
+	}
+
+	tracingEnabled := cfg.OTLPEndpoint != "" || cfg.OTLPTracesEndpoint != ""
+	shutdownTracing := func(context.Context) error { return nil }
+	if tracingEnabled {
+		if shutdownTracing, err = tracing.New(ctx); err != nil {
+			log.Error("invalid OTEL_EXPORTER_OTLP config", "error", err)
+			os.Exit(1)
+		}
+	}
+
+	allowUnsafe := cfg.allowUnsafe()
+	adminLocksEnabled := debug
+	if cfg.AdminLocksEnabled != nil {
+		adminLocksEnabled = *cfg.AdminLocksEnabled
+	}
+
+	var hooks *webhook.Webhook
+	if cfg.WebhookURLs != "" {
+		secret := cfg.WebhookSecret
+		if secret == "" {
+			secret = cfg.SignatureSecretKey
+		}
+		hooks, err = webhook.New(webhook.Config{
+			URLs:           strings.Split(cfg.WebhookURLs, ","),
+			Secret:         secret,
+			MaxRetries:     cfg.WebhookMaxRetries,
+			Timeout:        cfg.WebhookTimeout,
+			DeadLetterPath: cfg.WebhookDeadLetterPath,
+			QueueSize:      cfg.WebhookQueueSize,
+			QueuePolicy:    cfg.WebhookQueuePolicy,
+			Logger:         log,
+		})
+		if err != nil {
+			log.Error("invalid webhook config", "error", err)
+			os.Exit(1)
+		}
+		go hooks.Run(ctx)
+	}
+
+	kvService, err := newKeyVal(cfg, hooks, log)
 	if err != nil {
 		log.Error("keyval app failed to start", "error", err)
 		os.Exit(1)
 	}
 	defer kvService.Close()
 
-	imagorService, err := imagor.New(ctx, imagor.Config{
-		KeyVal:             kvService,
-		UploadPath:         cfg.UploadPath,
-		MaxUploadSize:      cfg.MaxUploadSize,
-		SignSecret:         cfg.SignatureSecretKey,
-		AllowedHTTPSources: cfg.ServeAllowedHTTPSources,
-		AutoWebP:           cfg.ServeAutoWebP,
-		AutoAVIF:           cfg.ServeAutoAVIF,
-		ResultCacheTTL:     cfg.ServeCacheTTL,
-		Concurrency:        cfg.ServeConcurrency,
-		CacheControlTTL:    cfg.ServeCacheControlTTL,
-		CacheControlSWR:    cfg.ServeCacheControlSWR,
-		RequestTimeout:     cfg.RequestTimeout,
-		Debug:              debug,
-	})
+	imagorService, err := newImagor(ctx, cfg, kvService, log)
 	if err != nil {
 		log.Error("imagor app failed to start", "error", err)
 		os.Exit(1)
 	}
 
-	signatureService := signature.New(cfg.SignatureSecretKey)
+	responseHeaders, err := mw.ParseResponseHeaders(cfg.ResponseHeaders)
+	if err != nil {
+		log.Error("invalid RESPONSE_HEADERS", "error", err)
+		os.Exit(1)
+	}
+
+	var nonceMethods []string
+	for _, method := range strings.Split(cfg.SignatureNonceMethods, ",") {
+		if method = strings.ToUpper(strings.TrimSpace(method)); method != "" {
+			nonceMethods = append(nonceMethods, method)
+		}
+	}
+	signatureService := signature.New(signature.Config{
+		Secret:          cfg.SignatureSecretKey,
+		PreviousSecrets: cfg.SignaturePreviousSecretKeys,
+		Nonce:           len(nonceMethods) > 0,
+		SignServeQuery:  cfg.ServeSignQuery,
+		ClockSkew:       cfg.SignatureClockSkew,
+		DefaultTTL:      cfg.SignatureDefaultTTL,
+		MaxTTL:          cfg.SignatureMaxTTL,
+	})
 
 	app := fiber.New(fiber.Config{
 		StrictRouting:     true,
@@ -95,70 +139,276 @@ func main() {
 		JSONEncoder: func(v interface{}) ([]byte, error) {
 			return json.MarshalWithOption(v, json.DisableHTMLEscape())
 		},
-		JSONDecoder: json.Unmarshal,
+		JSONDecoder:  json.Unmarshal,
+		ErrorHandler: httperr.ErrorHandler,
 	})
 
-	if cfg.Environment == EnvironmentDevelopment {
-		log.Warn("running in development mode, signed URLs are not required")
+	app.Server().HeaderReceived = newRouteTimeouts(cfg)
+
+	if allowUnsafe {
+		log.Warn("unsafe serving is enabled, signed URLs are not required to process images")
 	}
-	if cfg.SecretKey == "" {
+	apiKeys, err := loadAPIKeys(cfg)
+	if err != nil {
+		log.Error("invalid API keys", "error", err)
+		os.Exit(1)
+	}
+	if cfg.SecretKey == "" && len(apiKeys) == 0 {
 		log.Warn("no secret key provided, API key verification is disabled")
 	}
+	if cfg.SecretKey != "" || len(apiKeys) == 0 {
+		// an empty secret key matches requests without one
+		apiKeys[cfg.SecretKey] = mw.Scopes
+	}
 
-	verifyAPIKey := mw.NewVerifyAPIKey(cfg.SecretKey)
-	verifyAccess := mw.NewVerifyAccess(cfg.SecretKey, cfg.SignatureSecretKey)
-	app.Use(mw.NewRealIP())
+	verifyAPIKey := func(scope string) fiber.Handler {
+		return mw.NewVerifyAPIKey(apiKeys, scope)
+	}
+	maxVerifications := mw.WithMaxConcurrentVerifications(cfg.SignatureMaxConcurrentVerifications)
+	clockSkew := mw.WithClockSkew(cfg.SignatureClockSkew)
+	previousSecrets := mw.WithPreviousSecrets(cfg.SignaturePreviousSecretKeys...)
+	accessOpts := []mw.VerifyAccessOption{maxVerifications, clockSkew, previousSecrets}
+	if cfg.RateLimitRPS > 0 {
+		accessOpts = append(accessOpts, mw.WithSignatureRateLimit(cfg.RateLimitRPS, cfg.RateLimitBurst))
+	}
+	blobAccess := func(method string) fiber.Handler {
+		scope := mw.ScopeFilesWrite
+		if method == fiber.MethodGet {
+			scope = mw.ScopeFilesRead
+		}
+		opts := slices.Clone(accessOpts)
+		if slices.Contains(nonceMethods, method) {
+			opts = append(opts, mw.WithRequiredNonce(kvService))
+		}
+		return mw.NewVerifyAccess(apiKeys, scope, cfg.SignatureSecretKey, opts...)
+	}
+	listAccess := mw.NewVerifyAccess(apiKeys, mw.ScopeFilesRead, cfg.SignatureSecretKey, accessOpts...)
+	trustedProxies, err := mw.ParseTrustedProxies(strings.Split(cfg.TrustedProxies, ","))
+	if err != nil {
+		log.Error("invalid TRUSTED_PROXIES", "error", err)
+		os.Exit(1)
+	}
+	app.Use(mw.NewRealIP(trustedProxies))
 	app.Use(helmet.New(helmet.Config{
 		HSTSPreloadEnabled:        true,
 		HSTSMaxAge:                31536000,
 		CrossOriginResourcePolicy: "cross-origin",
 	}))
+	// after helmet, so its headers can be overridden
+	app.Use(mw.NewResponseHeaders(responseHeaders))
 	app.Use(fiberrecover.New(fiberrecover.Config{EnableStackTrace: cfg.Environment == EnvironmentDevelopment}))
 	app.Use(favicon.New())
-	app.Use(requestid.New())
-	corsAllowedOrigins := strings.Split(cfg.CORSAllowedOrigins, ",")
-	app.Use(cors.New(cors.Config{
-		AllowOrigins:        corsAllowedOrigins,
-		AllowMethods:        []string{fiber.MethodGet, fiber.MethodHead, fiber.MethodPost, fiber.MethodPut, fiber.MethodPatch, fiber.MethodDelete, fiber.MethodOptions},
-		AllowHeaders:        []string{"Origin", "Content-Type", "Accept", "Cache-Control", "If-Match", "If-None-Match", "x-api-key", "x-signature", "x-expire"},
-		ExposeHeaders:       []string{"Content-Disposition", "X-Request-ID", "Content-Md5", "Content-Range", "Accept-Ranges", "ETag"},
-		AllowPrivateNetwork: true,
-		MaxAge:              int(time.Hour),
-		AllowCredentials:    !slices.Contains(corsAllowedOrigins, "*"),
-	}))
+	app.Use(mw.NewRequestID(cfg.RequestIDHeader, cfg.RequestIDTrustInbound))
+	app.Use(newCORS(cfg))
 	app.Get(mw.HealthCheckEndpoint, healthcheck.NewHealthChecker())
+	// health checks often address the server by its internal host
+	app.Use(mw.NewAllowedHosts(strings.Split(cfg.AllowedHosts, ",")))
+	if tracingEnabled {
+		// after the health check, so probes aren't traced
+		app.Use(mw.NewTrace(otel.Tracer("github.com/jaredLunde/railway-image-service/cmd/server")))
+	}
 	app.Use(mw.NewLogger(log.With("source", "http"), slog.LevelInfo))
-	app.Get("/serve/*", adaptor.HTTPHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+	if cfg.RateLimitRPS > 0 {
+		// after the logger, so limited requests are logged
+		app.Use(mw.NewRateLimit(cfg.RateLimitRPS, cfg.RateLimitBurst, apiKeys))
+	}
+	// imagor's errors, and those of the handlers wrapping it, aren't in the
+	// error envelope
+	serveHandler := httperr.Wrap(adaptor.HTTPHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		q := r.URL.Query()
+		servePath, err := sign.CanonicalServePath(r.URL.Path, q)
+		if err != nil {
+			w.WriteHeader(fiber.StatusBadRequest)
+			w.Write([]byte(err.Error()))
+			return
+		}
 		sig := q.Get("x-signature")
 		if sig == "" {
 			sig = r.Header.Get("x-signature")
 		}
+		if sig != "" && cfg.ServeSignQuery {
+			// imagor only verifies signatures of the path, so signatures that
+			// cover the query are verified here and replaced with one it accepts
+			payload := sign.ServePayload(servePath, q)
+			if !sign.MatchSignature(sig, payload, cfg.SignatureSecretKey) && !sign.MatchSignature(sig, payload, cfg.SignaturePreviousSecretKeys...) {
+				w.WriteHeader(fiber.StatusUnauthorized)
+				w.Write([]byte("unauthorized"))
+				return
+			}
+			sig = sign.Sign(servePath, cfg.SignatureSecretKey)
+		} else if sig != "" && sign.MatchSignature(sig, servePath, cfg.SignaturePreviousSecretKeys...) {
+			// imagor only verifies signatures of the current key, so signatures
+			// of the keys it was rotated from are replaced with one it accepts
+			sig = sign.Sign(servePath, cfg.SignatureSecretKey)
+		}
 		if sig == "" {
 			sig = "unsafe"
 			// Fallback to an API key if there is one. If it's a valid key, generate the signature
 			// on the fly so the request can succeed.
 			apiKey := r.Header.Get("x-api-key")
 			if apiKey != "" {
-				if subtle.ConstantTimeCompare([]byte(apiKey), []byte(cfg.SecretKey)) != 1 {
+				if _, ok := apiKeys.Lookup(apiKey); !ok {
 					w.WriteHeader(fiber.StatusUnauthorized)
 					w.Write([]byte("unauthorized"))
 					return
 				}
+				if !apiKeys.Allows(apiKey, mw.ScopeFilesRead) {
+					w.WriteHeader(fiber.StatusForbidden)
+					w.Write([]byte("api key lacks the " + mw.ScopeFilesRead + " scope"))
+					return
+				}
 
-				sig = sign.Sign(r.URL.Path, cfg.SignatureSecretKey)
+				sig = sign.Sign(servePath, cfg.SignatureSecretKey)
 			}
 		}
-		r.URL.Path = fmt.Sprintf("/%s%s", sig, strings.TrimPrefix(r.URL.Path, "/serve"))
+		r.URL.Path = fmt.Sprintf("/%s%s", sig, servePath)
 		q.Del("x-signature")
+		q.Del(sign.ForceFormatParam)
+		q.Del(sign.NoCacheParam)
 		r.URL.RawQuery = q.Encode()
 		imagorService.ServeHTTP(w, r)
 	})))
-	app.Get("/blob", kvService.ServeHTTP, verifyAccess)
-	app.Get("/blob/*", kvService.ServeHTTP, verifyAccess)
-	app.Put("/blob/*", kvService.ServeHTTP, verifyAccess)
-	app.Delete("/blob/*", kvService.ServeHTTP, verifyAccess)
-	app.Get("/sign/*", signatureService.ServeHTTP, verifyAPIKey)
+	if kvService.IsReplica() {
+		registerReplicaRoutes(app, cfg.ReplicaPrimaryURL, nonceMethods)
+	}
+	warmHandler := httperr.Wrap(adaptor.HTTPHandler(imagorService.WarmHandler(ctx)))
+	app.Get("/serve/warm", warmHandler, verifyAPIKey(mw.ScopeFilesWrite))
+	app.Post("/serve/warm", warmHandler, verifyAPIKey(mw.ScopeFilesWrite))
+	app.All("/serve/warm", mw.NewMethodNotAllowed(fiber.MethodGet, fiber.MethodPost))
+	if cfg.ServeImagorCompat {
+		nativeHandler := httperr.Wrap(adaptor.HTTPHandler(http.StripPrefix("/imagor", imagorService.NativeHandler())))
+		app.Get("/imagor/*", nativeHandler)
+		app.Head("/imagor/*", nativeHandler)
+		app.All("/imagor/*", mw.NewMethodNotAllowed(fiber.MethodGet, fiber.MethodHead))
+	}
+	app.Get("/serve/*", serveHandler)
+	app.Head("/serve/*", serveHandler)
+	app.All("/serve/*", mw.NewMethodNotAllowed(fiber.MethodGet, fiber.MethodHead))
+	// key listings compress extremely well
+	app.Get("/blob", kvService.ServeHTTP, listAccess, mw.NewCompress(compress.LevelBestSpeed))
+	app.Post("/blob", kvService.CreateHandler, blobAccess(fiber.MethodPost))
+	app.All("/blob", mw.NewMethodNotAllowed(fiber.MethodGet, fiber.MethodPost))
+	blobMethods := []string{fiber.MethodGet, fiber.MethodHead, fiber.MethodPut, fiber.MethodDelete}
+	if cfg.UploadTransforms != "" {
+		app.Post("/blob/*", kvService.TransformHandler(imagorService.Transform), blobAccess(fiber.MethodPost))
+		blobMethods = append(blobMethods, fiber.MethodPost)
+	}
+	app.Get("/blob/*", kvService.ServeHTTP, blobAccess(fiber.MethodGet))
+	app.Head("/blob/*", kvService.ServeHTTP, blobAccess(fiber.MethodGet))
+	app.Put("/blob/*", kvService.ServeHTTP, blobAccess(fiber.MethodPut))
+	app.Delete("/blob/*", kvService.ServeHTTP, blobAccess(fiber.MethodDelete))
+	app.All("/blob/*", mw.NewMethodNotAllowed(blobMethods...))
+	app.Get("/ping", kvService.PingHandler, verifyAPIKey(""))
+	app.Post("/sign/batch", signatureService.BatchHandler, verifyAPIKey(mw.ScopeSign))
+	if debug {
+		app.Get("/sign/debug", signatureService.DebugHandler, verifyAPIKey(mw.ScopeSign))
+	}
+	app.Get("/sign/check", signatureService.CheckHandler, verifyAPIKey(mw.ScopeSign))
+	app.Get("/sign/*", signatureService.ServeHTTP, verifyAPIKey(mw.ScopeSign))
+	app.All("/sign/*", mw.NewMethodNotAllowed(fiber.MethodGet))
+	reindexHandler := kvService.ReindexHandler(ctx)
+	app.Get("/admin/reindex", reindexHandler, verifyAPIKey(mw.ScopeAdmin))
+	app.Post("/admin/reindex", reindexHandler, verifyAPIKey(mw.ScopeAdmin))
+	app.All("/admin/reindex", mw.NewMethodNotAllowed(fiber.MethodGet, fiber.MethodPost))
+	app.Get("/admin/popular", kvService.PopularHandler, verifyAPIKey(mw.ScopeAdmin))
+	app.All("/admin/popular", mw.NewMethodNotAllowed(fiber.MethodGet))
+	app.Get("/admin/gc", kvService.GCHandler, verifyAPIKey(mw.ScopeAdmin))
+	app.All("/admin/gc", mw.NewMethodNotAllowed(fiber.MethodGet))
+	if hooks != nil {
+		app.Get("/admin/webhooks", hooks.StatsHandler, verifyAPIKey(mw.ScopeAdmin))
+		app.All("/admin/webhooks", mw.NewMethodNotAllowed(fiber.MethodGet))
+	}
+
+	if adminLocksEnabled {
+		log.Warn("the lock admin endpoint is enabled")
+		locksHandler := kvService.LocksHandler("/admin/locks")
+		app.Get("/admin/locks", locksHandler, verifyAPIKey(mw.ScopeAdmin))
+		app.All("/admin/locks", mw.NewMethodNotAllowed(fiber.MethodGet))
+		app.Delete("/admin/locks/*", locksHandler, verifyAPIKey(mw.ScopeAdmin))
+		app.All("/admin/locks/*", mw.NewMethodNotAllowed(fiber.MethodDelete))
+	}
+
+	if kvService.IsReplica() {
+		log.Info("running as a read replica", "primary", cfg.ReplicaPrimaryURL, "refresh_interval", cfg.ReplicaRefreshInterval)
+		go func() {
+			ticker := time.NewTicker(cfg.ReplicaRefreshInterval)
+			defer ticker.Stop()
+			for {
+				select {
+				case <-ctx.Done():
+					return
+				case <-ticker.C:
+					if err := kvService.RefreshReplica(); err != nil {
+						log.Error("failed to refresh replica", "error", err)
+					}
+				}
+			}
+		}()
+	} else {
+		go func() {
+			if n, err := kvService.SweepTempFiles(cfg.TempFileMaxAge); err != nil {
+				log.Error("failed to sweep temp files", "error", err)
+			} else if n > 0 {
+				log.Info("removed temp files of interrupted uploads", "count", n)
+			}
+		}()
+	}
+
+	if len(nonceMethods) > 0 && !kvService.IsReplica() {
+		go func() {
+			ticker := time.NewTicker(10 * time.Minute)
+			defer ticker.Stop()
+			for {
+				select {
+				case <-ctx.Done():
+					return
+				case <-ticker.C:
+					if n, err := kvService.PurgeExpiredNonces(); err != nil {
+						log.Error("failed to purge expired nonces", "error", err)
+					} else if n > 0 {
+						log.Debug("purged expired nonces", "count", n)
+					}
+				}
+			}
+		}()
+	}
+
+	if kvService.CountsAccess() {
+		go func() {
+			ticker := time.NewTicker(cfg.AccessStatsFlushInterval)
+			defer ticker.Stop()
+			for {
+				select {
+				case <-ctx.Done():
+					return
+				case <-ticker.C:
+					if _, err := kvService.FlushAccess(); err != nil {
+						log.Error("failed to flush access counts", "error", err)
+					}
+				}
+			}
+		}()
+	}
+
+	if kvService.CollectsGarbage() {
+		go func() {
+			ticker := time.NewTicker(cfg.SoftDeleteGCInterval)
+			defer ticker.Stop()
+			for {
+				select {
+				case <-ctx.Done():
+					return
+				case <-ticker.C:
+					status, err := kvService.CollectGarbage(ctx)
+					if err != nil {
+						log.Error("failed to collect soft-deleted files", "error", err)
+					} else if status.Collected > 0 {
+						log.Info("collected soft-deleted files", "count", status.Collected, "reclaimed_bytes", status.ReclaimedBytes, "failed", status.Failed)
+					}
+				}
+			}
+		}()
+	}
 
 	g := errgroup.Group{}
 	g.Go(func() error {
@@ -181,6 +431,15 @@ func main() {
 				if err := imagorService.Shutdown(ctx); err != nil {
 					log.Error("imagor service did not shutdown gracefully", "error", err)
 				}
+				if _, err := kvService.FlushAccess(); err != nil {
+					log.Error("failed to flush access counts", "error", err)
+				}
+				// ctx is already done, so spans get a moment of their own
+				flushCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+				defer cancel()
+				if err := shutdownTracing(flushCtx); err != nil {
+					log.Error("failed to flush spans", "error", err)
+				}
 
 				log.Info("server shutdown successfully")
 			},
@@ -202,3 +461,141 @@ func main() {
 	<-ctx.Done()
 	log.Info("exit 0")
 }
+
+func newKeyVal(cfg Config, hooks *webhook.Webhook, log *slog.Logger) (*keyval.KeyVal, error) {
+	var extractColor func(path string) (string, error)
+	if cfg.ExtractDominantColor != "" {
+		fn, err := imagor.ColorExtractor(cfg.ExtractDominantColor)
+		if err != nil {
+			return nil, err
+		}
+		extractColor = fn
+	}
+	var backend keyval.BlobBackend
+	if cfg.StorageBackend == keyval.StorageBackendS3 {
+		s3, err := keyval.NewS3Backend(keyval.S3Config{
+			Bucket:          cfg.S3Bucket,
+			Endpoint:        cfg.S3Endpoint,
+			Region:          cfg.S3Region,
+			AccessKeyID:     cfg.S3AccessKeyID,
+			SecretAccessKey: cfg.S3SecretAccessKey,
+			Prefix:          cfg.S3Prefix,
+		})
+		if err != nil {
+			return nil, err
+		}
+		backend = s3
+	}
+	var notify func(keyval.Event)
+	if hooks != nil {
+		notify = hooks.Notify
+	}
+	uploadTimeout := cfg.UploadTimeout
+	if uploadTimeout == 0 {
+		uploadTimeout = cfg.RequestTimeout
+	}
+	var allowedMimeTypes []string
+	for _, mtype := range strings.Split(cfg.AllowedMimeTypes, ",") {
+		if mtype = strings.ToLower(strings.TrimSpace(mtype)); mtype != "" {
+			allowedMimeTypes = append(allowedMimeTypes, mtype)
+		}
+	}
+	if len(allowedMimeTypes) == 0 {
+		return nil, fmt.Errorf("ALLOWED_MIME_TYPES is empty")
+	}
+	return keyval.New(keyval.Config{
+		BasePath:             "/blob",
+		UploadPath:           cfg.UploadPath,
+		Backend:              backend,
+		LevelDBPath:          cfg.LevelDBPath,
+		Recover:              cfg.LevelDBRecover,
+		Replica:              cfg.ReplicaPrimaryURL != "",
+		SoftDelete:           true,
+		SoftDeletePrefixes:   cfg.SoftDeletePrefixes,
+		SoftDeleteRetention:  cfg.SoftDeleteRetention,
+		WriteOnce:            cfg.WriteOnce,
+		WriteOncePrefixes:    cfg.WriteOncePrefixes,
+		SignSecret:           cfg.SignatureSecretKey,
+		PublicURL:            cfg.PublicURL,
+		MaxSize:              cfg.MaxUploadSize,
+		AllowedMimeTypes:     allowedMimeTypes,
+		MimeSniffBytes:       cfg.MimeSniffBytes,
+		AllowUnknownTypes:    cfg.UploadAllowUnknown,
+		AllowEmptyFiles:      cfg.AllowEmptyFiles,
+		RequireFileExtension: cfg.RequireFileExtension,
+		ExtensionTypes:       cfg.FileExtensionTypes,
+		ContentDisposition:   cfg.ContentDisposition,
+		CompressAtRest:       cfg.CompressAtRest,
+		ExtractColor:         extractColor,
+		Variants:             cfg.BlobVariants,
+		FsyncOnWrite:         cfg.FsyncOnWrite,
+		PathTemplate:         cfg.UploadPathTemplate,
+		UploadRateLimit:      cfg.UploadRateLimitBPS,
+		UploadIdleTimeout:    cfg.UploadIdleTimeout,
+		UploadTimeout:        uploadTimeout,
+		KeyNamespace:         cfg.DBKeyNamespace,
+		ChunkHashSize:        cfg.ChunkHashSize,
+		DownloadRateLimit:    cfg.FilesRateLimitBPS,
+		DownloadConcurrency:  cfg.FilesServeConcurrency,
+		SendfileHeader:       cfg.FilesSendfileHeader,
+		AccessSampleRate:     cfg.AccessStatsSampleRate,
+		SendfilePrefix:       cfg.FilesSendfilePrefix,
+		CleanKeys:            cfg.CleanKeys,
+		Notify:               notify,
+		Logger:               log,
+		Debug:                cfg.Environment == EnvironmentDevelopment,
+	})
+}
+
+func newImagor(ctx context.Context, cfg Config, kv *keyval.KeyVal, log *slog.Logger) (*imagor.Imagor, error) {
+	var nativeSigner imagorpath.Signer
+	if cfg.ServeImagorCompat {
+		secret := cfg.ServeImagorSecret
+		if secret == "" {
+			secret = cfg.SignatureSecretKey
+		}
+		signer, err := imagor.NewNativeSigner(cfg.ServeImagorSignerType, cfg.ServeImagorSignerTruncate, secret)
+		if err != nil {
+			return nil, err
+		}
+		nativeSigner = signer
+	}
+	return imagor.New(ctx, imagor.Config{
+		KeyVal:               kv,
+		UploadPath:           cfg.UploadPath,
+		MaxUploadSize:        cfg.MaxUploadSize,
+		SignSecret:           cfg.SignatureSecretKey,
+		PublicURL:            cfg.PublicURL,
+		AllowedHTTPSources:   cfg.ServeAllowedHTTPSources,
+		AutoWebP:             cfg.ServeAutoWebP,
+		AutoAVIF:             cfg.ServeAutoAVIF,
+		ClientHints:          cfg.ServeClientHints,
+		MaxDPR:               cfg.ServeMaxDPR,
+		ResultCacheTTL:       cfg.ServeCacheTTL,
+		MaxCacheTTL:          cfg.ServeMaxCacheTTL,
+		ResultMaxAge:         cfg.ServeResultMaxAge,
+		SourceCheck:          cfg.ServeSourceCheck,
+		Concurrency:          cfg.ServeConcurrency,
+		FetchConcurrency:     cfg.ServeSourceFetchConcurrency,
+		FetchQueue:           cfg.ServeSourceFetchQueue,
+		CacheControlTTL:      cfg.ServeCacheControlTTL,
+		CacheControlSWR:      cfg.ServeCacheControlSWR,
+		RequestTimeout:       cfg.RequestTimeout,
+		CustomFilters:        strings.Split(cfg.ServeCustomFilters, ","),
+		AllowUnsafe:          cfg.allowUnsafe(),
+		MaxFilters:           cfg.ServeMaxFilters,
+		NoUpscale:            cfg.ServeNoUpscale,
+		NormalizeCacheKeys:   cfg.ServeNormalizeCacheKeys,
+		AllowedOutputFormats: strings.Split(cfg.ServeAllowedOutputFormats, ","),
+		LoaderOrder:          strings.Split(cfg.ServeLoaderOrder, ","),
+		HTTPAccept:           cfg.ServeHTTPAccept,
+		AllowSVGSources:      cfg.ServeAllowSVGSources,
+		SVGMaxDimension:      cfg.ServeSVGMaxDimension,
+		ErrorImageKey:        cfg.ServeErrorImageKey,
+		ServeOriginals:       cfg.ServeOriginals,
+		NativeSigner:         nativeSigner,
+		UploadTransforms:     strings.Split(cfg.UploadTransforms, ","),
+		Logger:               log,
+		Debug:                cfg.Environment == EnvironmentDevelopment,
+	})
+}
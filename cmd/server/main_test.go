@@ -0,0 +1,27 @@
+package main
+
+import (
+	"io"
+	"log/slog"
+	"path/filepath"
+	"testing"
+)
+
+func TestNewKeyVal_SoftDeletePrefixes(t *testing.T) {
+	dir := t.TempDir()
+	t.Setenv("UPLOAD_PATH", filepath.Join(dir, "uploads"))
+	t.Setenv("LEVELDB_PATH", filepath.Join(dir, "db"))
+	t.Setenv("SOFT_DELETE_PREFIXES", "tmp/:false")
+	cfg, err := LoadConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	kv, err := newKeyVal(cfg, nil, slog.New(slog.NewTextHandler(io.Discard, nil)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer kv.Close()
+	if !kv.SoftDelete([]byte("a.png")) || kv.SoftDelete([]byte("tmp/a.png")) {
+		t.Error("expected SOFT_DELETE_PREFIXES to override soft delete for its prefixes")
+	}
+}
@@ -0,0 +1,30 @@
+package main
+
+import (
+	"strings"
+
+	"github.com/gofiber/fiber/v3"
+	"github.com/gofiber/fiber/v3/middleware/proxy"
+)
+
+// registerReplicaRoutes forwards every request that writes to the database to
+// the primary. They are registered before the regular routes, so they take
+// precedence. Signatures and API keys are verified by the primary.
+func registerReplicaRoutes(app *fiber.App, primaryURL string, nonceMethods []string) {
+	primaryURL = strings.TrimSuffix(primaryURL, "/")
+	forward := func(c fiber.Ctx) error {
+		return proxy.Do(c, primaryURL+c.OriginalURL())
+	}
+	app.Post("/blob", forward)
+	app.Post("/blob/*", forward)
+	app.Put("/blob/*", forward)
+	app.Delete("/blob/*", forward)
+	// nonces are recorded in the database
+	for _, method := range nonceMethods {
+		app.Add([]string{method}, "/blob/*", forward)
+		if method == fiber.MethodGet {
+			app.Head("/blob/*", forward)
+		}
+	}
+	app.All("/admin/*", forward)
+}
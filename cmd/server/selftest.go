@@ -0,0 +1,160 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"fmt"
+	"image"
+	"image/color"
+	"image/png"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+
+	"github.com/gofiber/fiber/v3"
+	"github.com/jaredLunde/railway-image-service/client/sign"
+	"github.com/jaredLunde/railway-image-service/internal/app/keyval"
+)
+
+// selftest exercises the storage, signing, and image processing components
+// the server is built from without binding the HTTP port, then prints a
+// pass/fail report. It reports whether every check passed.
+func selftest(ctx context.Context, cfg Config, log *slog.Logger) bool {
+	ok := true
+	report := func(name string, err error) bool {
+		if err != nil {
+			ok = false
+			fmt.Fprintf(os.Stdout, "FAIL  %s: %v\n", name, err)
+			return false
+		}
+		fmt.Fprintf(os.Stdout, "PASS  %s\n", name)
+		return true
+	}
+
+	report("sign and verify url", selftestSign(cfg))
+
+	kv, err := newKeyVal(cfg, nil, log)
+	if !report("open leveldb "+cfg.LevelDBPath, err) {
+		return false
+	}
+	defer kv.Close()
+
+	probe := selftestImage()
+	key := []byte("selftest/" + sign.NewNonce() + ".png")
+	if !report("write probe object", selftestStatus(kv.Write(ctx, key, bytes.NewReader(probe), len(probe), keyval.WriteOptions{}), fiber.StatusCreated)) {
+		return false
+	}
+	report("read probe object", selftestRead(ctx, kv, key, probe))
+	report("transform probe object", selftestTransform(ctx, cfg, kv, log, key))
+	report("delete probe object", selftestDelete(ctx, kv, key))
+	return ok
+}
+
+func selftestSign(cfg Config) error {
+	u, err := url.Parse("http://localhost/blob/selftest.png")
+	if err != nil {
+		return err
+	}
+	signed, err := sign.SignURL(u, cfg.SignatureSecretKey)
+	if err != nil {
+		return err
+	}
+	su, err := url.Parse(*signed)
+	if err != nil {
+		return err
+	}
+	if err := sign.VerifyURL(su, cfg.SignatureSecretKey); err != nil {
+		return err
+	}
+	su.Path = "/blob/tampered.png"
+	if sign.VerifyURL(su, cfg.SignatureSecretKey) == nil {
+		return fmt.Errorf("a tampered url was verified")
+	}
+	return nil
+}
+
+func selftestRead(ctx context.Context, kv *keyval.KeyVal, key, want []byte) error {
+	rec := kv.GetRecord(ctx, key)
+	if rec.Deleted != keyval.NO {
+		return fmt.Errorf("record not found")
+	}
+	if rec.Hash != fmt.Sprintf("%x", md5.Sum(want)) {
+		return fmt.Errorf("record hash %q does not match the probe", rec.Hash)
+	}
+	r, err := kv.Open(key, rec)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	got, err := io.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(got, want) {
+		return fmt.Errorf("read %d bytes that do not match the probe", len(got))
+	}
+	return nil
+}
+
+func selftestTransform(ctx context.Context, cfg Config, kv *keyval.KeyVal, log *slog.Logger, key []byte) error {
+	imagorService, err := newImagor(ctx, cfg, kv, log)
+	if err != nil {
+		return err
+	}
+	defer imagorService.Shutdown(ctx)
+
+	path := fmt.Sprintf("/fit-in/8x8/filters:format(png)/blob/%s", key)
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest(http.MethodGet, "/"+sign.Sign(path, cfg.SignatureSecretKey)+path, nil).WithContext(ctx)
+	imagorService.ServeHTTP(w, r)
+	if w.Code != http.StatusOK {
+		return fmt.Errorf("status %d: %s", w.Code, w.Body.String())
+	}
+	img, _, err := image.DecodeConfig(w.Body)
+	if err != nil {
+		return err
+	}
+	if img.Width > 8 || img.Height > 8 {
+		return fmt.Errorf("expected at most 8x8, got %dx%d", img.Width, img.Height)
+	}
+	return nil
+}
+
+func selftestDelete(ctx context.Context, kv *keyval.KeyVal, key []byte) error {
+	if kv.SoftDelete(key) {
+		if err := selftestStatus(kv.Delete(ctx, key, true), fiber.StatusNoContent); err != nil {
+			return err
+		}
+	}
+	if err := selftestStatus(kv.Delete(ctx, key, false), fiber.StatusNoContent); err != nil {
+		return err
+	}
+	if kv.GetRecord(ctx, key).Deleted != keyval.HARD {
+		return fmt.Errorf("record still exists")
+	}
+	return nil
+}
+
+func selftestStatus(got, want int) error {
+	if got != want {
+		return fmt.Errorf("status %d, expected %d", got, want)
+	}
+	return nil
+}
+
+// selftestImage returns a small PNG to probe the storage and processing with
+func selftestImage() []byte {
+	img := image.NewRGBA(image.Rect(0, 0, 16, 16))
+	for x := 0; x < 16; x++ {
+		for y := 0; y < 16; y++ {
+			img.Set(x, y, color.RGBA{R: uint8(x * 16), G: uint8(y * 16), B: 128, A: 255})
+		}
+	}
+	var buf bytes.Buffer
+	png.Encode(&buf, img)
+	return buf.Bytes()
+}
@@ -0,0 +1,33 @@
+package main
+
+import (
+	"bytes"
+	"time"
+
+	"github.com/valyala/fasthttp"
+)
+
+// newRouteTimeouts overrides the server's read and write timeouts for route
+// groups whose requests legitimately take longer, or should take less, than
+// REQUEST_TIMEOUT. fasthttp applies them once the request headers are read,
+// so the read timeout covers the request body and the write timeout covers
+// the response.
+func newRouteTimeouts(cfg Config) func(header *fasthttp.RequestHeader) fasthttp.RequestConfig {
+	return func(header *fasthttp.RequestHeader) fasthttp.RequestConfig {
+		path := header.RequestURI()
+		if i := bytes.IndexByte(path, '?'); i >= 0 {
+			path = path[:i]
+		}
+		var timeout time.Duration
+		switch {
+		case bytes.HasPrefix(path, []byte("/blob")) && (header.IsPut() || header.IsPost()):
+			timeout = cfg.UploadTimeout
+		case bytes.HasPrefix(path, []byte("/serve/")):
+			timeout = cfg.ServeTimeout
+		case bytes.HasPrefix(path, []byte("/sign/")):
+			timeout = cfg.SignTimeout
+		}
+		// zero values keep the server's timeouts
+		return fasthttp.RequestConfig{ReadTimeout: timeout, WriteTimeout: timeout}
+	}
+}
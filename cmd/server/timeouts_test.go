@@ -0,0 +1,38 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/valyala/fasthttp"
+)
+
+func TestRouteTimeouts(t *testing.T) {
+	timeouts := newRouteTimeouts(Config{
+		RequestTimeout: 30 * time.Second,
+		UploadTimeout:  10 * time.Minute,
+		ServeTimeout:   time.Minute,
+	})
+
+	tests := []struct {
+		method string
+		uri    string
+		want   time.Duration
+	}{
+		{fasthttp.MethodPut, "/blob/a.png?x-signature=abc", 10 * time.Minute},
+		{fasthttp.MethodPost, "/blob?key_strategy=content-hash", 10 * time.Minute},
+		{fasthttp.MethodGet, "/blob/a.png", 0},
+		{fasthttp.MethodGet, "/serve/300x300/blob/a.png", time.Minute},
+		// unset overrides keep the server's timeout
+		{fasthttp.MethodGet, "/sign/blob/a.png", 0},
+	}
+	for _, tt := range tests {
+		var header fasthttp.RequestHeader
+		header.SetMethod(tt.method)
+		header.SetRequestURI(tt.uri)
+		got := timeouts(&header)
+		if got.ReadTimeout != tt.want || got.WriteTimeout != tt.want {
+			t.Errorf("%s %s: expected timeouts of %s, got %+v", tt.method, tt.uri, tt.want, got)
+		}
+	}
+}
@@ -3,10 +3,11 @@ package imagor
 import (
 	"bytes"
 	"context"
+	"errors"
 	"io"
+	"io/fs"
 	"net/http"
 	"os"
-	"path/filepath"
 	"regexp"
 	"strings"
 
@@ -22,8 +23,6 @@ type BlobStorage struct {
 	KV              *keyval.KeyVal
 	PathPrefix      string
 	Blacklists      []*regexp.Regexp
-	MkdirPermission os.FileMode
-	WritePermission os.FileMode
 	SaveErrIfExists bool
 	SafeChars       string
 
@@ -33,109 +32,118 @@ type BlobStorage struct {
 // New creates FileStorage
 func NewBlobStorage(kv *keyval.KeyVal, uploadPath string) *BlobStorage {
 	s := &BlobStorage{
-		KV:              kv,
-		Blacklists:      []*regexp.Regexp{dotFileRegex},
-		MkdirPermission: 0755,
-		WritePermission: 0666,
-		PathPrefix:      uploadPath,
+		KV:         kv,
+		Blacklists: []*regexp.Regexp{dotFileRegex},
+		PathPrefix: uploadPath,
 	}
 	s.safeChars = imagorpath.NewSafeChars(s.SafeChars)
 	return s
 }
 
-// Path transforms and validates image key for storage path
+// Path transforms and validates image key for storage path. Only images in a
+// local storage backend have one.
 func (s *BlobStorage) Path(image string) (string, bool) {
+	key, rec, err := s.record(context.Background(), image)
+	if err != nil {
+		return "", false
+	}
+	return s.KV.LocalPath(key, rec)
+}
+
+// record returns the key and record of a live image. Images that aren't blobs
+// or don't exist are not found, so the next loader gets a chance to load them.
+func (s *BlobStorage) record(ctx context.Context, image string) ([]byte, keyval.Record, error) {
 	key := []byte(image)
 	if strings.HasPrefix(image, "/") {
 		key = []byte(image[1:])
 	}
 	if !bytes.HasPrefix(key, []byte("blob/")) {
-		return "", false
+		return nil, keyval.Record{}, imagor.ErrNotFound
 	}
-	key = bytes.TrimPrefix(key, []byte("blob/"))
-	if s.KV.GetRecord(key).Deleted != keyval.NO {
-		return "", false
+	key, ok := s.KV.CleanKey(bytes.TrimPrefix(key, []byte("blob/")))
+	if !ok {
+		return nil, keyval.Record{}, imagor.ErrInvalid
+	}
+	rec := s.KV.GetRecord(ctx, key)
+	if rec.Deleted != keyval.NO {
+		return nil, keyval.Record{}, imagor.ErrNotFound
 	}
-	return filepath.Join(s.PathPrefix, keyval.KeyToPath(key)), true
+	return key, rec, nil
 }
 
 // Get implements imagor.Storage interface
-func (s *BlobStorage) Get(_ *http.Request, image string) (*imagor.Blob, error) {
-	image, ok := s.Path(image)
-	if !ok {
-		return nil, imagor.ErrInvalid
+func (s *BlobStorage) Get(r *http.Request, image string) (*imagor.Blob, error) {
+	key, rec, err := s.record(r.Context(), image)
+	if err != nil {
+		return nil, err
+	}
+	fp, local := s.KV.LocalPath(key, rec)
+	if rec.Compression != "" || !local {
+		// files compressed at rest are never images, so reading them into
+		// memory is fine. Images in remote backends are read into memory,
+		// like the HTTP loader does.
+		r, err := s.KV.Open(key, rec)
+		if err != nil {
+			return nil, err
+		}
+		defer r.Close()
+		data, err := io.ReadAll(r)
+		if err != nil {
+			return nil, err
+		}
+		return imagor.NewBlobFromBytes(data), nil
 	}
-	f := imagor.NewBlobFromFile(image, func(stat os.FileInfo) error {
+	f := imagor.NewBlobFromFile(fp, func(stat os.FileInfo) error {
 		return nil
 	})
 	return f, nil
 }
 
 // Put implements imagor.Storage interface
-func (s *BlobStorage) Put(_ context.Context, image string, blob *imagor.Blob) (err error) {
-	image, ok := s.Path(image)
-	if !ok {
+func (s *BlobStorage) Put(ctx context.Context, image string, blob *imagor.Blob) error {
+	key, rec, err := s.record(ctx, image)
+	if err != nil {
 		return imagor.ErrInvalid
 	}
-	if err = os.MkdirAll(filepath.Dir(image), s.MkdirPermission); err != nil {
-		return
+	if s.SaveErrIfExists {
+		if _, err := s.KV.StatFile(ctx, key, rec); err == nil {
+			return fs.ErrExist
+		}
 	}
-	reader, _, err := blob.NewReader()
+	reader, size, err := blob.NewReader()
 	if err != nil {
 		return err
 	}
 	defer func() {
 		_ = reader.Close()
 	}()
-	flag := os.O_RDWR | os.O_CREATE | os.O_TRUNC
-	if s.SaveErrIfExists {
-		flag = os.O_RDWR | os.O_CREATE | os.O_EXCL
-	}
-	w, err := os.OpenFile(image, flag, s.WritePermission)
-	if err != nil {
-		return
-	}
-	defer func() {
-		_ = w.Close()
-		if err != nil {
-			_ = os.Remove(w.Name())
-		}
-	}()
-	if _, err = io.Copy(w, reader); err != nil {
-		return
-	}
-	if err = w.Sync(); err != nil {
-		return
-	}
-	return
+	return s.KV.PutFile(ctx, key, rec, reader, size)
 }
 
 // Delete implements imagor.Storage interface
-func (s *BlobStorage) Delete(_ context.Context, image string) error {
-	image, ok := s.Path(image)
-	if !ok {
+func (s *BlobStorage) Delete(ctx context.Context, image string) error {
+	key, rec, err := s.record(ctx, image)
+	if err != nil {
 		return imagor.ErrInvalid
 	}
-	return os.Remove(image)
+	return s.KV.DeleteFile(ctx, key, rec)
 }
 
 // Stat implements imagor.Storage interface
-func (s *BlobStorage) Stat(_ context.Context, image string) (stat *imagor.Stat, err error) {
-	image, ok := s.Path(image)
-	if !ok {
+func (s *BlobStorage) Stat(ctx context.Context, image string) (*imagor.Stat, error) {
+	key, rec, err := s.record(ctx, image)
+	if err != nil {
 		return nil, imagor.ErrInvalid
 	}
-	osStat, err := os.Stat(image)
+	info, err := s.KV.StatFile(ctx, key, rec)
 	if err != nil {
-		if os.IsNotExist(err) {
+		if errors.Is(err, fs.ErrNotExist) {
 			return nil, imagor.ErrNotFound
 		}
 		return nil, err
 	}
-	size := osStat.Size()
-	modTime := osStat.ModTime()
 	return &imagor.Stat{
-		Size:         size,
-		ModifiedTime: modTime,
+		Size:         info.Size,
+		ModifiedTime: info.ModTime,
 	}, nil
 }
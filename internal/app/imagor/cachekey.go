@@ -0,0 +1,67 @@
+package imagor
+
+import (
+	"sort"
+
+	"github.com/cshum/imagor/imagorpath"
+)
+
+// optionFilters are filters that only set an option of the processor. Where
+// they appear among the other filters makes no difference to the result.
+// upscale and no_upscale set the same option, so they share a group.
+var optionFilters = map[string]string{
+	"format":         "format",
+	"quality":        "quality",
+	"autojpg":        "autojpg",
+	"max_frames":     "max_frames",
+	"max_bytes":      "max_bytes",
+	"stretch":        "stretch",
+	"page":           "page",
+	"dpi":            "dpi",
+	"orient":         "orient",
+	"strip_metadata": "strip_metadata",
+	"palette":        "palette",
+	"bitdepth":       "bitdepth",
+	"compression":    "compression",
+	"upscale":        "upscale",
+	"no_upscale":     "upscale",
+	"cache":          "cache",
+}
+
+// normalizeFilters moves option filters behind the other filters, sorted by
+// name, so e.g. quality(80):format(webp) and format(webp):quality(80) are the
+// same. The order of the other filters is kept, since it changes the result.
+// When an option is set more than once, the last one wins, so the filters are
+// returned as-is.
+func normalizeFilters(filters imagorpath.Filters) imagorpath.Filters {
+	seen := map[string]bool{}
+	var ops, options imagorpath.Filters
+	for _, f := range filters {
+		group, ok := optionFilters[f.Name]
+		if !ok {
+			ops = append(ops, f)
+			continue
+		}
+		if seen[group] {
+			return filters
+		}
+		seen[group] = true
+		options = append(options, f)
+	}
+	sort.SliceStable(options, func(a, b int) bool {
+		return options[a].Name < options[b].Name
+	})
+	return append(ops, options...)
+}
+
+// normalizedResultStorageHasher lets transforms that only differ in the order
+// of their option filters share a result cache entry. The path is generated
+// from the parsed params, which also canonicalizes sizes, e.g. 100x and
+// 100x0.
+func normalizedResultStorageHasher(hasher imagorpath.ResultStorageHasher) imagorpath.ResultStorageHasher {
+	return imagorpath.ResultStorageHasherFunc(func(p imagorpath.Params) string {
+		p.Filters = normalizeFilters(p.Filters)
+		p.Path = imagorpath.GeneratePath(p)
+		return hasher.HashResult(p)
+	})
+}
@@ -0,0 +1,36 @@
+package imagor
+
+import (
+	"testing"
+
+	"github.com/cshum/imagor/imagorpath"
+)
+
+func TestNormalizedResultStorageHasher(t *testing.T) {
+	hasher := normalizedResultStorageHasher(imagorpath.DigestResultStorageHasher)
+	hash := func(path string) string {
+		return hasher.HashResult(imagorpath.Parse(path))
+	}
+
+	tests := []struct {
+		name string
+		a, b string
+		same bool
+	}{
+		{"option order", "100x100/filters:quality(80):format(webp)/blob/a.jpg", "100x100/filters:format(webp):quality(80)/blob/a.jpg", true},
+		{"options around operations", "100x100/filters:format(webp):blur(2):quality(80)/blob/a.jpg", "100x100/filters:blur(2):quality(80):format(webp)/blob/a.jpg", true},
+		{"sizes", "100x/blob/a.jpg", "100x0/blob/a.jpg", true},
+		{"operation order", "100x100/filters:blur(2):brightness(10)/blob/a.jpg", "100x100/filters:brightness(10):blur(2)/blob/a.jpg", false},
+		{"repeated option", "100x100/filters:format(webp):format(png)/blob/a.jpg", "100x100/filters:format(png):format(webp)/blob/a.jpg", false},
+		{"upscale and no_upscale", "100x100/filters:upscale():no_upscale()/blob/a.jpg", "100x100/filters:no_upscale():upscale()/blob/a.jpg", false},
+		{"different options", "100x100/filters:quality(80)/blob/a.jpg", "100x100/filters:quality(90)/blob/a.jpg", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if same := hash(tt.a) == hash(tt.b); same != tt.same {
+				t.Errorf("expected same key %v for %s and %s", tt.same, tt.a, tt.b)
+			}
+		})
+	}
+}
@@ -0,0 +1,74 @@
+package imagor
+
+import (
+	"context"
+	"net/http"
+	"sync"
+)
+
+// HeaderCache reports whether a response was served from the result cache
+const HeaderCache = "X-Imagor-Cache"
+
+const (
+	// CacheHit is a result served from the result cache
+	CacheHit = "HIT"
+	// CacheMiss is a result that was processed because it wasn't cached, or
+	// because the cache was skipped
+	CacheMiss = "MISS"
+	// CacheStale is a result that was processed again because the cached one
+	// had outlived its TTL
+	CacheStale = "STALE"
+)
+
+type cacheOutcomeKey struct{}
+
+// cacheOutcome is filled in by the result storage while imagor handles a
+// request. Requests that are deduplicated into another in-flight request of
+// the same result never reach the result storage, so they have no outcome.
+type cacheOutcome struct {
+	mu     sync.Mutex
+	status string
+}
+
+func (o *cacheOutcome) get() string {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return o.status
+}
+
+func withCacheOutcome(r *http.Request) (*http.Request, *cacheOutcome) {
+	o := &cacheOutcome{}
+	return r.WithContext(context.WithValue(r.Context(), cacheOutcomeKey{}, o)), o
+}
+
+func recordCacheOutcome(ctx context.Context, status string) {
+	if o, ok := ctx.Value(cacheOutcomeKey{}).(*cacheOutcome); ok {
+		o.mu.Lock()
+		o.status = status
+		o.mu.Unlock()
+	}
+}
+
+// cacheOutcomeWriter sets the X-Imagor-Cache header of successful responses
+type cacheOutcomeWriter struct {
+	http.ResponseWriter
+	outcome     *cacheOutcome
+	wroteHeader bool
+}
+
+func (w *cacheOutcomeWriter) WriteHeader(code int) {
+	if !w.wroteHeader {
+		w.wroteHeader = true
+		if status := w.outcome.get(); status != "" && code == http.StatusOK {
+			w.Header().Set(HeaderCache, status)
+		}
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *cacheOutcomeWriter) Write(b []byte) (int, error) {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	return w.ResponseWriter.Write(b)
+}
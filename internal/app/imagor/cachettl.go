@@ -0,0 +1,155 @@
+package imagor
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	i "github.com/cshum/imagor"
+	"github.com/cshum/imagor/imagorpath"
+)
+
+// cacheTTL returns the TTL of a cache(seconds) filter, clamped to maxTTL.
+// Because the filter is part of the signed path, it can't be changed by
+// clients and results with different TTLs are stored separately.
+func cacheTTL(path string, maxTTL time.Duration) (time.Duration, bool) {
+	for _, f := range imagorpath.Parse(path).Filters {
+		if f.Name != "cache" {
+			continue
+		}
+		seconds, err := strconv.ParseInt(f.Args, 10, 64)
+		if err != nil || seconds < 0 {
+			return 0, false
+		}
+		ttl := time.Duration(seconds) * time.Second
+		if maxTTL > 0 && ttl > maxTTL {
+			ttl = maxTTL
+		}
+		return ttl, true
+	}
+	return 0, false
+}
+
+// resultStorage expires results after the TTL of their cache() filter, or the
+// default TTL otherwise. Results older than the max age are always processed
+// again, whatever their TTL, as are results whose source changed according to
+// the source check.
+type resultStorage struct {
+	i.Storage
+	defaultTTL  time.Duration
+	maxTTL      time.Duration
+	maxAge      time.Duration
+	sources     *BlobStorage
+	sourceCheck string
+}
+
+func (s *resultStorage) Get(r *http.Request, key string) (*i.Blob, error) {
+	blob, err := s.get(r, key)
+	if err != nil && s.sourceCheck == SourceCheckMD5 && s.sources != nil {
+		// the result is processed again and stored under the same key
+		s.saveSourceHash(r, key)
+	}
+	return blob, err
+}
+
+func (s *resultStorage) get(r *http.Request, key string) (*i.Blob, error) {
+	if hasFilter(imagorpath.Parse(r.URL.EscapedPath()).Filters, "no_cache") {
+		// processed again and written back under the same key
+		recordCacheOutcome(r.Context(), CacheMiss)
+		return nil, i.ErrNotFound
+	}
+	ttl := s.defaultTTL
+	if t, ok := cacheTTL(r.URL.EscapedPath(), s.maxTTL); ok {
+		if t == 0 {
+			recordCacheOutcome(r.Context(), CacheMiss)
+			return nil, i.ErrNotFound
+		}
+		ttl = t
+	}
+	if s.maxAge > 0 && (ttl == 0 || s.maxAge < ttl) {
+		ttl = s.maxAge
+	}
+	if ttl > 0 {
+		stat, err := s.Storage.Stat(r.Context(), key)
+		if err != nil {
+			recordCacheOutcome(r.Context(), CacheMiss)
+			return nil, err
+		}
+		if time.Since(stat.ModifiedTime) > ttl {
+			recordCacheOutcome(r.Context(), CacheStale)
+			return nil, i.ErrNotFound
+		}
+	}
+	if s.sourceCheck != "" && s.sources != nil && s.sourceChanged(r, key) {
+		recordCacheOutcome(r.Context(), CacheStale)
+		return nil, i.ErrNotFound
+	}
+	blob, err := s.Storage.Get(r, key)
+	if err != nil {
+		recordCacheOutcome(r.Context(), CacheMiss)
+	} else {
+		recordCacheOutcome(r.Context(), CacheHit)
+	}
+	return blob, err
+}
+
+// cacheControlWriter replaces the public Cache-Control header set by imagor
+// with one using the TTL of a cache() filter
+type cacheControlWriter struct {
+	http.ResponseWriter
+	ttl         time.Duration
+	swr         time.Duration
+	wroteHeader bool
+}
+
+func (w *cacheControlWriter) WriteHeader(code int) {
+	if !w.wroteHeader {
+		w.wroteHeader = true
+		h := w.Header()
+		if code == http.StatusOK || code == http.StatusNotModified {
+			if strings.HasPrefix(h.Get("Cache-Control"), "public") {
+				h.Set("Cache-Control", cacheControl(w.ttl, w.swr))
+				h.Set("Expires", time.Now().Add(w.ttl).UTC().Format(http.TimeFormat))
+			}
+		}
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *cacheControlWriter) Write(b []byte) (int, error) {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+// cacheControl formats a Cache-Control header the same way imagor does
+func cacheControl(ttl, swr time.Duration) string {
+	if ttl == 0 {
+		return "private, no-cache, no-store, must-revalidate"
+	}
+	seconds := int64(ttl.Seconds())
+	val := fmt.Sprintf("public, s-maxage=%d, max-age=%d, no-transform", seconds, seconds)
+	if swr > 0 && swr < ttl {
+		val += fmt.Sprintf(", stale-while-revalidate=%d", int64(swr.Seconds()))
+	}
+	return val
+}
+
+// withoutNoCache makes results of no_cache() requests share their key with
+// regular requests, so forcing a fresh result also refreshes the cache
+func withoutNoCache(hasher imagorpath.ResultStorageHasher) imagorpath.ResultStorageHasher {
+	return imagorpath.ResultStorageHasherFunc(func(p imagorpath.Params) string {
+		filters := make(imagorpath.Filters, 0, len(p.Filters))
+		for _, f := range p.Filters {
+			if f.Name != "no_cache" {
+				filters = append(filters, f)
+			}
+		}
+		p.Filters = filters
+		p.Path = imagorpath.GeneratePath(p)
+		return hasher.HashResult(p)
+	})
+}
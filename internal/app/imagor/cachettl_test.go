@@ -0,0 +1,113 @@
+package imagor
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	i "github.com/cshum/imagor"
+	"github.com/cshum/imagor/imagorpath"
+	"github.com/cshum/imagor/storage/filestorage"
+)
+
+func TestCacheTTL(t *testing.T) {
+	tests := []struct {
+		path   string
+		want   time.Duration
+		wantOK bool
+	}{
+		{"/Jdjq2EZb4ta9Bc-6aAbWZpAuQrQ/300x200/blob/image.jpg", 0, false},
+		{"/Jdjq2EZb4ta9Bc-6aAbWZpAuQrQ/300x200/filters:cache(3600)/blob/image.jpg", time.Hour, true},
+		{"/Jdjq2EZb4ta9Bc-6aAbWZpAuQrQ/filters:format(webp):cache(60)/blob/image.jpg", time.Minute, true},
+		{"/Jdjq2EZb4ta9Bc-6aAbWZpAuQrQ/filters:cache(0)/blob/image.jpg", 0, true},
+		{"/Jdjq2EZb4ta9Bc-6aAbWZpAuQrQ/filters:cache(999999999)/blob/image.jpg", 24 * time.Hour, true},
+		{"/Jdjq2EZb4ta9Bc-6aAbWZpAuQrQ/filters:cache(-1)/blob/image.jpg", 0, false},
+		{"/Jdjq2EZb4ta9Bc-6aAbWZpAuQrQ/filters:cache(soon)/blob/image.jpg", 0, false},
+	}
+
+	for _, tt := range tests {
+		got, ok := cacheTTL(tt.path, 24*time.Hour)
+		if got != tt.want || ok != tt.wantOK {
+			t.Errorf("cacheTTL(%q) = %v, %v, want %v, %v", tt.path, got, ok, tt.want, tt.wantOK)
+		}
+	}
+}
+
+func TestWithoutNoCache(t *testing.T) {
+	hasher := withoutNoCache(imagorpath.DigestResultStorageHasher)
+	regular := imagorpath.Parse("/Jdjq2EZb4ta9Bc-6aAbWZpAuQrQ/300x200/filters:format(png)/blob/image.jpg")
+	noCache := imagorpath.Parse("/Jdjq2EZb4ta9Bc-6aAbWZpAuQrQ/300x200/filters:format(png):no_cache()/blob/image.jpg")
+	other := imagorpath.Parse("/Jdjq2EZb4ta9Bc-6aAbWZpAuQrQ/300x300/filters:format(png)/blob/image.jpg")
+
+	if hasher.HashResult(regular) != hasher.HashResult(noCache) {
+		t.Error("expected no_cache() results to share the key of regular results")
+	}
+	if hasher.HashResult(regular) == hasher.HashResult(other) {
+		t.Error("expected different transforms to have different keys")
+	}
+}
+
+func TestResultStorage_CacheOutcome(t *testing.T) {
+	dir := t.TempDir()
+	s := &resultStorage{Storage: filestorage.New(dir), defaultTTL: time.Hour}
+
+	get := func(path string) string {
+		t.Helper()
+		r, outcome := withCacheOutcome(httptest.NewRequest(http.MethodGet, path, nil))
+		_, _ = s.Get(r, "result")
+		return outcome.get()
+	}
+
+	if got := get("/unsafe/100x100/blob/a.png"); got != CacheMiss {
+		t.Errorf("expected %s before the result is stored, got %s", CacheMiss, got)
+	}
+	if err := s.Put(context.Background(), "result", i.NewBlobFromBytes([]byte("result"))); err != nil {
+		t.Fatal(err)
+	}
+	if got := get("/unsafe/100x100/blob/a.png"); got != CacheHit {
+		t.Errorf("expected %s, got %s", CacheHit, got)
+	}
+	if got := get("/unsafe/100x100/filters:no_cache()/blob/a.png"); got != CacheMiss {
+		t.Errorf("expected %s with no_cache(), got %s", CacheMiss, got)
+	}
+
+	old := time.Now().Add(-2 * time.Hour)
+	if err := os.Chtimes(filepath.Join(dir, "result"), old, old); err != nil {
+		t.Fatal(err)
+	}
+	if got := get("/unsafe/100x100/blob/a.png"); got != CacheStale {
+		t.Errorf("expected %s after the TTL, got %s", CacheStale, got)
+	}
+}
+
+func TestResultStorage_MaxAge(t *testing.T) {
+	dir := t.TempDir()
+	s := &resultStorage{Storage: filestorage.New(dir), maxTTL: 24 * time.Hour, maxAge: time.Hour}
+	if err := s.Put(context.Background(), "result", i.NewBlobFromBytes([]byte("result"))); err != nil {
+		t.Fatal(err)
+	}
+	get := func(path string) string {
+		t.Helper()
+		r, outcome := withCacheOutcome(httptest.NewRequest(http.MethodGet, path, nil))
+		_, _ = s.Get(r, "result")
+		return outcome.get()
+	}
+
+	if got := get("/unsafe/100x100/blob/a.png"); got != CacheHit {
+		t.Errorf("expected %s, got %s", CacheHit, got)
+	}
+	old := time.Now().Add(-2 * time.Hour)
+	if err := os.Chtimes(filepath.Join(dir, "result"), old, old); err != nil {
+		t.Fatal(err)
+	}
+	if got := get("/unsafe/100x100/blob/a.png"); got != CacheStale {
+		t.Errorf("expected %s after the max age without a TTL, got %s", CacheStale, got)
+	}
+	if got := get("/unsafe/100x100/filters:cache(86400)/blob/a.png"); got != CacheStale {
+		t.Errorf("expected %s after the max age with a longer TTL, got %s", CacheStale, got)
+	}
+}
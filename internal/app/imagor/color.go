@@ -0,0 +1,114 @@
+package imagor
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/cshum/imagor/vips"
+)
+
+const (
+	// ColorAverage is the mean color of all pixels
+	ColorAverage = "average"
+	// ColorDominant is the most common color, after pixels are grouped into
+	// similar colors. Unlike the average, it isn't muddied by small areas of
+	// contrasting color.
+	ColorDominant = "dominant"
+)
+
+// colorSampleSize is the size images are shrunk to before their color is
+// computed, which keeps it cheap for large images
+const colorSampleSize = 32
+
+// ColorExtractor returns a function that computes the color of the image at a
+// path as #rrggbb, using the average or dominant color mode. Transparent
+// pixels are flattened onto white.
+func ColorExtractor(mode string) (func(path string) (string, error), error) {
+	switch mode {
+	case ColorAverage, ColorDominant:
+	default:
+		return nil, fmt.Errorf("unknown color mode %q: must be %s or %s", mode, ColorAverage, ColorDominant)
+	}
+	return func(path string) (string, error) {
+		f, err := os.Open(path)
+		if err != nil {
+			return "", err
+		}
+		src := vips.NewSource(f)
+		defer src.Close()
+		img, err := src.LoadThumbnail(colorSampleSize, colorSampleSize, vips.InterestingNone, vips.SizeDown, nil)
+		if err != nil {
+			return "", err
+		}
+		defer img.Close()
+		if img.HasAlpha() {
+			if err := img.Flatten(&vips.Color{R: 255, G: 255, B: 255}); err != nil {
+				return "", err
+			}
+		}
+		if err := img.ToColorSpace(vips.InterpretationSRGB); err != nil {
+			return "", err
+		}
+		if mode == ColorAverage {
+			// shrinking to a single pixel averages all of them
+			if err := img.ThumbnailWithSize(1, 1, vips.InterestingNone, vips.SizeForce); err != nil {
+				return "", err
+			}
+			return pixelColor(img, 0, 0)
+		}
+		return dominantColor(img)
+	}, nil
+}
+
+// dominantColor groups the pixels of img into buckets of similar colors and
+// returns the average color of the largest bucket
+func dominantColor(img *vips.Image) (string, error) {
+	type bucket struct {
+		count   int
+		r, g, b int
+	}
+	buckets := map[int]*bucket{}
+	var largest *bucket
+	for y := range img.Height() {
+		for x := range img.Width() {
+			px, err := img.GetPoint(x, y)
+			if err != nil {
+				return "", err
+			}
+			if len(px) < 3 {
+				return "", fmt.Errorf("expected an RGB pixel, got %d bands", len(px))
+			}
+			r, g, b := int(px[0]), int(px[1]), int(px[2])
+			// 4 bits per channel is coarse enough to group shades together
+			id := r>>4<<8 | g>>4<<4 | b>>4
+			bk, ok := buckets[id]
+			if !ok {
+				bk = &bucket{}
+				buckets[id] = bk
+			}
+			bk.count++
+			bk.r += r
+			bk.g += g
+			bk.b += b
+			if largest == nil || bk.count > largest.count {
+				largest = bk
+			}
+		}
+	}
+	if largest == nil {
+		return "", fmt.Errorf("image has no pixels")
+	}
+	n := largest.count
+	return fmt.Sprintf("#%02x%02x%02x", largest.r/n, largest.g/n, largest.b/n), nil
+}
+
+func pixelColor(img *vips.Image, x, y int) (string, error) {
+	px, err := img.GetPoint(x, y)
+	if err != nil {
+		return "", err
+	}
+	if len(px) < 3 {
+		return "", fmt.Errorf("expected an RGB pixel, got %d bands", len(px))
+	}
+	return fmt.Sprintf("#%02x%02x%02x", uint8(px[0]), uint8(px[1]), uint8(px[2])), nil
+}
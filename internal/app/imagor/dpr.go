@@ -0,0 +1,67 @@
+package imagor
+
+import (
+	"math"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/cshum/imagor/imagorpath"
+)
+
+// DefaultMaxDPR is the default highest device pixel ratio client hints can
+// scale images by
+const DefaultMaxDPR = 3.0
+
+// dprHints are the client hints a device pixel ratio is read from, in order
+// of preference. DPR is the legacy name of Sec-CH-DPR.
+var dprHints = []string{"Sec-CH-DPR", "DPR"}
+
+// requestDPR returns the device pixel ratio of the client hints of a request,
+// rounded to the nearest 0.5 so results are only cached for a few ratios, and
+// capped at maxDPR. Requests without a hint have a ratio of 1.
+func requestDPR(r *http.Request, maxDPR float64) float64 {
+	for _, name := range dprHints {
+		value := strings.TrimSpace(r.Header.Get(name))
+		if value == "" {
+			continue
+		}
+		dpr, err := strconv.ParseFloat(value, 64)
+		if err != nil || math.IsNaN(dpr) {
+			return 1
+		}
+		return min(max(math.Round(dpr*2)/2, 1), maxDPR)
+	}
+	return 1
+}
+
+// applyDPR multiplies the dimensions of a verified request by the device pixel
+// ratio of its client hints and re-signs it. The result of each ratio is
+// cached under its own path, like a request for the scaled dimensions.
+func (s *Imagor) applyDPR(r *http.Request) {
+	dpr := requestDPR(r, s.maxDPR)
+	if dpr <= 1 {
+		return
+	}
+	p, ok := s.verifiedParams(r)
+	if !ok || p.Meta || (p.Width <= 0 && p.Height <= 0) {
+		return
+	}
+	if p.Width > 0 {
+		p.Width = int(math.Round(float64(p.Width) * dpr))
+	}
+	if p.Height > 0 {
+		p.Height = int(math.Round(float64(p.Height) * dpr))
+	}
+	signer := s.Imagor.Signer
+	if p.Unsafe {
+		signer = nil
+	}
+	escaped := "/" + imagorpath.Generate(p, signer)
+	path, err := url.PathUnescape(escaped)
+	if err != nil {
+		return
+	}
+	r.URL.Path, r.URL.RawPath = path, escaped
+}
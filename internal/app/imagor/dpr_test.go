@@ -0,0 +1,96 @@
+package imagor
+
+import (
+	"context"
+	"crypto/sha256"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	i "github.com/cshum/imagor"
+)
+
+func TestRequestDPR(t *testing.T) {
+	tests := []struct {
+		name    string
+		headers map[string]string
+		want    float64
+	}{
+		{"no hint", nil, 1},
+		{"sec-ch-dpr", map[string]string{"Sec-CH-DPR": "2"}, 2},
+		{"legacy dpr", map[string]string{"DPR": "1.5"}, 1.5},
+		{"sec-ch-dpr preferred", map[string]string{"Sec-CH-DPR": "2", "DPR": "3"}, 2},
+		{"rounded", map[string]string{"Sec-CH-DPR": "2.625"}, 2.5},
+		{"capped", map[string]string{"Sec-CH-DPR": "8"}, 3},
+		{"never below 1", map[string]string{"Sec-CH-DPR": "0.5"}, 1},
+		{"invalid", map[string]string{"Sec-CH-DPR": "NaN"}, 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/", nil)
+			for name, value := range tt.headers {
+				r.Header.Set(name, value)
+			}
+			if got := requestDPR(r, 3); got != tt.want {
+				t.Errorf("expected %v, got %v", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestImagor_ClientHints(t *testing.T) {
+	signer := NewHMACSigner(sha256.New, 0, "secret")
+	processor := &paramsProcessor{fakeProcessor: fakeProcessor{out: []byte("\x89PNG\r\n\x1a\n")}}
+	app := i.New(
+		i.WithLoaders(bytesLoader("\x89PNG\r\n\x1a\n")),
+		i.WithProcessors(processor),
+		i.WithSigner(signer),
+	)
+	if err := app.Startup(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	s := &Imagor{Imagor: app, clientHints: true, maxDPR: 3}
+
+	tests := []struct {
+		name       string
+		path       string
+		dpr        string
+		wantWidth  int
+		wantHeight int
+	}{
+		{"no hint", "100x50/blob/image.png", "", 100, 50},
+		{"scaled", "100x50/blob/image.png", "2", 200, 100},
+		{"derived height", "fit-in/100x0/blob/a%20b.png", "1.5", 150, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/"+signer.Sign(tt.path)+"/"+tt.path, nil)
+			if tt.dpr != "" {
+				r.Header.Set("Sec-CH-DPR", tt.dpr)
+			}
+			w := httptest.NewRecorder()
+			s.ServeHTTP(w, r)
+			if w.Code != http.StatusOK {
+				t.Fatalf("unexpected status %d: %s", w.Code, w.Body)
+			}
+			if processor.params.Width != tt.wantWidth || processor.params.Height != tt.wantHeight {
+				t.Errorf("expected %dx%d, got %dx%d", tt.wantWidth, tt.wantHeight, processor.params.Width, processor.params.Height)
+			}
+			if got := w.Header().Get("Accept-CH"); got != "Sec-CH-DPR, DPR" {
+				t.Errorf("unexpected Accept-CH %q", got)
+			}
+			if got := w.Header().Get("Vary"); got != "Sec-CH-DPR, DPR" {
+				t.Errorf("unexpected Vary %q", got)
+			}
+		})
+	}
+
+	// the hint can't be used to get around the signature
+	r := httptest.NewRequest(http.MethodGet, "/"+signer.Sign("200x100/blob/image.png")+"/100x50/blob/image.png", nil)
+	r.Header.Set("Sec-CH-DPR", "2")
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, r)
+	if w.Code != http.StatusForbidden {
+		t.Errorf("expected a mismatched signature to be rejected, got %d", w.Code)
+	}
+}
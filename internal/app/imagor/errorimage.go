@@ -0,0 +1,126 @@
+package imagor
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gabriel-vasile/mimetype"
+)
+
+// isProcessingError reports whether a status code is the result of a failed
+// transform, as opposed to a missing source or a bad request
+func isProcessingError(code int) bool {
+	switch code {
+	case http.StatusNotAcceptable, http.StatusUnsupportedMediaType,
+		http.StatusUnprocessableEntity, http.StatusInternalServerError:
+		return true
+	}
+	return false
+}
+
+// acceptsImage reports whether a client accepts an image as the body of an
+// error. A missing Accept header accepts anything.
+func acceptsImage(accept string) bool {
+	if accept == "" {
+		return true
+	}
+	for _, part := range strings.Split(accept, ",") {
+		mediaRange, params, _ := strings.Cut(part, ";")
+		mediaRange = strings.ToLower(strings.TrimSpace(mediaRange))
+		if mediaRange != "*/*" && !strings.HasPrefix(mediaRange, "image/") {
+			continue
+		}
+		if q, ok := strings.CutPrefix(strings.TrimSpace(params), "q="); ok {
+			if v, err := strconv.ParseFloat(q, 64); err == nil && v == 0 {
+				continue
+			}
+		}
+		return true
+	}
+	return false
+}
+
+// errorImageWriter holds back processing error responses so they can be
+// replaced by the configured error image
+type errorImageWriter struct {
+	http.ResponseWriter
+	wroteHeader bool
+	status      int
+	body        bytes.Buffer
+}
+
+func (w *errorImageWriter) WriteHeader(code int) {
+	if w.wroteHeader {
+		return
+	}
+	w.wroteHeader = true
+	if isProcessingError(code) {
+		w.status = code
+		return
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *errorImageWriter) Write(b []byte) (int, error) {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	if w.status != 0 {
+		return w.body.Write(b)
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+// intercepted reports whether a processing error was held back
+func (w *errorImageWriter) intercepted() bool {
+	return w.status != 0
+}
+
+// serveErrorImage replaces a held back processing error with the error image,
+// keeping the original status code. The original error is always logged and
+// is written as-is if the error image can't be read.
+func (s *Imagor) serveErrorImage(w *errorImageWriter, r *http.Request) {
+	var e struct {
+		Message string `json:"message"`
+	}
+	_ = json.Unmarshal(w.body.Bytes(), &e)
+	s.log.Error("image processing failed", "status", w.status, "error", e.Message, "path", r.URL.Path)
+
+	header := w.ResponseWriter.Header()
+	data, err := s.readErrorImage(r.Context())
+	if err != nil {
+		s.log.Error("failed to read error image", "key", s.errorImageKey, "error", err)
+		header.Set("Content-Type", "application/json")
+		w.ResponseWriter.WriteHeader(w.status)
+		_, _ = w.ResponseWriter.Write(w.body.Bytes())
+		return
+	}
+
+	header.Del("Content-Disposition")
+	header.Set("Content-Type", mimetype.Detect(data).String())
+	header.Set("Content-Length", strconv.Itoa(len(data)))
+	header.Set("Cache-Control", "no-store")
+	w.ResponseWriter.WriteHeader(w.status)
+	if r.Method != http.MethodHead {
+		_, _ = w.ResponseWriter.Write(data)
+	}
+}
+
+// readErrorImage reads the error image from the storage backend
+func (s *Imagor) readErrorImage(ctx context.Context) ([]byte, error) {
+	key, rec, err := s.blobs.record(ctx, "blob/"+s.errorImageKey)
+	if err != nil {
+		return nil, err
+	}
+	f, err := s.blobs.KV.Open(key, rec)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return io.ReadAll(f)
+}
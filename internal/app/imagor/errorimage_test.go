@@ -0,0 +1,108 @@
+package imagor
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+
+	i "github.com/cshum/imagor"
+	"github.com/cshum/imagor/imagorpath"
+)
+
+// brokenProcessor fails every transform like a corrupt source would
+type brokenProcessor struct{}
+
+func (brokenProcessor) Startup(context.Context) error  { return nil }
+func (brokenProcessor) Shutdown(context.Context) error { return nil }
+func (brokenProcessor) Process(context.Context, *i.Blob, imagorpath.Params, i.LoadFunc) (*i.Blob, error) {
+	return nil, i.NewError("corrupt image", http.StatusUnprocessableEntity)
+}
+
+func TestImagor_ErrorImage(t *testing.T) {
+	dir := t.TempDir()
+	kv := newTestKeyVal(t, dir)
+	putTestPNG(t, kv, "image.png", 7)
+	errorImage := putTestPNG(t, kv, "error.png", 9)
+
+	blobs := NewBlobStorage(kv, filepath.Join(dir, "uploads"))
+	app := i.New(
+		i.WithLoaders(blobs),
+		i.WithProcessors(brokenProcessor{}),
+		i.WithUnsafe(true),
+	)
+	if err := app.Startup(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	s := &Imagor{
+		Imagor:        app,
+		blobs:         blobs,
+		errorImageKey: "error.png",
+		log:           slog.New(slog.NewTextHandler(io.Discard, nil)),
+	}
+	serve := func(accept string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodGet, "/unsafe/100x100/blob/image.png", nil)
+		if accept != "" {
+			r.Header.Set("Accept", accept)
+		}
+		w := httptest.NewRecorder()
+		s.ServeHTTP(w, r)
+		return w
+	}
+	isJSONError := func(res *httptest.ResponseRecorder) bool {
+		var e struct {
+			Message string `json:"message"`
+		}
+		return res.Header().Get("Content-Type") == "application/json" && json.Unmarshal(res.Body.Bytes(), &e) == nil && e.Message != ""
+	}
+
+	for _, accept := range []string{"", "image/avif,image/webp,*/*;q=0.8", "image/png"} {
+		res := serve(accept)
+		if res.Code != http.StatusUnprocessableEntity || !bytes.Equal(res.Body.Bytes(), errorImage) {
+			t.Errorf("%q: expected the error image with a 422, got %d with %d bytes", accept, res.Code, res.Body.Len())
+		}
+		if ct := res.Header().Get("Content-Type"); ct != "image/png" {
+			t.Errorf("%q: expected the type of the error image, got %q", accept, ct)
+		}
+		if cc := res.Header().Get("Cache-Control"); cc != "no-store" {
+			t.Errorf("%q: expected the error image not to be cached, got %q", accept, cc)
+		}
+	}
+
+	for _, accept := range []string{"application/json", "image/*;q=0, application/json"} {
+		if res := serve(accept); res.Code != http.StatusUnprocessableEntity || !isJSONError(res) {
+			t.Errorf("%q: expected the JSON error, got %d %q", accept, res.Code, res.Body.String())
+		}
+	}
+
+	// the error is served as-is when the error image can't be read
+	s.errorImageKey = "missing.png"
+	if res := serve(""); res.Code != http.StatusUnprocessableEntity || !isJSONError(res) {
+		t.Errorf("expected the JSON error without an error image, got %d %q", res.Code, res.Body.String())
+	}
+}
+
+func TestAcceptsImage(t *testing.T) {
+	tests := []struct {
+		accept string
+		want   bool
+	}{
+		{"", true},
+		{"*/*", true},
+		{"image/webp,image/*", true},
+		{"text/html, IMAGE/PNG;q=0.5", true},
+		{"application/json", false},
+		{"image/*;q=0, application/json", false},
+		{"*/*;q=0", false},
+	}
+	for _, tt := range tests {
+		if got := acceptsImage(tt.accept); got != tt.want {
+			t.Errorf("acceptsImage(%q) = %v, want %v", tt.accept, got, tt.want)
+		}
+	}
+}
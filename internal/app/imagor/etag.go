@@ -0,0 +1,129 @@
+package imagor
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/cshum/imagor/imagorpath"
+)
+
+// etag returns a strong entity tag for a signed request for an image in blob
+// storage. It is derived from the hash of the source and the result cache key,
+// which covers the transform, the negotiated format, and settings that change
+// the result. Sources fetched over HTTP have no known hash, so they get none.
+func (s *Imagor) etag(r *http.Request) string {
+	if s.blobs == nil || s.Imagor.ResultStoragePathStyle == nil {
+		return ""
+	}
+	p, ok := s.verifiedParams(r)
+	if !ok || p.Params || p.Image == "" {
+		return ""
+	}
+	_, rec, err := s.blobs.record(r.Context(), p.Image)
+	if err != nil || rec.Hash == "" {
+		return ""
+	}
+
+	// mirror the params imagor derives its result key from
+	hasFormat := false
+	filters := make(imagorpath.Filters, 0, len(p.Filters)+1)
+	for _, f := range p.Filters {
+		switch f.Name {
+		case "format":
+			hasFormat = true
+		case "expire", "attachment":
+			continue
+		}
+		filters = append(filters, f)
+	}
+	if format := s.negotiatedFormat(r); !hasFormat && format != "" {
+		filters = append(filters, imagorpath.Filter{Name: "format", Args: format})
+	}
+	p.Filters = filters
+	p.Path = imagorpath.GeneratePath(p)
+	key := s.Imagor.ResultStoragePathStyle.HashResult(p)
+
+	sum := sha256.Sum256([]byte(rec.Hash + ":" + key))
+	return `"` + base64.RawURLEncoding.EncodeToString(sum[:18]) + `"`
+}
+
+// verifiedParams parses the image processing path of a request, reporting
+// whether imagor accepts its signature
+func (s *Imagor) verifiedParams(r *http.Request) (imagorpath.Params, bool) {
+	path := r.URL.EscapedPath()
+	p := imagorpath.Parse(path)
+	if !s.verified(p) {
+		// imagor retries unescaped paths
+		unescaped, err := url.QueryUnescape(path)
+		if err != nil {
+			return p, false
+		}
+		if p = imagorpath.Parse(unescaped); !s.verified(p) {
+			return p, false
+		}
+	}
+	return p, true
+}
+
+// negotiatedFormat returns the format automatic WebP/AVIF negotiation converts
+// a request to without a format() filter, if any
+func (s *Imagor) negotiatedFormat(r *http.Request) string {
+	accept := r.Header.Get("Accept")
+	if s.Imagor.AutoAVIF && strings.Contains(accept, "image/avif") {
+		return "avif"
+	}
+	if s.Imagor.AutoWebP && strings.Contains(accept, "image/webp") {
+		return "webp"
+	}
+	return ""
+}
+
+// verified reports whether imagor accepts the signature of a request
+func (s *Imagor) verified(p imagorpath.Params) bool {
+	if s.Imagor.Unsafe && p.Unsafe {
+		return true
+	}
+	return p.Path != "" && s.Imagor.Signer.Sign(p.Path) == p.Hash
+}
+
+// etagMatch reports whether an If-None-Match header matches an entity tag
+func etagMatch(ifNoneMatch, etag string) bool {
+	for _, tag := range strings.Split(ifNoneMatch, ",") {
+		tag = strings.TrimSpace(tag)
+		// If-None-Match uses the weak comparison
+		if tag == "*" || strings.TrimPrefix(tag, "W/") == etag {
+			return true
+		}
+	}
+	return false
+}
+
+// etagWriter replaces the time-based ETag imagor sets for cached results with
+// a content-derived one
+type etagWriter struct {
+	http.ResponseWriter
+	etag        string
+	wroteHeader bool
+}
+
+func (w *etagWriter) WriteHeader(code int) {
+	if !w.wroteHeader {
+		w.wroteHeader = true
+		if code == http.StatusOK || code == http.StatusNotModified {
+			w.Header().Set("ETag", w.etag)
+		} else {
+			w.Header().Del("ETag")
+		}
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *etagWriter) Write(b []byte) (int, error) {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	return w.ResponseWriter.Write(b)
+}
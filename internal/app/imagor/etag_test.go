@@ -0,0 +1,73 @@
+package imagor
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+
+	i "github.com/cshum/imagor"
+	"github.com/cshum/imagor/imagorpath"
+)
+
+func TestImagor_ETag(t *testing.T) {
+	dir := t.TempDir()
+	kv := newTestKeyVal(t, dir)
+	put := func(fill byte) { putTestPNG(t, kv, "image.png", fill) }
+	put(0)
+
+	blobs := NewBlobStorage(kv, filepath.Join(dir, "uploads"))
+	app := i.New(
+		i.WithLoaders(blobs),
+		i.WithUnsafe(true),
+		i.WithAutoWebP(true),
+		i.WithResultStoragePathStyle(withoutNoCache(imagorpath.DigestResultStorageHasher)),
+	)
+	if err := app.Startup(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	s := &Imagor{Imagor: app, blobs: blobs}
+	serve := func(path string, header http.Header) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodGet, path, nil)
+		for k, v := range header {
+			r.Header[k] = v
+		}
+		w := httptest.NewRecorder()
+		s.ServeHTTP(w, r)
+		return w
+	}
+
+	res := serve("/unsafe/blob/image.png", nil)
+	etag := res.Header().Get("ETag")
+	if res.Code != http.StatusOK || etag == "" {
+		t.Fatalf("expected a 200 with an ETag, got %d and %q", res.Code, etag)
+	}
+	if again := serve("/unsafe/blob/image.png", nil).Header().Get("ETag"); again != etag {
+		t.Errorf("expected a stable ETag, got %q and %q", etag, again)
+	}
+
+	res = serve("/unsafe/blob/image.png", http.Header{"If-None-Match": {etag}})
+	if res.Code != http.StatusNotModified || res.Body.Len() != 0 {
+		t.Errorf("expected a 304 without a body, got %d with %d bytes", res.Code, res.Body.Len())
+	}
+	if res.Header().Get("ETag") != etag {
+		t.Errorf("expected the 304 to carry the ETag")
+	}
+
+	if other := serve("/unsafe/100x100/blob/image.png", nil).Header().Get("ETag"); other == etag {
+		t.Error("expected a different transform to have a different ETag")
+	}
+	if webp := serve("/unsafe/blob/image.png", http.Header{"Accept": {"image/webp"}}).Header().Get("ETag"); webp == etag {
+		t.Error("expected a negotiated format to have a different ETag")
+	}
+	if missing := serve("/unsafe/blob/missing.png", nil).Header().Get("ETag"); missing != "" {
+		t.Errorf("expected no ETag for a missing source, got %q", missing)
+	}
+
+	put(1)
+	res = serve("/unsafe/blob/image.png", http.Header{"If-None-Match": {etag}})
+	if res.Code == http.StatusNotModified || res.Header().Get("ETag") == etag {
+		t.Error("expected a changed source to change the ETag")
+	}
+}
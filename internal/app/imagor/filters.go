@@ -0,0 +1,103 @@
+package imagor
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+
+	i "github.com/cshum/imagor"
+	"github.com/cshum/imagor/vips"
+)
+
+// customFilters are vips-backed filters that are not part of imagor's default
+// filter set. They are only registered with the processor when explicitly
+// allowlisted, since some of them expose raw vips parameters.
+var customFilters = map[string]vips.FilterFunc{
+	// unsharp(sigma,x1,m2) exposes the full vips_sharpen parameter set
+	"unsharp": unsharp,
+	// linear(a,b) applies out = in * a + b to every color band
+	"linear": linear,
+	// invert() inverts the colors of the image
+	"invert": invert,
+}
+
+func customFilterOptions(allowed []string) ([]vips.Option, error) {
+	opts := make([]vips.Option, 0, len(allowed))
+	for _, name := range allowed {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		fn, ok := customFilters[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown custom filter %q", name)
+		}
+		opts = append(opts, vips.WithFilter(name, fn))
+	}
+	return opts, nil
+}
+
+func unsharp(_ context.Context, img *vips.Image, _ i.LoadFunc, args ...string) error {
+	if isAnimated(img) || len(args) == 0 {
+		return nil
+	}
+	params := []float64{1, 2, 20}
+	for n := 0; n < len(args) && n < len(params); n++ {
+		v, err := strconv.ParseFloat(args[n], 64)
+		if err != nil {
+			return i.ErrInvalid
+		}
+		params[n] = v
+	}
+	if params[0] <= 0 || params[0] > 10 {
+		return i.ErrInvalid
+	}
+	return img.Sharpen(params[0], params[1], params[2])
+}
+
+func linear(_ context.Context, img *vips.Image, _ i.LoadFunc, args ...string) error {
+	if len(args) != 2 {
+		return nil
+	}
+	a, err := strconv.ParseFloat(args[0], 64)
+	if err != nil {
+		return i.ErrInvalid
+	}
+	b, err := strconv.ParseFloat(args[1], 64)
+	if err != nil {
+		return i.ErrInvalid
+	}
+	return linearColor(img, a, b)
+}
+
+func invert(_ context.Context, img *vips.Image, _ i.LoadFunc, _ ...string) error {
+	return linearColor(img, -1, 255)
+}
+
+// linearColor applies the linear transform to the color bands only, leaving
+// the alpha channel untouched.
+func linearColor(img *vips.Image, a, b float64) error {
+	bands := img.Bands()
+	if img.HasAlpha() {
+		bands--
+	}
+	if bands < 1 {
+		bands = 1
+	}
+	as := make([]float64, 0, bands+1)
+	bs := make([]float64, 0, bands+1)
+	for n := 0; n < bands; n++ {
+		as = append(as, a)
+		bs = append(bs, b)
+	}
+	if img.HasAlpha() {
+		as = append(as, 1)
+		bs = append(bs, 0)
+	}
+	return img.Linear(as, bs)
+}
+
+func isAnimated(img *vips.Image) bool {
+	return img.Height() > img.PageHeight()
+}
@@ -0,0 +1,97 @@
+package imagor
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+
+	i "github.com/cshum/imagor"
+	"github.com/cshum/imagor/imagorpath"
+)
+
+// ErrOutputFormatNotAllowed is returned when a request would produce an image
+// in a format that isn't in SERVE_ALLOWED_OUTPUT_FORMATS
+var ErrOutputFormatNotAllowed = i.NewError("output format not allowed", http.StatusBadRequest)
+
+var outputFormats = map[i.BlobType]string{
+	i.BlobTypeJPEG: "jpeg",
+	i.BlobTypePNG:  "png",
+	i.BlobTypeGIF:  "gif",
+	i.BlobTypeWEBP: "webp",
+	i.BlobTypeAVIF: "avif",
+	i.BlobTypeHEIF: "heif",
+	i.BlobTypeTIFF: "tiff",
+	i.BlobTypeJP2:  "jp2",
+	i.BlobTypeBMP:  "bmp",
+}
+
+// parseOutputFormats returns the set of allowed output formats, or nil if all
+// formats are allowed
+func parseOutputFormats(formats []string) (map[string]bool, error) {
+	var allowed map[string]bool
+	for _, format := range formats {
+		format = normalizeFormat(format)
+		if format == "" {
+			continue
+		}
+		if !isOutputFormat(format) {
+			return nil, fmt.Errorf("unknown output format %q", format)
+		}
+		if allowed == nil {
+			allowed = map[string]bool{}
+		}
+		allowed[format] = true
+	}
+	return allowed, nil
+}
+
+func normalizeFormat(format string) string {
+	format = strings.ToLower(strings.TrimSpace(format))
+	if format == "jpg" {
+		return "jpeg"
+	}
+	return format
+}
+
+// outputFormatProcessor rejects requests for output formats that aren't
+// allowed. An explicit format() filter, including the one added by automatic
+// WebP/AVIF negotiation, is rejected before processing. Without one, the
+// output format follows the source, so it is checked after processing.
+type outputFormatProcessor struct {
+	i.Processor
+	allowed map[string]bool
+}
+
+func (v *outputFormatProcessor) Process(ctx context.Context, blob *i.Blob, p imagorpath.Params, load i.LoadFunc) (*i.Blob, error) {
+	if p.Meta {
+		return v.Processor.Process(ctx, blob, p, load)
+	}
+	for _, f := range p.Filters {
+		if f.Name != "format" {
+			continue
+		}
+		// unknown formats are ignored by the processor, so they fall through to
+		// the check of the output
+		if format := normalizeFormat(f.Args); isOutputFormat(format) && !v.allowed[format] {
+			return nil, ErrOutputFormatNotAllowed
+		}
+	}
+	out, err := v.Processor.Process(ctx, blob, p, load)
+	if err != nil {
+		return out, err
+	}
+	if !v.allowed[outputFormats[out.BlobType()]] {
+		return nil, ErrOutputFormatNotAllowed
+	}
+	return out, nil
+}
+
+func isOutputFormat(format string) bool {
+	for _, f := range outputFormats {
+		if f == format {
+			return true
+		}
+	}
+	return false
+}
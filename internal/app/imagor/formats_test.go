@@ -0,0 +1,64 @@
+package imagor
+
+import (
+	"context"
+	"testing"
+
+	i "github.com/cshum/imagor"
+	"github.com/cshum/imagor/imagorpath"
+)
+
+type fakeProcessor struct {
+	out       []byte
+	processed bool
+}
+
+func (p *fakeProcessor) Startup(context.Context) error  { return nil }
+func (p *fakeProcessor) Shutdown(context.Context) error { return nil }
+func (p *fakeProcessor) Process(context.Context, *i.Blob, imagorpath.Params, i.LoadFunc) (*i.Blob, error) {
+	p.processed = true
+	return i.NewBlobFromBytes(p.out), nil
+}
+
+func TestOutputFormatProcessor(t *testing.T) {
+	allowed, err := parseOutputFormats([]string{"jpg", " png", "webp", ""})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// blob types are only sniffed from more than 24 bytes
+	png := append([]byte("\x89PNG\r\n\x1a\n"), make([]byte, 32)...)
+	gif := append([]byte("GIF89a"), make([]byte, 32)...)
+
+	tests := []struct {
+		name          string
+		path          string
+		out           []byte
+		wantErr       bool
+		wantProcessed bool
+	}{
+		{"allowed source format", "fit-in/100x100/blob/a.png", png, false, true},
+		{"disallowed source format", "fit-in/100x100/blob/a.gif", gif, true, true},
+		{"allowed format filter", "fit-in/100x100/filters:format(png)/blob/a.gif", png, false, true},
+		{"disallowed format filter", "fit-in/100x100/filters:format(gif)/blob/a.png", gif, true, false},
+		{"unknown format filter", "fit-in/100x100/filters:format(nope)/blob/a.gif", gif, true, true},
+		{"meta", "meta/fit-in/100x100/blob/a.gif", []byte(`{"format":"gif"}`), false, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fake := &fakeProcessor{out: tt.out}
+			v := &outputFormatProcessor{Processor: fake, allowed: allowed}
+			_, err := v.Process(context.Background(), i.NewBlobFromBytes(png), imagorpath.Parse(tt.path), nil)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("expected error %v, got %v", tt.wantErr, err)
+			}
+			if fake.processed != tt.wantProcessed {
+				t.Errorf("expected processed %v, got %v", tt.wantProcessed, fake.processed)
+			}
+		})
+	}
+
+	if _, err := parseOutputFormats([]string{"png", "exe"}); err == nil {
+		t.Error("expected an unknown format to be rejected")
+	}
+}
@@ -0,0 +1,49 @@
+package imagor
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	i "github.com/cshum/imagor"
+)
+
+type bytesLoader []byte
+
+func (l bytesLoader) Get(_ *http.Request, _ string) (*i.Blob, error) {
+	return i.NewBlobFromBytes(l), nil
+}
+
+func TestImagor_Head(t *testing.T) {
+	content := append([]byte("\x89PNG\r\n\x1a\n"), bytes.Repeat([]byte{0}, 1024)...)
+	app := i.New(i.WithLoaders(bytesLoader(content)), i.WithUnsafe(true))
+	if err := app.Startup(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	s := &Imagor{Imagor: app, autoFormat: true}
+
+	get := httptest.NewRecorder()
+	s.ServeHTTP(get, httptest.NewRequest(http.MethodGet, "/unsafe/blob/image.png", nil))
+	head := httptest.NewRecorder()
+	s.ServeHTTP(head, httptest.NewRequest(http.MethodHead, "/unsafe/blob/image.png", nil))
+
+	if get.Code != http.StatusOK || head.Code != get.Code {
+		t.Fatalf("expected HEAD and GET to return 200, got %d and %d", head.Code, get.Code)
+	}
+	for _, h := range []string{"Content-Type", "Content-Length", "Cache-Control", "Vary"} {
+		if head.Header().Get(h) != get.Header().Get(h) {
+			t.Errorf("expected %s to match, got %q for HEAD and %q for GET", h, head.Header().Get(h), get.Header().Get(h))
+		}
+	}
+	if head.Header().Get("Content-Length") == "" {
+		t.Error("expected a Content-Length")
+	}
+	if head.Body.Len() != 0 {
+		t.Errorf("expected HEAD to have no body, got %d bytes", head.Body.Len())
+	}
+	if !bytes.Equal(get.Body.Bytes(), content) {
+		t.Error("expected GET to return the image")
+	}
+}
@@ -18,6 +18,7 @@ import (
 	"syscall"
 
 	"github.com/cshum/imagor"
+	"golang.org/x/sync/semaphore"
 )
 
 func randomProxyFunc(proxyURLs, hosts string) func(*http.Request) (*url.URL, error) {
@@ -166,7 +167,16 @@ type HTTPLoader struct {
 	// BaseURL base URL for HTTP loader
 	BaseURL *url.URL
 
-	accepts []string
+	// MaxConcurrentFetches bounds the number of in-flight requests to remote
+	// sources. Zero means unlimited.
+	MaxConcurrentFetches int
+
+	// RejectWhenFetchesSaturated rejects fetches beyond MaxConcurrentFetches
+	// with a 503 instead of queueing them.
+	RejectWhenFetchesSaturated bool
+
+	accepts   []string
+	fetchSema *semaphore.Weighted
 }
 
 // New creates HTTPLoader
@@ -195,9 +205,45 @@ func New(options ...Option) *HTTPLoader {
 			}
 		}
 	}
+	if h.MaxConcurrentFetches > 0 {
+		h.fetchSema = semaphore.NewWeighted(int64(h.MaxConcurrentFetches))
+	}
 	return h
 }
 
+// ErrFetchesSaturated is returned when the fetch concurrency limit has been
+// reached and queueing is disabled
+var ErrFetchesSaturated = imagor.NewError("too many concurrent source fetches", http.StatusServiceUnavailable)
+
+// acquireFetch reserves a fetch slot, returning a function that releases it
+func (h *HTTPLoader) acquireFetch(r *http.Request) (func(), error) {
+	if h.fetchSema == nil {
+		return func() {}, nil
+	}
+	if h.RejectWhenFetchesSaturated {
+		if !h.fetchSema.TryAcquire(1) {
+			return nil, ErrFetchesSaturated
+		}
+	} else if err := h.fetchSema.Acquire(r.Context(), 1); err != nil {
+		return nil, err
+	}
+	var once sync.Once
+	return func() {
+		once.Do(func() { h.fetchSema.Release(1) })
+	}, nil
+}
+
+// releaseOnClose releases a fetch slot once the response body has been closed
+type releaseOnClose struct {
+	io.ReadCloser
+	release func()
+}
+
+func (r *releaseOnClose) Close() error {
+	defer r.release()
+	return r.ReadCloser.Close()
+}
+
 // Get implements imagor.Loader interface
 func (h *HTTPLoader) Get(r *http.Request, image string) (*imagor.Blob, error) {
 	if !strings.HasPrefix(image, "url/") {
@@ -245,7 +291,12 @@ func (h *HTTPLoader) Get(r *http.Request, image string) (*imagor.Blob, error) {
 		if err != nil {
 			return nil, err
 		}
+		release, err := h.acquireFetch(r)
+		if err != nil {
+			return nil, err
+		}
 		resp, err := client.Do(req)
+		release()
 		if err != nil {
 			return nil, err
 		}
@@ -265,8 +316,13 @@ func (h *HTTPLoader) Get(r *http.Request, image string) (*imagor.Blob, error) {
 	var blob *imagor.Blob
 	var once sync.Once
 	blob = imagor.NewBlob(func() (io.ReadCloser, int64, error) {
+		release, err := h.acquireFetch(r)
+		if err != nil {
+			return nil, 0, err
+		}
 		resp, err := client.Do(req)
 		if err != nil {
+			release()
 			if errors.Is(err, ErrUnauthorizedRequest) {
 				err = imagor.NewError(
 					fmt.Sprintf("%s: %s", err.Error(), image),
@@ -289,14 +345,15 @@ func (h *HTTPLoader) Get(r *http.Request, image string) (*imagor.Blob, error) {
 				}
 			}
 		})
-		body := resp.Body
+		var body io.ReadCloser = &releaseOnClose{ReadCloser: resp.Body, release: release}
 		size, _ := strconv.ParseInt(resp.Header.Get("Content-Length"), 10, 64)
 		if resp.Header.Get("Content-Encoding") == "gzip" {
 			gzipBody, err := gzip.NewReader(resp.Body)
 			if err != nil {
+				_ = body.Close()
 				return nil, 0, err
 			}
-			body = gzipBody
+			body = &releaseOnClose{ReadCloser: gzipBody, release: func() { _ = resp.Body.Close(); release() }}
 			size = 0 // size unknown after decompress
 		}
 		if resp.StatusCode >= 400 {
@@ -560,6 +617,18 @@ func WithBlockPrivateNetworks(enabled bool) Option {
 	}
 }
 
+// WithMaxConcurrentFetches with option to bound the number of concurrent
+// requests to remote sources. When reject is true, fetches beyond the limit
+// fail with a 503 instead of waiting for a free slot.
+func WithMaxConcurrentFetches(n int, reject bool) Option {
+	return func(h *HTTPLoader) {
+		if n > 0 {
+			h.MaxConcurrentFetches = n
+			h.RejectWhenFetchesSaturated = reject
+		}
+	}
+}
+
 // WithBlockNetworks with option to reject
 // HTTP connections to a configurable list of networks
 func WithBlockNetworks(networks ...*net.IPNet) Option {
@@ -0,0 +1,63 @@
+package httploader
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestHTTPLoader_MaxConcurrentFetches(t *testing.T) {
+	unblock := make(chan struct{})
+	started := make(chan struct{}, 2)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		started <- struct{}{}
+		<-unblock
+		w.Header().Set("Content-Type", "image/png")
+		w.Write([]byte("\x89PNG\r\n\x1a\n"))
+	}))
+	defer srv.Close()
+
+	fetch := func(h *HTTPLoader, path string) error {
+		blob, err := h.Get(httptest.NewRequest(http.MethodGet, "/", nil), "url/"+srv.URL+path)
+		if err != nil {
+			return err
+		}
+		_, err = blob.ReadAll()
+		return err
+	}
+
+	for _, reject := range []bool{true, false} {
+		h := New(WithMaxConcurrentFetches(1, reject))
+		first := make(chan error, 1)
+		go func() { first <- fetch(h, "/a.png") }()
+		<-started
+
+		second := make(chan error, 1)
+		go func() { second <- fetch(h, "/b.png") }()
+		if reject {
+			if err := <-second; !errors.Is(err, ErrFetchesSaturated) {
+				t.Errorf("expected %v, got %v", ErrFetchesSaturated, err)
+			}
+		} else {
+			select {
+			case <-started:
+				t.Error("expected the second fetch to wait for a free slot")
+			case <-time.After(50 * time.Millisecond):
+			}
+		}
+
+		unblock <- struct{}{}
+		if err := <-first; err != nil {
+			t.Fatal(err)
+		}
+		if !reject {
+			<-started
+			unblock <- struct{}{}
+			if err := <-second; err != nil {
+				t.Errorf("expected the queued fetch to succeed, got %v", err)
+			}
+		}
+	}
+}
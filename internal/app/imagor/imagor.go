@@ -5,8 +5,13 @@ import (
 	"crypto/hmac"
 	"crypto/sha256"
 	"encoding/base64"
+	"encoding/json"
 	"hash"
+	"log/slog"
+	"net/http"
+	"net/url"
 	"os"
+	"strings"
 	"time"
 
 	i "github.com/cshum/imagor"
@@ -18,35 +23,97 @@ import (
 )
 
 type Config struct {
-	KeyVal             *keyval.KeyVal
-	UploadPath         string
-	MaxUploadSize      int
-	SignSecret         string
+	KeyVal        *keyval.KeyVal
+	UploadPath    string
+	MaxUploadSize int
+	SignSecret    string
+	// The scheme and host of the URLs in manifests, e.g.
+	// https://images.example.com. Empty returns paths.
+	PublicURL          string
 	AllowedHTTPSources string
-	AutoWebP           bool
-	AutoAVIF           bool
-	ResultCacheTTL     time.Duration
-	Concurrency        int
-	RequestTimeout     time.Duration
-	CacheControlTTL    time.Duration
-	CacheControlSWR    time.Duration
-	Debug              bool
+	// The order loaders are tried in, by name. Defaults to DefaultLoaderOrder.
+	LoaderOrder []string
+	// The content types the HTTP loader accepts. Defaults to "image/*".
+	HTTPAccept string
+	// Rasterize SVG sources from HTTP instead of rejecting them. SVGs in blob
+	// storage are always rasterized.
+	AllowSVGSources bool
+	// The max width and height SVG sources are rasterized at. Defaults to
+	// DefaultSVGMaxDimension.
+	SVGMaxDimension int
+	AutoWebP        bool
+	AutoAVIF        bool
+	// Multiply the dimensions of requests by the device pixel ratio of their
+	// Sec-CH-DPR or DPR client hint
+	ClientHints bool
+	// The highest device pixel ratio client hints can scale images by.
+	// Defaults to DefaultMaxDPR.
+	MaxDPR         float64
+	ResultCacheTTL time.Duration
+	// The max TTL a cache() filter can set
+	MaxCacheTTL time.Duration
+	// The age after which results are always processed again, e.g. to pick
+	// up encoder improvements. Zero disables it.
+	ResultMaxAge time.Duration
+	// Treat cached results of blob storage sources as stale when the source
+	// changed: SourceCheckModTime, SourceCheckMD5, or empty to disable it
+	SourceCheck      string
+	Concurrency      int
+	FetchConcurrency int
+	FetchQueue       bool
+	RequestTimeout   time.Duration
+	CacheControlTTL  time.Duration
+	CacheControlSWR  time.Duration
+	CustomFilters    []string
+	AllowUnsafe      bool
+	MaxFilters       int
+	NoUpscale        bool
+	// Let transforms that only differ in the order of their option filters
+	// share a result cache entry
+	NormalizeCacheKeys bool
+	// The formats images can be served in. Empty allows all formats.
+	AllowedOutputFormats []string
+	// The blob key of an image served in place of processing errors
+	ErrorImageKey string
+	// Stream blobs as-is for requests without a transform
+	ServeOriginals bool
+	// Verifies imagor's native signed URLs for NativeHandler, e.g. from
+	// NewNativeSigner. nil rejects every signed native URL.
+	NativeSigner imagorpath.Signer
+	// The transforms uploads can be stored with, e.g. fit-in/2000x2000. "*"
+	// allows any transform.
+	UploadTransforms []string
+	Logger           *slog.Logger
+	Debug            bool
 }
 
-func New(ctx context.Context, cfg Config) (*i.Imagor, error) {
+func New(ctx context.Context, cfg Config) (*Imagor, error) {
 	tmpDir, err := os.MkdirTemp("", "imagor-*")
 	if err != nil {
 		return nil, err
 	}
 
-	loaders := []i.Loader{
-		NewBlobStorage(cfg.KeyVal, cfg.UploadPath),
+	if err := validSourceCheck(cfg.SourceCheck); err != nil {
+		return nil, err
+	}
+	processorOptions, err := customFilterOptions(cfg.CustomFilters)
+	if err != nil {
+		return nil, err
 	}
 
+	blobs := NewBlobStorage(cfg.KeyVal, cfg.UploadPath)
+	available := map[string]i.Loader{LoaderBlob: blobs}
+
+	if cfg.HTTPAccept == "" {
+		cfg.HTTPAccept = "image/*"
+	}
+	if cfg.MaxDPR <= 0 {
+		cfg.MaxDPR = DefaultMaxDPR
+	}
 	if cfg.AllowedHTTPSources != "" {
-		loaders = append(loaders, httploader.New(
+		var httpLoader i.Loader = httploader.New(
 			httploader.WithForwardClientHeaders(false),
-			httploader.WithAccept("image/*"),
+			httploader.WithAccept(cfg.HTTPAccept),
 			httploader.WithForwardHeaders(""),
 			httploader.WithOverrideResponseHeaders(""),
 			httploader.WithAllowedSources(cfg.AllowedHTTPSources),
@@ -60,13 +127,57 @@ func New(ctx context.Context, cfg Config) (*i.Imagor, error) {
 			httploader.WithBlockPrivateNetworks(false),
 			httploader.WithBlockLinkLocalNetworks(false),
 			httploader.WithBlockNetworks(),
+			httploader.WithMaxConcurrentFetches(cfg.FetchConcurrency, !cfg.FetchQueue),
 			httploader.WithUserAgent("RailwayImagesClient/1.0 (Platform: Linux; Architecture: x64)"),
-		))
+		)
+		if !cfg.AllowSVGSources {
+			// SVGs in blob storage were uploaded by trusted clients
+			httpLoader = rejectSVGLoader{Loader: httpLoader}
+		}
+		available[LoaderHTTP] = httpLoader
+	}
+	loaders, err := orderLoaders(cfg.LoaderOrder, available)
+	if err != nil {
+		return nil, err
+	}
+	var loader i.Loader = loaderChain(loaders)
+
+	allowedOutputFormats, err := parseOutputFormats(cfg.AllowedOutputFormats)
+	if err != nil {
+		return nil, err
+	}
+	if allowedOutputFormats != nil {
+		// negotiating a format that isn't allowed would reject every request
+		// from a client that accepts it
+		cfg.AutoWebP = cfg.AutoWebP && allowedOutputFormats["webp"]
+		cfg.AutoAVIF = cfg.AutoAVIF && allowedOutputFormats["avif"]
 	}
 
+	vipsProcessor := vips.NewProcessor(processorOptions...)
+	var processor i.Processor = vipsProcessor
+	var resultStorageHasher imagorpath.ResultStorageHasher = imagorpath.DigestResultStorageHasher
+	if cfg.NoUpscale {
+		processor = &noUpscaleProcessor{Processor: vipsProcessor}
+		resultStorageHasher = noUpscaleResultStorageHasher
+	}
+	if cfg.NormalizeCacheKeys {
+		resultStorageHasher = normalizedResultStorageHasher(resultStorageHasher)
+	}
+	maxDimension := cfg.SVGMaxDimension
+	if maxDimension <= 0 {
+		maxDimension = DefaultSVGMaxDimension
+	}
+	processor = &svgProcessor{Processor: processor, vips: vipsProcessor, maxDimension: maxDimension}
+	if allowedOutputFormats != nil {
+		processor = &outputFormatProcessor{Processor: processor, allowed: allowedOutputFormats}
+	}
+	drain := &drainEstimator{concurrency: cfg.Concurrency}
+	processor = &timedProcessor{Processor: processor, drain: drain}
+	processor = &tracedProcessor{Processor: processor}
+
 	imagorService := i.New(
-		i.WithLoaders(loaders...),
-		i.WithProcessors(vips.NewProcessor()),
+		i.WithLoaders(loader),
+		i.WithProcessors(processor),
 		i.WithSigner(NewHMACSigner(sha256.New, 0, cfg.SignSecret)),
 		i.WithBasePathRedirect(""),
 		i.WithBaseParams(""),
@@ -75,19 +186,28 @@ func New(ctx context.Context, cfg Config) (*i.Imagor, error) {
 		i.WithSaveTimeout(cfg.RequestTimeout),
 		i.WithProcessTimeout(cfg.RequestTimeout),
 		i.WithProcessConcurrency(int64(cfg.Concurrency)),
-		i.WithProcessQueueSize(100),
+		i.WithProcessQueueSize(processQueueSize),
 		i.WithCacheHeaderTTL(cfg.CacheControlTTL),
 		i.WithCacheHeaderSWR(cfg.CacheControlSWR),
 		i.WithCacheHeaderNoCache(false),
 		i.WithAutoWebP(cfg.AutoWebP),
 		i.WithAutoAVIF(cfg.AutoAVIF),
+		// imagor only checks the modification time of sources in its own
+		// storages, so the result storage checks blob storage sources itself
 		i.WithModifiedTimeCheck(false),
 		i.WithDisableErrorBody(false),
 		i.WithDisableParamsEndpoint(true),
-		i.WithResultStorages(filestorage.New(tmpDir, filestorage.WithExpiration(cfg.ResultCacheTTL))),
+		i.WithResultStorages(&resultStorage{
+			Storage:     filestorage.New(tmpDir),
+			defaultTTL:  cfg.ResultCacheTTL,
+			maxTTL:      cfg.MaxCacheTTL,
+			maxAge:      cfg.ResultMaxAge,
+			sources:     blobs,
+			sourceCheck: cfg.SourceCheck,
+		}),
 		i.WithStoragePathStyle(imagorpath.DigestStorageHasher),
-		i.WithResultStoragePathStyle(imagorpath.DigestResultStorageHasher),
-		i.WithUnsafe(cfg.Debug),
+		i.WithResultStoragePathStyle(withoutNoCache(resultStorageHasher)),
+		i.WithUnsafe(cfg.AllowUnsafe),
 		i.WithDebug(cfg.Debug),
 	)
 
@@ -98,7 +218,189 @@ func New(ctx context.Context, cfg Config) (*i.Imagor, error) {
 		return nil, err
 	}
 
-	return imagorService, nil
+	return &Imagor{
+		Imagor:           imagorService,
+		blobs:            blobs,
+		vips:             vipsProcessor,
+		signSecret:       cfg.SignSecret,
+		publicURL:        cfg.PublicURL,
+		log:              cfg.Logger,
+		autoFormat:       cfg.AutoWebP || cfg.AutoAVIF,
+		clientHints:      cfg.ClientHints,
+		maxDPR:           cfg.MaxDPR,
+		maxFilters:       cfg.MaxFilters,
+		allowedFormats:   allowedOutputFormats,
+		allowSVG:         cfg.AllowSVGSources,
+		serveOriginals:   cfg.ServeOriginals,
+		nativeSigner:     cfg.NativeSigner,
+		uploadTransforms: parseUploadTransforms(cfg.UploadTransforms),
+		drain:            drain,
+		errorImageKey:    cfg.ErrorImageKey,
+		maxCacheTTL:      cfg.MaxCacheTTL,
+		cacheSWR:         cfg.CacheControlSWR,
+	}, nil
+}
+
+// Imagor wraps the imagor application with the response handling specific to
+// this service.
+type Imagor struct {
+	*i.Imagor
+	blobs       *BlobStorage
+	vips        *vips.Processor
+	signSecret  string
+	publicURL   string
+	log         *slog.Logger
+	autoFormat  bool
+	clientHints bool
+	maxDPR      float64
+	maxFilters  int
+	// raw() serves the source as-is, bypassing the output format check. Nil
+	// allows all formats.
+	allowedFormats map[string]bool
+	// SVGs are served as originals, rather than rasterized
+	allowSVG       bool
+	serveOriginals bool
+	nativeSigner   imagorpath.Signer
+	// nil allows any transform
+	uploadTransforms map[string]bool
+	warm             warmJob
+	drain            *drainEstimator
+	errorImageKey    string
+	maxCacheTTL      time.Duration
+	cacheSWR         time.Duration
+}
+
+// ErrTooManyFilters is returned when a request exceeds the configured maximum
+// number of filters
+var ErrTooManyFilters = i.NewError("too many filters", http.StatusBadRequest)
+
+func (s *Imagor) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if key, ok := s.manifestKey(r); ok {
+		s.serveManifest(w, r, key)
+		return
+	}
+	if s.maxFilters > 0 && countFilters(r.URL.EscapedPath()) > s.maxFilters {
+		writeError(w, ErrTooManyFilters)
+		return
+	}
+	if s.allowedFormats != nil && hasRawFilter(r.URL.EscapedPath()) {
+		writeError(w, ErrOutputFormatNotAllowed)
+		return
+	}
+	if s.clientHints {
+		s.applyDPR(r)
+	}
+	if s.blobs != nil && s.blobs.KV.CountsAccess() {
+		s.recordAccess(r)
+	}
+	var vary []string
+	if s.autoFormat {
+		// The response format depends on the Accept header whenever automatic
+		// format negotiation is enabled, even if this particular request was not
+		// converted. Without this, a CDN would cache e.g. a JPEG and serve it to
+		// clients that accept WebP, or vice versa.
+		vary = append(vary, "Accept")
+	}
+	if s.clientHints {
+		w.Header().Set("Accept-CH", strings.Join(dprHints, ", "))
+		vary = append(vary, dprHints...)
+	}
+	if len(vary) > 0 {
+		w = &varyResponseWriter{ResponseWriter: w, vary: vary}
+	}
+	if ttl, ok := cacheTTL(r.URL.EscapedPath(), s.maxCacheTTL); ok {
+		w = &cacheControlWriter{ResponseWriter: w, ttl: ttl, swr: s.cacheSWR}
+	}
+	if etag := s.etag(r); etag != "" {
+		if etagMatch(r.Header.Get("If-None-Match"), etag) {
+			w.Header().Set("ETag", etag)
+			w.Header().Set("Cache-Control", cacheControl(s.Imagor.CacheHeaderTTL, s.Imagor.CacheHeaderSWR))
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w = &etagWriter{ResponseWriter: w, etag: etag}
+	}
+	if s.serveOriginals && s.blobs != nil && s.serveOriginal(w, r) {
+		return
+	}
+	r, outcome := withCacheOutcome(r)
+	w = &cacheOutcomeWriter{ResponseWriter: w, outcome: outcome}
+	hw := &headerWriter{ResponseWriter: w}
+	defer hw.finish()
+	qw := &queueFullWriter{ResponseWriter: hw, drain: s.drain}
+	// clients that don't accept images, e.g. API clients, get the error itself
+	if s.errorImageKey != "" && acceptsImage(r.Header.Get("Accept")) {
+		ew := &errorImageWriter{ResponseWriter: qw}
+		s.Imagor.ServeHTTP(ew, r)
+		if ew.intercepted() {
+			s.serveErrorImage(ew, r)
+		}
+		return
+	}
+	s.Imagor.ServeHTTP(qw, r)
+}
+
+// recordAccess counts a signed request towards the access count of its source
+// blob, whether or not the result is cached
+func (s *Imagor) recordAccess(r *http.Request) {
+	p, ok := s.verifiedParams(r)
+	if !ok || p.Image == "" {
+		return
+	}
+	if key, _, err := s.blobs.record(r.Context(), p.Image); err == nil {
+		s.blobs.KV.RecordAccess(key)
+	}
+}
+
+// headerWriter makes sure the header rewriting writers it wraps see a
+// WriteHeader call, even when imagor relies on the implicit 200 of a response
+// without a body, e.g. for HEAD requests.
+type headerWriter struct {
+	http.ResponseWriter
+	wroteHeader bool
+}
+
+func (w *headerWriter) WriteHeader(code int) {
+	w.wroteHeader = true
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *headerWriter) Write(b []byte) (int, error) {
+	w.wroteHeader = true
+	return w.ResponseWriter.Write(b)
+}
+
+func (w *headerWriter) finish() {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+}
+
+// countFilters counts the filters of an image processing path. imagor retries
+// unescaped paths, so the larger of both interpretations is returned.
+func countFilters(path string) int {
+	n := len(imagorpath.Parse(path).Filters)
+	if unescaped, err := url.QueryUnescape(path); err == nil {
+		n = max(n, len(imagorpath.Parse(unescaped).Filters))
+	}
+	return n
+}
+
+// hasRawFilter reports whether either interpretation of an image processing
+// path has a raw() filter
+func hasRawFilter(path string) bool {
+	if hasFilter(imagorpath.Parse(path).Filters, "raw") {
+		return true
+	}
+	unescaped, err := url.QueryUnescape(path)
+	return err == nil && hasFilter(imagorpath.Parse(unescaped).Filters, "raw")
+}
+
+// writeError writes an error in the same format as imagor
+func writeError(w http.ResponseWriter, err i.Error) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(err.Code)
+	_ = json.NewEncoder(w).Encode(err)
 }
 
 func NewHMACSigner(alg func() hash.Hash, truncate int, secret string) imagorpath.Signer {
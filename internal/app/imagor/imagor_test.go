@@ -0,0 +1,59 @@
+package imagor
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"log/slog"
+	"net/http"
+	"path/filepath"
+	"testing"
+
+	"github.com/jaredLunde/railway-image-service/internal/app/keyval"
+)
+
+// newTestKeyVal returns a store for images with its files in dir/uploads
+func newTestKeyVal(t *testing.T, dir string) *keyval.KeyVal {
+	t.Helper()
+	kv, err := keyval.New(keyval.Config{
+		UploadPath:       filepath.Join(dir, "uploads"),
+		LevelDBPath:      filepath.Join(dir, "db"),
+		MaxSize:          1 << 20,
+		AllowedMimeTypes: []string{"image/"},
+		Logger:           slog.New(slog.NewTextHandler(io.Discard, nil)),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { kv.Close() })
+	return kv
+}
+
+// putTestPNG stores a PNG filled with fill at key, returning its content
+func putTestPNG(t *testing.T, kv *keyval.KeyVal, key string, fill byte) []byte {
+	t.Helper()
+	content := append([]byte("\x89PNG\r\n\x1a\n"), bytes.Repeat([]byte{fill}, 1024)...)
+	if status := kv.Write(context.Background(), []byte(key), bytes.NewReader(content), len(content), keyval.WriteOptions{}); status != http.StatusCreated {
+		t.Fatalf("unexpected status %d", status)
+	}
+	return content
+}
+
+func TestCountFilters(t *testing.T) {
+	tests := []struct {
+		path string
+		want int
+	}{
+		{"/unsafe/300x300/blob/test.jpg", 0},
+		{"/unsafe/300x300/filters:blur(2):grayscale()/blob/test.jpg", 2},
+		{"/unsafe/300x300/filters%3Ablur(2)%3Agrayscale()%3Aquality(80)/blob/test.jpg", 3},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.path, func(t *testing.T) {
+			if got := countFilters(tt.path); got != tt.want {
+				t.Errorf("expected %d filters, got %d", tt.want, got)
+			}
+		})
+	}
+}
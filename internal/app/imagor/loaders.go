@@ -0,0 +1,73 @@
+package imagor
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	i "github.com/cshum/imagor"
+)
+
+const (
+	// LoaderBlob loads blob/ images from blob storage
+	LoaderBlob = "blob"
+	// LoaderHTTP loads url/ images over HTTP from the allowed sources
+	LoaderHTTP = "http"
+)
+
+// DefaultLoaderOrder is the order loaders are tried in when none is configured
+var DefaultLoaderOrder = []string{LoaderBlob, LoaderHTTP}
+
+// orderLoaders returns the named loaders in order. Loaders that aren't
+// available, like HTTP without any allowed sources, are skipped.
+func orderLoaders(order []string, available map[string]i.Loader) ([]i.Loader, error) {
+	names := make([]string, 0, len(order))
+	for _, name := range order {
+		if name = strings.TrimSpace(name); name != "" {
+			names = append(names, name)
+		}
+	}
+	if len(names) == 0 {
+		names = DefaultLoaderOrder
+	}
+	seen := make(map[string]bool, len(names))
+	loaders := make([]i.Loader, 0, len(names))
+	for _, name := range names {
+		if name != LoaderBlob && name != LoaderHTTP {
+			return nil, fmt.Errorf("unknown loader %q, expected %s or %s", name, LoaderBlob, LoaderHTTP)
+		}
+		if seen[name] {
+			return nil, fmt.Errorf("loader %q is listed more than once", name)
+		}
+		seen[name] = true
+		if loader, ok := available[name]; ok {
+			loaders = append(loaders, loader)
+		}
+	}
+	return loaders, nil
+}
+
+// loaderChain tries its loaders in order until one loads the image. A loader
+// that doesn't find the image passes it on to the next one, whereas any other
+// error, like a source that isn't allowed, is a hard rejection that ends the
+// chain. imagor itself would try every loader and report the last error.
+type loaderChain []i.Loader
+
+func (l loaderChain) Get(r *http.Request, image string) (*i.Blob, error) {
+	for _, loader := range l {
+		blob, err := loader.Get(r, image)
+		if err == nil {
+			return blob, nil
+		}
+		if !isNotFound(err) {
+			return nil, err
+		}
+	}
+	return nil, i.ErrNotFound
+}
+
+func isNotFound(err error) bool {
+	var e i.Error
+	return errors.As(err, &e) && e.Code == http.StatusNotFound
+}
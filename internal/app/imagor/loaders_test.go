@@ -0,0 +1,84 @@
+package imagor
+
+import (
+	"net/http"
+	"testing"
+
+	i "github.com/cshum/imagor"
+)
+
+type fakeLoader struct {
+	blob  *i.Blob
+	err   error
+	calls int
+}
+
+func (l *fakeLoader) Get(*http.Request, string) (*i.Blob, error) {
+	l.calls++
+	return l.blob, l.err
+}
+
+func TestLoaderChain(t *testing.T) {
+	blob := i.NewBlobFromBytes([]byte("image"))
+
+	tests := []struct {
+		name      string
+		first     *fakeLoader
+		wantErr   error
+		wantBlob  bool
+		wantCalls int
+	}{
+		{"first loads", &fakeLoader{blob: blob}, nil, true, 0},
+		{"not found falls through", &fakeLoader{err: i.ErrNotFound}, nil, true, 1},
+		{"rejection stops the chain", &fakeLoader{err: i.ErrSourceNotAllowed}, i.ErrSourceNotAllowed, false, 0},
+		{"invalid stops the chain", &fakeLoader{err: i.ErrInvalid}, i.ErrInvalid, false, 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			second := &fakeLoader{blob: blob}
+			got, err := loaderChain{tt.first, second}.Get(nil, "blob/photo.png")
+			if err != tt.wantErr {
+				t.Fatalf("expected error %v, got %v", tt.wantErr, err)
+			}
+			if (got != nil) != tt.wantBlob {
+				t.Errorf("expected blob %v, got %v", tt.wantBlob, got != nil)
+			}
+			if second.calls != tt.wantCalls {
+				t.Errorf("expected the next loader to be called %d times, got %d", tt.wantCalls, second.calls)
+			}
+		})
+	}
+
+	if _, err := (loaderChain{&fakeLoader{err: i.ErrNotFound}}).Get(nil, "blob/photo.png"); err != i.ErrNotFound {
+		t.Errorf("expected not found when no loader finds the image, got %v", err)
+	}
+}
+
+func TestOrderLoaders(t *testing.T) {
+	blob, http := &fakeLoader{}, &fakeLoader{}
+	available := map[string]i.Loader{LoaderBlob: blob, LoaderHTTP: http}
+
+	loaders, err := orderLoaders([]string{"http", " blob"}, available)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(loaders) != 2 || loaders[0] != http || loaders[1] != blob {
+		t.Errorf("expected http then blob, got %v", loaders)
+	}
+
+	loaders, err = orderLoaders([]string{""}, map[string]i.Loader{LoaderBlob: blob})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(loaders) != 1 || loaders[0] != blob {
+		t.Errorf("expected the default order without unavailable loaders, got %v", loaders)
+	}
+
+	if _, err := orderLoaders([]string{"s3"}, available); err == nil {
+		t.Error("expected an unknown loader to be rejected")
+	}
+	if _, err := orderLoaders([]string{"blob", "blob"}, available); err == nil {
+		t.Error("expected a duplicate loader to be rejected")
+	}
+}
@@ -0,0 +1,111 @@
+package imagor
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+
+	i "github.com/cshum/imagor"
+	"github.com/cshum/imagor/imagorpath"
+	"github.com/jaredLunde/railway-image-service/client/sign"
+)
+
+// manifestWidths are the derivative widths recommended by a manifest, if the
+// source is at least as wide
+var manifestWidths = []int{320, 480, 640, 768, 1024, 1280, 1536, 1920, 2560, 3840}
+
+// Manifest describes a source image and the derivatives recommended for
+// serving it responsively
+type Manifest struct {
+	Key    string `json:"key"`
+	Width  int    `json:"width"`
+	Height int    `json:"height"`
+	Format string `json:"format"`
+	// Derivatives by ascending width. None are wider than the source.
+	Sizes []ManifestSize `json:"sizes"`
+}
+
+type ManifestSize struct {
+	Width  int    `json:"width"`
+	Height int    `json:"height"`
+	URL    string `json:"url"`
+}
+
+// manifestKey returns the blob key of a signed /serve/manifest/:key request
+func (s *Imagor) manifestKey(r *http.Request) (string, bool) {
+	p := imagorpath.Parse(r.URL.EscapedPath())
+	if s.vips == nil || !strings.HasPrefix(p.Image, "manifest/") || !s.verified(p) {
+		return "", false
+	}
+	key, err := url.PathUnescape(strings.TrimPrefix(p.Image, "manifest/"))
+	return key, err == nil
+}
+
+// serveManifest writes the manifest of a source in blob storage. Its
+// dimensions are read from the image header, so the source is not decoded.
+func (s *Imagor) serveManifest(w http.ResponseWriter, r *http.Request, key string) {
+	blob, err := s.blobs.Get(r, "blob/"+key)
+	if err != nil {
+		writeError(w, i.ErrNotFound)
+		return
+	}
+	img, err := s.vips.NewImage(r.Context(), blob, 1, 1, 0)
+	if err != nil {
+		writeError(w, i.WrapError(err))
+		return
+	}
+	width, height := img.Width(), img.PageHeight()
+	if img.Orientation() >= 5 {
+		// 90 and 270 degree orientations are swapped on auto-rotate
+		width, height = height, width
+	}
+	img.Close()
+
+	manifest := Manifest{Key: key, Width: width, Height: height, Format: outputFormats[blob.BlobType()]}
+	manifest.Sizes, err = s.manifestSizes(key, width, height)
+	if err != nil {
+		writeError(w, i.WrapError(err))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", cacheControl(s.Imagor.CacheHeaderTTL, s.Imagor.CacheHeaderSWR))
+	w.WriteHeader(http.StatusOK)
+	if r.Method != http.MethodHead {
+		_ = json.NewEncoder(w).Encode(manifest)
+	}
+}
+
+// manifestSizes returns the recommended derivatives of a source with signed
+// URLs, which are relative unless there is a public URL
+func (s *Imagor) manifestSizes(key string, width, height int) ([]ManifestSize, error) {
+	base, err := url.Parse(s.publicURL)
+	if err != nil {
+		return nil, err
+	}
+	widths := make([]int, 0, len(manifestWidths)+1)
+	for _, dw := range manifestWidths {
+		if dw < width {
+			widths = append(widths, dw)
+		}
+	}
+	widths = append(widths, width)
+	sizes := make([]ManifestSize, 0, len(widths))
+	for _, dw := range widths {
+		u := *base
+		u.Path += "/" + path.Join("serve", fmt.Sprintf("%dx0", dw), "blob", key)
+		signed, err := sign.SignURL(&u, s.signSecret)
+		if err != nil {
+			return nil, err
+		}
+		size := ManifestSize{Width: dw, URL: *signed}
+		if width > 0 {
+			size.Height = max(1, (height*dw+width/2)/width)
+		}
+		sizes = append(sizes, size)
+	}
+	return sizes, nil
+}
@@ -0,0 +1,38 @@
+package imagor
+
+import (
+	"net/url"
+	"testing"
+
+	"github.com/jaredLunde/railway-image-service/client/sign"
+)
+
+func TestImagor_ManifestSizes(t *testing.T) {
+	s := &Imagor{signSecret: "secret"}
+	sizes, err := s.manifestSizes("a b.png", 500, 250)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(sizes) != 3 || sizes[0].Width != 320 || sizes[0].Height != 160 || sizes[2].Width != 500 {
+		t.Fatalf("unexpected sizes %+v", sizes)
+	}
+	u, err := url.Parse(sizes[0].URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if u.IsAbs() || u.Path != "/serve/320x0/blob/a b.png" {
+		t.Errorf("expected a relative URL without a public URL, got %s", sizes[0].URL)
+	}
+	if err := sign.VerifyURL(u, "secret"); err != nil {
+		t.Errorf("expected a signed URL, got %v", err)
+	}
+
+	s.publicURL = "https://images.example.com"
+	sizes, err = s.manifestSizes("a.png", 100, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if u, err := url.Parse(sizes[0].URL); err != nil || u.Scheme != "https" || u.Host != "images.example.com" || u.Path != "/serve/100x0/blob/a.png" {
+		t.Errorf("expected a URL of the public URL, got %s", sizes[0].URL)
+	}
+}
@@ -0,0 +1,65 @@
+package imagor
+
+import (
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/subtle"
+	"fmt"
+	"hash"
+	"net/http"
+	"net/url"
+
+	i "github.com/cshum/imagor"
+	"github.com/cshum/imagor/imagorpath"
+)
+
+var nativeSignerAlgs = map[string]func() hash.Hash{
+	"sha1":   sha1.New,
+	"sha256": sha256.New,
+	"sha512": sha512.New,
+}
+
+// NewNativeSigner returns a signer for URLs signed the way imagor signs them
+// natively, as configured by its IMAGOR_SIGNER_TYPE and IMAGOR_SIGNER_TRUNCATE
+// options. Unlike the signatures of /serve URLs, they are padded.
+func NewNativeSigner(signerType string, truncate int, secret string) (imagorpath.Signer, error) {
+	alg, ok := nativeSignerAlgs[signerType]
+	if !ok {
+		return nil, fmt.Errorf("unknown signer type %q: must be sha1, sha256, or sha512", signerType)
+	}
+	// imagor only recognizes hashes of at least 8 characters
+	if truncate != 0 && truncate < 8 {
+		return nil, fmt.Errorf("invalid signer truncate %d: must be 0 or at least 8", truncate)
+	}
+	return imagorpath.NewHMACSigner(alg, truncate, secret), nil
+}
+
+// NativeHandler serves imagor's native /HASH/path URLs, so URLs signed by
+// existing imagor tooling work without re-signing them. Requests must have the
+// native prefix stripped. Signatures are checked with the native signer, then
+// the path is re-signed for the image service, so they are processed and
+// cached exactly like /serve requests.
+func (s *Imagor) NativeHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		p := imagorpath.Parse(r.URL.EscapedPath())
+		if p.Unsafe {
+			// imagor rejects these itself unless unsafe URLs are allowed
+			s.ServeHTTP(w, r)
+			return
+		}
+		if s.nativeSigner == nil || p.Path == "" ||
+			subtle.ConstantTimeCompare([]byte(s.nativeSigner.Sign(p.Path)), []byte(p.Hash)) != 1 {
+			writeError(w, i.ErrSignatureMismatch)
+			return
+		}
+		escaped := "/" + s.Imagor.Signer.Sign(p.Path) + "/" + p.Path
+		path, err := url.PathUnescape(escaped)
+		if err != nil {
+			writeError(w, i.ErrInvalid)
+			return
+		}
+		r.URL.Path, r.URL.RawPath = path, escaped
+		s.ServeHTTP(w, r)
+	})
+}
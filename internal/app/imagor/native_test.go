@@ -0,0 +1,57 @@
+package imagor
+
+import (
+	"context"
+	"crypto/sha256"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	i "github.com/cshum/imagor"
+)
+
+func TestImagor_NativeHandler(t *testing.T) {
+	signer := NewHMACSigner(sha256.New, 0, "secret")
+	app := i.New(
+		i.WithLoaders(bytesLoader("\x89PNG\r\n\x1a\n")),
+		i.WithProcessors(failingProcessor{}),
+		i.WithSigner(signer),
+	)
+	if err := app.Startup(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	native, err := NewNativeSigner("sha1", 0, "native")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &Imagor{Imagor: app, nativeSigner: native}
+	serve := func(path string) int {
+		w := httptest.NewRecorder()
+		s.NativeHandler().ServeHTTP(w, httptest.NewRequest(http.MethodGet, path, nil))
+		return w.Code
+	}
+
+	tests := []struct {
+		name string
+		path string
+		want int
+	}{
+		// failingProcessor answers every request that gets past the signature
+		{"native signature", "/" + native.Sign("100x100/blob/image.png") + "/100x100/blob/image.png", http.StatusTeapot},
+		{"escaped path", "/" + native.Sign("100x100/blob/a%20b.png") + "/100x100/blob/a%20b.png", http.StatusTeapot},
+		{"signature of another path", "/" + native.Sign("200x200/blob/image.png") + "/100x100/blob/image.png", http.StatusForbidden},
+		{"service signature", "/" + signer.Sign("100x100/blob/image.png") + "/100x100/blob/image.png", http.StatusForbidden},
+		{"unsafe", "/unsafe/100x100/blob/image.png", http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := serve(tt.path); got != tt.want {
+				t.Errorf("expected status %d, got %d", tt.want, got)
+			}
+		})
+	}
+
+	if _, err := NewNativeSigner("md5", 0, "native"); err == nil {
+		t.Error("expected an unknown signer type to be rejected")
+	}
+}
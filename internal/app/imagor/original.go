@@ -0,0 +1,51 @@
+package imagor
+
+import (
+	"io"
+	"net/http"
+	"strconv"
+
+	i "github.com/cshum/imagor"
+	"github.com/cshum/imagor/imagorpath"
+)
+
+// untransformed reports whether an image processing path only names an image,
+// so processing it would just re-encode the source
+func untransformed(p imagorpath.Params) bool {
+	return p.Image != "" && imagorpath.GeneratePath(p) == imagorpath.GeneratePath(imagorpath.Params{Image: p.Image})
+}
+
+// serveOriginal streams a blob as-is for a signed request without a transform,
+// skipping the vips round trip. It reports false without writing anything if
+// the request has to be processed, e.g. because automatic WebP/AVIF negotiation
+// would convert it or the source can't be served in its own format.
+func (s *Imagor) serveOriginal(w http.ResponseWriter, r *http.Request) bool {
+	p, ok := s.verifiedParams(r)
+	if !ok || !untransformed(p) || s.negotiatedFormat(r) != "" {
+		return false
+	}
+	blob, err := s.blobs.Get(r, p.Image)
+	if err != nil {
+		return false
+	}
+	if blob.BlobType() == i.BlobTypeUnknown || (isSVG(blob) && !s.allowSVG) {
+		return false
+	}
+	if s.allowedFormats != nil && !s.allowedFormats[outputFormats[blob.BlobType()]] {
+		return false
+	}
+	reader, size, err := blob.NewReader()
+	if err != nil {
+		return false
+	}
+	defer reader.Close()
+
+	w.Header().Set("Content-Type", blob.ContentType())
+	w.Header().Set("Content-Length", strconv.FormatInt(size, 10))
+	w.Header().Set("Cache-Control", cacheControl(s.Imagor.CacheHeaderTTL, s.Imagor.CacheHeaderSWR))
+	w.WriteHeader(http.StatusOK)
+	if r.Method != http.MethodHead {
+		_, _ = io.Copy(w, reader)
+	}
+	return true
+}
@@ -0,0 +1,72 @@
+package imagor
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+
+	i "github.com/cshum/imagor"
+	"github.com/cshum/imagor/imagorpath"
+)
+
+// failingProcessor fails every request, so a successful response proves the
+// processor was skipped
+type failingProcessor struct{}
+
+func (failingProcessor) Startup(context.Context) error  { return nil }
+func (failingProcessor) Shutdown(context.Context) error { return nil }
+func (failingProcessor) Process(context.Context, *i.Blob, imagorpath.Params, i.LoadFunc) (*i.Blob, error) {
+	return nil, i.NewError("processed", http.StatusTeapot)
+}
+
+func TestImagor_ServeOriginals(t *testing.T) {
+	dir := t.TempDir()
+	kv := newTestKeyVal(t, dir)
+	content := putTestPNG(t, kv, "image.png", 7)
+
+	blobs := NewBlobStorage(kv, filepath.Join(dir, "uploads"))
+	app := i.New(
+		i.WithLoaders(blobs),
+		i.WithProcessors(failingProcessor{}),
+		i.WithUnsafe(true),
+		i.WithAutoWebP(true),
+	)
+	if err := app.Startup(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	s := &Imagor{Imagor: app, blobs: blobs, serveOriginals: true}
+	serve := func(method, path string, header http.Header) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(method, path, nil)
+		for k, v := range header {
+			r.Header[k] = v
+		}
+		w := httptest.NewRecorder()
+		s.ServeHTTP(w, r)
+		return w
+	}
+
+	res := serve(http.MethodGet, "/unsafe/blob/image.png", nil)
+	if res.Code != http.StatusOK || !bytes.Equal(res.Body.Bytes(), content) {
+		t.Fatalf("expected the original bytes, got %d with %d bytes", res.Code, res.Body.Len())
+	}
+	if ct := res.Header().Get("Content-Type"); ct != "image/png" {
+		t.Errorf("expected the original content type, got %q", ct)
+	}
+	if res := serve(http.MethodHead, "/unsafe/blob/image.png", nil); res.Code != http.StatusOK || res.Body.Len() != 0 {
+		t.Errorf("expected a 200 without a body for HEAD, got %d with %d bytes", res.Code, res.Body.Len())
+	}
+	if res := serve(http.MethodGet, "/unsafe/100x100/blob/image.png", nil); res.Code != http.StatusTeapot {
+		t.Errorf("expected a transform to be processed, got %d", res.Code)
+	}
+	if res := serve(http.MethodGet, "/unsafe/blob/image.png", http.Header{"Accept": {"image/webp"}}); res.Code != http.StatusTeapot {
+		t.Errorf("expected a negotiated format to be processed, got %d", res.Code)
+	}
+
+	s.allowedFormats = map[string]bool{"jpeg": true}
+	if res := serve(http.MethodGet, "/unsafe/blob/image.png", nil); res.Code != http.StatusTeapot {
+		t.Errorf("expected a source in a disallowed format to be processed, got %d", res.Code)
+	}
+}
@@ -0,0 +1,113 @@
+package imagor
+
+import (
+	"context"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	i "github.com/cshum/imagor"
+	"github.com/cshum/imagor/imagorpath"
+)
+
+// processQueueSize is the max number of requests waiting for or being
+// processed. imagor rejects requests beyond it.
+const processQueueSize = 100
+
+// maxRetryAfter caps the Retry-After of a full queue, so a few slow transforms
+// don't send clients away for minutes
+const maxRetryAfter = time.Minute
+
+// ErrQueueFull is returned in place of imagor's 429 when the process queue is
+// full. The service is overloaded rather than the client sending too much, so
+// it is a 503 with a Retry-After header.
+var ErrQueueFull = i.NewError("process queue is full", http.StatusServiceUnavailable)
+
+// drainEstimator tracks how long processing takes to estimate how long a full
+// queue takes to drain
+type drainEstimator struct {
+	concurrency int
+	mu          sync.Mutex
+	avg         time.Duration
+}
+
+func (e *drainEstimator) observe(d time.Duration) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.avg == 0 {
+		e.avg = d
+		return
+	}
+	// exponentially weighted, so the estimate follows the current load
+	e.avg += (d - e.avg) / 5
+}
+
+// retryAfter estimates the time until a full queue has drained
+func (e *drainEstimator) retryAfter() time.Duration {
+	e.mu.Lock()
+	avg := e.avg
+	e.mu.Unlock()
+	d := avg * processQueueSize / time.Duration(max(e.concurrency, 1))
+	return min(max(d, time.Second), maxRetryAfter)
+}
+
+// timedProcessor feeds processing times to a drain estimator
+type timedProcessor struct {
+	i.Processor
+	drain *drainEstimator
+}
+
+func (v *timedProcessor) Process(ctx context.Context, blob *i.Blob, p imagorpath.Params, load i.LoadFunc) (*i.Blob, error) {
+	start := time.Now()
+	out, err := v.Processor.Process(ctx, blob, p, load)
+	if err == nil {
+		v.drain.observe(time.Since(start))
+	}
+	return out, err
+}
+
+// saturatedRetryAfter is the Retry-After of other 503s, e.g. for saturated
+// source fetches, whose slots free up as soon as a fetch finishes
+const saturatedRetryAfter = "1"
+
+// queueFullWriter replaces imagor's 429 for a full process queue with a 503
+// and a Retry-After header, and adds a Retry-After header to other 503s
+type queueFullWriter struct {
+	http.ResponseWriter
+	drain       *drainEstimator
+	wroteHeader bool
+	intercepted bool
+}
+
+func (w *queueFullWriter) WriteHeader(code int) {
+	if w.wroteHeader {
+		return
+	}
+	w.wroteHeader = true
+	if code == http.StatusTooManyRequests {
+		w.intercepted = true
+		seconds := int(math.Ceil(w.drain.retryAfter().Seconds()))
+		w.ResponseWriter.Header().Set("Retry-After", strconv.Itoa(seconds))
+		w.ResponseWriter.Header().Set("Cache-Control", "no-store")
+		writeError(w.ResponseWriter, ErrQueueFull)
+		return
+	}
+	if code == http.StatusServiceUnavailable && w.ResponseWriter.Header().Get("Retry-After") == "" {
+		w.ResponseWriter.Header().Set("Retry-After", saturatedRetryAfter)
+		w.ResponseWriter.Header().Set("Cache-Control", "no-store")
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *queueFullWriter) Write(b []byte) (int, error) {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	if w.intercepted {
+		// imagor's own error body
+		return len(b), nil
+	}
+	return w.ResponseWriter.Write(b)
+}
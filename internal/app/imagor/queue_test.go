@@ -0,0 +1,62 @@
+package imagor
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	i "github.com/cshum/imagor"
+	"github.com/jaredLunde/railway-image-service/internal/app/imagor/httploader"
+)
+
+// errorLoader fails every load with err
+type errorLoader struct {
+	err error
+}
+
+func (l errorLoader) Get(*http.Request, string) (*i.Blob, error) {
+	return nil, l.err
+}
+
+func TestImagor_ServiceUnavailable(t *testing.T) {
+	tests := []struct {
+		name       string
+		err        error
+		message    string
+		retryAfter string
+	}{
+		// 100 queued requests of 500ms each on 10 workers
+		{"process queue full", i.ErrTooManyRequests, ErrQueueFull.Message, "5"},
+		{"fetches saturated", httploader.ErrFetchesSaturated, httploader.ErrFetchesSaturated.Message, saturatedRetryAfter},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			app := i.New(i.WithLoaders(errorLoader{tt.err}), i.WithUnsafe(true))
+			if err := app.Startup(context.Background()); err != nil {
+				t.Fatal(err)
+			}
+			drain := &drainEstimator{concurrency: 10}
+			drain.observe(500 * time.Millisecond)
+			s := &Imagor{Imagor: app, drain: drain}
+
+			w := httptest.NewRecorder()
+			s.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/unsafe/100x100/url/example.com/a.png", nil))
+			if w.Code != http.StatusServiceUnavailable {
+				t.Fatalf("expected a 503, got %d", w.Code)
+			}
+			if got := w.Header().Get("Retry-After"); got != tt.retryAfter {
+				t.Errorf("expected Retry-After %q, got %q", tt.retryAfter, got)
+			}
+			if got := w.Header().Get("Cache-Control"); got != "no-store" {
+				t.Errorf("expected the response not to be cached, got %q", got)
+			}
+			var e i.Error
+			if err := json.Unmarshal(w.Body.Bytes(), &e); err != nil || e.Message != tt.message {
+				t.Errorf("expected the error %q, got %q", tt.message, w.Body.String())
+			}
+		})
+	}
+}
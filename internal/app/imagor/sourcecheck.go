@@ -0,0 +1,76 @@
+package imagor
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+
+	i "github.com/cshum/imagor"
+	"github.com/cshum/imagor/imagorpath"
+)
+
+const (
+	// SourceCheckModTime treats cached results as stale if their source in
+	// blob storage was modified after they were stored
+	SourceCheckModTime = "modtime"
+	// SourceCheckMD5 treats cached results as stale if the MD5 of their source
+	// in blob storage differs from the one they were processed from. Unlike
+	// file modification times, it survives restores and copies of the volume.
+	SourceCheckMD5 = "md5"
+)
+
+// sourceHashSuffix is appended to the key of a result to store the MD5 of the
+// source it was processed from
+const sourceHashSuffix = ".source"
+
+func validSourceCheck(mode string) error {
+	switch mode {
+	case "", SourceCheckModTime, SourceCheckMD5:
+		return nil
+	}
+	return fmt.Errorf("unknown source check %q: must be %s or %s", mode, SourceCheckModTime, SourceCheckMD5)
+}
+
+// sourceChanged reports whether the blob storage source of a cached result has
+// changed since the result was stored. Sources fetched over HTTP can't be
+// checked, so they are never considered changed.
+func (s *resultStorage) sourceChanged(r *http.Request, key string) bool {
+	image := imagorpath.Parse(r.URL.EscapedPath()).Image
+	_, rec, err := s.sources.record(r.Context(), image)
+	if err != nil {
+		return false
+	}
+	switch s.sourceCheck {
+	case SourceCheckModTime:
+		result, err := s.Storage.Stat(r.Context(), key)
+		if err != nil {
+			return false
+		}
+		source, err := s.sources.Stat(r.Context(), image)
+		return err == nil && result.ModifiedTime.Before(source.ModifiedTime)
+	case SourceCheckMD5:
+		if rec.Hash == "" {
+			return false
+		}
+		blob, err := s.Storage.Get(r, key+sourceHashSuffix)
+		if err != nil {
+			return true
+		}
+		hash, err := blob.ReadAll()
+		// results stored before the check was enabled have no source hash
+		return err != nil || string(hash) != rec.Hash
+	}
+	return false
+}
+
+// saveSourceHash stores the MD5 of the blob storage source of a result that is
+// about to be processed, so sourceChanged can tell if it changes
+func (s *resultStorage) saveSourceHash(r *http.Request, key string) {
+	_, rec, err := s.sources.record(r.Context(), imagorpath.Parse(r.URL.EscapedPath()).Image)
+	if err != nil || rec.Hash == "" {
+		return
+	}
+	// the request may be canceled before the result is stored
+	ctx := context.WithoutCancel(r.Context())
+	_ = s.Storage.Put(ctx, key+sourceHashSuffix, i.NewBlobFromBytes([]byte(rec.Hash)))
+}
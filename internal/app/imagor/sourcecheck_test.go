@@ -0,0 +1,61 @@
+package imagor
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+
+	i "github.com/cshum/imagor"
+	"github.com/cshum/imagor/storage/filestorage"
+)
+
+func TestResultStorage_SourceCheck(t *testing.T) {
+	for _, mode := range []string{SourceCheckModTime, SourceCheckMD5} {
+		t.Run(mode, func(t *testing.T) {
+			dir := t.TempDir()
+			kv := newTestKeyVal(t, dir)
+			put := func(fill byte) { putTestPNG(t, kv, "image.png", fill) }
+			put(0)
+
+			s := &resultStorage{
+				Storage:     filestorage.New(filepath.Join(dir, "results")),
+				defaultTTL:  time.Hour,
+				sources:     NewBlobStorage(kv, filepath.Join(dir, "uploads")),
+				sourceCheck: mode,
+			}
+			get := func() string {
+				t.Helper()
+				r, outcome := withCacheOutcome(httptest.NewRequest(http.MethodGet, "/unsafe/100x100/blob/image.png", nil))
+				_, _ = s.Get(r, "result")
+				return outcome.get()
+			}
+			store := func() {
+				t.Helper()
+				if err := s.Put(context.Background(), "result", i.NewBlobFromBytes([]byte("result"))); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			if got := get(); got != CacheMiss {
+				t.Fatalf("expected %s before the result is stored, got %s", CacheMiss, got)
+			}
+			store()
+			if got := get(); got != CacheHit {
+				t.Fatalf("expected %s, got %s", CacheHit, got)
+			}
+			// modification times can be too coarse to order writes this close
+			time.Sleep(10 * time.Millisecond)
+			put(1)
+			if got := get(); got != CacheStale {
+				t.Errorf("expected %s after the source changed, got %s", CacheStale, got)
+			}
+			store()
+			if got := get(); got != CacheHit {
+				t.Errorf("expected %s after the result was processed again, got %s", CacheHit, got)
+			}
+		})
+	}
+}
@@ -0,0 +1,72 @@
+package imagor
+
+import (
+	"context"
+	"net/http"
+	"slices"
+	"strings"
+
+	i "github.com/cshum/imagor"
+	"github.com/cshum/imagor/imagorpath"
+	"github.com/cshum/imagor/vips"
+)
+
+var (
+	// ErrSVGNotAllowed is returned for SVG sources unless they are allowed
+	ErrSVGNotAllowed = i.NewError("svg sources are not allowed", http.StatusUnsupportedMediaType)
+	// ErrSVGTooLarge is returned for SVG sources that would rasterize to more
+	// than the max dimensions
+	ErrSVGTooLarge = i.NewError("svg source exceeds the max rasterization dimensions", http.StatusUnprocessableEntity)
+)
+
+// DefaultSVGMaxDimension caps the width and height SVG sources are rasterized
+// at when no cap is configured
+const DefaultSVGMaxDimension = 4096
+
+func isSVG(blob *i.Blob) bool {
+	return blob.BlobType() == i.BlobTypeSVG || strings.HasPrefix(blob.ContentType(), "image/svg+xml")
+}
+
+// rejectSVGLoader rejects SVG sources from HTTP before they are processed or
+// served as-is by raw()
+type rejectSVGLoader struct {
+	i.Loader
+}
+
+func (l rejectSVGLoader) Get(r *http.Request, image string) (*i.Blob, error) {
+	blob, err := l.Loader.Get(r, image)
+	if err == nil && isSVG(blob) {
+		return nil, ErrSVGNotAllowed
+	}
+	return blob, err
+}
+
+// svgProcessor bounds how large SVG sources are rasterized. Vector sources have
+// no natural output format, so without a format() filter, including the one
+// added by automatic WebP/AVIF negotiation, they are rasterized to PNG to keep
+// their transparency.
+type svgProcessor struct {
+	i.Processor
+	vips         *vips.Processor
+	maxDimension int
+}
+
+func (v *svgProcessor) Process(ctx context.Context, blob *i.Blob, p imagorpath.Params, load i.LoadFunc) (*i.Blob, error) {
+	if p.Meta || !isSVG(blob) {
+		return v.Processor.Process(ctx, blob, p, load)
+	}
+	img, err := v.vips.NewImage(ctx, blob, 1, 1, 0)
+	if err != nil {
+		return nil, err
+	}
+	width, height := img.Width(), img.PageHeight()
+	img.Close()
+	if width > v.maxDimension || height > v.maxDimension {
+		return nil, ErrSVGTooLarge
+	}
+	p.Width, p.Height = clampDimensions(p.Width, p.Height, v.maxDimension, v.maxDimension)
+	if !hasFilter(p.Filters, "format") {
+		p.Filters = append(slices.Clip(p.Filters), imagorpath.Filter{Name: "format", Args: "png"})
+	}
+	return v.Processor.Process(ctx, blob, p, load)
+}
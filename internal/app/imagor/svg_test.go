@@ -0,0 +1,83 @@
+package imagor
+
+import (
+	"context"
+	"testing"
+
+	i "github.com/cshum/imagor"
+	"github.com/cshum/imagor/imagorpath"
+	"github.com/cshum/imagor/vips"
+)
+
+var testSVG = []byte(`<svg xmlns="http://www.w3.org/2000/svg" width="100" height="100"><rect width="100" height="100"/></svg>`)
+
+func TestRejectSVGLoader(t *testing.T) {
+	png := append([]byte("\x89PNG\r\n\x1a\n"), make([]byte, 32)...)
+	remote := i.NewBlobFromBytes([]byte("<svg/>"))
+	remote.SetContentType("image/svg+xml")
+
+	tests := []struct {
+		name    string
+		blob    *i.Blob
+		wantErr error
+	}{
+		{"raster source", i.NewBlobFromBytes(png), nil},
+		{"svg source", i.NewBlobFromBytes(testSVG), ErrSVGNotAllowed},
+		{"svg content type", remote, ErrSVGNotAllowed},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := rejectSVGLoader{Loader: &fakeLoader{blob: tt.blob}}.Get(nil, "blob/image")
+			if err != tt.wantErr {
+				t.Errorf("expected error %v, got %v", tt.wantErr, err)
+			}
+		})
+	}
+}
+
+type paramsProcessor struct {
+	fakeProcessor
+	params imagorpath.Params
+}
+
+func (p *paramsProcessor) Process(ctx context.Context, blob *i.Blob, params imagorpath.Params, load i.LoadFunc) (*i.Blob, error) {
+	p.params = params
+	return p.fakeProcessor.Process(ctx, blob, params, load)
+}
+
+func TestSVGProcessor(t *testing.T) {
+	tests := []struct {
+		name       string
+		path       string
+		wantWidth  int
+		wantHeight int
+		wantFormat string
+	}{
+		{"rasterized to png", "100x50/blob/a.svg", 100, 50, "png"},
+		{"explicit format", "100x50/filters:format(webp)/blob/a.svg", 100, 50, "webp"},
+		{"capped dimensions", "fit-in/2000x500/blob/a.svg", 1024, 256, "png"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fake := &paramsProcessor{}
+			v := &svgProcessor{Processor: fake, vips: vips.NewProcessor(), maxDimension: 1024}
+			if _, err := v.Process(context.Background(), i.NewBlobFromBytes(testSVG), imagorpath.Parse(tt.path), nil); err != nil {
+				t.Fatal(err)
+			}
+			if fake.params.Width != tt.wantWidth || fake.params.Height != tt.wantHeight {
+				t.Errorf("expected %dx%d, got %dx%d", tt.wantWidth, tt.wantHeight, fake.params.Width, fake.params.Height)
+			}
+			format := ""
+			for _, f := range fake.params.Filters {
+				if f.Name == "format" {
+					format = f.Args
+				}
+			}
+			if format != tt.wantFormat {
+				t.Errorf("expected format %q, got %q", tt.wantFormat, format)
+			}
+		})
+	}
+}
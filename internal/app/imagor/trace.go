@@ -0,0 +1,34 @@
+package imagor
+
+import (
+	"context"
+
+	i "github.com/cshum/imagor"
+	"github.com/cshum/imagor/imagorpath"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+var tracer = otel.Tracer("github.com/jaredLunde/railway-image-service/internal/app/imagor")
+
+// tracedProcessor records a span for each image processed, whose parent is
+// the span of the request being served
+type tracedProcessor struct {
+	i.Processor
+}
+
+func (v *tracedProcessor) Process(ctx context.Context, blob *i.Blob, p imagorpath.Params, load i.LoadFunc) (*i.Blob, error) {
+	ctx, span := tracer.Start(ctx, "imagor.process", trace.WithAttributes(
+		attribute.String("imagor.image", p.Image),
+		attribute.String("imagor.path", p.Path),
+	))
+	defer span.End()
+	out, err := v.Processor.Process(ctx, blob, p, load)
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, "processing failed")
+	}
+	return out, err
+}
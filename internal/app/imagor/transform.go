@@ -0,0 +1,71 @@
+package imagor
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strings"
+
+	i "github.com/cshum/imagor"
+	"github.com/cshum/imagor/imagorpath"
+	"github.com/jaredLunde/railway-image-service/internal/app/keyval"
+)
+
+// ErrTransformNotAllowed is returned when an upload transform isn't in
+// UPLOAD_TRANSFORMS
+var ErrTransformNotAllowed = i.NewError("transform not allowed", http.StatusForbidden)
+
+// uploadImage stands in for the image of an upload transform, since the
+// transform itself has none
+const uploadImage = "upload"
+
+// parseUploadTransforms returns the set of allowed upload transforms, or nil
+// if any transform is allowed
+func parseUploadTransforms(transforms []string) map[string]bool {
+	allowed := map[string]bool{}
+	for _, t := range transforms {
+		t = strings.Trim(strings.TrimSpace(t), "/")
+		if t == "*" {
+			return nil
+		}
+		if t != "" {
+			allowed[t] = true
+		}
+	}
+	return allowed
+}
+
+// Transform processes an uploaded image with an image processing path without
+// the image, e.g. fit-in/2000x2000/filters:format(webp), for
+// keyval.KeyVal.TransformHandler. The transform must be allowed by
+// UploadTransforms and is subject to the same limits as /serve requests.
+func (s *Imagor) Transform(ctx context.Context, transform, srcPath string) ([]byte, error) {
+	transform = strings.Trim(transform, "/")
+	if s.uploadTransforms != nil && !s.uploadTransforms[transform] {
+		return nil, transformError(ErrTransformNotAllowed)
+	}
+	path := "unsafe/" + transform + "/" + uploadImage
+	p := imagorpath.Parse(path)
+	if p.Image != uploadImage || p.Meta {
+		return nil, transformError(i.ErrInvalid)
+	}
+	if s.maxFilters > 0 && countFilters(path) > s.maxFilters {
+		return nil, transformError(ErrTooManyFilters)
+	}
+	if s.allowedFormats != nil && hasRawFilter(path) {
+		return nil, transformError(ErrOutputFormatNotAllowed)
+	}
+	blob, err := s.Imagor.ServeBlob(ctx, i.NewBlobFromFile(srcPath), p)
+	if err != nil {
+		var ierr i.Error
+		if errors.As(err, &ierr) {
+			return nil, transformError(ierr)
+		}
+		return nil, err
+	}
+	return blob.ReadAll()
+}
+
+func transformError(err i.Error) error {
+	return &keyval.TransformError{Status: err.Code, Message: err.Message}
+}
@@ -0,0 +1,60 @@
+package imagor
+
+import (
+	"context"
+	"crypto/sha256"
+	"errors"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+
+	i "github.com/cshum/imagor"
+	"github.com/jaredLunde/railway-image-service/internal/app/keyval"
+)
+
+func TestImagor_Transform(t *testing.T) {
+	app := i.New(
+		i.WithProcessors(failingProcessor{}),
+		i.WithSigner(NewHMACSigner(sha256.New, 0, "secret")),
+	)
+	if err := app.Startup(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	s := &Imagor{
+		Imagor:           app,
+		maxFilters:       1,
+		uploadTransforms: parseUploadTransforms([]string{"/fit-in/100x100/", "fit-in/100x100/filters:quality(80):strip_exif()"}),
+	}
+
+	tests := []struct {
+		transform string
+		want      int
+	}{
+		// failingProcessor answers every transform that is allowed
+		{"fit-in/100x100", http.StatusTeapot},
+		{"/fit-in/100x100", http.StatusTeapot},
+		{"fit-in/200x200", http.StatusForbidden},
+		{"fit-in/100x100/filters:quality(80):strip_exif()", http.StatusBadRequest},
+	}
+	src := filepath.Join(t.TempDir(), "upload.png")
+	if err := os.WriteFile(src, []byte("\x89PNG\r\n\x1a\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	for _, tt := range tests {
+		t.Run(tt.transform, func(t *testing.T) {
+			_, err := s.Transform(context.Background(), tt.transform, src)
+			var terr *keyval.TransformError
+			if !errors.As(err, &terr) {
+				t.Fatalf("expected a transform error, got %v", err)
+			}
+			if terr.Status != tt.want {
+				t.Errorf("expected status %d, got %d", tt.want, terr.Status)
+			}
+		})
+	}
+
+	if parseUploadTransforms([]string{"fit-in/100x100", "*"}) != nil {
+		t.Error("expected * to allow any transform")
+	}
+}
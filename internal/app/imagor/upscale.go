@@ -0,0 +1,85 @@
+package imagor
+
+import (
+	"context"
+	"math"
+
+	i "github.com/cshum/imagor"
+	"github.com/cshum/imagor/imagorpath"
+	"github.com/cshum/imagor/vips"
+)
+
+// noUpscaleProcessor clamps the requested dimensions to the dimensions of the
+// source image, so small sources are never enlarged. An explicit upscale()
+// filter opts a request out. fit-in requests are left alone, since fit-in never
+// enlarges and clamping its box would shrink the result.
+type noUpscaleProcessor struct {
+	*vips.Processor
+}
+
+func (v *noUpscaleProcessor) Process(ctx context.Context, blob *i.Blob, p imagorpath.Params, load i.LoadFunc) (*i.Blob, error) {
+	if clampsDimensions(p) {
+		// vips loads lazily, so this only reads the image header
+		img, err := v.NewImage(ctx, blob, 1, 1, 0)
+		if err != nil {
+			return nil, err
+		}
+		srcWidth, srcHeight := img.Width(), img.PageHeight()
+		if img.Orientation() >= 5 {
+			// 90 and 270 degree orientations are swapped on auto-rotate
+			srcWidth, srcHeight = srcHeight, srcWidth
+		}
+		img.Close()
+		p.Width, p.Height = clampDimensions(p.Width, p.Height, srcWidth, srcHeight)
+	}
+	return v.Processor.Process(ctx, blob, p, load)
+}
+
+// clampsDimensions reports whether the requested dimensions of a request are
+// clamped to its source
+func clampsDimensions(p imagorpath.Params) bool {
+	return (p.Width > 0 || p.Height > 0) && !p.FitIn && !hasFilter(p.Filters, "upscale")
+}
+
+// clampDimensions scales the requested dimensions down, preserving their aspect
+// ratio, until neither exceeds the source dimensions. A zero dimension stays
+// zero, since it is derived from the other one.
+func clampDimensions(width, height, srcWidth, srcHeight int) (int, int) {
+	scale := 1.0
+	if width > srcWidth && srcWidth > 0 {
+		scale = min(scale, float64(srcWidth)/float64(width))
+	}
+	if height > srcHeight && srcHeight > 0 {
+		scale = min(scale, float64(srcHeight)/float64(height))
+	}
+	if scale == 1 {
+		return width, height
+	}
+	if width > 0 {
+		width = max(1, int(math.Round(float64(width)*scale)))
+	}
+	if height > 0 {
+		height = max(1, int(math.Round(float64(height)*scale)))
+	}
+	return width, height
+}
+
+// noUpscaleResultStorageHasher keeps results processed with clamped dimensions
+// apart from results cached before SERVE_NO_UPSCALE was enabled. The clamped
+// dimensions are fully determined by the source and the requested dimensions,
+// which are already part of the key.
+var noUpscaleResultStorageHasher = imagorpath.ResultStorageHasherFunc(func(p imagorpath.Params) string {
+	if p.Path == "" {
+		p.Path = imagorpath.GeneratePath(p)
+	}
+	return imagorpath.DigestResultStorageHasher.HashResult(imagorpath.Params{Path: p.Path + "#no_upscale"})
+})
+
+func hasFilter(filters imagorpath.Filters, name string) bool {
+	for _, f := range filters {
+		if f.Name == name {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,52 @@
+package imagor
+
+import (
+	"testing"
+
+	"github.com/cshum/imagor/imagorpath"
+)
+
+func TestClampDimensions(t *testing.T) {
+	tests := []struct {
+		name                string
+		width, height       int
+		srcWidth, srcHeight int
+		wantWidth           int
+		wantHeight          int
+	}{
+		{"smaller than source", 100, 50, 400, 300, 100, 50},
+		{"equal to source", 400, 300, 400, 300, 400, 300},
+		{"both larger", 800, 600, 400, 300, 400, 300},
+		{"width larger keeps aspect ratio", 800, 200, 400, 300, 400, 100},
+		{"height larger keeps aspect ratio", 200, 600, 400, 300, 100, 300},
+		{"width only", 1000, 0, 400, 300, 400, 0},
+		{"height only", 0, 1000, 400, 300, 0, 300},
+		{"unknown source", 800, 600, 0, 0, 800, 600},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w, h := clampDimensions(tt.width, tt.height, tt.srcWidth, tt.srcHeight)
+			if w != tt.wantWidth || h != tt.wantHeight {
+				t.Errorf("clampDimensions(%d, %d, %d, %d) = %d, %d, want %d, %d",
+					tt.width, tt.height, tt.srcWidth, tt.srcHeight, w, h, tt.wantWidth, tt.wantHeight)
+			}
+		})
+	}
+}
+
+func TestClampsDimensions(t *testing.T) {
+	tests := map[string]bool{
+		"800x600/a.png":                   true,
+		"0x600/a.png":                     true,
+		"a.png":                           false,
+		"fit-in/800x600/a.png":            false,
+		"800x600/filters:upscale()/a.png": false,
+		"fit-in/800x600/filters:fill(white)/a.png": false,
+	}
+	for path, want := range tests {
+		if got := clampsDimensions(imagorpath.Parse(path)); got != want {
+			t.Errorf("%s: expected %v, got %v", path, want, got)
+		}
+	}
+}
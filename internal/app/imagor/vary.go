@@ -0,0 +1,50 @@
+package imagor
+
+import (
+	"net/http"
+	"strings"
+)
+
+// varyResponseWriter merges additional values into the Vary header right
+// before the response headers are written.
+type varyResponseWriter struct {
+	http.ResponseWriter
+	vary        []string
+	wroteHeader bool
+}
+
+func (w *varyResponseWriter) WriteHeader(code int) {
+	if !w.wroteHeader {
+		w.wroteHeader = true
+		mergeVary(w.Header(), w.vary...)
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *varyResponseWriter) Write(b []byte) (int, error) {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+// mergeVary adds values to the Vary header of h, collapsing the header into a
+// single de-duplicated value.
+func mergeVary(h http.Header, values ...string) {
+	var merged []string
+	seen := map[string]bool{}
+	for _, v := range append(h.Values("Vary"), values...) {
+		for _, field := range strings.Split(v, ",") {
+			field = strings.TrimSpace(field)
+			key := strings.ToLower(field)
+			if field == "" || seen[key] {
+				continue
+			}
+			seen[key] = true
+			merged = append(merged, field)
+		}
+	}
+	if len(merged) > 0 {
+		h.Set("Vary", strings.Join(merged, ", "))
+	}
+}
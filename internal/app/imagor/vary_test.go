@@ -0,0 +1,51 @@
+package imagor
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestVaryResponseWriter(t *testing.T) {
+	tests := []struct {
+		name    string
+		handler http.HandlerFunc
+		want    string
+	}{
+		{
+			name: "no existing vary header",
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				w.Write([]byte("image"))
+			},
+			want: "Accept",
+		},
+		{
+			name: "auto format already set vary",
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Add("Vary", "Accept")
+				w.WriteHeader(http.StatusOK)
+			},
+			want: "Accept",
+		},
+		{
+			name: "merges with other values",
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Add("Vary", "Origin")
+				w.Header().Add("Vary", "accept")
+				w.WriteHeader(http.StatusNotFound)
+			},
+			want: "Origin, accept",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			w := &varyResponseWriter{ResponseWriter: rec, vary: []string{"Accept"}}
+			tt.handler(w, httptest.NewRequest(http.MethodGet, "/unsafe/blob/test.jpg", nil))
+			if got := rec.Header().Values("Vary"); len(got) != 1 || got[0] != tt.want {
+				t.Errorf("expected Vary %q, got %q", tt.want, got)
+			}
+		})
+	}
+}
@@ -0,0 +1,253 @@
+package imagor
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	i "github.com/cshum/imagor"
+	"github.com/cshum/imagor/imagorpath"
+)
+
+// MaxWarmResults is the max number of results, keys times transforms, a warm
+// job can process
+const MaxWarmResults = 10000
+
+// WarmRequest is the body of POST /serve/warm. Every transform is applied to
+// every key.
+type WarmRequest struct {
+	// Blob keys of the sources
+	Keys []string `json:"keys"`
+	// Image processing paths without the signature and image, e.g.
+	// "fit-in/640x0/filters:format(webp)". An empty transform warms the
+	// untransformed image.
+	Transforms []string `json:"transforms"`
+	// The Accept header the results are negotiated for, e.g. "image/avif" to
+	// warm the results automatic AVIF negotiation serves
+	Accept string `json:"accept,omitempty"`
+}
+
+type WarmStatus struct {
+	Running bool `json:"running"`
+	// Results to warm
+	Total int `json:"total"`
+	// Results that were processed and cached
+	Warmed int `json:"warmed"`
+	// Results that were already cached
+	Cached     int        `json:"cached"`
+	Failed     int        `json:"failed"`
+	StartedAt  *time.Time `json:"started_at,omitempty"`
+	FinishedAt *time.Time `json:"finished_at,omitempty"`
+	Error      string     `json:"error,omitempty"`
+}
+
+type warmJob struct {
+	mu     sync.Mutex
+	status WarmStatus
+}
+
+func (j *warmJob) update(fn func(s *WarmStatus)) {
+	j.mu.Lock()
+	fn(&j.status)
+	j.mu.Unlock()
+}
+
+func (j *warmJob) Status() WarmStatus {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return j.status
+}
+
+// warmPaths returns the image processing paths of a warm request
+func (s *Imagor) warmPaths(req WarmRequest) ([]string, error) {
+	if len(req.Keys) == 0 || len(req.Transforms) == 0 {
+		return nil, errors.New("keys and transforms are required")
+	}
+	if len(req.Keys)*len(req.Transforms) > MaxWarmResults {
+		return nil, fmt.Errorf("too many results, the max is %d", MaxWarmResults)
+	}
+	paths := make([]string, 0, len(req.Keys)*len(req.Transforms))
+	for _, key := range req.Keys {
+		clean, ok := s.blobs.KV.CleanKey([]byte(strings.TrimPrefix(key, "/")))
+		if !ok || len(clean) == 0 {
+			return nil, fmt.Errorf("invalid key %q", key)
+		}
+		image := "blob/" + string(clean)
+		for _, transform := range req.Transforms {
+			transform = strings.Trim(transform, "/")
+			path := image
+			if transform != "" {
+				path = transform + "/" + image
+			}
+			// the transform must not name an image of its own
+			if p := parseWarmPath(path); p.Image != image || p.Meta {
+				return nil, fmt.Errorf("invalid transform %q", transform)
+			}
+			paths = append(paths, path)
+		}
+	}
+	return paths, nil
+}
+
+// StartWarm processes the results of a warm request in the background, so
+// they are served from the result cache. It reports false if a warm job is
+// already running.
+func (s *Imagor) StartWarm(ctx context.Context, req WarmRequest) (WarmStatus, bool, error) {
+	paths, err := s.warmPaths(req)
+	if err != nil {
+		return WarmStatus{}, false, err
+	}
+	s.warm.mu.Lock()
+	defer s.warm.mu.Unlock()
+	if s.warm.status.Running {
+		return s.warm.status, false, nil
+	}
+	now := time.Now().UTC()
+	s.warm.status = WarmStatus{Running: true, Total: len(paths), StartedAt: &now}
+	go func() {
+		err := s.Warm(ctx, paths, req.Accept)
+		s.warm.update(func(st *WarmStatus) {
+			finished := time.Now().UTC()
+			st.Running = false
+			st.FinishedAt = &finished
+			if err != nil {
+				st.Error = err.Error()
+			}
+		})
+		status := s.warm.Status()
+		s.log.Info("warm finished", "total", status.Total, "warmed", status.Warmed, "cached", status.Cached, "failed", status.Failed, "error", err)
+	}()
+	return s.warm.status, true, nil
+}
+
+// WarmStatus returns the progress of the running or last warm job
+func (s *Imagor) WarmStatus() WarmStatus {
+	return s.warm.Status()
+}
+
+// Warm processes image processing paths into the result cache. It uses at
+// most half of the process concurrency, so requests keep being served, and
+// waits for room when the process queue is full.
+func (s *Imagor) Warm(ctx context.Context, paths []string, accept string) error {
+	workers := 1
+	if s.drain != nil {
+		workers = max(s.drain.concurrency/2, 1)
+	}
+	work := make(chan string)
+	var wg sync.WaitGroup
+	for range workers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for path := range work {
+				outcome, err := s.warmPath(ctx, path, accept)
+				s.warm.update(func(st *WarmStatus) {
+					switch {
+					case err != nil:
+						st.Failed++
+					case outcome == CacheHit:
+						st.Cached++
+					default:
+						st.Warmed++
+					}
+				})
+				if err != nil && ctx.Err() == nil {
+					s.log.Warn("failed to warm result", "path", path, "error", err)
+				}
+			}
+		}()
+	}
+	defer wg.Wait()
+	defer close(work)
+	for _, path := range paths {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case work <- path:
+		}
+	}
+	return nil
+}
+
+// parseWarmPath parses an image processing path without a signature
+func parseWarmPath(path string) imagorpath.Params {
+	// without a signature segment, a transform like 1920x1080 would be taken
+	// for one
+	p := imagorpath.Parse("unsafe/" + path)
+	p.Unsafe = false
+	return p
+}
+
+// warmPath processes a single result, returning its cache outcome
+func (s *Imagor) warmPath(ctx context.Context, path, accept string) (string, error) {
+	p := parseWarmPath(path)
+	if s.Imagor.Signer != nil {
+		p.Hash = s.Imagor.Signer.Sign(p.Path)
+	}
+	for {
+		r, err := http.NewRequestWithContext(ctx, http.MethodGet, "/", nil)
+		if err != nil {
+			return "", err
+		}
+		r.URL.Path = "/" + p.Hash + "/" + p.Path
+		if accept != "" {
+			r.Header.Set("Accept", accept)
+		}
+		r, outcome := withCacheOutcome(r)
+		_, err = s.Imagor.Do(r, p)
+		if !errors.Is(err, i.ErrTooManyRequests) {
+			return outcome.get(), err
+		}
+		wait := time.Second
+		if s.drain != nil {
+			wait = s.drain.retryAfter()
+		}
+		select {
+		case <-ctx.Done():
+			return "", ctx.Err()
+		case <-time.After(wait):
+		}
+	}
+}
+
+// WarmHandler starts a warm job from a JSON WarmRequest on POST and returns
+// the progress of the running or last warm job on GET
+func (s *Imagor) WarmHandler(ctx context.Context) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		writeStatus := func(code int, status WarmStatus) {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(code)
+			_ = json.NewEncoder(w).Encode(status)
+		}
+		switch r.Method {
+		case http.MethodGet:
+			writeStatus(http.StatusOK, s.WarmStatus())
+
+		case http.MethodPost:
+			var req WarmRequest
+			if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<20)).Decode(&req); err != nil {
+				http.Error(w, "invalid request body", http.StatusBadRequest)
+				return
+			}
+			status, started, err := s.StartWarm(ctx, req)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			if !started {
+				writeStatus(http.StatusConflict, status)
+				return
+			}
+			s.log.Info("started warm", "total", status.Total)
+			writeStatus(http.StatusAccepted, status)
+
+		default:
+			w.WriteHeader(http.StatusMethodNotAllowed)
+		}
+	})
+}
@@ -0,0 +1,79 @@
+package imagor
+
+import (
+	"context"
+	"crypto/sha256"
+	"io"
+	"log/slog"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	i "github.com/cshum/imagor"
+	"github.com/cshum/imagor/imagorpath"
+	"github.com/cshum/imagor/storage/filestorage"
+)
+
+type countingProcessor struct {
+	processed atomic.Int32
+}
+
+func (p *countingProcessor) Startup(context.Context) error  { return nil }
+func (p *countingProcessor) Shutdown(context.Context) error { return nil }
+func (p *countingProcessor) Process(_ context.Context, blob *i.Blob, _ imagorpath.Params, _ i.LoadFunc) (*i.Blob, error) {
+	p.processed.Add(1)
+	return blob, nil
+}
+
+func TestImagor_Warm(t *testing.T) {
+	dir := t.TempDir()
+	kv := newTestKeyVal(t, dir)
+	putTestPNG(t, kv, "image.png", 7)
+
+	processor := &countingProcessor{}
+	blobs := NewBlobStorage(kv, filepath.Join(dir, "uploads"))
+	app := i.New(
+		i.WithLoaders(blobs),
+		i.WithProcessors(processor),
+		i.WithSigner(NewHMACSigner(sha256.New, 0, "secret")),
+		i.WithResultStorages(&resultStorage{Storage: filestorage.New(filepath.Join(dir, "results")), defaultTTL: time.Hour}),
+		i.WithResultStoragePathStyle(withoutNoCache(imagorpath.DigestResultStorageHasher)),
+	)
+	if err := app.Startup(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	s := &Imagor{Imagor: app, blobs: blobs, log: slog.New(slog.NewTextHandler(io.Discard, nil))}
+
+	if _, _, err := s.StartWarm(context.Background(), WarmRequest{Keys: []string{"image.png"}, Transforms: []string{"1920x1080/blob/other.png"}}); err == nil {
+		t.Error("expected a transform naming an image to be rejected")
+	}
+
+	req := WarmRequest{Keys: []string{"image.png", "missing.png"}, Transforms: []string{"1920x1080", "fit-in/100x100"}}
+	wait := func() WarmStatus {
+		t.Helper()
+		if _, started, err := s.StartWarm(context.Background(), req); err != nil || !started {
+			t.Fatalf("expected the warm job to start, got %v %v", started, err)
+		}
+		for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+			if status := s.WarmStatus(); !status.Running {
+				return status
+			}
+		}
+		t.Fatal("warm job did not finish")
+		return WarmStatus{}
+	}
+
+	if status := wait(); status.Total != 4 || status.Warmed != 2 || status.Cached != 0 || status.Failed != 2 {
+		t.Errorf("unexpected status of the first warm job: %+v", status)
+	}
+	if n := processor.processed.Load(); n != 2 {
+		t.Errorf("expected 2 results to be processed, got %d", n)
+	}
+	if status := wait(); status.Warmed != 0 || status.Cached != 2 || status.Failed != 2 {
+		t.Errorf("expected warmed results to be cached, got %+v", status)
+	}
+	if n := processor.processed.Load(); n != 2 {
+		t.Errorf("expected cached results not to be processed again, got %d", n)
+	}
+}
@@ -0,0 +1,179 @@
+package keyval
+
+import (
+	"container/heap"
+	"context"
+	"encoding/binary"
+	"math"
+	"math/rand"
+	"strconv"
+	"sync"
+
+	"github.com/gofiber/fiber/v3"
+	"github.com/jaredLunde/railway-image-service/internal/pkg/httperr"
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/util"
+)
+
+var accessPrefix = []byte(internalKeyPrefix + "stats/access/")
+
+const (
+	// DefaultPopularLimit is the number of keys /admin/popular returns without
+	// a limit
+	DefaultPopularLimit = 100
+	// MaxPopularLimit is the max number of keys /admin/popular returns
+	MaxPopularLimit = 1000
+)
+
+// accessCounter buffers sampled reads in memory until they are flushed, so
+// reads don't each cost a write
+type accessCounter struct {
+	mu      sync.Mutex
+	pending map[string]uint64
+	// serializes flushes, which read and then write the stored counts
+	flushMu sync.Mutex
+}
+
+// CountsAccess reports whether reads are counted. Replicas can't write their
+// counts, so they don't count reads.
+func (k *KeyVal) CountsAccess() bool {
+	return k.accessSampleRate > 0 && !k.replica
+}
+
+// RecordAccess counts a read of a key if it is sampled. Each sample counts
+// for the reads it stands in for, so stored counts are estimates.
+func (k *KeyVal) RecordAccess(key []byte) {
+	if !k.CountsAccess() {
+		return
+	}
+	if k.accessSampleRate < 1 && rand.Float64() >= k.accessSampleRate {
+		return
+	}
+	weight := uint64(math.Round(1 / k.accessSampleRate))
+	k.access.mu.Lock()
+	if k.access.pending == nil {
+		k.access.pending = map[string]uint64{}
+	}
+	k.access.pending[string(key)] += max(weight, 1)
+	k.access.mu.Unlock()
+}
+
+// FlushAccess adds the reads counted since the last flush to the counts
+// stored in LevelDB
+func (k *KeyVal) FlushAccess() (int, error) {
+	k.access.flushMu.Lock()
+	defer k.access.flushMu.Unlock()
+	k.access.mu.Lock()
+	pending := k.access.pending
+	k.access.pending = nil
+	k.access.mu.Unlock()
+	if len(pending) == 0 {
+		return 0, nil
+	}
+
+	db, release := k.database()
+	defer release()
+	batch := new(leveldb.Batch)
+	for key, n := range pending {
+		dbKey := k.dbKey(append(append([]byte{}, accessPrefix...), key...))
+		v, err := db.Get(dbKey, nil)
+		if err != nil && err != leveldb.ErrNotFound {
+			return 0, err
+		}
+		if len(v) == 8 {
+			n += binary.BigEndian.Uint64(v)
+		}
+		value := make([]byte, 8)
+		binary.BigEndian.PutUint64(value, n)
+		batch.Put(dbKey, value)
+	}
+	return batch.Len(), db.Write(batch, nil)
+}
+
+// forgetAccess drops the counted reads of a key whose file was deleted, so a
+// new file at the key starts from zero
+func (k *KeyVal) forgetAccess(key []byte) error {
+	k.access.flushMu.Lock()
+	defer k.access.flushMu.Unlock()
+	k.access.mu.Lock()
+	delete(k.access.pending, string(key))
+	k.access.mu.Unlock()
+	db, release := k.database()
+	defer release()
+	return db.Delete(k.dbKey(append(append([]byte{}, accessPrefix...), key...)), nil)
+}
+
+// KeyAccess is the estimated number of reads of a key
+type KeyAccess struct {
+	Key   string `json:"key"`
+	Count uint64 `json:"count"`
+}
+
+type accessHeap []KeyAccess
+
+func (h accessHeap) Len() int           { return len(h) }
+func (h accessHeap) Less(i, j int) bool { return h[i].Count < h[j].Count }
+func (h accessHeap) Swap(i, j int)      { h[i], h[j] = h[j], h[i] }
+func (h *accessHeap) Push(x any)        { *h = append(*h, x.(KeyAccess)) }
+func (h *accessHeap) Pop() any {
+	old := *h
+	x := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return x
+}
+
+// Popular returns up to limit live keys with the most flushed reads, most
+// read first
+func (k *KeyVal) Popular(ctx context.Context, limit int) ([]KeyAccess, error) {
+	prefix := k.dbKey(accessPrefix)
+	db, release := k.database()
+	defer release()
+	iter := db.NewIterator(util.BytesPrefix(prefix), nil)
+	defer iter.Release()
+	h := make(accessHeap, 0, limit)
+	for iter.Next() {
+		v := iter.Value()
+		if len(v) != 8 {
+			continue
+		}
+		n := binary.BigEndian.Uint64(v)
+		if len(h) == limit && n <= h[0].Count {
+			continue
+		}
+		key := iter.Key()[len(prefix):]
+		if k.GetRecord(ctx, key).Deleted != NO {
+			continue
+		}
+		heap.Push(&h, KeyAccess{Key: string(key), Count: n})
+		if len(h) > limit {
+			heap.Pop(&h)
+		}
+	}
+	if err := iter.Error(); err != nil {
+		return nil, err
+	}
+	popular := make([]KeyAccess, len(h))
+	for i := len(h) - 1; i >= 0; i-- {
+		popular[i] = heap.Pop(&h).(KeyAccess)
+	}
+	return popular, nil
+}
+
+// PopularHandler lists the most read keys, up to the limit query parameter.
+// Reads that haven't been flushed yet aren't counted.
+func (k *KeyVal) PopularHandler(c fiber.Ctx) error {
+	limit := DefaultPopularLimit
+	if l := c.Query("limit"); l != "" {
+		n, err := strconv.Atoi(l)
+		if err != nil || n < 1 || n > MaxPopularLimit {
+			return httperr.SendMessage(c, fiber.StatusBadRequest, "limit must be between 1 and "+strconv.Itoa(MaxPopularLimit))
+		}
+		limit = n
+	}
+	popular, err := k.Popular(c.Context(), limit)
+	if err != nil {
+		k.log.Error("failed to list popular keys", "error", err)
+		return httperr.SendStatus(c, fiber.StatusInternalServerError)
+	}
+	return c.JSON(popular)
+}
@@ -0,0 +1,183 @@
+package keyval
+
+import (
+	"context"
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// BlobBackend stores the files of records. Paths are slash-separated and
+// start with a slash, e.g. "/6b/65/6b6579". Get and Stat return an error
+// matching fs.ErrNotExist for files that don't exist.
+type BlobBackend interface {
+	// Put stores size bytes from r at path, replacing any file there
+	Put(ctx context.Context, path string, r io.Reader, size int64) error
+	Get(ctx context.Context, path string) (io.ReadCloser, error)
+	// GetRange reads length bytes of the file at path from offset, or the rest
+	// of it if length < 0
+	GetRange(ctx context.Context, path string, offset, length int64) (io.ReadCloser, error)
+	// Delete removes the file at path. Deleting a missing file isn't an error.
+	Delete(ctx context.Context, path string) error
+	Stat(ctx context.Context, path string) (BlobInfo, error)
+	// List calls fn with every file whose path starts with prefix
+	List(ctx context.Context, prefix string, fn func(BlobInfo) error) error
+}
+
+// BlobInfo describes a stored file
+type BlobInfo struct {
+	Path    string
+	Size    int64
+	ModTime time.Time
+}
+
+const (
+	StorageBackendLocal = "local"
+	StorageBackendS3    = "s3"
+)
+
+// LocalBackend stores files in a directory on disk, e.g. a volume
+type LocalBackend struct {
+	Root string
+	// Sync files to disk before they are renamed into place
+	Fsync bool
+}
+
+func NewLocalBackend(root string) *LocalBackend {
+	return &LocalBackend{Root: root}
+}
+
+// FilePath returns the location of a file on disk
+func (b *LocalBackend) FilePath(p string) string {
+	return filepath.Join(b.Root, filepath.FromSlash(p))
+}
+
+// Put writes r to a temporary file next to path and renames it into place
+func (b *LocalBackend) Put(_ context.Context, p string, r io.Reader, size int64) error {
+	fp := b.FilePath(p)
+	if err := os.MkdirAll(filepath.Dir(fp), 0755); err != nil {
+		return err
+	}
+	f, err := os.CreateTemp(filepath.Dir(fp), tempFilePattern)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+	written, err := io.Copy(f, r)
+	if err != nil {
+		return err
+	}
+	if size >= 0 && written != size {
+		return io.ErrUnexpectedEOF
+	}
+	if b.Fsync {
+		if err := f.Sync(); err != nil {
+			return err
+		}
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return b.rename(f.Name(), p)
+}
+
+// rename moves a complete file on the same filesystem into place at path
+func (b *LocalBackend) rename(src, p string) error {
+	return os.Rename(src, b.FilePath(p))
+}
+
+func (b *LocalBackend) Get(_ context.Context, p string) (io.ReadCloser, error) {
+	return os.Open(b.FilePath(p))
+}
+
+func (b *LocalBackend) GetRange(_ context.Context, p string, offset, length int64) (io.ReadCloser, error) {
+	f, err := os.Open(b.FilePath(p))
+	if err != nil {
+		return nil, err
+	}
+	if _, err := f.Seek(offset, io.SeekStart); err != nil {
+		f.Close()
+		return nil, err
+	}
+	if length < 0 {
+		return f, nil
+	}
+	return struct {
+		io.Reader
+		io.Closer
+	}{io.LimitReader(f, length), f}, nil
+}
+
+func (b *LocalBackend) Delete(_ context.Context, p string) error {
+	if err := os.Remove(b.FilePath(p)); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	return nil
+}
+
+func (b *LocalBackend) Stat(_ context.Context, p string) (BlobInfo, error) {
+	stat, err := os.Stat(b.FilePath(p))
+	if err != nil {
+		return BlobInfo{}, err
+	}
+	return BlobInfo{Path: p, Size: stat.Size(), ModTime: stat.ModTime()}, nil
+}
+
+// List walks the directory, including the temporary files of uploads in
+// progress
+func (b *LocalBackend) List(ctx context.Context, prefix string, fn func(BlobInfo) error) error {
+	return filepath.WalkDir(b.Root, func(fp string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if !d.Type().IsRegular() {
+			return nil
+		}
+		rel, err := filepath.Rel(b.Root, fp)
+		if err != nil {
+			return err
+		}
+		p := path.Join("/", filepath.ToSlash(rel))
+		if !strings.HasPrefix(p, prefix) {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		return fn(BlobInfo{Path: p, Size: info.Size(), ModTime: info.ModTime()})
+	})
+}
+
+// commit stores a complete temporary file at path in the backend. Local
+// backends rename it into place, so it must be on the same filesystem.
+func (k *KeyVal) commit(ctx context.Context, tmpPath, p string) error {
+	if k.local != nil {
+		return k.local.rename(tmpPath, p)
+	}
+	f, err := os.Open(tmpPath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	stat, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	return k.backend.Put(ctx, p, f, stat.Size())
+}
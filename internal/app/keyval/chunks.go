@@ -0,0 +1,100 @@
+package keyval
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"hash"
+
+	"github.com/gofiber/fiber/v3"
+	"github.com/jaredLunde/railway-image-service/internal/pkg/httperr"
+)
+
+// ChunkHashes are the SHA-256 hashes of consecutive, fixed-size chunks of a
+// file's content, so corruption can be localized to a range of the file. The
+// last chunk may be shorter.
+type ChunkHashes struct {
+	Size      int64    `json:"size"`
+	ChunkSize int      `json:"chunk_size"`
+	Hashes    []string `json:"hashes"`
+}
+
+// chunkHasher hashes the content written to it in chunks of size bytes
+type chunkHasher struct {
+	size    int
+	h       hash.Hash
+	n       int
+	written int64
+	hashes  []string
+}
+
+func newChunkHasher(size int) *chunkHasher {
+	return &chunkHasher{size: size, h: sha256.New()}
+}
+
+func (c *chunkHasher) Write(p []byte) (int, error) {
+	total := len(p)
+	for len(p) > 0 {
+		m := min(len(p), c.size-c.n)
+		c.h.Write(p[:m])
+		c.n += m
+		p = p[m:]
+		if c.n == c.size {
+			c.flush()
+		}
+	}
+	c.written += int64(total)
+	return total, nil
+}
+
+func (c *chunkHasher) flush() {
+	c.hashes = append(c.hashes, hex.EncodeToString(c.h.Sum(nil)))
+	c.h.Reset()
+	c.n = 0
+}
+
+// Sum returns the hashes of all chunks written, including a final partial one
+func (c *chunkHasher) Sum() *ChunkHashes {
+	if c.n > 0 {
+		c.flush()
+	}
+	return &ChunkHashes{Size: c.written, ChunkSize: c.size, Hashes: c.hashes}
+}
+
+type Chunk struct {
+	Offset int64  `json:"offset"`
+	Length int64  `json:"length"`
+	Hash   string `json:"hash"`
+}
+
+type ChunkHashesResponse struct {
+	Size      int64 `json:"size"`
+	ChunkSize int   `json:"chunk_size"`
+	// The SHA-256 of the concatenated hex chunk hashes
+	Root   string  `json:"root"`
+	Chunks []Chunk `json:"chunks"`
+}
+
+// sendChunkHashes responds with the chunk hashes of a record and the byte range
+// each of them covers, which can be re-fetched with a Range request
+func (k *KeyVal) sendChunkHashes(c fiber.Ctx, rec Record) error {
+	if rec.Chunks == nil {
+		return httperr.SendMessage(c, fiber.StatusNotFound, "no chunk hashes")
+	}
+	res := ChunkHashesResponse{
+		Size:      rec.Chunks.Size,
+		ChunkSize: rec.Chunks.ChunkSize,
+		Chunks:    make([]Chunk, len(rec.Chunks.Hashes)),
+	}
+	root := sha256.New()
+	for n, h := range rec.Chunks.Hashes {
+		offset := int64(n) * int64(rec.Chunks.ChunkSize)
+		res.Chunks[n] = Chunk{
+			Offset: offset,
+			Length: min(int64(rec.Chunks.ChunkSize), rec.Chunks.Size-offset),
+			Hash:   h,
+		}
+		root.Write([]byte(h))
+	}
+	res.Root = hex.EncodeToString(root.Sum(nil))
+	return c.JSON(res)
+}
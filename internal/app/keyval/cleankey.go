@@ -0,0 +1,63 @@
+package keyval
+
+import (
+	"bytes"
+	"net/url"
+	"strings"
+
+	"github.com/gofiber/fiber/v3"
+)
+
+// cleanKey collapses duplicate slashes and resolves "." segments of a key, so
+// the same logical key always maps to the same record and file. Leading
+// slashes are removed and a trailing slash is kept. Keys with ".." segments
+// are rejected rather than resolved.
+func cleanKey(key string) (string, bool) {
+	segments := strings.Split(key, "/")
+	cleaned := make([]string, 0, len(segments))
+	for _, seg := range segments {
+		switch seg {
+		case "..":
+			return "", false
+		case ".", "":
+			continue
+		}
+		cleaned = append(cleaned, seg)
+	}
+	if len(cleaned) > 0 && strings.HasSuffix(key, "/") {
+		cleaned = append(cleaned, "")
+	}
+	return strings.Join(cleaned, "/"), true
+}
+
+// CleanKey cleans a key if CleanKeys is enabled, reporting false for keys that
+// are rejected. Otherwise the key is returned as-is.
+func (k *KeyVal) CleanKey(key []byte) ([]byte, bool) {
+	if !k.cleanKeys {
+		return key, true
+	}
+	cleaned, ok := cleanKey(string(key))
+	return []byte(cleaned), ok
+}
+
+// requestKey returns the key a request path refers to, reporting false for
+// paths that can't be decoded or keys that are rejected. The path is
+// percent-decoded exactly once, so "a%20b.png" is the key "a b.png" and
+// "a%2520b.png" is the key "a%20b.png". "+" is a literal plus, as in any URL
+// path. Signatures of /blob URLs cover the same decoded path.
+func (k *KeyVal) requestKey(c fiber.Ctx) ([]byte, bool) {
+	var key []byte
+	if k.cleanKeys {
+		// the request path, before fasthttp resolves ".." segments
+		raw, err := url.PathUnescape(c.Path())
+		if err != nil {
+			return nil, false
+		}
+		key = []byte(strings.TrimPrefix(raw, k.basePath))
+	} else {
+		// fasthttp has already decoded and normalized the path
+		key = bytes.Replace(c.Request().URI().Path(), []byte(k.basePath), []byte(""), 1)
+	}
+	key = bytes.TrimPrefix(key, []byte("/"))
+	return k.CleanKey(key)
+}
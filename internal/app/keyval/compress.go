@@ -0,0 +1,141 @@
+package keyval
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"io"
+	"strconv"
+	"strings"
+
+	"github.com/gabriel-vasile/mimetype"
+	"github.com/gofiber/fiber/v3"
+	"github.com/jaredLunde/railway-image-service/internal/pkg/httperr"
+)
+
+const CompressionGzip = "gzip"
+
+// isCompressible reports whether a content type is worth compressing at rest.
+// Image formats are excluded, since most of them are compressed already and
+// they are read by the image processor.
+func isCompressible(contentType string) bool {
+	mediaType, _, _ := strings.Cut(contentType, ";")
+	switch {
+	case strings.HasPrefix(mediaType, "image/"):
+		return false
+	case strings.HasPrefix(mediaType, "text/"),
+		strings.HasSuffix(mediaType, "+json"),
+		strings.HasSuffix(mediaType, "+xml"):
+		return true
+	}
+	switch mediaType {
+	case "application/json", "application/xml", "application/javascript",
+		"application/x-ndjson", "application/wasm":
+		return true
+	}
+	return false
+}
+
+// Open returns a reader for the original, uncompressed content of a file
+func (k *KeyVal) Open(key []byte, rec Record) (io.ReadCloser, error) {
+	f, err := k.backend.Get(context.Background(), blobPath(key, rec))
+	if err != nil {
+		return nil, err
+	}
+	if rec.Compression != CompressionGzip {
+		return f, nil
+	}
+	gz, err := gzip.NewReader(f)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return &gzipReadCloser{Reader: gz, file: f}, nil
+}
+
+type gzipReadCloser struct {
+	*gzip.Reader
+	file io.Closer
+}
+
+func (r *gzipReadCloser) Close() error {
+	r.Reader.Close()
+	return r.file.Close()
+}
+
+// sendCompressed serves a file that is compressed at rest. Clients that accept
+// gzip get the stored bytes as-is, everyone else gets them decompressed. Ranges
+// are of the bytes that are sent, so they are only supported for decompressed
+// content whose size is stored in its record.
+func (k *KeyVal) sendCompressed(c fiber.Ctx, p string, info BlobInfo, rec Record) error {
+	c.Vary(fiber.HeaderAcceptEncoding)
+	if c.Get(fiber.HeaderRange) != "" && !ifRange(c, "", info.ModTime) {
+		c.Request().Header.Del(fiber.HeaderRange)
+	}
+	// the size of the content is only known for records that store it
+	sized := rec.ContentType != ""
+
+	f, err := k.openDownload(p)
+	if err != nil {
+		return k.sendOpenError(c, err)
+	}
+	gz, err := gzip.NewReader(f)
+	if err != nil {
+		f.Close()
+		k.log.Error("failed to read compressed file", "error", err)
+		return httperr.SendStatus(c, fiber.StatusInternalServerError)
+	}
+	var head []byte
+	if sized {
+		c.Set(fiber.HeaderContentType, rec.ContentType)
+	} else {
+		// sniff the content type of the original content
+		head = make([]byte, k.mimeSniffBytes)
+		n, _ := io.ReadFull(gz, head)
+		head = head[:n]
+		c.Set(fiber.HeaderContentType, mimetype.Detect(head).String())
+	}
+	c.Status(fiber.StatusOK)
+
+	// a missing Accept-Encoding header accepts anything, but only clients that
+	// explicitly ask for it should get compressed bytes
+	if c.Get(fiber.HeaderAcceptEncoding) != "" && c.AcceptsEncodings(rec.Compression) == rec.Compression {
+		gz.Close()
+		c.Set(fiber.HeaderContentEncoding, rec.Compression)
+		if c.Method() == fiber.MethodHead {
+			c.Set(fiber.HeaderAcceptRanges, "bytes")
+			c.Set(fiber.HeaderContentLength, strconv.FormatInt(info.Size, 10))
+			return f.Close()
+		}
+		// the stored bytes are sent from the start
+		f.Close()
+		if f, err = k.openDownload(p); err != nil {
+			return k.sendOpenError(c, err)
+		}
+		return k.sendRange(c, f, info.Size, func(offset int64) (io.Reader, error) {
+			return f.seek(f, offset)
+		}, k.downloadRateLimit(c))
+	}
+
+	body := &gzipReadCloser{Reader: gz, file: f}
+	if c.Method() == fiber.MethodHead {
+		if sized {
+			c.Set(fiber.HeaderAcceptRanges, "bytes")
+			c.Set(fiber.HeaderContentLength, strconv.FormatInt(rec.Size, 10))
+		}
+		return body.Close()
+	}
+	if sized {
+		return k.sendRange(c, body, rec.Size, func(offset int64) (io.Reader, error) {
+			_, err := io.CopyN(io.Discard, gz, offset)
+			return gz, err
+		}, k.downloadRateLimit(c))
+	}
+	return c.SendStream(throttled(struct {
+		io.Reader
+		io.Closer
+	}{
+		Reader: io.MultiReader(bytes.NewReader(head), gz),
+		Closer: body,
+	}, k.downloadRateLimit(c)))
+}
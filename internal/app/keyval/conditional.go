@@ -0,0 +1,37 @@
+package keyval
+
+import (
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v3"
+)
+
+// etag returns the strong entity tag of a record, derived from its MD5 hash
+func etag(rec Record) string {
+	if rec.Hash == "" {
+		return ""
+	}
+	return `"` + rec.Hash + `"`
+}
+
+// ifRange reports whether the Range header of a request may be honored. It is
+// false when an If-Range precondition no longer matches the stored entity, in
+// which case the full entity has to be sent instead of the partial content.
+func ifRange(c fiber.Ctx, etag string, modTime time.Time) bool {
+	cond := c.Get(fiber.HeaderIfRange)
+	if cond == "" {
+		return true
+	}
+	if strings.HasPrefix(cond, `"`) || strings.HasPrefix(cond, "W/") {
+		// If-Range requires a strong comparison, so weak tags never match
+		return etag != "" && cond == etag
+	}
+	t, err := http.ParseTime(cond)
+	if err != nil {
+		return false
+	}
+	// Last-Modified only has second precision
+	return modTime.Truncate(time.Second).Equal(t)
+}
@@ -0,0 +1,101 @@
+package keyval
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"net/url"
+	"os"
+
+	"github.com/gabriel-vasile/mimetype"
+	"github.com/gofiber/fiber/v3"
+	"github.com/jaredLunde/railway-image-service/internal/pkg/httperr"
+	"github.com/jaredLunde/railway-image-service/internal/pkg/throttle"
+)
+
+const KeyStrategyContentHash = "content-hash"
+
+type CreateResponse struct {
+	Key string `json:"key"`
+}
+
+// CreateHandler stores an upload under a key assigned by the server. With the
+// content-hash strategy, the key is the SHA-256 of the content plus the file
+// extension of its type, so identical uploads always end up under the same key.
+func (k *KeyVal) CreateHandler(c fiber.Ctx) error {
+	if strategy := c.Query("key_strategy", KeyStrategyContentHash); strategy != KeyStrategyContentHash {
+		return httperr.SendMessage(c, fiber.StatusBadRequest, "unsupported key strategy")
+	}
+
+	// The key depends on the content, so the upload is spooled to a temporary
+	// file first
+	if err := os.MkdirAll(k.spoolDir(), 0755); err != nil {
+		k.log.Error("failed to create directory", "error", err)
+		return httperr.SendStatus(c, fiber.StatusInternalServerError)
+	}
+	tmpFile, err := k.createTemp(k.spoolDir())
+	if err != nil {
+		k.log.Error("failed to create temp file", "error", err)
+		return httperr.SendStatus(c, fiber.StatusInternalServerError)
+	}
+	defer os.Remove(tmpFile.Name())
+	defer tmpFile.Close()
+
+	h := sha256.New()
+	written, err := io.Copy(io.MultiWriter(tmpFile, h), io.LimitReader(k.uploadBody(c), int64(k.maxFileSize+1)))
+	if errors.Is(err, throttle.ErrIdleTimeout) {
+		return httperr.SendStatus(c, fiber.StatusRequestTimeout)
+	}
+	if err != nil {
+		k.log.Error("failed to write upload", "error", err)
+		return httperr.SendMessage(c, fiber.StatusBadRequest, "failed to read upload")
+	}
+	if written == 0 && !k.allowEmptyFiles {
+		return httperr.SendMessage(c, fiber.StatusBadRequest, "empty upload")
+	}
+	if written > int64(k.maxFileSize) {
+		return httperr.SendStatus(c, fiber.StatusRequestEntityTooLarge)
+	}
+	if _, err := tmpFile.Seek(0, io.SeekStart); err != nil {
+		k.log.Error("failed to seek temp file", "error", err)
+		return httperr.SendStatus(c, fiber.StatusInternalServerError)
+	}
+	key := []byte(hex.EncodeToString(h.Sum(nil)))
+	if written > 0 {
+		mtype, err := mimetype.DetectReader(io.LimitReader(tmpFile, int64(k.mimeSniffBytes)))
+		if err != nil {
+			k.log.Error("failed to read temp file", "error", err)
+			return httperr.SendStatus(c, fiber.StatusInternalServerError)
+		}
+		if _, err := tmpFile.Seek(0, io.SeekStart); err != nil {
+			k.log.Error("failed to seek temp file", "error", err)
+			return httperr.SendStatus(c, fiber.StatusInternalServerError)
+		}
+		key = append(key, mtype.Extension()...)
+	}
+	location, err := url.JoinPath(k.basePath, string(key))
+	if err != nil {
+		return httperr.SendStatus(c, fiber.StatusInternalServerError)
+	}
+	c.Set(fiber.HeaderLocation, location)
+
+	if !k.LockKey(key) {
+		return sendKeyLocked(c)
+	}
+	defer k.UnlockKey(key)
+
+	// Identical content was uploaded before
+	if k.GetRecord(c.Context(), key).Deleted == NO {
+		return c.Status(fiber.StatusOK).JSON(CreateResponse{Key: string(key)})
+	}
+
+	status := k.Write(c.Context(), key, tmpFile, int(written), WriteOptions{
+		Filename:    uploadFilename(c.Get(fiber.HeaderContentDisposition)),
+		ContentType: c.Get(fiber.HeaderContentType),
+	})
+	if status != fiber.StatusCreated {
+		return sendWriteStatus(c, status)
+	}
+	return c.Status(fiber.StatusCreated).JSON(CreateResponse{Key: string(key)})
+}
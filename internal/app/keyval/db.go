@@ -2,8 +2,10 @@ package keyval
 
 import (
 	"encoding/hex"
+	"encoding/json"
 	"fmt"
 	"strings"
+	"time"
 )
 
 const (
@@ -13,36 +15,130 @@ const (
 )
 
 type Record struct {
-	Deleted int
-	Hash    string
+	Deleted  int
+	Hash     string
+	Filename string
+	// The compression of the stored file, if any. Hash is always the hash of
+	// the uncompressed content.
+	Compression string
+	// The path of the file relative to the volume. Empty for files laid out
+	// with KeyToPath.
+	Path string
+	// The hashes of the chunks of the uncompressed content, if enabled
+	Chunks *ChunkHashes
+	// The color of images as #rrggbb, if enabled
+	DominantColor string
+	// The detected content type and the size of the content, before any
+	// compression at rest. Empty and 0 for empty files and records stored
+	// before they were tracked.
+	ContentType string
+	Size        int64
+	// When the key was first uploaded, and when its content was last written.
+	// Zero for records stored before they were tracked.
+	CreatedAt  time.Time
+	ModifiedAt time.Time
+	// When the record was soft deleted. Zero for live records and records
+	// that were soft deleted before it was stored.
+	DeletedAt time.Time
 }
 
-func toRecord(data []byte) Record {
+// recordVersion1 is the first byte of records encoded as JSON. Legacy records
+// are plain strings starting with "DELETED", "HASH" or nothing at all, so they
+// can never start with a version byte.
+const recordVersion1 byte = 0x01
+
+type recordV1 struct {
+	Deleted     bool         `json:"deleted,omitempty"`
+	Hash        string       `json:"hash,omitempty"`
+	Filename    string       `json:"filename,omitempty"`
+	Compression string       `json:"compression,omitempty"`
+	Path        string       `json:"path,omitempty"`
+	Chunks      *ChunkHashes `json:"chunks,omitempty"`
+	Color       string       `json:"color,omitempty"`
+	ContentType string       `json:"content_type,omitempty"`
+	Size        int64        `json:"size,omitempty"`
+	CreatedAt   *time.Time   `json:"created_at,omitempty"`
+	ModifiedAt  *time.Time   `json:"modified_at,omitempty"`
+	DeletedAt   *time.Time   `json:"deleted_at,omitempty"`
+}
+
+func toRecord(data []byte) (Record, error) {
+	if len(data) == 0 || data[0] > 0x1f {
+		return toLegacyRecord(string(data)), nil
+	}
+	switch data[0] {
+	case recordVersion1:
+		var v recordV1
+		if err := json.Unmarshal(data[1:], &v); err != nil {
+			return Record{}, fmt.Errorf("invalid record: %w", err)
+		}
+		rec := Record{Deleted: NO, Hash: v.Hash, Filename: v.Filename, Compression: v.Compression, Path: v.Path, Chunks: v.Chunks, DominantColor: v.Color, ContentType: v.ContentType, Size: v.Size}
+		if v.Deleted {
+			rec.Deleted = SOFT
+		}
+		if v.CreatedAt != nil {
+			rec.CreatedAt = *v.CreatedAt
+		}
+		if v.ModifiedAt != nil {
+			rec.ModifiedAt = *v.ModifiedAt
+		}
+		if v.DeletedAt != nil {
+			rec.DeletedAt = *v.DeletedAt
+		}
+		return rec, nil
+	default:
+		return Record{}, fmt.Errorf("unknown record version %d", data[0])
+	}
+}
+
+// toLegacyRecord decodes the original "DELETED" + "HASH" + md5 + "NAME" +
+// filename string encoding
+func toLegacyRecord(ss string) Record {
 	var rec Record
-	ss := string(data)
 	rec.Deleted = NO
 	if strings.HasPrefix(ss, "DELETED") {
 		rec.Deleted = SOFT
 		ss = ss[7:]
 	}
-	if strings.HasPrefix(ss, "HASH") {
+	if strings.HasPrefix(ss, "HASH") && len(ss) >= 36 {
 		rec.Hash = ss[4:36]
+		ss = ss[36:]
+	}
+	if strings.HasPrefix(ss, "NAME") {
+		rec.Filename = ss[4:]
 	}
 	return rec
 }
 
 func fromRecord(rec Record) ([]byte, error) {
-	cc := ""
 	if rec.Deleted == HARD {
 		return nil, fmt.Errorf("cannot put HARD delete in the database")
 	}
-	if rec.Deleted == SOFT {
-		cc = "DELETED"
+	v := recordV1{
+		Deleted:     rec.Deleted == SOFT,
+		Hash:        rec.Hash,
+		Filename:    rec.Filename,
+		Compression: rec.Compression,
+		Path:        rec.Path,
+		Chunks:      rec.Chunks,
+		Color:       rec.DominantColor,
+		ContentType: rec.ContentType,
+		Size:        rec.Size,
+	}
+	if !rec.CreatedAt.IsZero() {
+		v.CreatedAt = &rec.CreatedAt
+	}
+	if !rec.ModifiedAt.IsZero() {
+		v.ModifiedAt = &rec.ModifiedAt
+	}
+	if !rec.DeletedAt.IsZero() {
+		v.DeletedAt = &rec.DeletedAt
 	}
-	if len(rec.Hash) == 32 {
-		cc += "HASH" + rec.Hash
+	data, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
 	}
-	return []byte(cc), nil
+	return append([]byte{recordVersion1}, data...), nil
 }
 
 func KeyToPath(key []byte) string {
@@ -0,0 +1,79 @@
+package keyval
+
+import (
+	"testing"
+)
+
+func TestRecord_RoundTrip(t *testing.T) {
+	tests := []Record{
+		{Deleted: NO},
+		{Deleted: SOFT},
+		{Deleted: NO, Hash: "5d41402abc4b2a76b9719d911017c592"},
+		{Deleted: SOFT, Hash: "5d41402abc4b2a76b9719d911017c592"},
+		{Deleted: NO, Hash: "5d41402abc4b2a76b9719d911017c592", Filename: "résumé \"final\".png"},
+		{Deleted: NO, Filename: "NAMEHASH.png"},
+		{Deleted: NO, Hash: "5d41402abc4b2a76b9719d911017c592", Compression: CompressionGzip},
+		{Deleted: NO, Hash: "5d41402abc4b2a76b9719d911017c592", DominantColor: "#1a2b3c"},
+	}
+
+	for _, want := range tests {
+		data, err := fromRecord(want)
+		if err != nil {
+			t.Fatalf("fromRecord(%+v): %v", want, err)
+		}
+		if data[0] != recordVersion1 {
+			t.Errorf("expected version byte %d, got %d", recordVersion1, data[0])
+		}
+		got, err := toRecord(data)
+		if err != nil {
+			t.Fatalf("toRecord(%q): %v", data, err)
+		}
+		if got != want {
+			t.Errorf("round trip: got %+v, want %+v", got, want)
+		}
+	}
+}
+
+func TestRecord_HardDelete(t *testing.T) {
+	if _, err := fromRecord(Record{Deleted: HARD}); err == nil {
+		t.Error("expected an error when encoding a HARD delete")
+	}
+}
+
+func TestRecord_Legacy(t *testing.T) {
+	hash := "5d41402abc4b2a76b9719d911017c592"
+	tests := []struct {
+		data string
+		want Record
+	}{
+		{"", Record{Deleted: NO}},
+		{"DELETED", Record{Deleted: SOFT}},
+		{"HASH" + hash, Record{Deleted: NO, Hash: hash}},
+		{"DELETEDHASH" + hash, Record{Deleted: SOFT, Hash: hash}},
+		{"HASH" + hash + "NAMEphoto.png", Record{Deleted: NO, Hash: hash, Filename: "photo.png"}},
+		{"HASHshort", Record{Deleted: NO}},
+	}
+
+	for _, tt := range tests {
+		got, err := toRecord([]byte(tt.data))
+		if err != nil {
+			t.Fatalf("toRecord(%q): %v", tt.data, err)
+		}
+		if got != tt.want {
+			t.Errorf("toRecord(%q) = %+v, want %+v", tt.data, got, tt.want)
+		}
+	}
+}
+
+func TestRecord_Invalid(t *testing.T) {
+	tests := [][]byte{
+		{0x02, '{', '}'},
+		{recordVersion1, 'n', 'o', 'p', 'e'},
+	}
+
+	for _, data := range tests {
+		if _, err := toRecord(data); err == nil {
+			t.Errorf("toRecord(%q): expected an error", data)
+		}
+	}
+}
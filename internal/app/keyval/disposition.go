@@ -0,0 +1,89 @@
+package keyval
+
+import (
+	"fmt"
+	"mime"
+	"path"
+	"strings"
+)
+
+const (
+	DispositionNone       = "none"
+	DispositionInline     = "inline"
+	DispositionAttachment = "attachment"
+)
+
+// contentDisposition returns the Content-Disposition header for a stored file.
+// An explicit download name always results in an attachment.
+func (k *KeyVal) contentDisposition(key []byte, rec Record, download string) string {
+	dispositionType := k.contentDispositionType
+	filename := rec.Filename
+	if download != "" {
+		dispositionType = DispositionAttachment
+		filename = download
+	}
+	if dispositionType == DispositionNone || dispositionType == "" {
+		return ""
+	}
+	if filename == "" {
+		filename = path.Base(string(key))
+	}
+	return formatContentDisposition(dispositionType, filename)
+}
+
+// formatContentDisposition formats a Content-Disposition header with a
+// sanitized ASCII filename, plus an RFC 5987 encoded filename when the
+// original contains non-ASCII characters.
+func formatContentDisposition(dispositionType, filename string) string {
+	filename = path.Base(strings.ReplaceAll(filename, "\\", "/"))
+	var ascii strings.Builder
+	isASCII := true
+	for _, r := range filename {
+		switch {
+		case r > 0x7e:
+			isASCII = false
+			ascii.WriteRune('_')
+		case r < 0x20, r == '"', r == 0x7f:
+			ascii.WriteRune('_')
+		default:
+			ascii.WriteRune(r)
+		}
+	}
+	disposition := fmt.Sprintf(`%s; filename="%s"`, dispositionType, ascii.String())
+	if !isASCII {
+		disposition += "; filename*=UTF-8''" + encodeExtValue(filename)
+	}
+	return disposition
+}
+
+// encodeExtValue percent-encodes every byte of s that isn't an RFC 5987
+// attr-char
+func encodeExtValue(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || '0' <= c && c <= '9' || strings.IndexByte("!#$&+-.^_`|~", c) >= 0 {
+			b.WriteByte(c)
+		} else {
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+// uploadFilename extracts the filename from the Content-Disposition header of
+// an upload request
+func uploadFilename(header string) string {
+	if header == "" {
+		return ""
+	}
+	_, params, err := mime.ParseMediaType(header)
+	if err != nil {
+		return ""
+	}
+	filename := path.Base(strings.ReplaceAll(params["filename"], "\\", "/"))
+	if filename == "." || filename == "/" {
+		return ""
+	}
+	return filename
+}
@@ -0,0 +1,255 @@
+package keyval
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/gofiber/fiber/v3"
+	"github.com/jaredLunde/railway-image-service/internal/pkg/httperr"
+	"github.com/jaredLunde/railway-image-service/internal/pkg/mw"
+	"github.com/jaredLunde/railway-image-service/internal/pkg/throttle"
+)
+
+// HeaderRateLimit lets API key requests override the download rate limit, in
+// bytes per second. 0 disables the limit.
+const HeaderRateLimit = "x-rate-limit-bps"
+
+// downloadRateLimit returns the rate limit of a download in bytes per second
+func (k *KeyVal) downloadRateLimit(c fiber.Ctx) int {
+	if v := c.Get(HeaderRateLimit); v != "" && mw.HasAPIKey(c) {
+		if bps, err := strconv.Atoi(v); err == nil && bps >= 0 {
+			return bps
+		}
+	}
+	return k.downloadRateLimitBPS
+}
+
+// errDownloadsBusy is returned by openDownload when DownloadConcurrency files
+// are already being served
+var errDownloadsBusy = errors.New("too many concurrent downloads")
+
+// downloadFile is a file being served, which frees its download slot when it
+// is closed
+type downloadFile struct {
+	io.ReadCloser
+	backend BlobBackend
+	path    string
+	release func()
+	once    sync.Once
+}
+
+func (f *downloadFile) Close() error {
+	err := f.ReadCloser.Close()
+	f.once.Do(f.release)
+	return err
+}
+
+// openDownload opens the file at path in the backend to serve it, holding one
+// of the DownloadConcurrency slots until it is closed. The response streams the
+// file after the handler returns, so the slot is held for as long as its file
+// descriptor or connection is open.
+func (k *KeyVal) openDownload(p string) (*downloadFile, error) {
+	release := func() {}
+	if k.downloadSlots != nil {
+		select {
+		case k.downloadSlots <- struct{}{}:
+			release = func() { <-k.downloadSlots }
+		default:
+			return nil, errDownloadsBusy
+		}
+	}
+	f, err := k.backend.Get(context.Background(), p)
+	if err != nil {
+		release()
+		return nil, err
+	}
+	return &downloadFile{ReadCloser: f, backend: k.backend, path: p, release: release}, nil
+}
+
+// seek returns a reader of a download from offset. r reads the download from
+// its current offset. Files in remote backends can't seek, so they are opened
+// again from offset with a ranged read instead.
+func (f *downloadFile) seek(r io.Reader, offset int64) (io.Reader, error) {
+	if s, ok := f.ReadCloser.(io.Seeker); ok {
+		_, err := s.Seek(offset, io.SeekStart)
+		return f, err
+	}
+	if offset == 0 {
+		return r, nil
+	}
+	ranged, err := f.backend.GetRange(context.Background(), f.path, offset, -1)
+	if err != nil {
+		return nil, err
+	}
+	f.ReadCloser.Close()
+	f.ReadCloser = ranged
+	return f, nil
+}
+
+// sendOpenError responds to a file that couldn't be opened for a download
+func (k *KeyVal) sendOpenError(c fiber.Ctx, err error) error {
+	if errors.Is(err, errDownloadsBusy) {
+		c.Set(fiber.HeaderRetryAfter, "1")
+		return httperr.SendStatus(c, fiber.StatusServiceUnavailable)
+	}
+	k.log.Error("failed to open file", "error", err)
+	return httperr.SendStatus(c, fiber.StatusInternalServerError)
+}
+
+// throttled limits reads from r to bps bytes per second, keeping it closable
+func throttled(r io.ReadCloser, bps int) io.ReadCloser {
+	if bps <= 0 {
+		return r
+	}
+	return struct {
+		io.Reader
+		io.Closer
+	}{throttle.NewReader(r, bps), r}
+}
+
+// sendThrottled streams a file at bps bytes per second, or as fast as possible
+// if bps is 0. fasthttp can't throttle SendFile or tell when it closes the
+// file, so the single-range requests it would handle are handled here, and the
+// limit applies to the bytes of the range that are actually sent. Files in
+// remote backends are always sent this way.
+func (k *KeyVal) sendThrottled(c fiber.Ctx, p, contentType string, info BlobInfo, bps int) error {
+	f, err := k.openDownload(p)
+	if err != nil {
+		return k.sendOpenError(c, err)
+	}
+
+	r := setContentType(c, contentType, p, f)
+	c.Set(fiber.HeaderLastModified, info.ModTime.UTC().Format(http.TimeFormat))
+	return k.sendRange(c, f, info.Size, func(offset int64) (io.Reader, error) {
+		return f.seek(r, offset)
+	}, bps)
+}
+
+// sendRange streams size bytes of content at bps bytes per second, or the
+// single byte range of them that the request asks for. seek returns a reader
+// of the content from an offset, and body is closed once it is sent.
+func (k *KeyVal) sendRange(c fiber.Ctx, body io.Closer, size int64, seek func(offset int64) (io.Reader, error), bps int) error {
+	c.Set(fiber.HeaderAcceptRanges, "bytes")
+	start, end := int64(0), size-1
+	// multiple ranges aren't supported, so they select the whole file
+	if header := c.Get(fiber.HeaderRange); strings.HasPrefix(header, "bytes=") && !strings.Contains(header, ",") {
+		var ok bool
+		start, end, ok = parseRange(header, size)
+		if !ok {
+			body.Close()
+			c.Set(fiber.HeaderContentRange, fmt.Sprintf("bytes */%d", size))
+			return httperr.SendStatus(c, fiber.StatusRequestedRangeNotSatisfiable)
+		}
+		c.Set(fiber.HeaderContentRange, fmt.Sprintf("bytes %d-%d/%d", start, end, size))
+		c.Status(fiber.StatusPartialContent)
+	}
+	r, err := seek(start)
+	if err != nil {
+		body.Close()
+		k.log.Error("failed to seek file", "error", err)
+		return httperr.SendStatus(c, fiber.StatusInternalServerError)
+	}
+	length := end - start + 1
+	return c.SendStream(throttled(struct {
+		io.Reader
+		io.Closer
+	}{io.LimitReader(r, length), body}, bps), int(length))
+}
+
+// parseRange parses the single byte range of a Range header into inclusive
+// offsets, reporting false if it can't be satisfied
+func parseRange(header string, size int64) (int64, int64, bool) {
+	spec := strings.TrimPrefix(header, "bytes=")
+	first, last, ok := strings.Cut(strings.TrimSpace(spec), "-")
+	if !ok {
+		return 0, 0, false
+	}
+	if first == "" {
+		// the last n bytes
+		n, err := strconv.ParseInt(last, 10, 64)
+		if err != nil || n <= 0 || size == 0 {
+			return 0, 0, false
+		}
+		return max(size-n, 0), size - 1, true
+	}
+	start, err := strconv.ParseInt(first, 10, 64)
+	if err != nil || start < 0 || start >= size {
+		return 0, 0, false
+	}
+	end := size - 1
+	if last != "" {
+		if end, err = strconv.ParseInt(last, 10, 64); err != nil || end < start {
+			return 0, 0, false
+		}
+		end = min(end, size-1)
+	}
+	return start, end, true
+}
+
+// setContentType sets the Content-Type of a file to the stored content type.
+// Records without one get the type of the file's extension, or of its first
+// bytes if it has none. The read offset of f is then left past them, and the
+// returned reader reads f from its start.
+func setContentType(c fiber.Ctx, contentType, fp string, f io.Reader) io.Reader {
+	if contentType != "" {
+		c.Set(fiber.HeaderContentType, contentType)
+		return f
+	}
+	if ext := filepath.Ext(fp); ext != "" {
+		c.Type(ext[1:])
+		return f
+	}
+	head := make([]byte, 512)
+	n, _ := io.ReadFull(f, head)
+	c.Set(fiber.HeaderContentType, http.DetectContentType(head[:n]))
+	return io.MultiReader(bytes.NewReader(head[:n]), f)
+}
+
+// HeaderAccelLimitRate limits the rate of a response that nginx serves with
+// X-Accel-Redirect
+const HeaderAccelLimitRate = "X-Accel-Limit-Rate"
+
+// sendfile hands a file off to the reverse proxy in front of the server. With
+// a sendfile prefix, the header holds the file's path under that prefix, which
+// the proxy maps to the volume, e.g. an internal nginx location. Otherwise it
+// holds the file's absolute path, as X-Sendfile expects.
+func (k *KeyVal) sendfile(c fiber.Ctx, fp, contentType string, bps int) error {
+	if contentType == "" {
+		f, err := os.Open(fp)
+		if err != nil {
+			k.log.Error("failed to open file", "error", err)
+			return httperr.SendStatus(c, fiber.StatusInternalServerError)
+		}
+		setContentType(c, "", fp, f)
+		f.Close()
+	} else {
+		c.Set(fiber.HeaderContentType, contentType)
+	}
+
+	location := fp
+	if k.sendfilePrefix != "" {
+		rel, err := filepath.Rel(k.volume, fp)
+		if err != nil {
+			k.log.Error("failed to map file to sendfile location", "error", err)
+			return httperr.SendStatus(c, fiber.StatusInternalServerError)
+		}
+		location = strings.TrimSuffix(k.sendfilePrefix, "/") + (&url.URL{Path: "/" + filepath.ToSlash(rel)}).EscapedPath()
+	}
+	c.Set(k.sendfileHeader, location)
+	if bps > 0 {
+		c.Set(HeaderAccelLimitRate, strconv.Itoa(bps))
+	}
+	// the proxy replaces the body
+	c.Status(fiber.StatusOK)
+	return nil
+}
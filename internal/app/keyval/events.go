@@ -0,0 +1,33 @@
+package keyval
+
+import "time"
+
+const (
+	// A file was stored under a key, including overwrites
+	EventUploaded = "blob.uploaded"
+	// A key and its file were removed, including by garbage collection
+	EventDeleted = "blob.deleted"
+	// A key was soft deleted. Its file is kept until it is deleted.
+	EventUnlinked = "blob.unlinked"
+)
+
+// Event describes a change to a key, see Config.Notify
+type Event struct {
+	Type string `json:"type"`
+	Key  string `json:"key"`
+	// The MD5 of the content of the key
+	Hash string `json:"hash,omitempty"`
+	// The size and content type of uploads
+	Size        int64     `json:"size,omitempty"`
+	ContentType string    `json:"content_type,omitempty"`
+	Time        time.Time `json:"time"`
+}
+
+// emit passes an event to Notify, if any
+func (k *KeyVal) emit(e Event) {
+	if k.notify == nil {
+		return
+	}
+	e.Time = time.Now().UTC()
+	k.notify(e)
+}
@@ -0,0 +1,48 @@
+package keyval
+
+import (
+	"path"
+	"strings"
+
+	"github.com/gabriel-vasile/mimetype"
+)
+
+// DefaultExtensionTypes maps the file extensions keys may end with to the
+// content type they must contain when extensions are required
+var DefaultExtensionTypes = map[string]string{
+	".jpg":  "image/jpeg",
+	".jpeg": "image/jpeg",
+	".png":  "image/png",
+	".gif":  "image/gif",
+	".webp": "image/webp",
+	".avif": "image/avif",
+	".heic": "image/heic",
+	".heif": "image/heif",
+	".jxl":  "image/jxl",
+	".tif":  "image/tiff",
+	".tiff": "image/tiff",
+	".bmp":  "image/bmp",
+	".ico":  "image/x-icon",
+	".svg":  "image/svg+xml",
+	".jp2":  "image/jp2",
+}
+
+// acceptExtension reports whether the extension of a key is recognized and
+// matches the detected type of its content. The type of empty content and
+// content that can't be detected is unknown, so only the extension is checked.
+func (k *KeyVal) acceptExtension(key []byte, detected *mimetype.MIME) bool {
+	ext := strings.ToLower(path.Ext(string(key)))
+	mtype, ok := k.extensionTypes[ext]
+	if !ok {
+		return false
+	}
+	if detected == nil || detected.Is("application/octet-stream") {
+		return true
+	}
+	for m := detected; m != nil; m = m.Parent() {
+		if m.Is(mtype) {
+			return true
+		}
+	}
+	return false
+}
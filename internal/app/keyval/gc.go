@@ -0,0 +1,165 @@
+package keyval
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io/fs"
+	"sync"
+	"time"
+
+	"github.com/gofiber/fiber/v3"
+	"github.com/syndtr/goleveldb/leveldb/util"
+)
+
+type GCStatus struct {
+	Running bool `json:"running"`
+	// Soft-deleted records visited by the last run
+	Scanned int `json:"scanned"`
+	// Records hard deleted by the last run
+	Collected int `json:"collected"`
+	// Bytes of files removed by the last run
+	ReclaimedBytes int64 `json:"reclaimed_bytes"`
+	Failed         int   `json:"failed"`
+	// Totals of every run since the service started
+	TotalCollected      int        `json:"total_collected"`
+	TotalReclaimedBytes int64      `json:"total_reclaimed_bytes"`
+	StartedAt           *time.Time `json:"started_at,omitempty"`
+	FinishedAt          *time.Time `json:"finished_at,omitempty"`
+	Error               string     `json:"error,omitempty"`
+}
+
+type gcJob struct {
+	mu     sync.Mutex
+	status GCStatus
+	// serializes runs
+	runMu sync.Mutex
+}
+
+func (j *gcJob) update(fn func(s *GCStatus)) {
+	j.mu.Lock()
+	fn(&j.status)
+	j.mu.Unlock()
+}
+
+func (j *gcJob) Status() GCStatus {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return j.status
+}
+
+// GCStatus returns the progress of the running or last garbage collection
+func (k *KeyVal) GCStatus() GCStatus {
+	return k.gc.Status()
+}
+
+// CollectsGarbage reports whether soft-deleted records expire. Replicas can't
+// delete records, so they never collect them.
+func (k *KeyVal) CollectsGarbage() bool {
+	return k.softDeleteRetention > 0 && !k.replica
+}
+
+// CollectGarbage hard deletes the records that were soft deleted more than
+// SoftDeleteRetention ago, and removes their files. Records that were soft
+// deleted before deletion times were stored have none, so they are stamped
+// with the current time on the first run and collected once it expires.
+func (k *KeyVal) CollectGarbage(ctx context.Context) (GCStatus, error) {
+	k.gc.runMu.Lock()
+	defer k.gc.runMu.Unlock()
+	now := time.Now().UTC()
+	k.gc.update(func(s *GCStatus) {
+		*s = GCStatus{Running: true, StartedAt: &now, TotalCollected: s.TotalCollected, TotalReclaimedBytes: s.TotalReclaimedBytes}
+	})
+
+	err := k.collectGarbage(ctx, now.Add(-k.softDeleteRetention))
+	k.gc.update(func(s *GCStatus) {
+		finished := time.Now().UTC()
+		s.Running = false
+		s.FinishedAt = &finished
+		if err != nil {
+			s.Error = err.Error()
+		}
+	})
+	return k.gc.Status(), err
+}
+
+func (k *KeyVal) collectGarbage(ctx context.Context, cutoff time.Time) error {
+	db, release := k.database()
+	defer release()
+	iter := db.NewIterator(util.BytesPrefix(k.namespace), nil)
+	defer iter.Release()
+	for iter.Next() {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		key := iter.Key()[len(k.namespace):]
+		if bytes.HasPrefix(key, []byte(internalKeyPrefix)) {
+			continue
+		}
+		if rec, err := toRecord(iter.Value()); err != nil || rec.Deleted != SOFT {
+			continue
+		}
+		k.gc.update(func(s *GCStatus) { s.Scanned++ })
+
+		key = append([]byte{}, key...)
+		reclaimed, collected, err := k.collectRecord(ctx, key, cutoff)
+		k.gc.update(func(s *GCStatus) {
+			switch {
+			case err != nil:
+				s.Failed++
+			case collected:
+				s.Collected++
+				s.TotalCollected++
+				s.ReclaimedBytes += reclaimed
+				s.TotalReclaimedBytes += reclaimed
+			}
+		})
+		if err != nil {
+			k.log.Error("failed to collect soft-deleted record", "key", string(key), "error", err)
+		}
+	}
+	return iter.Error()
+}
+
+// collectRecord hard deletes a soft-deleted record if it expired before cutoff,
+// returning the size of its file
+func (k *KeyVal) collectRecord(ctx context.Context, key []byte, cutoff time.Time) (int64, bool, error) {
+	if !k.LockKey(key) {
+		// a write or delete of the key is in progress
+		return 0, false, nil
+	}
+	defer k.UnlockKey(key)
+	rec := k.GetRecord(ctx, key)
+	if rec.Deleted != SOFT {
+		return 0, false, nil
+	}
+	if rec.DeletedAt.IsZero() {
+		rec.DeletedAt = time.Now().UTC()
+		return 0, false, k.PutRecord(ctx, key, rec)
+	}
+	if rec.DeletedAt.After(cutoff) {
+		return 0, false, nil
+	}
+
+	p := blobPath(key, rec)
+	info, err := k.backend.Stat(ctx, p)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return 0, false, err
+	}
+	if err := k.backend.Delete(ctx, p); err != nil {
+		return 0, false, err
+	}
+	if err := k.deleteRecord(ctx, key); err != nil {
+		return 0, false, err
+	}
+	if err := k.forgetAccess(key); err != nil {
+		return 0, false, err
+	}
+	k.emit(Event{Type: EventDeleted, Key: string(key), Hash: rec.Hash})
+	return info.Size, true, nil
+}
+
+// GCHandler reports the progress of the running or last garbage collection
+func (k *KeyVal) GCHandler(c fiber.Ctx) error {
+	return c.JSON(k.GCStatus())
+}
@@ -0,0 +1,42 @@
+package keyval
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"time"
+
+	"github.com/gofiber/fiber/v3"
+	"github.com/jaredLunde/railway-image-service/internal/pkg/httperr"
+)
+
+// pingTimeout bounds how long a health check waits for the storage backend
+const pingTimeout = 5 * time.Second
+
+// Ping checks that the database can be read and the storage backend is
+// reachable
+func (k *KeyVal) Ping(ctx context.Context) error {
+	db, release := k.database()
+	defer release()
+	if _, err := db.Has(k.dbKey([]byte(internalKeyPrefix+"ping")), nil); err != nil {
+		return fmt.Errorf("database: %w", err)
+	}
+	// the probe file doesn't exist, so anything but a not found is a failure
+	if _, err := k.backend.Stat(ctx, "/.ping"); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return fmt.Errorf("storage backend: %w", err)
+	}
+	return nil
+}
+
+// PingHandler responds with a 204 if the service is healthy, or a 503
+// otherwise
+func (k *KeyVal) PingHandler(c fiber.Ctx) error {
+	ctx, cancel := context.WithTimeout(c.Context(), pingTimeout)
+	defer cancel()
+	if err := k.Ping(ctx); err != nil {
+		k.log.Error("health check failed", "error", err)
+		return httperr.SendStatus(c, fiber.StatusServiceUnavailable)
+	}
+	return c.SendStatus(fiber.StatusNoContent)
+}
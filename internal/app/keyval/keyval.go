@@ -1,65 +1,349 @@
 package keyval
 
 import (
+	"bytes"
+	"context"
+	"fmt"
 	"log/slog"
+	"maps"
 	"math/rand"
+	"strings"
 	"sync"
 	"time"
 
+	"github.com/gabriel-vasile/mimetype"
 	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/errors"
+	"github.com/syndtr/goleveldb/leveldb/opt"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
 )
 
 type Config struct {
-	UploadPath       string
-	LevelDBPath      string
-	SoftDelete       bool
-	SignSecret       string
+	UploadPath string
+	// Stores the files of records. Defaults to a LocalBackend in UploadPath.
+	Backend     BlobBackend
+	LevelDBPath string
+	// Rebuild the database from its table files if it fails to open because
+	// it is corrupted. Records in a damaged journal or table are lost.
+	Recover bool
+	// Open a read-only snapshot of the database of a primary that is running
+	// elsewhere. See RefreshReplica.
+	Replica    bool
+	SoftDelete bool
+	// Overrides SoftDelete for keys with a given prefix. When prefixes overlap,
+	// the longest (most specific) matching prefix wins.
+	SoftDeletePrefixes map[string]bool
+	// How long soft-deleted records are kept before CollectGarbage hard
+	// deletes them and removes their files. 0 keeps them forever.
+	SoftDeleteRetention time.Duration
+	// Refuse to overwrite live keys
+	WriteOnce bool
+	// Overrides WriteOnce for keys with a given prefix. When prefixes overlap,
+	// the longest (most specific) matching prefix wins.
+	WriteOncePrefixes map[string]bool
+	SignSecret        string
+	// The scheme and host of the URLs in upload responses, e.g.
+	// https://images.example.com. Empty returns paths.
+	PublicURL        string
 	BasePath         string
 	MaxSize          int
 	AllowedMimeTypes []string
-	Logger           *slog.Logger
-	Debug            bool
+	// The number of leading bytes the content type of a file is detected from.
+	// More bytes detect formats that identify themselves deeper in the file,
+	// at the cost of buffering them before an upload is accepted or rejected.
+	// Defaults to DefaultMimeSniffBytes.
+	MimeSniffBytes int
+	// Accept uploads whose type can't be detected, unless the client declares
+	// a Content-Type that isn't allowed
+	AllowUnknownTypes bool
+	// Store zero-byte uploads, e.g. placeholder markers. Their type can't be
+	// detected, so they bypass AllowedMimeTypes.
+	AllowEmptyFiles bool
+	// Reject keys without a recognized file extension, or whose extension
+	// doesn't match the detected type of their content
+	RequireFileExtension bool
+	// Recognized file extensions and their content types, in addition to
+	// DefaultExtensionTypes, e.g. ".jfif": "image/jpeg"
+	ExtensionTypes map[string]string
+	// Sync uploads to disk before they are renamed into place. Without it, a
+	// crash shortly after an upload can leave an empty or truncated file.
+	FsyncOnWrite bool
+	// Lays out files in the volume, e.g. "{yyyy}/{mm}/{hashfan}/{hexkey}".
+	// Defaults to KeyToPath.
+	PathTemplate string
+	// Clean keys from request paths: collapse duplicate slashes, resolve "."
+	// segments, and reject ".." segments
+	CleanKeys bool
+	// Limits how fast each upload is read from its connection, in bytes per
+	// second. 0 disables the limit.
+	UploadRateLimit int
+	// Aborts uploads that send no bytes for this long. 0 disables the timeout.
+	UploadIdleTimeout time.Duration
+	// The read timeout of uploads, which UploadIdleTimeout doesn't extend. 0
+	// means none.
+	UploadTimeout time.Duration
+	// Limits how fast each download is sent, in bytes per second. 0 disables
+	// the limit. API key requests can override it with the x-rate-limit-bps
+	// header.
+	DownloadRateLimit int
+	// Limits how many files are served at once, so bursts of downloads can't
+	// exhaust the file descriptors of the process. Downloads beyond it get a
+	// 503. 0 disables the limit.
+	DownloadConcurrency int
+	// Hand downloads off to a reverse proxy with this header, e.g.
+	// X-Accel-Redirect or X-Sendfile, instead of sending them. Files that are
+	// compressed at rest are still sent by the server.
+	SendfileHeader string
+	// The location the reverse proxy serves the volume from. Without it, the
+	// header holds the absolute path of the file.
+	SendfilePrefix string
+	// Prefixes every LevelDB key, so several stores can share a database.
+	// Changing it orphans the records stored under the previous namespace. It
+	// can't contain a NUL byte, which separates it from keys.
+	KeyNamespace string
+	// Hash the content of uploads in chunks of this many bytes, so clients can
+	// verify and re-fetch ranges of large files. 0 disables chunk hashes.
+	ChunkHashSize int
+	// Gzip compressible, non-image files before storing them
+	CompressAtRest bool
+	// Store client-provided variants of a key with ?variant=, e.g. 2x, under
+	// the key with a VariantSeparator and the variant name appended
+	Variants bool
+	// Computes the color of an uploaded image from its path, e.g.
+	// imagor.ColorExtractor. It is stored in the record and sent in the
+	// x-dominant-color header. nil disables it.
+	ExtractColor func(path string) (string, error)
+	// The Content-Disposition type of downloads: inline, attachment, or none
+	ContentDisposition string
+	// The fraction of reads counted towards the access counts of keys, from 0
+	// to 1. 0 disables access counting. See RecordAccess.
+	AccessSampleRate float64
+	// Called after a key is uploaded, deleted, or unlinked, e.g. to send
+	// webhooks. It must not block. nil disables events.
+	Notify func(Event)
+	Logger *slog.Logger
+	Debug  bool
 }
 
+// DefaultMimeSniffBytes is the default number of leading bytes the content type
+// of a file is detected from
+const DefaultMimeSniffBytes = 512
+
+// MaxMimeSniffBytes is the most leading bytes the content type of a file can
+// be detected from, since every upload buffers that many
+const MaxMimeSniffBytes = 1 << 20
+
+// mimetypeReadLimit is the default number of bytes mimetype detects types from
+const mimetypeReadLimit = 3072
+
 func New(cfg Config) (*KeyVal, error) {
 	rand.New(rand.NewSource(time.Now().UnixNano()))
-	db, err := leveldb.OpenFile(cfg.LevelDBPath, nil)
-	if err != nil {
+	if err := validatePathTemplate(cfg.PathTemplate); err != nil {
+		return nil, err
+	}
+	if cfg.MimeSniffBytes < 0 || cfg.MimeSniffBytes > MaxMimeSniffBytes {
+		return nil, fmt.Errorf("invalid MIME sniff bytes %d", cfg.MimeSniffBytes)
+	}
+	backend := cfg.Backend
+	if backend == nil {
+		backend = &LocalBackend{Root: cfg.UploadPath, Fsync: cfg.FsyncOnWrite}
+	}
+	local, _ := backend.(*LocalBackend)
+	if local != nil {
+		cfg.UploadPath = local.Root
+	} else if cfg.SendfileHeader != "" {
+		return nil, fmt.Errorf("a sendfile header requires the local storage backend")
+	}
+	if strings.IndexByte(cfg.KeyNamespace, namespaceSeparator) >= 0 {
+		return nil, fmt.Errorf("invalid key namespace %q", cfg.KeyNamespace)
+	}
+	var db *leveldb.DB
+	var snapshot *replicaSnapshot
+	var err error
+	if cfg.Replica {
+		if snapshot, err = openSnapshot(cfg.LevelDBPath); err != nil {
+			return nil, err
+		}
+		db = snapshot.db
+	} else if db, err = openDB(cfg); err != nil {
 		return nil, err
 	}
 
+	extensionTypes := maps.Clone(DefaultExtensionTypes)
+	for ext, mtype := range cfg.ExtensionTypes {
+		ext = strings.ToLower(ext)
+		if !strings.HasPrefix(ext, ".") {
+			ext = "." + ext
+		}
+		extensionTypes[ext] = mtype
+	}
+	if cfg.MimeSniffBytes == 0 {
+		cfg.MimeSniffBytes = DefaultMimeSniffBytes
+	}
+	if cfg.MimeSniffBytes > mimetypeReadLimit {
+		// the detector ignores anything past its limit, which is global
+		mimetype.SetLimit(uint32(cfg.MimeSniffBytes))
+	}
+	var downloadSlots chan struct{}
+	if cfg.DownloadConcurrency > 0 {
+		downloadSlots = make(chan struct{}, cfg.DownloadConcurrency)
+	}
+
 	return &KeyVal{
-		db:               db,
-		lock:             map[string]struct{}{},
-		softDelete:       cfg.SoftDelete,
-		volume:           cfg.UploadPath,
-		signSecret:       cfg.SignSecret,
-		basePath:         cfg.BasePath,
-		maxFileSize:      cfg.MaxSize,
-		allowedMimeTypes: cfg.AllowedMimeTypes,
-		log:              cfg.Logger,
-		debug:            cfg.Debug,
+		db:                     db,
+		dbPath:                 cfg.LevelDBPath,
+		replica:                cfg.Replica,
+		snapshot:               snapshot,
+		lock:                   map[string]struct{}{},
+		softDelete:             cfg.SoftDelete,
+		softDeletePrefixes:     cfg.SoftDeletePrefixes,
+		softDeleteRetention:    cfg.SoftDeleteRetention,
+		writeOnce:              cfg.WriteOnce,
+		writeOncePrefixes:      cfg.WriteOncePrefixes,
+		compressAtRest:         cfg.CompressAtRest,
+		variants:               cfg.Variants,
+		extractColor:           cfg.ExtractColor,
+		fsyncOnWrite:           cfg.FsyncOnWrite,
+		pathTemplate:           cfg.PathTemplate,
+		cleanKeys:              cfg.CleanKeys,
+		namespace:              namespacePrefix(cfg.KeyNamespace),
+		chunkHashSize:          cfg.ChunkHashSize,
+		uploadRateLimitBPS:     cfg.UploadRateLimit,
+		uploadIdleTimeout:      cfg.UploadIdleTimeout,
+		uploadTimeout:          cfg.UploadTimeout,
+		downloadRateLimitBPS:   cfg.DownloadRateLimit,
+		downloadSlots:          downloadSlots,
+		sendfileHeader:         cfg.SendfileHeader,
+		sendfilePrefix:         cfg.SendfilePrefix,
+		volume:                 cfg.UploadPath,
+		backend:                backend,
+		local:                  local,
+		signSecret:             cfg.SignSecret,
+		publicURL:              cfg.PublicURL,
+		basePath:               cfg.BasePath,
+		maxFileSize:            cfg.MaxSize,
+		allowedMimeTypes:       cfg.AllowedMimeTypes,
+		mimeSniffBytes:         cfg.MimeSniffBytes,
+		allowUnknownTypes:      cfg.AllowUnknownTypes,
+		allowEmptyFiles:        cfg.AllowEmptyFiles,
+		requireExtension:       cfg.RequireFileExtension,
+		extensionTypes:         extensionTypes,
+		contentDispositionType: cfg.ContentDisposition,
+		accessSampleRate:       min(cfg.AccessSampleRate, 1),
+		notify:                 cfg.Notify,
+		log:                    cfg.Logger,
+		debug:                  cfg.Debug,
 	}, nil
 }
 
 type KeyVal struct {
-	db               *leveldb.DB
-	mlock            sync.Mutex
-	lock             map[string]struct{}
-	log              *slog.Logger
-	signSecret       string
-	volume           string
-	basePath         string
-	maxFileSize      int
-	allowedMimeTypes []string
-	softDelete       bool
-	debug            bool
+	dbMu       sync.RWMutex
+	db         *leveldb.DB
+	dbPath     string
+	replica    bool
+	snapshot   *replicaSnapshot
+	mlock      sync.Mutex
+	lock       map[string]struct{}
+	log        *slog.Logger
+	signSecret string
+	publicURL  string
+	volume     string
+	backend    BlobBackend
+	// The backend if it is on disk, which enables serving files with
+	// sendfile and renaming uploads into place
+	local                  *LocalBackend
+	basePath               string
+	maxFileSize            int
+	allowedMimeTypes       []string
+	mimeSniffBytes         int
+	allowUnknownTypes      bool
+	allowEmptyFiles        bool
+	requireExtension       bool
+	extensionTypes         map[string]string
+	contentDispositionType string
+	softDelete             bool
+	softDeletePrefixes     map[string]bool
+	softDeleteRetention    time.Duration
+	writeOnce              bool
+	writeOncePrefixes      map[string]bool
+	compressAtRest         bool
+	variants               bool
+	extractColor           func(path string) (string, error)
+	fsyncOnWrite           bool
+	pathTemplate           string
+	cleanKeys              bool
+	namespace              []byte
+	chunkHashSize          int
+	uploadRateLimitBPS     int
+	uploadIdleTimeout      time.Duration
+	uploadTimeout          time.Duration
+	downloadRateLimitBPS   int
+	downloadSlots          chan struct{}
+	sendfileHeader         string
+	sendfilePrefix         string
+	reindex                reindexJob
+	gc                     gcJob
+	accessSampleRate       float64
+	access                 accessCounter
+	notify                 func(Event)
+	debug                  bool
+}
+
+func openDB(cfg Config) (*leveldb.DB, error) {
+	db, err := leveldb.OpenFile(cfg.LevelDBPath, nil)
+	if err != nil {
+		if !cfg.Recover || !errors.IsCorrupted(err) {
+			return nil, err
+		}
+		cfg.Logger.Warn("leveldb is corrupted, attempting recovery", "path", cfg.LevelDBPath, "error", err)
+		if db, err = recoverDB(cfg.LevelDBPath); err != nil {
+			return nil, err
+		}
+		iter := db.NewIterator(nil, nil)
+		recovered := 0
+		for iter.Next() {
+			recovered++
+		}
+		iter.Release()
+		cfg.Logger.Warn("leveldb recovered", "path", cfg.LevelDBPath, "records", recovered)
+	}
+	return db, nil
+}
+
+// recoverDB rebuilds the manifest of a corrupted database. Corrupted blocks
+// are skipped rather than failing the recovery.
+func recoverDB(path string) (*leveldb.DB, error) {
+	return leveldb.RecoverFile(path, &opt.Options{Strict: opt.NoStrict})
 }
 
 func (k *KeyVal) Close() error {
+	if k.replica {
+		k.dbMu.Lock()
+		defer k.dbMu.Unlock()
+		k.snapshot.users.Wait()
+		k.snapshot.close()
+		return nil
+	}
 	return k.db.Close()
 }
 
+// database returns the database, which is swapped out on replicas when they
+// are refreshed. The snapshot of a replica isn't closed until release is
+// called.
+func (k *KeyVal) database() (*leveldb.DB, func()) {
+	k.dbMu.RLock()
+	defer k.dbMu.RUnlock()
+	if k.snapshot == nil {
+		return k.db, func() {}
+	}
+	snapshot := k.snapshot
+	snapshot.users.Add(1)
+	return k.db, snapshot.users.Done
+}
+
 func (k *KeyVal) UnlockKey(key []byte) {
 	k.mlock.Lock()
 	delete(k.lock, string(key))
@@ -76,19 +360,98 @@ func (k *KeyVal) LockKey(key []byte) bool {
 	return true
 }
 
-func (k *KeyVal) GetRecord(key []byte) Record {
-	data, err := k.db.Get(key, nil)
-	rec := Record{HARD, ""}
+// SoftDelete reports whether keys must be unlinked before they can be deleted.
+// The most specific matching prefix in SoftDeletePrefixes takes precedence over
+// the service-wide setting.
+func (k *KeyVal) SoftDelete(key []byte) bool {
+	return prefixPolicy(key, k.softDelete, k.softDeletePrefixes)
+}
+
+// WriteOnce reports whether live keys must not be overwritten. The most
+// specific matching prefix in WriteOncePrefixes takes precedence over the
+// service-wide setting.
+func (k *KeyVal) WriteOnce(key []byte) bool {
+	return prefixPolicy(key, k.writeOnce, k.writeOncePrefixes)
+}
+
+// prefixPolicy returns the setting of the longest prefix of key, or the
+// service-wide setting if none matches
+func prefixPolicy(key []byte, enabled bool, prefixes map[string]bool) bool {
+	matched := -1
+	for prefix, v := range prefixes {
+		if len(prefix) > matched && bytes.HasPrefix(key, []byte(prefix)) {
+			enabled = v
+			matched = len(prefix)
+		}
+	}
+	return enabled
+}
+
+// namespaceSeparator follows the namespace in LevelDB keys, so no namespace is
+// a prefix of the keys of another, e.g. "a" of those of "ab"
+const namespaceSeparator = 0
+
+// namespacePrefix returns the prefix of the LevelDB keys of a namespace
+func namespacePrefix(namespace string) []byte {
+	if namespace == "" {
+		return nil
+	}
+	return append([]byte(namespace), namespaceSeparator)
+}
+
+// dbKey returns the LevelDB key of a key in the namespace
+func (k *KeyVal) dbKey(key []byte) []byte {
+	if len(k.namespace) == 0 {
+		return key
+	}
+	return append(append(make([]byte, 0, len(k.namespace)+len(key)), k.namespace...), key...)
+}
+
+var tracer = otel.Tracer("github.com/jaredLunde/railway-image-service/internal/app/keyval")
+
+func (k *KeyVal) GetRecord(ctx context.Context, key []byte) Record {
+	_, span := tracer.Start(ctx, "leveldb.get", trace.WithAttributes(attribute.String("blob.key", string(key))))
+	defer span.End()
+	db, release := k.database()
+	defer release()
+	data, err := db.Get(k.dbKey(key), nil)
+	rec := Record{Deleted: HARD}
 	if err != leveldb.ErrNotFound {
-		rec = toRecord(data)
+		if rec, err = toRecord(data); err != nil {
+			// never serve a record we can't read, but allow it to be overwritten
+			k.log.Error("failed to decode record", "key", string(key), "error", err)
+			rec = Record{Deleted: SOFT}
+		}
 	}
 	return rec
 }
 
-func (k *KeyVal) PutRecord(key []byte, rec Record) error {
+func (k *KeyVal) PutRecord(ctx context.Context, key []byte, rec Record) error {
+	_, span := tracer.Start(ctx, "leveldb.put", trace.WithAttributes(attribute.String("blob.key", string(key))))
+	defer span.End()
 	data, err := fromRecord(rec)
 	if err != nil {
 		return err
 	}
-	return k.db.Put(key, data, nil)
+	db, release := k.database()
+	defer release()
+	if err := db.Put(k.dbKey(key), data, nil); err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, "put failed")
+		return err
+	}
+	return nil
+}
+
+func (k *KeyVal) deleteRecord(ctx context.Context, key []byte) error {
+	_, span := tracer.Start(ctx, "leveldb.delete", trace.WithAttributes(attribute.String("blob.key", string(key))))
+	defer span.End()
+	db, release := k.database()
+	defer release()
+	if err := db.Delete(k.dbKey(key), nil); err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, "delete failed")
+		return err
+	}
+	return nil
 }
@@ -0,0 +1,337 @@
+package keyval
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/util"
+)
+
+func TestKeyVal_SoftDelete(t *testing.T) {
+	kv := &KeyVal{
+		softDelete: true,
+		softDeletePrefixes: map[string]bool{
+			"tmp/":          false,
+			"tmp/keep/":     true,
+			"tmp/keep/tmp/": false,
+		},
+	}
+
+	tests := []struct {
+		key  string
+		want bool
+	}{
+		{"images/a.png", true},
+		{"tmp/a.png", false},
+		{"tmp/keep/a.png", true},
+		{"tmp/keep/tmp/a.png", false},
+		{"tmpfile.png", true},
+	}
+
+	for _, tt := range tests {
+		if got := kv.SoftDelete([]byte(tt.key)); got != tt.want {
+			t.Errorf("SoftDelete(%q) = %v, want %v", tt.key, got, tt.want)
+		}
+	}
+}
+
+func TestNew_Recover(t *testing.T) {
+	dir := t.TempDir()
+	cfg := Config{
+		UploadPath:  filepath.Join(dir, "uploads"),
+		LevelDBPath: filepath.Join(dir, "db"),
+		Logger:      slog.New(slog.NewTextHandler(io.Discard, nil)),
+	}
+	kv, err := New(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := kv.PutRecord(context.Background(), []byte("a.png"), Record{Deleted: NO, Hash: "5d41402abc4b2a76b9719d911017c592"}); err != nil {
+		t.Fatal(err)
+	}
+	kv.Close()
+
+	manifests, _ := filepath.Glob(filepath.Join(cfg.LevelDBPath, "MANIFEST-*"))
+	if len(manifests) == 0 {
+		t.Fatal("expected a manifest")
+	}
+	for _, m := range manifests {
+		if err := os.WriteFile(m, []byte("corrupted"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if _, err := New(cfg); err == nil {
+		t.Fatal("expected a corrupted database to fail to open")
+	}
+
+	cfg.Recover = true
+	kv, err = New(cfg)
+	if err != nil {
+		t.Fatalf("expected recovery to succeed: %v", err)
+	}
+	defer kv.Close()
+	if rec := kv.GetRecord(context.Background(), []byte("a.png")); rec.Deleted != NO {
+		t.Errorf("expected the record to be recovered, got %+v", rec)
+	}
+}
+
+func TestNew_Replica(t *testing.T) {
+	dir := t.TempDir()
+	cfg := Config{
+		UploadPath:  filepath.Join(dir, "uploads"),
+		LevelDBPath: filepath.Join(dir, "db"),
+		Logger:      slog.New(slog.NewTextHandler(io.Discard, nil)),
+	}
+	primary, err := New(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer primary.Close()
+	if err := primary.PutRecord(context.Background(), []byte("a.png"), Record{Deleted: NO}); err != nil {
+		t.Fatal(err)
+	}
+
+	// the primary holds the database lock
+	cfg.Replica = true
+	replica, err := New(cfg)
+	if err != nil {
+		t.Fatalf("expected the replica to open: %v", err)
+	}
+	defer replica.Close()
+	if rec := replica.GetRecord(context.Background(), []byte("a.png")); rec.Deleted != NO {
+		t.Errorf("expected the replica to see the record, got %+v", rec)
+	}
+	if err := replica.PutRecord(context.Background(), []byte("b.png"), Record{Deleted: NO}); err == nil {
+		t.Error("expected the replica to be read-only")
+	}
+
+	if err := primary.PutRecord(context.Background(), []byte("b.png"), Record{Deleted: NO}); err != nil {
+		t.Fatal(err)
+	}
+	if rec := replica.GetRecord(context.Background(), []byte("b.png")); rec.Deleted != HARD {
+		t.Errorf("expected the write to be invisible until a refresh, got %+v", rec)
+	}
+	for i := 0; i < 3; i++ {
+		if err := replica.RefreshReplica(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if rec := replica.GetRecord(context.Background(), []byte("b.png")); rec.Deleted != NO {
+		t.Errorf("expected the replica to see the write after a refresh, got %+v", rec)
+	}
+
+	// reads that started before a refresh finish on the previous snapshot
+	db, release := replica.database()
+	retired := replica.snapshot
+	if err := replica.RefreshReplica(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Get(replica.dbKey([]byte("a.png")), nil); err != nil {
+		t.Errorf("expected the previous snapshot to stay open, got %v", err)
+	}
+	if _, err := os.Stat(retired.dir); err != nil {
+		t.Errorf("expected the previous snapshot to be kept, got %v", err)
+	}
+	release()
+	for i := 0; i < 100; i++ {
+		if _, err := os.Stat(retired.dir); os.IsNotExist(err) {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Error("expected the previous snapshot to be removed once released")
+}
+
+func TestOpenSnapshot_Inconsistent(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "db")
+	db, err := leveldb.OpenFile(path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 100; i++ {
+		if err := db.Put([]byte(fmt.Sprintf("key-%d", i)), []byte("value"), nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := db.CompactRange(util.Range{}); err != nil {
+		t.Fatal(err)
+	}
+	db.Close()
+
+	// a table file that was compacted away while it was copied
+	tables, _ := filepath.Glob(filepath.Join(path, "*.ldb"))
+	if len(tables) == 0 {
+		t.Fatal("expected a table file")
+	}
+	for _, table := range tables {
+		os.Remove(table)
+	}
+	if snapshot, err := openSnapshot(path); err == nil {
+		snapshot.close()
+		t.Fatal("expected an inconsistent snapshot to be rejected")
+	}
+}
+
+func TestKeyVal_ResolvePath(t *testing.T) {
+	now := time.Date(2024, 3, 9, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		tmpl string
+		key  string
+		want string
+	}{
+		{"", "a.png", KeyToPath([]byte("a.png"))},
+		{"{yyyy}/{mm}/{dd}/{key}", "images/a.png", "/2024/03/09/images/a.png"},
+		{"{hashfan}/{hexkey}", "a.png", KeyToPath([]byte("a.png"))},
+		{"{yyyy}/{key}", "../a.png", "/2024/2e2e2f612e706e67"},
+		{"{key}", "a/.upload-1", KeyToPath([]byte("a/.upload-1"))},
+	}
+
+	for _, tt := range tests {
+		if err := validatePathTemplate(tt.tmpl); err != nil {
+			t.Fatalf("validatePathTemplate(%q): %v", tt.tmpl, err)
+		}
+		kv := &KeyVal{pathTemplate: tt.tmpl}
+		if got := kv.resolvePath([]byte(tt.key), now); got != tt.want {
+			t.Errorf("resolvePath(%q, %q) = %q, want %q", tt.tmpl, tt.key, got, tt.want)
+		}
+	}
+
+	for _, tmpl := range []string{"{yyyy}/{mm}", "{yyyy}/{hour}/{key}"} {
+		if err := validatePathTemplate(tmpl); err == nil {
+			t.Errorf("validatePathTemplate(%q) succeeded, want error", tmpl)
+		}
+	}
+}
+
+func TestCleanKey(t *testing.T) {
+	tests := []struct {
+		key    string
+		want   string
+		wantOK bool
+	}{
+		{"a/b.png", "a/b.png", true},
+		{"a//b.png", "a/b.png", true},
+		{"/a/./b.png", "a/b.png", true},
+		{"./a/b/", "a/b/", true},
+		{"a/../b.png", "", false},
+		{"..", "", false},
+		{"a/..b.png", "a/..b.png", true},
+		{"", "", true},
+	}
+
+	for _, tt := range tests {
+		got, ok := cleanKey(tt.key)
+		if got != tt.want || ok != tt.wantOK {
+			t.Errorf("cleanKey(%q) = %q, %v, want %q, %v", tt.key, got, ok, tt.want, tt.wantOK)
+		}
+	}
+}
+
+func TestKeyVal_ContentDisposition(t *testing.T) {
+	tests := []struct {
+		name        string
+		disposition string
+		key         string
+		filename    string
+		download    string
+		want        string
+	}{
+		{"none", DispositionNone, "a.png", "", "", ""},
+		{"unset", "", "a.png", "", "", ""},
+		{"inline", DispositionInline, "images/a.png", "", "", `inline; filename="a.png"`},
+		{"stored filename", DispositionInline, "a.png", "photo.png", "", `inline; filename="photo.png"`},
+		{"attachment", DispositionAttachment, "a.png", "", "", `attachment; filename="a.png"`},
+		{"download", DispositionNone, "a.png", "photo.png", "b.png", `attachment; filename="b.png"`},
+		{"download overrides inline", DispositionInline, "a.png", "", "b.png", `attachment; filename="b.png"`},
+		{"download path", DispositionNone, "a.png", "", "../../etc/b.png", `attachment; filename="b.png"`},
+		{"windows path", DispositionNone, "a.png", "", `C:\photos\b.png`, `attachment; filename="b.png"`},
+		{"quotes", DispositionInline, "a.png", `say "hi".png`, "", `inline; filename="say _hi_.png"`},
+		{"control characters", DispositionInline, "a.png", "a\r\nb.png", "", `inline; filename="a__b.png"`},
+		{"unicode", DispositionInline, "a.png", "naïve (1).png", "", `inline; filename="na_ve (1).png"; filename*=UTF-8''na%C3%AFve%20%281%29.png`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			kv := &KeyVal{contentDispositionType: tt.disposition}
+			got := kv.contentDisposition([]byte(tt.key), Record{Filename: tt.filename}, tt.download)
+			if got != tt.want {
+				t.Errorf("expected %q, got %q", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestUploadFilename(t *testing.T) {
+	tests := []struct {
+		header string
+		want   string
+	}{
+		{"", ""},
+		{`attachment; filename="photo.png"`, "photo.png"},
+		{`form-data; name="file"; filename="../photo.png"`, "photo.png"},
+		{`attachment; filename="C:\\photos\\photo.png"`, "photo.png"},
+		{`attachment; filename*=UTF-8''na%C3%AFve.png`, "naïve.png"},
+		{`attachment; filename="/"`, ""},
+		{"attachment", ""},
+		{`attachment; filename="unterminated`, ""},
+	}
+
+	for _, tt := range tests {
+		if got := uploadFilename(tt.header); got != tt.want {
+			t.Errorf("uploadFilename(%q) = %q, want %q", tt.header, got, tt.want)
+		}
+	}
+}
+
+func TestKeyVal_SweepTempFiles(t *testing.T) {
+	tests := []struct {
+		name    string
+		tmpl    string
+		file    string
+		old     bool
+		removed bool
+	}{
+		{"stale temp file", "", "ab/cd/.upload-123", true, true},
+		{"fresh temp file", "", "ab/cd/.upload-123", false, false},
+		{"stored file", "", "ab/cd/616263", true, false},
+		{"stale legacy temp file", "", "ab/cd/tmp-123", true, true},
+		{"file named after its key", "{key}", "images/tmp-123", true, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			kv := &KeyVal{volume: dir, local: NewLocalBackend(dir), pathTemplate: tt.tmpl, log: slog.New(slog.NewTextHandler(io.Discard, nil))}
+			fp := filepath.Join(dir, filepath.FromSlash(tt.file))
+			if err := os.MkdirAll(filepath.Dir(fp), 0755); err != nil {
+				t.Fatal(err)
+			}
+			if err := os.WriteFile(fp, []byte("partial"), 0644); err != nil {
+				t.Fatal(err)
+			}
+			if tt.old {
+				old := time.Now().Add(-2 * time.Hour)
+				if err := os.Chtimes(fp, old, old); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			n, err := kv.SweepTempFiles(time.Hour)
+			if err != nil {
+				t.Fatal(err)
+			}
+			_, statErr := os.Stat(fp)
+			if removed := os.IsNotExist(statErr); removed != tt.removed || (n == 1) != tt.removed {
+				t.Errorf("expected removed to be %v, got %v (%d files)", tt.removed, removed, n)
+			}
+		})
+	}
+}
@@ -0,0 +1,133 @@
+package keyval
+
+import (
+	"context"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+)
+
+var pathTemplateToken = regexp.MustCompile(`\{[a-z]+\}`)
+
+// validatePathTemplate checks that a path template only uses known tokens and
+// resolves to a unique path per key
+func validatePathTemplate(tmpl string) error {
+	if tmpl == "" {
+		return nil
+	}
+	for _, tok := range pathTemplateToken.FindAllString(tmpl, -1) {
+		switch tok {
+		case "{yyyy}", "{mm}", "{dd}", "{hashfan}", "{hexkey}", "{key}":
+		default:
+			return fmt.Errorf("unknown path template token %s", tok)
+		}
+	}
+	if !strings.Contains(tmpl, "{key}") && !strings.Contains(tmpl, "{hexkey}") {
+		return fmt.Errorf("path template must contain {key} or {hexkey}")
+	}
+	return nil
+}
+
+// resolvePath lays out a new file for key according to the path template. The
+// resolved path is stored in the record, so changing the template only affects
+// new uploads.
+func (k *KeyVal) resolvePath(key []byte, now time.Time) string {
+	if k.pathTemplate == "" {
+		return KeyToPath(key)
+	}
+	hexkey := hex.EncodeToString(key)
+	p := pathTemplateToken.ReplaceAllStringFunc(k.pathTemplate, func(tok string) string {
+		switch tok {
+		case "{yyyy}":
+			return now.Format("2006")
+		case "{mm}":
+			return now.Format("01")
+		case "{dd}":
+			return now.Format("02")
+		case "{hashfan}":
+			return fmt.Sprintf("%02x/%02x", hexkey[0], hexkey[1])
+		case "{hexkey}":
+			return hexkey
+		case "{key}":
+			// keys that aren't clean paths could collide with or escape other
+			// paths, so they fall back to their hex encoding
+			if path.Clean("/"+string(key)) != "/"+string(key) {
+				return hexkey
+			}
+			return string(key)
+		}
+		return tok
+	})
+	p = path.Clean("/" + p)
+	if strings.HasPrefix(path.Base(p), tempFilePrefix) {
+		// it would be mistaken for a leftover temporary file
+		return KeyToPath(key)
+	}
+	return p
+}
+
+// pathConflict reports whether a file can't be laid out at p in the local
+// backend because a file is in the way of its directory or a directory is in
+// its way, as with the keys "a" and "a/b" under the {key} layout
+func (k *KeyVal) pathConflict(p string) bool {
+	if k.local == nil {
+		return false
+	}
+	fp := k.local.FilePath(p)
+	if fi, err := os.Stat(fp); err == nil {
+		return fi.IsDir()
+	}
+	for dir := filepath.Dir(fp); dir != filepath.Dir(dir); dir = filepath.Dir(dir) {
+		if fi, err := os.Stat(dir); err == nil {
+			return !fi.IsDir()
+		}
+	}
+	return false
+}
+
+// blobPath returns the path of the file of a record in the backend
+func blobPath(key []byte, rec Record) string {
+	if rec.Path != "" {
+		return rec.Path
+	}
+	return KeyToPath(key)
+}
+
+// FilePath returns the location of the file of a record on disk. It is only
+// meaningful with the local backend, see LocalPath.
+func (k *KeyVal) FilePath(key []byte, rec Record) string {
+	return filepath.Join(k.volume, filepath.FromSlash(blobPath(key, rec)))
+}
+
+// LocalPath returns the location of the file of a record on disk, reporting
+// false if the backend isn't local
+func (k *KeyVal) LocalPath(key []byte, rec Record) (string, bool) {
+	if k.local == nil {
+		return "", false
+	}
+	return k.local.FilePath(blobPath(key, rec)), true
+}
+
+// StatFile describes the stored file of a record in the storage backend. The
+// size is of the stored bytes, which are compressed for files compressed at
+// rest.
+func (k *KeyVal) StatFile(ctx context.Context, key []byte, rec Record) (BlobInfo, error) {
+	return k.backend.Stat(ctx, blobPath(key, rec))
+}
+
+// PutFile replaces the stored file of a record with size bytes from r as-is,
+// leaving the record alone
+func (k *KeyVal) PutFile(ctx context.Context, key []byte, rec Record, r io.Reader, size int64) error {
+	return k.backend.Put(ctx, blobPath(key, rec), r, size)
+}
+
+// DeleteFile removes the stored file of a record, leaving the record alone
+func (k *KeyVal) DeleteFile(ctx context.Context, key []byte, rec Record) error {
+	return k.backend.Delete(ctx, blobPath(key, rec))
+}
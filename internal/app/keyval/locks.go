@@ -0,0 +1,62 @@
+package keyval
+
+import (
+	"bytes"
+	"sort"
+
+	"github.com/gofiber/fiber/v3"
+	"github.com/jaredLunde/railway-image-service/internal/pkg/httperr"
+	"github.com/jaredLunde/railway-image-service/internal/pkg/mw"
+)
+
+// Locks returns the keys that are currently locked by an in-progress write or
+// delete
+func (k *KeyVal) Locks() []string {
+	k.mlock.Lock()
+	defer k.mlock.Unlock()
+	keys := make([]string, 0, len(k.lock))
+	for key := range k.lock {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+type LocksResponse struct {
+	Locks []string `json:"locks"`
+}
+
+// LocksHandler lists held locks and force-releases the lock of a key. This is
+// an escape hatch for keys that are stuck returning 409. Releasing the lock of
+// a key with a write still in progress allows concurrent writes to that key.
+func (k *KeyVal) LocksHandler(basePath string) fiber.Handler {
+	return func(c fiber.Ctx) error {
+		key := bytes.TrimPrefix(c.Request().URI().Path(), []byte(basePath))
+		key = bytes.TrimPrefix(key, []byte("/"))
+		key, ok := k.CleanKey(key)
+		if !ok {
+			return httperr.SendMessage(c, fiber.StatusBadRequest, "invalid key")
+		}
+
+		switch c.Method() {
+		case fiber.MethodGet:
+			return c.JSON(LocksResponse{Locks: k.Locks()})
+
+		case fiber.MethodDelete:
+			if len(key) == 0 {
+				return httperr.SendMessage(c, fiber.StatusBadRequest, "key required")
+			}
+			k.mlock.Lock()
+			_, locked := k.lock[string(key)]
+			delete(k.lock, string(key))
+			k.mlock.Unlock()
+			if !locked {
+				return httperr.SendStatus(c, fiber.StatusNotFound)
+			}
+			k.log.Warn("force released key lock", "key", string(key), "ip", c.IP(), "request_id", mw.RequestID(c))
+			return c.SendStatus(fiber.StatusNoContent)
+		}
+
+		return httperr.SendStatus(c, fiber.StatusMethodNotAllowed)
+	}
+}
@@ -0,0 +1,111 @@
+package keyval
+
+import (
+	"context"
+	"errors"
+	"io"
+	"io/fs"
+	"time"
+
+	"github.com/gabriel-vasile/mimetype"
+	"github.com/gofiber/fiber/v3"
+	"github.com/jaredLunde/railway-image-service/internal/pkg/httperr"
+)
+
+// Metadata describes a stored file and the state of its key
+type Metadata struct {
+	Key string `json:"key"`
+	// The size of the content, before any compression at rest
+	Size int64 `json:"size"`
+	// The hex MD5 of the content
+	MD5         string `json:"md5"`
+	ContentType string `json:"content_type,omitempty"`
+	// The original filename of the upload, if it had one
+	Filename string `json:"filename,omitempty"`
+	// The color extracted from the image, e.g. #1a2b3c. Omitted when color
+	// extraction is disabled or the file isn't an image.
+	DominantColor string `json:"dominant_color,omitempty"`
+	// When the key was first uploaded. Omitted for files stored before
+	// creation times were tracked.
+	CreatedAt *time.Time `json:"created_at,omitempty"`
+	// When the content of the key was last written
+	ModifiedAt time.Time `json:"modified_at"`
+	// Whether the key was soft deleted. Soft-deleted files are kept until they
+	// are deleted or collected.
+	Deleted   bool       `json:"deleted"`
+	DeletedAt *time.Time `json:"deleted_at,omitempty"`
+}
+
+// Metadata describes the file of a key, including soft-deleted ones. It
+// returns an error matching fs.ErrNotExist for keys without a file.
+func (k *KeyVal) Metadata(ctx context.Context, key []byte) (Metadata, error) {
+	rec := k.GetRecord(ctx, key)
+	if rec.Deleted == HARD {
+		return Metadata{}, fs.ErrNotExist
+	}
+	info, err := k.backend.Stat(ctx, blobPath(key, rec))
+	if err != nil {
+		return Metadata{}, err
+	}
+
+	md := Metadata{
+		Key:           string(key),
+		Size:          info.Size,
+		MD5:           rec.Hash,
+		Filename:      rec.Filename,
+		DominantColor: rec.DominantColor,
+		ContentType:   rec.ContentType,
+		ModifiedAt:    rec.ModifiedAt,
+		Deleted:       rec.Deleted == SOFT,
+	}
+	if md.ModifiedAt.IsZero() {
+		md.ModifiedAt = info.ModTime.UTC()
+	}
+	if !rec.CreatedAt.IsZero() {
+		md.CreatedAt = &rec.CreatedAt
+	}
+	if !rec.DeletedAt.IsZero() {
+		md.DeletedAt = &rec.DeletedAt
+	}
+
+	if rec.ContentType != "" {
+		md.Size = rec.Size
+		return md, nil
+	}
+	// records stored before content types were tracked, or of empty files,
+	// are read from the content itself
+	r, err := k.Open(key, rec)
+	if err != nil {
+		return Metadata{}, err
+	}
+	defer r.Close()
+	head := make([]byte, k.mimeSniffBytes)
+	n, err := io.ReadFull(r, head)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return Metadata{}, err
+	}
+	if n > 0 {
+		md.ContentType = mimetype.Detect(head[:n]).String()
+	}
+	if rec.Compression != "" {
+		rest, err := io.Copy(io.Discard, r)
+		if err != nil {
+			return Metadata{}, err
+		}
+		md.Size = int64(n) + rest
+	}
+	return md, nil
+}
+
+// sendMetadata responds with the metadata of a key as JSON
+func (k *KeyVal) sendMetadata(c fiber.Ctx, key []byte) error {
+	md, err := k.Metadata(c.Context(), key)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return httperr.SendStatus(c, fiber.StatusNotFound)
+		}
+		k.log.Error("failed to read metadata", "key", string(key), "error", err)
+		return httperr.SendStatus(c, fiber.StatusInternalServerError)
+	}
+	return c.JSON(md)
+}
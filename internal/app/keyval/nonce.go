@@ -0,0 +1,58 @@
+package keyval
+
+import (
+	"encoding/binary"
+	"time"
+
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/util"
+)
+
+// internalKeyPrefix prefixes LevelDB keys that are used by the service itself
+// rather than for stored files. Keys with this prefix are never listed and
+// cannot be written through the blob storage API.
+const internalKeyPrefix = "\x00"
+
+var noncePrefix = []byte(internalKeyPrefix + "nonce/")
+
+// UseNonce records a signature nonce as used until expireAt. It returns false
+// if the nonce had already been used.
+func (k *KeyVal) UseNonce(nonce string, expireAt time.Time) (bool, error) {
+	key := k.dbKey(append(append([]byte{}, noncePrefix...), nonce...))
+	k.mlock.Lock()
+	defer k.mlock.Unlock()
+	db, release := k.database()
+	defer release()
+	if _, err := db.Get(key, nil); err != leveldb.ErrNotFound {
+		return false, err
+	}
+	value := make([]byte, 8)
+	binary.BigEndian.PutUint64(value, uint64(expireAt.UnixMilli()))
+	if err := db.Put(key, value, nil); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// PurgeExpiredNonces removes nonces whose signatures have expired, since they
+// can no longer be replayed anyway.
+func (k *KeyVal) PurgeExpiredNonces() (int, error) {
+	db, release := k.database()
+	defer release()
+	iter := db.NewIterator(util.BytesPrefix(k.dbKey(noncePrefix)), nil)
+	defer iter.Release()
+	now := uint64(time.Now().UnixMilli())
+	batch := new(leveldb.Batch)
+	for iter.Next() {
+		if v := iter.Value(); len(v) != 8 || binary.BigEndian.Uint64(v) < now {
+			batch.Delete(append([]byte{}, iter.Key()...))
+		}
+	}
+	if err := iter.Error(); err != nil {
+		return 0, err
+	}
+	if batch.Len() == 0 {
+		return 0, nil
+	}
+	return batch.Len(), db.Write(batch, nil)
+}
@@ -0,0 +1,235 @@
+package keyval
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gabriel-vasile/mimetype"
+	"github.com/gofiber/fiber/v3"
+	"github.com/jaredLunde/railway-image-service/internal/pkg/httperr"
+	"github.com/jaredLunde/railway-image-service/internal/pkg/mw"
+)
+
+type ReindexStatus struct {
+	Running bool `json:"running"`
+	// Files visited in the volume
+	Scanned int `json:"scanned"`
+	// Records created for files that had none
+	Indexed int `json:"indexed"`
+	// Files that already had a record, or whose key can't be recovered from
+	// their path
+	Skipped    int        `json:"skipped"`
+	Failed     int        `json:"failed"`
+	StartedAt  *time.Time `json:"started_at,omitempty"`
+	FinishedAt *time.Time `json:"finished_at,omitempty"`
+	Error      string     `json:"error,omitempty"`
+}
+
+type reindexJob struct {
+	mu     sync.Mutex
+	status ReindexStatus
+}
+
+func (j *reindexJob) update(fn func(s *ReindexStatus)) {
+	j.mu.Lock()
+	fn(&j.status)
+	j.mu.Unlock()
+}
+
+func (j *reindexJob) Status() ReindexStatus {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return j.status
+}
+
+// StartReindex rebuilds missing records from the files in the volume in the
+// background. It reports false if a reindex is already running.
+func (k *KeyVal) StartReindex(ctx context.Context) (ReindexStatus, bool) {
+	k.reindex.mu.Lock()
+	defer k.reindex.mu.Unlock()
+	if k.reindex.status.Running {
+		return k.reindex.status, false
+	}
+	now := time.Now().UTC()
+	k.reindex.status = ReindexStatus{Running: true, StartedAt: &now}
+	go func() {
+		err := k.Reindex(ctx)
+		k.reindex.update(func(s *ReindexStatus) {
+			finished := time.Now().UTC()
+			s.Running = false
+			s.FinishedAt = &finished
+			if err != nil {
+				s.Error = err.Error()
+			}
+		})
+		status := k.reindex.Status()
+		k.log.Info("reindex finished", "scanned", status.Scanned, "indexed", status.Indexed, "skipped", status.Skipped, "failed", status.Failed, "error", err)
+	}()
+	return k.reindex.status, true
+}
+
+// ReindexStatus returns the progress of the running or last reindex
+func (k *KeyVal) ReindexStatus() ReindexStatus {
+	return k.reindex.Status()
+}
+
+// Reindex lists the files in the backend and creates a record for every file that doesn't
+// have one. The key of a file is recovered from its hex-encoded name, so only
+// files laid out with KeyToPath or a path template ending in {hexkey} can be
+// indexed. Existing records are left untouched and filenames from
+// Content-Disposition are lost.
+func (k *KeyVal) Reindex(ctx context.Context) error {
+	return k.backend.List(ctx, "/", func(info BlobInfo) error {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if strings.HasPrefix(path.Base(info.Path), tempFilePrefix) {
+			return nil
+		}
+		k.reindex.update(func(s *ReindexStatus) { s.Scanned++ })
+
+		indexed, err := k.reindexFile(ctx, info.Path)
+		k.reindex.update(func(s *ReindexStatus) {
+			switch {
+			case err != nil:
+				s.Failed++
+			case indexed:
+				s.Indexed++
+			default:
+				s.Skipped++
+			}
+		})
+		if err != nil {
+			k.log.Error("failed to reindex file", "path", info.Path, "error", err)
+		}
+		return nil
+	})
+}
+
+// reindexFile creates the record of the file at rel if its key can be
+// recovered and it has no record yet
+func (k *KeyVal) reindexFile(ctx context.Context, rel string) (bool, error) {
+	key, ok := k.keyFromPath(rel)
+	if !ok {
+		return false, nil
+	}
+	if !k.LockKey(key) {
+		// a write or delete of the key is in progress and will leave a record
+		return false, nil
+	}
+	defer k.UnlockKey(key)
+	if k.GetRecord(ctx, key).Deleted != HARD {
+		return false, nil
+	}
+
+	rec, err := k.hashFile(ctx, rel)
+	if err != nil {
+		return false, err
+	}
+	if rel != KeyToPath(key) {
+		rec.Path = rel
+	}
+	if err := k.PutRecord(ctx, key, rec); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// keyFromPath recovers the key of a file from its path relative to the volume
+func (k *KeyVal) keyFromPath(rel string) ([]byte, bool) {
+	key, err := hex.DecodeString(path.Base(rel))
+	if err != nil || len(key) == 0 {
+		return nil, false
+	}
+	if rel == KeyToPath(key) {
+		return key, true
+	}
+	// a file named after a clean key with {key} could also be valid hex
+	if strings.Contains(k.pathTemplate, "{hexkey}") && !strings.Contains(k.pathTemplate, "{key}") {
+		return key, true
+	}
+	return nil, false
+}
+
+// hashFile builds the record of a stored file. Files that are compressed at
+// rest are recognized by their gzip header and compressible content.
+func (k *KeyVal) hashFile(ctx context.Context, p string) (Record, error) {
+	f, err := k.backend.Get(ctx, p)
+	if err != nil {
+		return Record{}, err
+	}
+	defer func() { f.Close() }()
+
+	rec := Record{Deleted: NO}
+	br := bufio.NewReader(f)
+	var r io.Reader = br
+	if magic, _ := br.Peek(2); bytes.Equal(magic, []byte{0x1f, 0x8b}) {
+		if gz, err := gzip.NewReader(br); err == nil {
+			head := make([]byte, k.mimeSniffBytes)
+			n, _ := io.ReadFull(gz, head)
+			if isCompressible(mimetype.Detect(head[:n]).String()) {
+				rec.Compression = CompressionGzip
+				r = io.MultiReader(bytes.NewReader(head[:n]), gz)
+			} else {
+				// an upload that was gzipped to begin with
+				f.Close()
+				if f, err = k.backend.Get(ctx, p); err != nil {
+					return Record{}, err
+				}
+				r = f
+			}
+		}
+	}
+
+	hr := bufio.NewReaderSize(r, k.mimeSniffBytes)
+	if head, _ := hr.Peek(k.mimeSniffBytes); len(head) > 0 {
+		rec.ContentType = mimetype.Detect(head).String()
+	}
+
+	h := md5.New()
+	var hashes io.Writer = h
+	var chunks *chunkHasher
+	if k.chunkHashSize > 0 {
+		chunks = newChunkHasher(k.chunkHashSize)
+		hashes = io.MultiWriter(h, chunks)
+	}
+	if rec.Size, err = io.Copy(hashes, hr); err != nil {
+		return Record{}, fmt.Errorf("failed to hash file: %w", err)
+	}
+	rec.Hash = fmt.Sprintf("%x", h.Sum(nil))
+	if chunks != nil {
+		rec.Chunks = chunks.Sum()
+	}
+	return rec, nil
+}
+
+// ReindexHandler starts a reindex on POST and reports its progress on GET.
+// The reindex is cancelled when ctx is done.
+func (k *KeyVal) ReindexHandler(ctx context.Context) fiber.Handler {
+	return func(c fiber.Ctx) error {
+		switch c.Method() {
+		case fiber.MethodGet:
+			return c.JSON(k.ReindexStatus())
+
+		case fiber.MethodPost:
+			status, started := k.StartReindex(ctx)
+			if !started {
+				return c.Status(fiber.StatusConflict).JSON(status)
+			}
+			k.log.Warn("started reindex", "ip", c.IP(), "request_id", mw.RequestID(c))
+			return c.Status(fiber.StatusAccepted).JSON(status)
+		}
+
+		return httperr.SendStatus(c, fiber.StatusMethodNotAllowed)
+	}
+}
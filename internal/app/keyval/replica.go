@@ -0,0 +1,146 @@
+package keyval
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/opt"
+)
+
+// A running primary holds the exclusive file lock of its database, which
+// conflicts with even a read-only open. Replicas open a read-only snapshot of
+// it instead, which is refreshed with RefreshReplica. Writes made by the
+// primary are only visible to a replica after the next refresh.
+type replicaSnapshot struct {
+	db  *leveldb.DB
+	dir string
+	// reads that are using the snapshot
+	users sync.WaitGroup
+}
+
+func (s *replicaSnapshot) close() {
+	if s == nil {
+		return
+	}
+	s.db.Close()
+	os.RemoveAll(s.dir)
+}
+
+// How many times a snapshot is copied before RefreshReplica gives up. The
+// primary can compact away table files while they are copied.
+const snapshotAttempts = 3
+
+// openSnapshot copies the database at path and opens the copy read-only,
+// copying it again if the copy is inconsistent
+func openSnapshot(path string) (*replicaSnapshot, error) {
+	var err error
+	for attempt := 1; attempt <= snapshotAttempts; attempt++ {
+		var snapshot *replicaSnapshot
+		if snapshot, err = copySnapshot(path); err == nil {
+			return snapshot, nil
+		}
+		if attempt < snapshotAttempts {
+			time.Sleep(time.Duration(attempt) * 100 * time.Millisecond)
+		}
+	}
+	return nil, err
+}
+
+// copySnapshot copies the database at path and opens the copy read-only.
+// Table files are immutable, so they are hard linked when possible. A journal
+// that was copied mid-write has its torn tail dropped. Every record of the
+// copy is read once, so a copy missing a table file fails here instead of in
+// a later read.
+func copySnapshot(path string) (*replicaSnapshot, error) {
+	entries, err := os.ReadDir(path)
+	if err != nil {
+		return nil, err
+	}
+	dir, err := os.MkdirTemp("", "leveldb-replica-")
+	if err != nil {
+		return nil, err
+	}
+	for _, entry := range entries {
+		name := entry.Name()
+		if !entry.Type().IsRegular() || name == "LOCK" || strings.HasPrefix(name, "LOG") {
+			continue
+		}
+		src, dst := filepath.Join(path, name), filepath.Join(dir, name)
+		if strings.HasSuffix(name, ".ldb") || strings.HasSuffix(name, ".sst") {
+			if err := os.Link(src, dst); err == nil {
+				continue
+			}
+		}
+		if err := copyFile(src, dst); err != nil {
+			os.RemoveAll(dir)
+			return nil, fmt.Errorf("failed to copy %s: %w", name, err)
+		}
+	}
+	db, err := leveldb.OpenFile(dir, &opt.Options{ReadOnly: true, Strict: opt.NoStrict})
+	if err != nil {
+		os.RemoveAll(dir)
+		return nil, err
+	}
+	iter := db.NewIterator(nil, &opt.ReadOptions{Strict: opt.StrictAll})
+	for iter.Next() {
+	}
+	iter.Release()
+	if err := iter.Error(); err != nil {
+		db.Close()
+		os.RemoveAll(dir)
+		return nil, fmt.Errorf("inconsistent snapshot: %w", err)
+	}
+	return &replicaSnapshot{db: db, dir: dir}, nil
+}
+
+func copyFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
+
+// RefreshReplica replaces the snapshot a replica reads from with a fresh copy
+// of the primary's database. The previous snapshot is closed once the reads
+// that are still using it finish.
+func (k *KeyVal) RefreshReplica() error {
+	if !k.replica {
+		return nil
+	}
+	snapshot, err := openSnapshot(k.dbPath)
+	if err != nil {
+		return err
+	}
+	k.dbMu.Lock()
+	k.db = snapshot.db
+	retired := k.snapshot
+	k.snapshot = snapshot
+	k.dbMu.Unlock()
+	// no read can start using the retired snapshot anymore
+	go func() {
+		retired.users.Wait()
+		retired.close()
+	}()
+	return nil
+}
+
+// IsReplica reports whether the database is a read-only snapshot of a primary
+func (k *KeyVal) IsReplica() bool {
+	return k.replica
+}
@@ -0,0 +1,302 @@
+package keyval
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type S3Config struct {
+	Bucket string
+	// The endpoint of the S3-compatible API, e.g.
+	// https://<account>.r2.cloudflarestorage.com for R2. Defaults to the AWS
+	// endpoint of Region.
+	Endpoint string
+	// Defaults to us-east-1. R2 uses "auto".
+	Region          string
+	AccessKeyID     string
+	SecretAccessKey string
+	// Prefixes the key of every object, so several services can share a bucket
+	Prefix string
+	Client *http.Client
+}
+
+// S3Backend stores files as objects in an S3-compatible bucket, e.g. AWS S3
+// or Cloudflare R2. Requests are signed with AWS Signature Version 4 and
+// address the bucket by path.
+type S3Backend struct {
+	bucket    string
+	endpoint  *url.URL
+	region    string
+	accessKey string
+	secretKey string
+	prefix    string
+	client    *http.Client
+}
+
+func NewS3Backend(cfg S3Config) (*S3Backend, error) {
+	if cfg.Bucket == "" {
+		return nil, fmt.Errorf("missing S3 bucket")
+	}
+	if cfg.AccessKeyID == "" || cfg.SecretAccessKey == "" {
+		return nil, fmt.Errorf("missing S3 credentials")
+	}
+	if cfg.Region == "" {
+		cfg.Region = "us-east-1"
+	}
+	if cfg.Endpoint == "" {
+		cfg.Endpoint = "https://s3." + cfg.Region + ".amazonaws.com"
+	}
+	endpoint, err := url.Parse(cfg.Endpoint)
+	if err != nil || endpoint.Host == "" {
+		return nil, fmt.Errorf("invalid S3 endpoint %q", cfg.Endpoint)
+	}
+	if cfg.Client == nil {
+		cfg.Client = http.DefaultClient
+	}
+	return &S3Backend{
+		bucket:    cfg.Bucket,
+		endpoint:  endpoint,
+		region:    cfg.Region,
+		accessKey: cfg.AccessKeyID,
+		secretKey: cfg.SecretAccessKey,
+		prefix:    strings.TrimPrefix(cfg.Prefix, "/"),
+		client:    cfg.Client,
+	}, nil
+}
+
+// objectKey returns the key of the object of a path
+func (b *S3Backend) objectKey(p string) string {
+	return b.prefix + strings.TrimPrefix(p, "/")
+}
+
+func (b *S3Backend) Put(ctx context.Context, p string, r io.Reader, size int64) error {
+	res, err := b.do(ctx, http.MethodPut, b.objectKey(p), nil, nil, r, size)
+	if err != nil {
+		return err
+	}
+	return drain(res)
+}
+
+func (b *S3Backend) Get(ctx context.Context, p string) (io.ReadCloser, error) {
+	res, err := b.do(ctx, http.MethodGet, b.objectKey(p), nil, nil, nil, 0)
+	if err != nil {
+		return nil, err
+	}
+	return res.Body, nil
+}
+
+// GetRange requests the range with a Range header, so the skipped bytes are
+// never sent
+func (b *S3Backend) GetRange(ctx context.Context, p string, offset, length int64) (io.ReadCloser, error) {
+	if length == 0 {
+		return io.NopCloser(strings.NewReader("")), nil
+	}
+	rng := fmt.Sprintf("bytes=%d-", offset)
+	if length > 0 {
+		rng += strconv.FormatInt(offset+length-1, 10)
+	}
+	res, err := b.do(ctx, http.MethodGet, b.objectKey(p), nil, http.Header{"Range": {rng}}, nil, 0)
+	if err != nil {
+		return nil, err
+	}
+	return res.Body, nil
+}
+
+func (b *S3Backend) Delete(ctx context.Context, p string) error {
+	res, err := b.do(ctx, http.MethodDelete, b.objectKey(p), nil, nil, nil, 0)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil
+		}
+		return err
+	}
+	return drain(res)
+}
+
+func (b *S3Backend) Stat(ctx context.Context, p string) (BlobInfo, error) {
+	res, err := b.do(ctx, http.MethodHead, b.objectKey(p), nil, nil, nil, 0)
+	if err != nil {
+		return BlobInfo{}, err
+	}
+	res.Body.Close()
+	info := BlobInfo{Path: p, Size: res.ContentLength}
+	if modTime, err := http.ParseTime(res.Header.Get("Last-Modified")); err == nil {
+		info.ModTime = modTime
+	}
+	return info, nil
+}
+
+type listBucketResult struct {
+	Contents []struct {
+		Key          string    `xml:"Key"`
+		Size         int64     `xml:"Size"`
+		LastModified time.Time `xml:"LastModified"`
+	} `xml:"Contents"`
+	IsTruncated           bool   `xml:"IsTruncated"`
+	NextContinuationToken string `xml:"NextContinuationToken"`
+}
+
+func (b *S3Backend) List(ctx context.Context, prefix string, fn func(BlobInfo) error) error {
+	query := url.Values{"list-type": {"2"}, "prefix": {b.objectKey(prefix)}}
+	for {
+		res, err := b.do(ctx, http.MethodGet, "", query, nil, nil, 0)
+		if err != nil {
+			return err
+		}
+		var page listBucketResult
+		err = xml.NewDecoder(res.Body).Decode(&page)
+		res.Body.Close()
+		if err != nil {
+			return fmt.Errorf("failed to decode object list: %w", err)
+		}
+		for _, obj := range page.Contents {
+			info := BlobInfo{Path: "/" + strings.TrimPrefix(obj.Key, b.prefix), Size: obj.Size, ModTime: obj.LastModified}
+			if err := fn(info); err != nil {
+				return err
+			}
+		}
+		if !page.IsTruncated || page.NextContinuationToken == "" {
+			return nil
+		}
+		query.Set("continuation-token", page.NextContinuationToken)
+	}
+}
+
+// s3Error is a response from the API with an unexpected status
+type s3Error struct {
+	status int
+	body   string
+}
+
+func (e *s3Error) Error() string {
+	return fmt.Sprintf("s3: unexpected status code %d: %s", e.status, e.body)
+}
+
+func (e *s3Error) Is(target error) bool {
+	return target == fs.ErrNotExist && e.status == http.StatusNotFound
+}
+
+func drain(res *http.Response) error {
+	io.Copy(io.Discard, res.Body)
+	return res.Body.Close()
+}
+
+// do sends a signed request for an object, or the bucket if key is empty.
+// Responses that aren't a 2xx are returned as an *s3Error.
+func (b *S3Backend) do(ctx context.Context, method, key string, query url.Values, header http.Header, body io.Reader, size int64) (*http.Response, error) {
+	u := *b.endpoint
+	u.Path = strings.TrimSuffix(u.Path, "/") + "/" + b.bucket
+	if key != "" {
+		u.Path += "/" + key
+	}
+	u.RawPath = s3Escape(u.Path, false)
+	u.RawQuery = canonicalQuery(query)
+	req, err := http.NewRequestWithContext(ctx, method, u.String(), body)
+	if err != nil {
+		return nil, err
+	}
+	for name, values := range header {
+		req.Header[name] = values
+	}
+	if body != nil {
+		req.ContentLength = size
+	}
+	b.sign(req, time.Now().UTC())
+	res, err := b.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		msg, _ := io.ReadAll(io.LimitReader(res.Body, 1024))
+		res.Body.Close()
+		return nil, &s3Error{status: res.StatusCode, body: string(msg)}
+	}
+	return res, nil
+}
+
+// unsignedPayload skips hashing bodies, which would mean reading them twice
+const unsignedPayload = "UNSIGNED-PAYLOAD"
+
+// sign adds an AWS Signature Version 4 Authorization header to a request
+func (b *S3Backend) sign(req *http.Request, now time.Time) {
+	amzDate := now.Format("20060102T150405Z")
+	scope := now.Format("20060102") + "/" + b.region + "/s3/aws4_request"
+	req.Header.Set("x-amz-date", amzDate)
+	req.Header.Set("x-amz-content-sha256", unsignedPayload)
+
+	const signedHeaders = "host;x-amz-content-sha256;x-amz-date"
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		req.URL.RawQuery,
+		"host:" + req.URL.Host,
+		"x-amz-content-sha256:" + unsignedPayload,
+		"x-amz-date:" + amzDate,
+		"",
+		signedHeaders,
+		unsignedPayload,
+	}, "\n")
+	hash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(hash[:])
+
+	key := []byte("AWS4" + b.secretKey)
+	for _, part := range []string{now.Format("20060102"), b.region, "s3", "aws4_request"} {
+		key = hmacSHA256(key, part)
+	}
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+	req.Header.Set("Authorization", "AWS4-HMAC-SHA256 Credential="+b.accessKey+"/"+scope+
+		", SignedHeaders="+signedHeaders+", Signature="+signature)
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+// canonicalQuery encodes a query string the way Signature Version 4 expects:
+// sorted by name, with spaces as %20
+func canonicalQuery(query url.Values) string {
+	names := make([]string, 0, len(query))
+	for name := range query {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var pairs []string
+	for _, name := range names {
+		for _, value := range query[name] {
+			pairs = append(pairs, s3Escape(name, true)+"="+s3Escape(value, true))
+		}
+	}
+	return strings.Join(pairs, "&")
+}
+
+// s3Escape percent-encodes everything but unreserved characters, and slashes
+// unless escapeSlash is set
+func s3Escape(s string, escapeSlash bool) string {
+	var sb strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case 'A' <= c && c <= 'Z', 'a' <= c && c <= 'z', '0' <= c && c <= '9',
+			c == '-', c == '.', c == '_', c == '~', c == '/' && !escapeSlash:
+			sb.WriteByte(c)
+		default:
+			fmt.Fprintf(&sb, "%%%02X", c)
+		}
+	}
+	return sb.String()
+}
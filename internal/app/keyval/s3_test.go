@@ -0,0 +1,182 @@
+package keyval
+
+import (
+	"bytes"
+	"context"
+	"encoding/xml"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gofiber/fiber/v3"
+)
+
+// fakeS3 serves the subset of the S3 API that S3Backend uses from memory
+type fakeS3 struct {
+	mu      sync.Mutex
+	bucket  string
+	objects map[string][]byte
+	// the Range header of the last request
+	lastRange string
+}
+
+func (s *fakeS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !strings.HasPrefix(r.Header.Get("Authorization"), "AWS4-HMAC-SHA256 Credential=key-id/") {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+	key, ok := strings.CutPrefix(r.URL.Path, "/"+s.bucket+"/")
+	if !ok {
+		s.list(w, r)
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	switch r.Method {
+	case http.MethodPut:
+		data, _ := io.ReadAll(r.Body)
+		s.objects[key] = data
+	case http.MethodGet, http.MethodHead:
+		data, ok := s.objects[key]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		s.lastRange = r.Header.Get("Range")
+		status := http.StatusOK
+		if start, end, ok := parseRange(s.lastRange, int64(len(data))); ok {
+			data, status = data[start:end+1], http.StatusPartialContent
+		}
+		w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+		w.Header().Set("Last-Modified", time.Now().UTC().Format(http.TimeFormat))
+		w.WriteHeader(status)
+		w.Write(data)
+	case http.MethodDelete:
+		delete(s.objects, key)
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+func (s *fakeS3) list(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var res listBucketResult
+	var keys []string
+	for key := range s.objects {
+		if strings.HasPrefix(key, r.URL.Query().Get("prefix")) {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		res.Contents = append(res.Contents, struct {
+			Key          string    `xml:"Key"`
+			Size         int64     `xml:"Size"`
+			LastModified time.Time `xml:"LastModified"`
+		}{Key: key, Size: int64(len(s.objects[key])), LastModified: time.Now().UTC()})
+	}
+	xml.NewEncoder(w).Encode(struct {
+		XMLName xml.Name `xml:"ListBucketResult"`
+		listBucketResult
+	}{listBucketResult: res})
+}
+
+func TestKeyVal_S3Backend(t *testing.T) {
+	s3 := &fakeS3{bucket: "images", objects: map[string][]byte{}}
+	srv := httptest.NewServer(s3)
+	defer srv.Close()
+
+	backend, err := NewS3Backend(S3Config{
+		Bucket:          "images",
+		Endpoint:        srv.URL,
+		Region:          "auto",
+		AccessKeyID:     "key-id",
+		SecretAccessKey: "secret",
+		Prefix:          "uploads/",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	kv, err := New(Config{
+		Backend:          backend,
+		LevelDBPath:      filepath.Join(t.TempDir(), "db"),
+		BasePath:         "/blob",
+		MaxSize:          1 << 20,
+		AllowedMimeTypes: []string{"image/"},
+		Logger:           slog.New(slog.NewTextHandler(io.Discard, nil)),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer kv.Close()
+	if err := kv.Ping(context.Background()); err != nil {
+		t.Fatalf("expected a missing probe object to pass the health check, got %v", err)
+	}
+
+	app := fiber.New(fiber.Config{StreamRequestBody: true})
+	app.Get("/blob/*", kv.ServeHTTP)
+	app.Put("/blob/*", kv.ServeHTTP)
+	app.Delete("/blob/*", kv.ServeHTTP)
+
+	content := testPNG(4096, 'a')
+	res, err := app.Test(httptest.NewRequest(http.MethodPut, "/blob/images/a+b.png", bytes.NewReader(content)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.StatusCode != fiber.StatusCreated {
+		t.Fatalf("expected upload to succeed, got %d", res.StatusCode)
+	}
+	if !bytes.Equal(s3.objects["uploads"+KeyToPath([]byte("images/a+b.png"))], content) {
+		t.Fatal("expected the upload to be stored in the bucket under the prefix")
+	}
+
+	res, err = app.Test(httptest.NewRequest(http.MethodGet, "/blob/images/a+b.png", nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(res.Body)
+	if res.StatusCode != fiber.StatusOK || !bytes.Equal(body, content) {
+		t.Errorf("expected the stored content, got %d", res.StatusCode)
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/blob/images/a+b.png", nil)
+	req.Header.Set("Range", "bytes=100-199")
+	res, err = app.Test(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ = io.ReadAll(res.Body)
+	if res.StatusCode != fiber.StatusPartialContent || !bytes.Equal(body, content[100:200]) {
+		t.Errorf("expected the requested range, got %d", res.StatusCode)
+	}
+	if s3.lastRange != "bytes=100-" {
+		t.Errorf("expected the range to be requested from the bucket, got %q", s3.lastRange)
+	}
+
+	rec := kv.GetRecord(context.Background(), []byte("images/a+b.png"))
+	if err := kv.deleteRecord(context.Background(), []byte("images/a+b.png")); err != nil {
+		t.Fatal(err)
+	}
+	if err := kv.Reindex(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if got := kv.GetRecord(context.Background(), []byte("images/a+b.png")); got.Deleted != NO || got.Hash != rec.Hash {
+		t.Errorf("expected reindex to restore %+v from the bucket, got %+v", rec, got)
+	}
+
+	res, err = app.Test(httptest.NewRequest(http.MethodDelete, "/blob/images/a+b.png?unlink", nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.StatusCode != fiber.StatusNoContent || len(s3.objects) != 0 {
+		t.Errorf("expected the object to be deleted, got %d", res.StatusCode)
+	}
+}
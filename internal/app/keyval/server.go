@@ -2,21 +2,32 @@ package keyval
 
 import (
 	"bytes"
+	"compress/gzip"
+	"context"
 	"crypto/md5"
+	"errors"
 	"fmt"
 	"io"
+	"io/fs"
 	"net/url"
 	"os"
 	"path/filepath"
 	"strconv"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/gabriel-vasile/mimetype"
 	"github.com/gofiber/fiber/v3"
 	"github.com/jaredLunde/railway-image-service/client/sign"
+	"github.com/jaredLunde/railway-image-service/internal/pkg/httperr"
 	"github.com/jaredLunde/railway-image-service/internal/pkg/ptr"
+	"github.com/jaredLunde/railway-image-service/internal/pkg/throttle"
 	"github.com/syndtr/goleveldb/leveldb/util"
 	"github.com/valyala/fasthttp"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
 )
 
 type ListResponse struct {
@@ -29,6 +40,45 @@ const (
 	MAX_QUERY_LIMIT = 1000
 )
 
+const (
+	// The code of a 409 response to a write to a write-once key
+	ErrCodeKeyExists = "key_exists"
+	// The code of a 409 response to a write to a key that is being written
+	// to, which can be retried
+	ErrCodeKeyLocked = "key_locked"
+	// The code of a 409 response to a write to a key whose path collides
+	// with the path of another key, e.g. "a" and "a/b" under the {key} layout
+	ErrCodePathConflict = "path_conflict"
+)
+
+// ErrKeyExists is the message of a 409 response to a write to a write-once key
+const ErrKeyExists = "key already exists"
+
+// sendStatus responds with status, in the error envelope if it's an error
+func sendStatus(c fiber.Ctx, status int) error {
+	if status >= fiber.StatusBadRequest {
+		return httperr.SendStatus(c, status)
+	}
+	c.Status(status)
+	return nil
+}
+
+// sendWriteStatus responds with the status of a write, telling write-once keys
+// apart from locked keys
+func sendWriteStatus(c fiber.Ctx, status int) error {
+	if status == fiber.StatusConflict {
+		return httperr.Send(c, status, httperr.Error{Code: ErrCodeKeyExists, Message: ErrKeyExists})
+	}
+	return sendStatus(c, status)
+}
+
+func sendKeyLocked(c fiber.Ctx) error {
+	return httperr.Send(c, fiber.StatusConflict, httperr.Error{
+		Code:    ErrCodeKeyLocked,
+		Message: "the key is being written to, retry later",
+	})
+}
+
 func (k *KeyVal) QueryHandler(key []byte, c fiber.Ctx) {
 	m := c.Queries()
 	// operation is first query parameter (e.g. ?limit=10)
@@ -39,33 +89,48 @@ func (k *KeyVal) QueryHandler(key []byte, c fiber.Ctx) {
 	if qlimit != "" {
 		nlimit, err := strconv.Atoi(qlimit)
 		if err != nil {
-			c.Status(fiber.StatusBadRequest)
+			httperr.SendMessage(c, fiber.StatusBadRequest, "invalid limit")
 			return
 		}
 		limit = nlimit
 	}
 
-	slice := util.BytesPrefix(key)
+	slice := util.BytesPrefix(k.dbKey(key))
 	if start != "" {
-		slice.Start = []byte(start)
+		cleaned, ok := k.CleanKey([]byte(start))
+		if !ok {
+			httperr.SendMessage(c, fiber.StatusBadRequest, "invalid starting_at key")
+			return
+		}
+		slice.Start = k.dbKey(cleaned)
 	}
-	iter := k.db.NewIterator(slice, nil)
+	db, release := k.database()
+	defer release()
+	iter := db.NewIterator(slice, nil)
 	defer iter.Release()
 	keys := make([]string, 0)
 	next := ""
 	for iter.Next() {
-		rec := toRecord(iter.Value())
+		key := iter.Key()[len(k.namespace):]
+		if bytes.HasPrefix(key, []byte(internalKeyPrefix)) {
+			continue
+		}
+		rec, err := toRecord(iter.Value())
+		if err != nil {
+			k.log.Error("failed to decode record", "key", string(key), "error", err)
+			continue
+		}
 		if (rec.Deleted != NO) ||
 			(rec.Deleted != SOFT && unlinkedOpOk) {
 			continue
 		}
 		if len(keys) > MAX_QUERY_LIMIT {
-			c.Status(fiber.StatusRequestEntityTooLarge)
+			httperr.SendMessage(c, fiber.StatusRequestEntityTooLarge, "too many keys, set a limit")
 			return
 		}
-		keys = append(keys, string(iter.Key()))
+		keys = append(keys, string(key))
 		if limit > 0 && len(keys) > limit { // limit results returned
-			next = string(iter.Key())
+			next = string(key)
 			keys = keys[:limit]
 			break
 		}
@@ -85,12 +150,12 @@ func (k *KeyVal) QueryHandler(key []byte, c fiber.Ctx) {
 	if nextPage != "" {
 		nextPageURL, err := url.Parse(nextPage)
 		if err != nil {
-			c.Status(fiber.StatusInternalServerError)
+			httperr.SendStatus(c, fiber.StatusInternalServerError)
 			return
 		}
 		signedURL, err = sign.SignURL(nextPageURL, k.signSecret)
 		if err != nil {
-			c.Status(fiber.StatusInternalServerError)
+			httperr.SendStatus(c, fiber.StatusInternalServerError)
 			return
 		}
 	}
@@ -100,201 +165,492 @@ func (k *KeyVal) QueryHandler(key []byte, c fiber.Ctx) {
 	c.JSON(ListResponse{NextPage: *signedURL, HasMore: next != "", Keys: keys})
 }
 
-func (k *KeyVal) Delete(key []byte, unlink bool) int {
+func (k *KeyVal) Delete(ctx context.Context, key []byte, unlink bool) int {
 	// delete the key, first locally
-	rec := k.GetRecord(key)
+	rec := k.GetRecord(ctx, key)
 	if rec.Deleted == HARD || (unlink && rec.Deleted == SOFT) {
 		return fiber.StatusNotFound
 	}
 
-	if !unlink && k.softDelete && rec.Deleted == NO {
+	softDelete := k.SoftDelete(key)
+	if !unlink && softDelete && rec.Deleted == NO {
 		return fiber.StatusForbidden
 	}
 
+	// without soft delete, unlinking is a hard delete
+	if !softDelete {
+		unlink = false
+	}
+
 	// mark as deleted
-	if err := k.PutRecord(key, Record{SOFT, rec.Hash}); err != nil {
+	rec.Deleted = SOFT
+	rec.DeletedAt = time.Now().UTC()
+	if err := k.PutRecord(ctx, key, rec); err != nil {
 		k.log.Error("failed to put record", "error", err)
 		return fiber.StatusInternalServerError
 	}
 
 	if !unlink {
-		if err := os.Remove(filepath.Join(k.volume, KeyToPath(key))); err != nil {
+		if err := k.backend.Delete(context.Background(), blobPath(key, rec)); err != nil {
 			k.log.Error("failed to delete file", "error", err)
 			return fiber.StatusInternalServerError
 		}
 
 		// this is a hard delete in the database, aka nothing
-		k.db.Delete(key, nil)
+		k.deleteRecord(ctx, key)
+		if err := k.forgetAccess(key); err != nil {
+			k.log.Error("failed to delete access count", "error", err)
+		}
+		k.emit(Event{Type: EventDeleted, Key: string(key), Hash: rec.Hash})
+	} else {
+		k.emit(Event{Type: EventUnlinked, Key: string(key), Hash: rec.Hash})
 	}
 
 	// 204, all good
 	return fiber.StatusNoContent
 }
 
-func (k *KeyVal) Write(key []byte, value io.Reader, valueLen int) int {
+type WriteOptions struct {
+	// The original filename of the upload, used for Content-Disposition
+	Filename string
+	// The Content-Type declared by the client. It is only trusted for content
+	// that can't be detected, and only with AllowUnknownTypes.
+	ContentType string
+}
+
+// WriteResult describes the content stored by a write
+type WriteResult struct {
+	// The MD5 of the content
+	Hash string
+	// The size of the content, before any compression at rest
+	Size int64
+	// The detected content type. Empty for empty content.
+	ContentType string
+}
+
+// acceptType reports whether content of the detected type may be stored
+func (k *KeyVal) acceptType(key []byte, detected *mimetype.MIME, declared string) bool {
+	declared, _, _ = strings.Cut(declared, ";")
+	declared = strings.ToLower(strings.TrimSpace(declared))
+	unknown := detected.Is("application/octet-stream")
+	if declared != "" && declared != "application/octet-stream" && !unknown && !detected.Is(declared) {
+		k.log.Warn("declared content type does not match the content", "key", string(key), "detected", detected.String(), "declared", declared)
+	}
+	if k.allowedType(detected.String()) {
+		return true
+	}
+	if !unknown || !k.allowUnknownTypes {
+		return false
+	}
+	// the declared type can only narrow what is accepted
+	return declared == "" || declared == "application/octet-stream" || k.allowedType(declared)
+}
+
+func (k *KeyVal) allowedType(mtype string) bool {
+	for _, allowed := range k.allowedMimeTypes {
+		if strings.HasPrefix(mtype, allowed) {
+			return true
+		}
+	}
+	return false
+}
+
+// Write stores value under key, returning the status of the write
+func (k *KeyVal) Write(ctx context.Context, key []byte, value io.Reader, valueLen int, opts WriteOptions) int {
+	_, status := k.WriteWithResult(ctx, key, value, valueLen, opts)
+	return status
+}
+
+// WriteWithResult is Write, also returning what was stored when the write
+// succeeds
+func (k *KeyVal) WriteWithResult(ctx context.Context, key []byte, value io.Reader, valueLen int, opts WriteOptions) (WriteResult, int) {
+	ctx, span := tracer.Start(ctx, "keyval.write", trace.WithAttributes(attribute.String("blob.key", string(key))))
+	defer span.End()
+	res, status := k.write(ctx, key, value, valueLen, opts)
+	span.SetAttributes(attribute.Int("keyval.write.status", status), attribute.Int64("blob.size", res.Size))
+	if status >= fiber.StatusInternalServerError {
+		span.SetStatus(codes.Error, "write failed")
+	}
+	return res, status
+}
+
+func (k *KeyVal) write(ctx context.Context, key []byte, value io.Reader, valueLen int, opts WriteOptions) (WriteResult, int) {
 	if valueLen > k.maxFileSize {
-		return fiber.StatusRequestEntityTooLarge
+		return WriteResult{}, fiber.StatusRequestEntityTooLarge
 	}
 
 	succeeded := false
-	recordNotFound := k.GetRecord(key).Deleted == HARD
+	prev := k.GetRecord(ctx, key)
+	if prev.Deleted == NO && k.WriteOnce(key) {
+		return WriteResult{}, fiber.StatusConflict
+	}
+	recordNotFound := prev.Deleted == HARD
 	if recordNotFound {
-		if err := k.PutRecord(key, Record{SOFT, ""}); err != nil {
+		if err := k.PutRecord(ctx, key, Record{Deleted: SOFT}); err != nil {
 			k.log.Error("failed to put record", "error", err)
-			return fiber.StatusInternalServerError
+			return WriteResult{}, fiber.StatusInternalServerError
 		}
 	}
 
 	defer func() {
 		if !succeeded && recordNotFound {
-			k.db.Delete(key, nil)
+			k.deleteRecord(ctx, key)
 		}
 	}()
 
-	fp := filepath.Join(k.volume, KeyToPath(key))
-	if err := os.MkdirAll(filepath.Dir(fp), 0755); err != nil {
+	now := time.Now().UTC()
+	relPath := k.resolvePath(key, now)
+	if k.pathConflict(relPath) {
+		k.log.Warn("path collides with another key", "key", string(key), "path", relPath)
+		return WriteResult{}, fiber.StatusBadRequest
+	}
+	// the span of spooling the file and moving it into place
+	_, fileSpan := tracer.Start(ctx, "keyval.write.file")
+	endFileSpan := sync.OnceFunc(func() { fileSpan.End() })
+	defer endFileSpan()
+	// uploads to a local backend are spooled next to their destination, so
+	// they can be renamed into place
+	dir := k.spoolDir()
+	if k.local != nil {
+		dir = filepath.Dir(k.local.FilePath(relPath))
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
 		k.log.Error("failed to create directory", "error", err)
-		return fiber.StatusInternalServerError
+		return WriteResult{}, fiber.StatusInternalServerError
 	}
 
-	tmpFile, err := os.CreateTemp(filepath.Dir(fp), "tmp-*")
+	tmpFile, err := k.createTemp(dir)
 	if err != nil {
 		k.log.Error("failed to create temp file", "error", err)
-		return fiber.StatusInternalServerError
+		return WriteResult{}, fiber.StatusInternalServerError
 	}
 	defer os.Remove(tmpFile.Name()) // Clean up temp file on any error
 	defer tmpFile.Close()
 
 	h := md5.New()
+	var hashes io.Writer = h
+	var chunks *chunkHasher
+	if k.chunkHashSize > 0 {
+		chunks = newChunkHasher(k.chunkHashSize)
+		hashes = io.MultiWriter(h, chunks)
+	}
 	buf := make([]byte, 32*1024)
 	limitedReader := io.LimitReader(value, int64(k.maxFileSize+1))
-	teeReader := io.TeeReader(limitedReader, h)
-	prefix := make([]byte, 512)
-	n, _ := io.ReadFull(teeReader, prefix)
-	if n == 0 {
-		return fiber.StatusBadRequest
+	teeReader := io.TeeReader(limitedReader, hashes)
+	prefix := make([]byte, k.mimeSniffBytes)
+	n, err := io.ReadFull(teeReader, prefix)
+	if errors.Is(err, throttle.ErrIdleTimeout) {
+		k.log.Warn("upload stalled", "key", string(key), "timeout", k.uploadIdleTimeout)
+		return WriteResult{}, fiber.StatusRequestTimeout
 	}
-
-	mtype := mimetype.Detect(prefix[:n])
-	var validType bool
-	for _, allowed := range k.allowedMimeTypes {
-		if strings.HasPrefix(mtype.String(), allowed) {
-			validType = true
-			break
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		k.log.Error("failed to read upload", "error", err)
+		return WriteResult{}, fiber.StatusBadRequest
+	}
+	var mtype *mimetype.MIME
+	if n == 0 {
+		// the type of empty content can't be detected, so it bypasses the
+		// allowed types
+		if !k.allowEmptyFiles {
+			return WriteResult{}, fiber.StatusBadRequest
 		}
+	} else if mtype = mimetype.Detect(prefix[:n]); !k.acceptType(key, mtype, opts.ContentType) {
+		return WriteResult{}, fiber.StatusUnsupportedMediaType
+	}
+	if k.requireExtension && !k.acceptExtension(key, mtype) {
+		k.log.Warn("file extension is missing or does not match the content", "key", string(key), "detected", mtype)
+		return WriteResult{}, fiber.StatusBadRequest
 	}
-	if !validType {
-		return fiber.StatusUnsupportedMediaType
+
+	var dst io.Writer = tmpFile
+	var gz *gzip.Writer
+	var compression string
+	if k.compressAtRest && mtype != nil && isCompressible(mtype.String()) {
+		gz = gzip.NewWriter(tmpFile)
+		dst = gz
+		compression = CompressionGzip
 	}
 
 	// Combine the prefix we read with the remaining stream
 	combined := io.MultiReader(bytes.NewReader(prefix[:n]), teeReader)
-	written, err := io.CopyBuffer(tmpFile, combined, buf)
+	written, err := io.CopyBuffer(dst, combined, buf)
+	if errors.Is(err, throttle.ErrIdleTimeout) {
+		k.log.Warn("upload stalled", "key", string(key), "timeout", k.uploadIdleTimeout)
+		return WriteResult{}, fiber.StatusRequestTimeout
+	}
 	if err != nil {
-		if err != io.EOF {
-			return fiber.StatusInternalServerError
-		}
+		// Most likely the client went away mid-upload. The final file is only
+		// ever replaced by a rename of a complete temp file, so bail out here.
+		k.log.Error("failed to write upload", "error", err)
+		return WriteResult{}, fiber.StatusBadRequest
 	}
 
 	// Check if we hit the size limit
 	if written >= int64(k.maxFileSize) {
-		return fiber.StatusRequestEntityTooLarge
+		return WriteResult{}, fiber.StatusRequestEntityTooLarge
+	}
+
+	// A body shorter than its Content-Length means the upload was cut off
+	if valueLen > 0 && written != int64(valueLen) {
+		k.log.Error("incomplete upload", "expected", valueLen, "written", written)
+		return WriteResult{}, fiber.StatusBadRequest
+	}
+
+	if gz != nil {
+		if err := gz.Close(); err != nil {
+			k.log.Error("failed to compress upload", "error", err)
+			return WriteResult{}, fiber.StatusInternalServerError
+		}
 	}
 
 	hash := fmt.Sprintf("%x", h.Sum(nil))
 
 	// Sync temporary file to disk
-	if err := tmpFile.Sync(); err != nil {
-		k.log.Error("failed to sync temp file", "error", err)
-		return fiber.StatusInternalServerError
+	if k.fsyncOnWrite {
+		if err := tmpFile.Sync(); err != nil {
+			k.log.Error("failed to sync temp file", "error", err)
+			return WriteResult{}, fiber.StatusInternalServerError
+		}
+	}
+
+	if err := tmpFile.Close(); err != nil {
+		k.log.Error("failed to close temp file", "error", err)
+		return WriteResult{}, fiber.StatusInternalServerError
 	}
 
-	tmpFile.Close()
-	if err := os.Rename(tmpFile.Name(), fp); err != nil {
+	var color string
+	if k.extractColor != nil && gz == nil && mtype != nil && strings.HasPrefix(mtype.String(), "image/") {
+		// a missing color shouldn't fail the upload
+		if color, err = k.extractColor(tmpFile.Name()); err != nil {
+			k.log.Warn("failed to extract color", "key", string(key), "error", err)
+		}
+	}
+	if err := k.commit(context.Background(), tmpFile.Name(), relPath); err != nil {
 		k.log.Error("failed to move temp file", "error", err)
-		return fiber.StatusInternalServerError
+		return WriteResult{}, fiber.StatusInternalServerError
 	}
+	endFileSpan()
 
 	// Push to leveldb as existing
-	if err := k.PutRecord(key, Record{NO, hash}); err != nil {
+	rec := Record{Deleted: NO, Hash: hash, Filename: opts.Filename, Compression: compression, DominantColor: color, Size: written, CreatedAt: now, ModifiedAt: now}
+	if mtype != nil {
+		rec.ContentType = mtype.String()
+	}
+	if prev.Deleted == NO && !prev.CreatedAt.IsZero() {
+		// an overwrite keeps the creation time of the key
+		rec.CreatedAt = prev.CreatedAt
+	}
+	if chunks != nil {
+		rec.Chunks = chunks.Sum()
+	}
+	if k.pathTemplate != "" {
+		rec.Path = relPath
+	}
+	if err := k.PutRecord(ctx, key, rec); err != nil {
 		k.log.Error("failed to put record", "error", err)
-		return fiber.StatusInternalServerError
+		if recordNotFound {
+			// don't leave an orphaned file behind for a key that never existed
+			k.backend.Delete(context.Background(), relPath)
+		}
+		return WriteResult{}, fiber.StatusInternalServerError
 	}
 
 	succeeded = true
+	// an overwrite laid out under a different path leaves the old file behind
+	if !recordNotFound {
+		if prevPath := blobPath(key, prev); prevPath != relPath {
+			if err := k.backend.Delete(context.Background(), prevPath); err != nil {
+				k.log.Error("failed to remove previous file", "error", err)
+			}
+		}
+	}
+	res := WriteResult{Hash: hash, Size: written, ContentType: rec.ContentType}
+	k.emit(Event{Type: EventUploaded, Key: string(key), Hash: hash, Size: written, ContentType: res.ContentType})
 	// 201, all good
-	return fiber.StatusCreated
+	return res, fiber.StatusCreated
 }
 
 func (k *KeyVal) ServeHTTP(c fiber.Ctx) error {
-	url := c.Request().URI()
+	uri := c.Request().URI()
 	method := c.Method()
-	key := url.Path()
+	key := uri.Path()
 	m := c.Queries()
 
 	// List query
 	if string(key) == k.basePath && method == fiber.MethodGet {
-		k.QueryHandler([]byte(c.Query("prefix", "")), c)
+		prefix, ok := k.CleanKey([]byte(c.Query("prefix", "")))
+		if !ok {
+			return httperr.SendMessage(c, fiber.StatusBadRequest, "invalid prefix")
+		}
+		k.QueryHandler(prefix, c)
 		return nil
 	}
 
-	key = bytes.Replace(key, []byte(k.basePath), []byte(""), 1)
-	if bytes.HasPrefix(key, []byte("/")) {
-		key = key[1:]
+	key, ok := k.requestKey(c)
+	if !ok || bytes.HasPrefix(key, []byte(internalKeyPrefix)) {
+		return httperr.SendMessage(c, fiber.StatusBadRequest, "invalid key")
+	}
+	if _, ok := m["variants"]; ok && method == fiber.MethodGet {
+		return k.sendVariants(c, key)
+	}
+	key, problem := k.variantKey(c, key)
+	if problem != "" {
+		return httperr.SendMessage(c, fiber.StatusBadRequest, problem)
+	}
+	if _, ok := m["stat"]; ok && method == fiber.MethodGet {
+		return k.sendMetadata(c, key)
 	}
 
 	// Lock the key while a PUT or DELETE is in progress
 	if method == fiber.MethodPost || method == fiber.MethodPut || method == fiber.MethodDelete {
 		if !k.LockKey(key) {
-			// Retry later
-			c.Status(fiber.StatusConflict)
-			return nil
+			return sendKeyLocked(c)
 		}
 		defer k.UnlockKey(key)
 	}
 
 	switch method {
 	case fiber.MethodGet, fiber.MethodHead:
-		rec := k.GetRecord(key)
-		var fp string
+		rec := k.GetRecord(c.Context(), key)
 		if len(rec.Hash) != 0 {
 			// note that the hash is always of the whole file, not the content requested
 			c.Set("Content-Md5", rec.Hash)
 		}
 		if rec.Deleted == SOFT || rec.Deleted == HARD {
-			c.Set("Content-Length", "0")
-			c.Status(fiber.StatusNotFound)
-			return nil
+			return httperr.SendStatus(c, fiber.StatusNotFound)
+		}
+		if rec.DominantColor != "" {
+			c.Set("x-dominant-color", rec.DominantColor)
 		}
 
 		// check if the file exists
-		if _, err := os.Stat(filepath.Join(k.volume, KeyToPath(key))); err != nil {
-			c.Set("Content-Length", "0")
-			c.Status(fiber.StatusNotFound)
-			return nil
+		p := blobPath(key, rec)
+		info, err := k.backend.Stat(c.Context(), p)
+		if err != nil {
+			if !errors.Is(err, fs.ErrNotExist) {
+				k.log.Error("failed to stat file", "error", err)
+			}
+			return httperr.SendStatus(c, fiber.StatusNotFound)
 		}
 
+		if _, ok := m["hashes"]; ok && method == fiber.MethodGet {
+			return k.sendChunkHashes(c, rec)
+		}
+
+		if disposition := k.contentDisposition(key, rec, c.Query("download")); disposition != "" {
+			c.Set(fiber.HeaderContentDisposition, disposition)
+		}
+
+		if rec.Compression != "" {
+			return k.sendCompressed(c, p, info, rec)
+		}
+
+		tag := etag(rec)
+		if tag != "" {
+			c.Set(fiber.HeaderETag, tag)
+		}
+		if c.Get(fiber.HeaderRange) != "" && !ifRange(c, tag, info.ModTime) {
+			// the entity changed since the client got the rest of it
+			c.Request().Header.Del(fiber.HeaderRange)
+		}
+
+		if rec.ContentType != "" {
+			c.Set(fiber.HeaderContentType, rec.ContentType)
+		}
 		c.Status(fiber.StatusOK)
+		if method == fiber.MethodHead {
+			c.Set(fiber.HeaderAcceptRanges, "bytes")
+			c.Set(fiber.HeaderContentLength, strconv.FormatInt(info.Size, 10))
+		}
 		if method == "GET" {
-			fp = filepath.Join(k.volume, KeyToPath(key))
-			c.SendFile(fp)
+			k.RecordAccess(key)
+			bps := k.downloadRateLimit(c)
+			if k.sendfileHeader != "" && (bps == 0 || strings.EqualFold(k.sendfileHeader, "X-Accel-Redirect")) {
+				return k.sendfile(c, k.local.FilePath(p), rec.ContentType, bps)
+			}
+			if k.local == nil || bps > 0 || k.downloadSlots != nil {
+				return k.sendThrottled(c, p, rec.ContentType, info, bps)
+			}
+			c.SendFile(k.local.FilePath(p), fiber.SendFile{ByteRange: true})
+			if rec.ContentType != "" {
+				// SendFile guesses the type from the name of the file
+				c.Set(fiber.HeaderContentType, rec.ContentType)
+			}
 		}
 
 	case fiber.MethodPut:
 		contentLength := c.Request().Header.ContentLength()
-		if contentLength == 0 {
-			c.Status(fiber.StatusLengthRequired)
-			return nil
+		if contentLength == 0 && !k.allowEmptyFiles {
+			return httperr.SendMessage(c, fiber.StatusLengthRequired, "content length required")
+		}
+		if k.pathConflict(k.resolvePath(key, time.Now().UTC())) {
+			return httperr.Send(c, fiber.StatusConflict, httperr.Error{
+				Code:    ErrCodePathConflict,
+				Message: "the path of the key collides with the path of another key",
+			})
 		}
 
-		status := k.Write(key, c.Request().BodyStream(), contentLength)
-		c.Status(status)
+		res, status := k.WriteWithResult(c.Context(), key, k.uploadBody(c), contentLength, WriteOptions{
+			Filename:    uploadFilename(c.Get(fiber.HeaderContentDisposition)),
+			ContentType: c.Get(fiber.HeaderContentType),
+		})
+		if status == fiber.StatusCreated && wantsUploadResponse(c) {
+			return k.sendUploadResponse(c, key, res)
+		}
+		return sendWriteStatus(c, status)
 
 	case fiber.MethodDelete:
 		_, unlink := m["unlink"]
-		status := k.Delete(key, unlink)
-		c.Status(status)
+		return sendStatus(c, k.Delete(c.Context(), key, unlink))
 	}
 
 	return nil
 }
+
+// UploadResponse is the body of a successful upload when the client asks for
+// JSON with ?response=json or an Accept header
+type UploadResponse struct {
+	Key         string `json:"key"`
+	Hash        string `json:"hash"`
+	Size        int64  `json:"size"`
+	ContentType string `json:"content_type"`
+	// A signed /serve URL of the file, relative unless PublicURL is set. Only
+	// set for images when there is a sign secret.
+	ServeURL string `json:"serve_url,omitempty"`
+}
+
+func wantsUploadResponse(c fiber.Ctx) bool {
+	return c.Query("response") == "json" || strings.Contains(c.Get(fiber.HeaderAccept), fiber.MIMEApplicationJSON)
+}
+
+func (k *KeyVal) sendUploadResponse(c fiber.Ctx, key []byte, res WriteResult) error {
+	body := UploadResponse{Key: string(key), Hash: res.Hash, Size: res.Size, ContentType: res.ContentType}
+	if strings.HasPrefix(res.ContentType, "image/") && k.signSecret != "" {
+		serveURL, err := url.Parse(k.publicURL)
+		if err != nil {
+			return httperr.SendStatus(c, fiber.StatusInternalServerError)
+		}
+		serveURL.Path += "/serve/blob/" + string(key)
+		signedURL, err := sign.SignURL(serveURL, k.signSecret)
+		if err != nil {
+			return httperr.SendStatus(c, fiber.StatusInternalServerError)
+		}
+		body.ServeURL = *signedURL
+	}
+	return c.Status(fiber.StatusCreated).JSON(body)
+}
+
+// uploadBody returns the request body, throttled to UploadRateLimit. Time spent
+// throttling doesn't count towards UploadIdleTimeout.
+func (k *KeyVal) uploadBody(c fiber.Ctx) io.Reader {
+	var deadline time.Time
+	if k.uploadTimeout > 0 {
+		deadline = c.Context().Time().Add(k.uploadTimeout)
+	}
+	var conn throttle.ReadDeadliner
+	if nc := c.Context().Conn(); nc != nil {
+		conn = nc
+	}
+	body := throttle.NewIdleTimeoutReader(c.Request().BodyStream(), conn, k.uploadIdleTimeout, deadline)
+	return throttle.NewReader(body, k.uploadRateLimitBPS)
+}
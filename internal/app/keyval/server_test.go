@@ -0,0 +1,1593 @@
+package keyval
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"testing/iotest"
+	"time"
+
+	"github.com/gofiber/fiber/v3"
+	"github.com/jaredLunde/railway-image-service/client/sign"
+	"github.com/jaredLunde/railway-image-service/internal/pkg/httperr"
+	"go.opentelemetry.io/otel"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+)
+
+func newTestKeyVal(t *testing.T) *KeyVal {
+	t.Helper()
+	dir := t.TempDir()
+	kv, err := New(Config{
+		UploadPath:       filepath.Join(dir, "uploads"),
+		LevelDBPath:      filepath.Join(dir, "db"),
+		MaxSize:          1 << 20,
+		AllowedMimeTypes: []string{"image/"},
+		FsyncOnWrite:     true,
+		Logger:           slog.New(slog.NewTextHandler(io.Discard, nil)),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { kv.Close() })
+	return kv
+}
+
+func testPNG(size int, fill byte) []byte {
+	data := bytes.Repeat([]byte{fill}, size)
+	copy(data, "\x89PNG\r\n\x1a\n")
+	return data
+}
+
+func TestKeyVal_Write_Interrupted(t *testing.T) {
+	key := []byte("images/interrupted.png")
+	original := testPNG(64*1024, 'a')
+	replacement := testPNG(64*1024, 'b')
+
+	tests := []struct {
+		name   string
+		reader func() io.Reader
+	}{
+		{
+			name: "read error mid-stream",
+			reader: func() io.Reader {
+				return io.MultiReader(
+					bytes.NewReader(replacement[:40*1024]),
+					iotest.ErrReader(errors.New("connection reset by peer")),
+				)
+			},
+		},
+		{
+			name: "body shorter than content length",
+			reader: func() io.Reader {
+				return bytes.NewReader(replacement[:40*1024])
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			kv := newTestKeyVal(t)
+			if status := kv.Write(context.Background(), key, bytes.NewReader(original), len(original), WriteOptions{}); status != fiber.StatusCreated {
+				t.Fatalf("expected initial write to succeed, got %d", status)
+			}
+
+			status := kv.Write(context.Background(), key, tt.reader(), len(replacement), WriteOptions{})
+			if status == fiber.StatusCreated {
+				t.Fatalf("expected interrupted write to fail")
+			}
+
+			fp := filepath.Join(kv.volume, KeyToPath(key))
+			data, err := os.ReadFile(fp)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(data, original) {
+				t.Errorf("expected the original file to be left intact")
+			}
+
+			rec := kv.GetRecord(context.Background(), key)
+			if rec.Deleted != NO || rec.Hash != fmt.Sprintf("%x", md5.Sum(original)) {
+				t.Errorf("expected the original record to be left intact, got %+v", rec)
+			}
+
+			entries, err := os.ReadDir(filepath.Dir(fp))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(entries) != 1 {
+				t.Errorf("expected temp files to be cleaned up, found %d entries", len(entries))
+			}
+		})
+	}
+
+	t.Run("new key", func(t *testing.T) {
+		kv := newTestKeyVal(t)
+		status := kv.Write(context.Background(), key, bytes.NewReader(replacement[:40*1024]), len(replacement), WriteOptions{})
+		if status == fiber.StatusCreated {
+			t.Fatalf("expected interrupted write to fail")
+		}
+		if rec := kv.GetRecord(context.Background(), key); rec.Deleted != HARD {
+			t.Errorf("expected no record for an interrupted new key, got %+v", rec)
+		}
+		if _, err := os.Stat(filepath.Join(kv.volume, KeyToPath(key))); !os.IsNotExist(err) {
+			t.Errorf("expected no file for an interrupted new key")
+		}
+	})
+}
+
+func TestKeyVal_CompressAtRest(t *testing.T) {
+	kv := newTestKeyVal(t)
+	kv.basePath = "/blob"
+	kv.compressAtRest = true
+	kv.allowedMimeTypes = []string{"image/", "text/"}
+
+	app := fiber.New(fiber.Config{StreamRequestBody: true})
+	app.Get("/blob/*", kv.ServeHTTP)
+	app.Put("/blob/*", kv.ServeHTTP)
+
+	content := bytes.Repeat([]byte("hello, world\n"), 1024)
+	res, err := app.Test(httptest.NewRequest(http.MethodPut, "/blob/notes.txt", bytes.NewReader(content)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.StatusCode != fiber.StatusCreated {
+		t.Fatalf("expected upload to succeed, got %d", res.StatusCode)
+	}
+
+	rec := kv.GetRecord(context.Background(), []byte("notes.txt"))
+	if rec.Compression != CompressionGzip {
+		t.Errorf("expected the record to be marked as compressed, got %q", rec.Compression)
+	}
+	if rec.Hash != fmt.Sprintf("%x", md5.Sum(content)) {
+		t.Errorf("expected the hash of the uncompressed content")
+	}
+	stat, err := os.Stat(filepath.Join(kv.volume, KeyToPath([]byte("notes.txt"))))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stat.Size() >= int64(len(content)) {
+		t.Errorf("expected the stored file to be compressed")
+	}
+
+	res, err = app.Test(httptest.NewRequest(http.MethodGet, "/blob/notes.txt", nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(res.Body)
+	if res.Header.Get("Content-Encoding") != "" || !bytes.Equal(body, content) {
+		t.Errorf("expected the decompressed content")
+	}
+	if vary := res.Header.Get(fiber.HeaderVary); vary != fiber.HeaderAcceptEncoding {
+		t.Errorf("expected Vary: Accept-Encoding, got %q", vary)
+	}
+	if ct := res.Header.Get("Content-Type"); !strings.HasPrefix(ct, "text/plain") {
+		t.Errorf("expected a text/plain content type, got %q", ct)
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/blob/notes.txt", nil)
+	req.Header.Set("Accept-Encoding", "gzip")
+	res, err = app.Test(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Header.Get("Content-Encoding") != "gzip" {
+		t.Fatalf("expected gzip content encoding, got %q", res.Header.Get("Content-Encoding"))
+	}
+	if vary := res.Header.Get(fiber.HeaderVary); vary != fiber.HeaderAcceptEncoding {
+		t.Errorf("expected Vary: Accept-Encoding, got %q", vary)
+	}
+	gz, err := gzip.NewReader(res.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ = io.ReadAll(gz)
+	if !bytes.Equal(body, content) {
+		t.Errorf("expected the compressed bytes to decompress to the original content")
+	}
+}
+
+func TestKeyVal_IfRange(t *testing.T) {
+	kv := newTestKeyVal(t)
+	kv.basePath = "/blob"
+	app := fiber.New()
+	app.Get("/blob/*", kv.ServeHTTP)
+
+	content := testPNG(4096, 'a')
+	if status := kv.Write(context.Background(), []byte("range.png"), bytes.NewReader(content), len(content), WriteOptions{}); status != fiber.StatusCreated {
+		t.Fatalf("unexpected status %d", status)
+	}
+	rec := kv.GetRecord(context.Background(), []byte("range.png"))
+	stat, err := os.Stat(kv.FilePath([]byte("range.png"), rec))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		ifRange string
+		want    int
+	}{
+		{"no precondition", "", fiber.StatusPartialContent},
+		{"matching etag", `"` + rec.Hash + `"`, fiber.StatusPartialContent},
+		{"changed etag", `"5d41402abc4b2a76b9719d911017c592"`, fiber.StatusOK},
+		{"weak etag", `W/"` + rec.Hash + `"`, fiber.StatusOK},
+		{"matching date", stat.ModTime().UTC().Format(http.TimeFormat), fiber.StatusPartialContent},
+		{"changed date", stat.ModTime().Add(-time.Hour).UTC().Format(http.TimeFormat), fiber.StatusOK},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/blob/range.png", nil)
+			req.Header.Set("Range", "bytes=0-99")
+			if tt.ifRange != "" {
+				req.Header.Set("If-Range", tt.ifRange)
+			}
+			res, err := app.Test(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			body, _ := io.ReadAll(res.Body)
+			if res.StatusCode != tt.want {
+				t.Fatalf("expected status %d, got %d", tt.want, res.StatusCode)
+			}
+			want := content
+			if tt.want == fiber.StatusPartialContent {
+				want = content[:100]
+			}
+			if !bytes.Equal(body, want) {
+				t.Errorf("expected %d bytes, got %d", len(want), len(body))
+			}
+		})
+	}
+}
+
+func TestKeyVal_DownloadRateLimit(t *testing.T) {
+	kv := newTestKeyVal(t)
+	kv.basePath = "/blob"
+	kv.downloadRateLimitBPS = 1 << 20
+	app := fiber.New()
+	app.Get("/blob/*", kv.ServeHTTP)
+
+	content := testPNG(4096, 'a')
+	if status := kv.Write(context.Background(), []byte("throttled.png"), bytes.NewReader(content), len(content), WriteOptions{}); status != fiber.StatusCreated {
+		t.Fatalf("unexpected status %d", status)
+	}
+
+	tests := []struct {
+		name         string
+		rangeHeader  string
+		want         int
+		contentRange string
+		body         []byte
+	}{
+		{"whole file", "", fiber.StatusOK, "", content},
+		{"first bytes", "bytes=0-99", fiber.StatusPartialContent, "bytes 0-99/4096", content[:100]},
+		{"open ended", "bytes=4000-", fiber.StatusPartialContent, "bytes 4000-4095/4096", content[4000:]},
+		{"suffix", "bytes=-10", fiber.StatusPartialContent, "bytes 4086-4095/4096", content[4086:]},
+		{"past the end", "bytes=0-9999", fiber.StatusPartialContent, "bytes 0-4095/4096", content},
+		{"unsatisfiable", "bytes=5000-", fiber.StatusRequestedRangeNotSatisfiable, "bytes */4096", nil},
+		{"multiple ranges", "bytes=0-9,20-29", fiber.StatusOK, "", content},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/blob/throttled.png", nil)
+			if tt.rangeHeader != "" {
+				req.Header.Set("Range", tt.rangeHeader)
+			}
+			res, err := app.Test(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			body, _ := io.ReadAll(res.Body)
+			if res.StatusCode != tt.want {
+				t.Fatalf("expected status %d, got %d", tt.want, res.StatusCode)
+			}
+			if got := res.Header.Get("Content-Range"); got != tt.contentRange {
+				t.Errorf("expected Content-Range %q, got %q", tt.contentRange, got)
+			}
+			if tt.body != nil && !bytes.Equal(body, tt.body) {
+				t.Errorf("expected %d bytes, got %d", len(tt.body), len(body))
+			}
+			if ct := res.Header.Get("Content-Type"); tt.body != nil && ct != "image/png" {
+				t.Errorf("expected image/png, got %q", ct)
+			}
+		})
+	}
+}
+
+func TestKeyVal_DownloadConcurrency(t *testing.T) {
+	kv := newTestKeyVal(t)
+	kv.basePath = "/blob"
+	kv.downloadSlots = make(chan struct{}, 1)
+	app := fiber.New()
+	app.Get("/blob/*", kv.ServeHTTP)
+
+	content := testPNG(4096, 'a')
+	if status := kv.Write(context.Background(), []byte("image.png"), bytes.NewReader(content), len(content), WriteOptions{}); status != fiber.StatusCreated {
+		t.Fatalf("unexpected status %d", status)
+	}
+	get := func() *http.Response {
+		t.Helper()
+		res, err := app.Test(httptest.NewRequest(http.MethodGet, "/blob/image.png", nil))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return res
+	}
+
+	// another download holds the only slot
+	kv.downloadSlots <- struct{}{}
+	res := get()
+	if res.StatusCode != fiber.StatusServiceUnavailable || res.Header.Get("Retry-After") == "" {
+		t.Fatalf("expected a 503 with Retry-After, got %d", res.StatusCode)
+	}
+	<-kv.downloadSlots
+
+	res = get()
+	body, _ := io.ReadAll(res.Body)
+	if res.StatusCode != fiber.StatusOK || !bytes.Equal(body, content) {
+		t.Fatalf("expected the file once a slot is free, got %d", res.StatusCode)
+	}
+	if n := len(kv.downloadSlots); n != 0 {
+		t.Fatalf("expected the slot to be freed once the file was sent, %d still held", n)
+	}
+}
+
+func TestKeyVal_KeyNamespace(t *testing.T) {
+	kv := newTestKeyVal(t)
+	kv.basePath = "/blob"
+	kv.namespace = namespacePrefix("tenant")
+	app := fiber.New()
+	app.Get("/blob", kv.ServeHTTP)
+
+	// a record outside the namespace, as another store sharing the database
+	if err := kv.db.Put([]byte("other.png"), []byte("{}"), nil); err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range []string{"a.png", "b.png", "c.png"} {
+		content := testPNG(64, key[0])
+		if status := kv.Write(context.Background(), []byte(key), bytes.NewReader(content), len(content), WriteOptions{}); status != fiber.StatusCreated {
+			t.Fatalf("unexpected status %d", status)
+		}
+	}
+	if _, err := kv.db.Get([]byte("tenant\x00a.png"), nil); err != nil {
+		t.Fatalf("expected the record to be stored under the namespace: %v", err)
+	}
+	// a namespace that the namespace is a prefix of
+	if err := kv.db.Put([]byte("tenant2\x00d.png"), []byte("{}"), nil); err != nil {
+		t.Fatal(err)
+	}
+
+	list := func(query string) ListResponse {
+		t.Helper()
+		res, err := app.Test(httptest.NewRequest(http.MethodGet, "/blob?"+query, nil))
+		if err != nil {
+			t.Fatal(err)
+		}
+		var body ListResponse
+		if err := json.NewDecoder(res.Body).Decode(&body); err != nil {
+			t.Fatal(err)
+		}
+		return body
+	}
+
+	page := list("limit=2")
+	if strings.Join(page.Keys, ",") != "a.png,b.png" || !page.HasMore {
+		t.Fatalf("unexpected first page %+v", page)
+	}
+	next, err := url.Parse(page.NextPage)
+	if err != nil {
+		t.Fatal(err)
+	}
+	page = list(next.RawQuery)
+	if strings.Join(page.Keys, ",") != "c.png" || page.HasMore {
+		t.Fatalf("unexpected second page %+v", page)
+	}
+
+	if status := kv.Delete(context.Background(), []byte("a.png"), false); status != fiber.StatusNoContent {
+		t.Fatalf("unexpected status %d", status)
+	}
+	if _, err := kv.db.Get([]byte("tenant\x00a.png"), nil); err == nil {
+		t.Fatal("expected the namespaced record to be deleted")
+	}
+}
+
+func TestKeyVal_ChunkHashes(t *testing.T) {
+	kv := newTestKeyVal(t)
+	kv.basePath = "/blob"
+	kv.chunkHashSize = 100
+	app := fiber.New()
+	app.Get("/blob/*", kv.ServeHTTP)
+
+	content := testPNG(250, 'a')
+	if status := kv.Write(context.Background(), []byte("chunked.png"), bytes.NewReader(content), len(content), WriteOptions{}); status != fiber.StatusCreated {
+		t.Fatalf("unexpected status %d", status)
+	}
+
+	res, err := app.Test(httptest.NewRequest(http.MethodGet, "/blob/chunked.png?hashes", nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.StatusCode != fiber.StatusOK {
+		t.Fatalf("unexpected status %d", res.StatusCode)
+	}
+	var body ChunkHashesResponse
+	if err := json.NewDecoder(res.Body).Decode(&body); err != nil {
+		t.Fatal(err)
+	}
+	if body.Size != 250 || body.ChunkSize != 100 || len(body.Chunks) != 3 {
+		t.Fatalf("unexpected chunk hashes %+v", body)
+	}
+	root := sha256.New()
+	for n, chunk := range body.Chunks {
+		end := min(chunk.Offset+chunk.Length, int64(len(content)))
+		sum := sha256.Sum256(content[chunk.Offset:end])
+		if chunk.Offset != int64(n*100) || chunk.Hash != hex.EncodeToString(sum[:]) {
+			t.Errorf("unexpected chunk %d: %+v", n, chunk)
+		}
+		root.Write([]byte(chunk.Hash))
+	}
+	if body.Chunks[2].Length != 50 {
+		t.Errorf("expected the last chunk to be 50 bytes, got %d", body.Chunks[2].Length)
+	}
+	if body.Root != hex.EncodeToString(root.Sum(nil)) {
+		t.Errorf("unexpected root %s", body.Root)
+	}
+
+	// files uploaded without chunk hashes
+	kv.chunkHashSize = 0
+	if status := kv.Write(context.Background(), []byte("plain.png"), bytes.NewReader(content), len(content), WriteOptions{}); status != fiber.StatusCreated {
+		t.Fatalf("unexpected status %d", status)
+	}
+	res, err = app.Test(httptest.NewRequest(http.MethodGet, "/blob/plain.png?hashes", nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.StatusCode != fiber.StatusNotFound {
+		t.Errorf("expected status 404, got %d", res.StatusCode)
+	}
+}
+
+func TestKeyVal_CleanKeys(t *testing.T) {
+	kv := newTestKeyVal(t)
+	kv.basePath = "/blob"
+	kv.cleanKeys = true
+	app := fiber.New(fiber.Config{StreamRequestBody: true})
+	app.Get("/blob", kv.ServeHTTP)
+	app.Get("/blob/*", kv.ServeHTTP)
+	app.Put("/blob/*", kv.ServeHTTP)
+
+	content := testPNG(1024, 'a')
+	res, err := app.Test(httptest.NewRequest(http.MethodPut, "/blob/images//./a.png", bytes.NewReader(content)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.StatusCode != fiber.StatusCreated {
+		t.Fatalf("expected upload to succeed, got %d", res.StatusCode)
+	}
+	if kv.GetRecord(context.Background(), []byte("images/a.png")).Deleted != NO {
+		t.Fatal("expected the upload to be stored under the cleaned key")
+	}
+
+	for _, path := range []string{"/blob/images/a.png", "/blob/images//a.png", "/blob/./images/a.png", "/blob?prefix=images//"} {
+		res, err := app.Test(httptest.NewRequest(http.MethodGet, path, nil))
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := io.ReadAll(res.Body)
+		if res.StatusCode != fiber.StatusOK {
+			t.Errorf("GET %s: expected status 200, got %d", path, res.StatusCode)
+		}
+		if strings.Contains(path, "prefix") && !strings.Contains(string(body), `"images/a.png"`) {
+			t.Errorf("GET %s: expected the key to be listed, got %s", path, body)
+		}
+	}
+
+	for _, path := range []string{"/blob/images/../a.png", "/blob/images/%2E%2E/a.png", "/blob?prefix=images/.."} {
+		res, err := app.Test(httptest.NewRequest(http.MethodGet, path, nil))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if res.StatusCode != fiber.StatusBadRequest {
+			t.Errorf("GET %s: expected status 400, got %d", path, res.StatusCode)
+		}
+	}
+}
+
+func TestKeyVal_EncodedKeys(t *testing.T) {
+	tests := []struct {
+		path string
+		key  string
+	}{
+		{"/blob/a%20b.png", "a b.png"},
+		{"/blob/a+b.png", "a+b.png"},
+		{"/blob/c%2Bd.png", "c+d.png"},
+		{"/blob/100%25.png", "100%.png"},
+		{"/blob/a%2520b.png", "a%20b.png"},
+		{"/blob/%C3%A9t%C3%A9/caf%C3%A9.png", "été/café.png"},
+	}
+
+	for _, cleanKeys := range []bool{false, true} {
+		t.Run(fmt.Sprintf("clean keys %t", cleanKeys), func(t *testing.T) {
+			kv := newTestKeyVal(t)
+			kv.basePath = "/blob"
+			kv.cleanKeys = cleanKeys
+			app := fiber.New(fiber.Config{StreamRequestBody: true})
+			app.Get("/blob/*", kv.ServeHTTP)
+			app.Put("/blob/*", kv.ServeHTTP)
+
+			for n, tt := range tests {
+				content := testPNG(64, byte(n))
+				res, err := app.Test(httptest.NewRequest(http.MethodPut, tt.path, bytes.NewReader(content)))
+				if err != nil {
+					t.Fatal(err)
+				}
+				if res.StatusCode != fiber.StatusCreated {
+					t.Fatalf("PUT %s: expected status 201, got %d", tt.path, res.StatusCode)
+				}
+				if kv.GetRecord(context.Background(), []byte(tt.key)).Deleted != NO {
+					t.Fatalf("PUT %s: expected the upload to be stored under %q", tt.path, tt.key)
+				}
+
+				// the key decoded once, escaped again, refers to the same file
+				path := (&url.URL{Path: "/blob/" + tt.key}).EscapedPath()
+				res, err = app.Test(httptest.NewRequest(http.MethodGet, path, nil))
+				if err != nil {
+					t.Fatal(err)
+				}
+				body, _ := io.ReadAll(res.Body)
+				if res.StatusCode != fiber.StatusOK || !bytes.Equal(body, content) {
+					t.Errorf("GET %s: expected the content of %q, got status %d", path, tt.key, res.StatusCode)
+				}
+			}
+			// a double-encoded key is distinct from the key it encodes
+			if kv.GetRecord(context.Background(), []byte("a b.png")).Hash == kv.GetRecord(context.Background(), []byte("a%20b.png")).Hash {
+				t.Error("expected a%20b.png to be stored separately from a b.png")
+			}
+		})
+	}
+}
+
+func TestKeyVal_Variants(t *testing.T) {
+	kv := newTestKeyVal(t)
+	kv.basePath = "/blob"
+	app := fiber.New(fiber.Config{StreamRequestBody: true})
+	app.Get("/blob/*", kv.ServeHTTP)
+	app.Put("/blob/*", kv.ServeHTTP)
+	app.Delete("/blob/*", kv.ServeHTTP)
+	do := func(method, path string, body []byte) (int, []byte) {
+		t.Helper()
+		res, err := app.Test(httptest.NewRequest(method, path, bytes.NewReader(body)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, _ := io.ReadAll(res.Body)
+		return res.StatusCode, data
+	}
+
+	if status, _ := do(http.MethodPut, "/blob/hero.png?variant=2x", testPNG(64, 2)); status != fiber.StatusBadRequest {
+		t.Fatalf("expected variants to be rejected while disabled, got %d", status)
+	}
+
+	kv.variants = true
+	for n, variant := range []string{"1x", "2x", "3x"} {
+		if status, _ := do(http.MethodPut, "/blob/hero.png?variant="+variant, testPNG(64, byte(n))); status != fiber.StatusCreated {
+			t.Fatalf("PUT %s: unexpected status %d", variant, status)
+		}
+	}
+	// neither the base key nor keys under it are variants
+	for _, key := range []string{"hero.png", "hero.png@2x/other.png"} {
+		if status, _ := do(http.MethodPut, "/blob/"+key, testPNG(64, 9)); status != fiber.StatusCreated {
+			t.Fatalf("PUT %s: unexpected status %d", key, status)
+		}
+	}
+	if status, _ := do(http.MethodPut, "/blob/hero.png?variant=../x", testPNG(64, 9)); status != fiber.StatusBadRequest {
+		t.Fatalf("expected an invalid variant to be rejected, got %d", status)
+	}
+
+	status, body := do(http.MethodGet, "/blob/hero.png?variant=2x", nil)
+	if status != fiber.StatusOK || !bytes.Equal(body, testPNG(64, 1)) {
+		t.Fatalf("expected the content of the 2x variant, got status %d", status)
+	}
+	if kv.GetRecord(context.Background(), []byte("hero.png@2x")).Deleted != NO {
+		t.Fatal("expected the variant to be stored under hero.png@2x")
+	}
+
+	if status, _ := do(http.MethodDelete, "/blob/hero.png?variant=3x", nil); status != fiber.StatusNoContent {
+		t.Fatalf("unexpected status %d", status)
+	}
+	status, body = do(http.MethodGet, "/blob/hero.png?variants", nil)
+	if status != fiber.StatusOK {
+		t.Fatalf("unexpected status %d", status)
+	}
+	var res VariantsResponse
+	if err := json.Unmarshal(body, &res); err != nil {
+		t.Fatal(err)
+	}
+	if res.Key != "hero.png" || !slices.Equal(res.Variants, []string{"1x", "2x"}) {
+		t.Fatalf("unexpected variants %+v", res)
+	}
+}
+
+func TestKeyVal_WriteOnce(t *testing.T) {
+	kv := newTestKeyVal(t)
+	kv.basePath = "/blob"
+	kv.writeOncePrefixes = map[string]bool{"originals/": true, "originals/tmp/": false}
+	app := fiber.New(fiber.Config{StreamRequestBody: true})
+	app.Put("/blob/*", kv.ServeHTTP)
+
+	put := func(key string, fill byte) (int, string) {
+		t.Helper()
+		content := testPNG(64, fill)
+		res, err := app.Test(httptest.NewRequest(http.MethodPut, "/blob/"+key, bytes.NewReader(content)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := io.ReadAll(res.Body)
+		return res.StatusCode, string(body)
+	}
+
+	tests := []struct {
+		key  string
+		want int
+	}{
+		{"originals/a.png", fiber.StatusConflict},
+		{"originals/tmp/a.png", fiber.StatusCreated},
+		{"avatars/a.png", fiber.StatusCreated},
+	}
+	for _, tt := range tests {
+		if status, _ := put(tt.key, 'a'); status != fiber.StatusCreated {
+			t.Fatalf("%s: expected the first write to succeed, got %d", tt.key, status)
+		}
+		status, body := put(tt.key, 'b')
+		if status != tt.want {
+			t.Errorf("%s: expected status %d, got %d", tt.key, tt.want, status)
+		}
+		var e httperr.Response
+		if status == fiber.StatusConflict && (json.Unmarshal([]byte(body), &e) != nil || e.Error.Code != ErrCodeKeyExists) {
+			t.Errorf("%s: expected error code %q, got %q", tt.key, ErrCodeKeyExists, body)
+		}
+	}
+
+	// unlinked keys can be written again
+	if status := kv.Delete(context.Background(), []byte("originals/a.png"), true); status != fiber.StatusNoContent {
+		t.Fatalf("unexpected unlink status %d", status)
+	}
+	if status, _ := put("originals/a.png", 'c'); status != fiber.StatusCreated {
+		t.Fatalf("expected a write to an unlinked key to succeed, got %d", status)
+	}
+}
+
+func TestKeyVal_Ping(t *testing.T) {
+	kv := newTestKeyVal(t)
+	app := fiber.New()
+	app.Get("/ping", kv.PingHandler)
+
+	ping := func() int {
+		t.Helper()
+		res, err := app.Test(httptest.NewRequest(http.MethodGet, "/ping", nil))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return res.StatusCode
+	}
+
+	if status := ping(); status != fiber.StatusNoContent {
+		t.Fatalf("expected a healthy service, got %d", status)
+	}
+	// the volume can't be read
+	if err := os.WriteFile(kv.volume, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if status := ping(); status != fiber.StatusServiceUnavailable {
+		t.Errorf("expected a broken volume to fail the check, got %d", status)
+	}
+	if err := os.Remove(kv.volume); err != nil {
+		t.Fatal(err)
+	}
+	if status := ping(); status != fiber.StatusNoContent {
+		t.Errorf("expected a volume without uploads yet to pass the check, got %d", status)
+	}
+	kv.db.Close()
+	if status := ping(); status != fiber.StatusServiceUnavailable {
+		t.Errorf("expected a closed database to fail the check, got %d", status)
+	}
+}
+
+func TestKeyVal_PathConflict(t *testing.T) {
+	kv := newTestKeyVal(t)
+	kv.basePath = "/blob"
+	kv.pathTemplate = "{key}"
+	app := fiber.New(fiber.Config{StreamRequestBody: true})
+	app.Put("/blob/*", kv.ServeHTTP)
+
+	put := func(key string) (int, string) {
+		t.Helper()
+		content := testPNG(64, 'a')
+		res, err := app.Test(httptest.NewRequest(http.MethodPut, "/blob/"+key, bytes.NewReader(content)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := io.ReadAll(res.Body)
+		return res.StatusCode, string(body)
+	}
+
+	for _, key := range []string{"a", "b/c.png"} {
+		if status, _ := put(key); status != fiber.StatusCreated {
+			t.Fatalf("%s: unexpected status %d", key, status)
+		}
+	}
+	// a file is in the way of a directory, and a directory in the way of a file
+	for _, key := range []string{"a/b.png", "a/b/c.png", "b"} {
+		status, body := put(key)
+		var e httperr.Response
+		if status != fiber.StatusConflict || json.Unmarshal([]byte(body), &e) != nil || e.Error.Code != ErrCodePathConflict {
+			t.Errorf("%s: expected a path conflict, got %d %s", key, status, body)
+		}
+		if rec := kv.GetRecord(context.Background(), []byte(key)); rec.Deleted != HARD {
+			t.Errorf("%s: expected no record, got %+v", key, rec)
+		}
+	}
+	if status := kv.Write(context.Background(), []byte("a/b.png"), bytes.NewReader(testPNG(64, 'a')), 64, WriteOptions{}); status != fiber.StatusBadRequest {
+		t.Errorf("expected a direct write to fail, got %d", status)
+	}
+	// overwrites of the same key aren't conflicts
+	if status, _ := put("a"); status != fiber.StatusCreated {
+		t.Errorf("expected an overwrite to succeed, got %d", status)
+	}
+}
+
+func TestKeyVal_Reindex(t *testing.T) {
+	kv := newTestKeyVal(t)
+	kv.compressAtRest = true
+	kv.allowedMimeTypes = []string{"image/", "text/"}
+
+	files := map[string][]byte{
+		"a.png":          testPNG(1024, 'a'),
+		"docs/notes.txt": bytes.Repeat([]byte("hello, world\n"), 1024),
+		"b.png":          testPNG(1024, 'b'),
+	}
+	for key, content := range files {
+		if key == "b.png" {
+			kv.pathTemplate = "{yyyy}/{hexkey}"
+		}
+		if status := kv.Write(context.Background(), []byte(key), bytes.NewReader(content), len(content), WriteOptions{}); status != fiber.StatusCreated {
+			t.Fatalf("unexpected status %d", status)
+		}
+		kv.pathTemplate = ""
+	}
+	want := map[string]Record{}
+	for key := range files {
+		want[key] = kv.GetRecord(context.Background(), []byte(key))
+		if err := kv.deleteRecord(context.Background(), []byte(key)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// a file whose key can't be recovered
+	if err := os.WriteFile(filepath.Join(kv.volume, "stray.png"), testPNG(64, 's'), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	kv.pathTemplate = "{yyyy}/{hexkey}"
+	if err := kv.Reindex(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	status := kv.ReindexStatus()
+	if status.Scanned != 4 || status.Indexed != 3 || status.Skipped != 1 || status.Failed != 0 {
+		t.Errorf("unexpected status %+v", status)
+	}
+	for key, rec := range want {
+		got := kv.GetRecord(context.Background(), []byte(key))
+		if got.Deleted != NO || got.Hash != rec.Hash || got.Compression != rec.Compression || kv.FilePath([]byte(key), got) != kv.FilePath([]byte(key), rec) {
+			t.Errorf("%s: expected record %+v, got %+v", key, rec, got)
+		}
+	}
+	if want["docs/notes.txt"].Compression != CompressionGzip {
+		t.Error("expected the text file to be compressed at rest")
+	}
+}
+
+func TestKeyVal_CollectGarbage(t *testing.T) {
+	kv := newTestKeyVal(t)
+	kv.softDelete = true
+	kv.softDeleteRetention = time.Hour
+
+	content := testPNG(1024, 'a')
+	for _, key := range []string{"expired.png", "recent.png", "legacy.png", "live.png"} {
+		if status := kv.Write(context.Background(), []byte(key), bytes.NewReader(content), len(content), WriteOptions{}); status != fiber.StatusCreated {
+			t.Fatalf("unexpected status %d", status)
+		}
+	}
+	for _, key := range []string{"expired.png", "recent.png", "legacy.png"} {
+		if status := kv.Delete(context.Background(), []byte(key), true); status != fiber.StatusNoContent {
+			t.Fatalf("unexpected status %d", status)
+		}
+	}
+	expired := kv.GetRecord(context.Background(), []byte("expired.png"))
+	expired.DeletedAt = time.Now().Add(-2 * time.Hour)
+	legacy := kv.GetRecord(context.Background(), []byte("legacy.png"))
+	legacy.DeletedAt = time.Time{}
+	if err := kv.PutRecord(context.Background(), []byte("expired.png"), expired); err != nil {
+		t.Fatal(err)
+	}
+	if err := kv.PutRecord(context.Background(), []byte("legacy.png"), legacy); err != nil {
+		t.Fatal(err)
+	}
+
+	status, err := kv.CollectGarbage(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status.Scanned != 3 || status.Collected != 1 || status.ReclaimedBytes != int64(len(content)) || status.TotalReclaimedBytes != int64(len(content)) {
+		t.Errorf("unexpected status %+v", status)
+	}
+	if rec := kv.GetRecord(context.Background(), []byte("expired.png")); rec.Deleted != HARD {
+		t.Errorf("expected the expired record to be hard deleted, got %+v", rec)
+	}
+	if _, err := os.Stat(kv.FilePath([]byte("expired.png"), expired)); !os.IsNotExist(err) {
+		t.Errorf("expected the expired file to be removed, got %v", err)
+	}
+	if rec := kv.GetRecord(context.Background(), []byte("recent.png")); rec.Deleted != SOFT {
+		t.Errorf("expected the recently deleted record to be kept, got %+v", rec)
+	}
+	if rec := kv.GetRecord(context.Background(), []byte("legacy.png")); rec.Deleted != SOFT || rec.DeletedAt.IsZero() {
+		t.Errorf("expected the record without a deletion time to be stamped and kept, got %+v", rec)
+	}
+	if rec := kv.GetRecord(context.Background(), []byte("live.png")); rec.Deleted != NO {
+		t.Errorf("expected the live record to be kept, got %+v", rec)
+	}
+}
+
+func TestKeyVal_Notify(t *testing.T) {
+	kv := newTestKeyVal(t)
+	kv.softDelete = true
+	var events []Event
+	kv.notify = func(e Event) { events = append(events, e) }
+
+	content := testPNG(1024, 'a')
+	kv.Write(context.Background(), []byte("a.png"), bytes.NewReader(content), len(content), WriteOptions{})
+	kv.Delete(context.Background(), []byte("a.png"), true)
+	kv.Delete(context.Background(), []byte("a.png"), false)
+
+	want := []string{EventUploaded, EventUnlinked, EventDeleted}
+	if len(events) != len(want) {
+		t.Fatalf("expected %d events, got %+v", len(want), events)
+	}
+	for i, e := range events {
+		if e.Type != want[i] || e.Key != "a.png" || e.Hash != fmt.Sprintf("%x", md5.Sum(content)) || e.Time.IsZero() {
+			t.Errorf("expected a %s event, got %+v", want[i], e)
+		}
+	}
+	if events[0].Size != int64(len(content)) || events[0].ContentType != "image/png" {
+		t.Errorf("expected the upload event to describe the content, got %+v", events[0])
+	}
+}
+
+func TestKeyVal_Metadata(t *testing.T) {
+	kv := newTestKeyVal(t)
+	kv.basePath = "/blob"
+	kv.softDelete = true
+	kv.compressAtRest = true
+	kv.allowedMimeTypes = []string{"image/", "text/"}
+	kv.extractColor = func(string) (string, error) { return "#1a2b3c", nil }
+	app := fiber.New(fiber.Config{StreamRequestBody: true})
+	app.Get("/blob/*", kv.ServeHTTP)
+
+	stat := func(key string) (int, Metadata) {
+		t.Helper()
+		res, err := app.Test(httptest.NewRequest(http.MethodGet, "/blob/"+key+"?stat", nil))
+		if err != nil {
+			t.Fatal(err)
+		}
+		var md Metadata
+		json.NewDecoder(res.Body).Decode(&md)
+		return res.StatusCode, md
+	}
+
+	png := testPNG(1024, 'a')
+	text := bytes.Repeat([]byte("hello, world\n"), 1024)
+	kv.Write(context.Background(), []byte("a.png"), bytes.NewReader(png), len(png), WriteOptions{Filename: "gopher.png"})
+	kv.Write(context.Background(), []byte("notes.txt"), bytes.NewReader(text), len(text), WriteOptions{})
+	created := kv.GetRecord(context.Background(), []byte("a.png")).CreatedAt
+	kv.Write(context.Background(), []byte("a.png"), bytes.NewReader(png), len(png), WriteOptions{})
+
+	status, md := stat("a.png")
+	if status != fiber.StatusOK || md.Key != "a.png" || md.Size != int64(len(png)) || md.MD5 != fmt.Sprintf("%x", md5.Sum(png)) ||
+		md.ContentType != "image/png" || md.DominantColor != "#1a2b3c" || md.Deleted || md.CreatedAt == nil || !md.CreatedAt.Equal(created) || md.ModifiedAt.Before(created) {
+		t.Errorf("unexpected metadata %d %+v", status, md)
+	}
+	if status, md := stat("notes.txt"); status != fiber.StatusOK || md.Size != int64(len(text)) || !strings.HasPrefix(md.ContentType, "text/plain") || md.DominantColor != "" {
+		t.Errorf("expected the metadata of the uncompressed content, got %d %+v", status, md)
+	}
+
+	kv.Delete(context.Background(), []byte("a.png"), true)
+	if status, md := stat("a.png"); status != fiber.StatusOK || !md.Deleted || md.DeletedAt == nil {
+		t.Errorf("expected soft-deleted metadata, got %d %+v", status, md)
+	}
+	if status, _ := stat("missing.png"); status != fiber.StatusNotFound {
+		t.Errorf("expected 404 for a missing key, got %d", status)
+	}
+}
+
+func TestKeyVal_AllowUnknownTypes(t *testing.T) {
+	kv := newTestKeyVal(t)
+	unknown := bytes.Repeat([]byte{0x00, 0xfe, 0x13, 0x37}, 64)
+
+	tests := []struct {
+		name        string
+		allow       bool
+		contentType string
+		want        int
+	}{
+		{"rejected by default", false, "", fiber.StatusUnsupportedMediaType},
+		{"allowed", true, "", fiber.StatusCreated},
+		{"allowed with an allowed hint", true, "image/jxl", fiber.StatusCreated},
+		{"allowed as octet-stream", true, "application/octet-stream", fiber.StatusCreated},
+		{"rejected by a disallowed hint", true, "application/zip", fiber.StatusUnsupportedMediaType},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			kv.allowUnknownTypes = tt.allow
+			status := kv.Write(context.Background(), []byte("unknown"), bytes.NewReader(unknown), len(unknown), WriteOptions{ContentType: tt.contentType})
+			if status != tt.want {
+				t.Errorf("expected status %d, got %d", tt.want, status)
+			}
+		})
+	}
+
+	// detectable content is still held to the allowed types
+	kv.allowUnknownTypes = true
+	text := []byte("hello, world")
+	if status := kv.Write(context.Background(), []byte("notes.txt"), bytes.NewReader(text), len(text), WriteOptions{ContentType: "image/png"}); status != fiber.StatusUnsupportedMediaType {
+		t.Errorf("expected status 415, got %d", status)
+	}
+}
+
+func TestKeyVal_AllowEmptyFiles(t *testing.T) {
+	kv := newTestKeyVal(t)
+	if status := kv.Write(context.Background(), []byte("empty"), bytes.NewReader(nil), 0, WriteOptions{}); status != fiber.StatusBadRequest {
+		t.Errorf("expected empty files to be rejected by default, got %d", status)
+	}
+
+	kv.allowEmptyFiles = true
+	if status := kv.Write(context.Background(), []byte("empty"), bytes.NewReader(nil), 0, WriteOptions{}); status != fiber.StatusCreated {
+		t.Fatalf("expected an empty file to be stored, got %d", status)
+	}
+	rec := kv.GetRecord(context.Background(), []byte("empty"))
+	if rec.Deleted != NO || rec.Hash != "d41d8cd98f00b204e9800998ecf8427e" {
+		t.Errorf("expected a live record with the MD5 of empty content, got %+v", rec)
+	}
+	if stat, err := os.Stat(kv.FilePath([]byte("empty"), rec)); err != nil || stat.Size() != 0 {
+		t.Errorf("expected an empty file, got %v", err)
+	}
+}
+
+func TestKeyVal_UploadResponse(t *testing.T) {
+	kv := newTestKeyVal(t)
+	kv.basePath = "/blob"
+	kv.signSecret = "secret"
+	app := fiber.New(fiber.Config{StreamRequestBody: true})
+	app.Put("/blob/*", kv.ServeHTTP)
+	content := testPNG(1024, 'r')
+
+	res, err := app.Test(httptest.NewRequest(http.MethodPut, "/blob/plain.png", bytes.NewReader(content)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if body, _ := io.ReadAll(res.Body); res.StatusCode != fiber.StatusCreated || len(body) != 0 {
+		t.Fatalf("expected an empty 201 by default, got %d: %s", res.StatusCode, body)
+	}
+
+	for _, req := range []*http.Request{
+		httptest.NewRequest(http.MethodPut, "/blob/a%20b.png?response=json", bytes.NewReader(content)),
+		httptest.NewRequest(http.MethodPut, "/blob/a%20b.png", bytes.NewReader(content)),
+	} {
+		if req.URL.RawQuery == "" {
+			req.Header.Set("Accept", "application/json")
+		}
+		res, err := app.Test(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if res.StatusCode != fiber.StatusCreated {
+			t.Fatalf("unexpected status %d", res.StatusCode)
+		}
+		var body UploadResponse
+		if err := json.NewDecoder(res.Body).Decode(&body); err != nil {
+			t.Fatal(err)
+		}
+		sum := md5.Sum(content)
+		if body.Key != "a b.png" || body.Hash != hex.EncodeToString(sum[:]) || body.Size != int64(len(content)) || body.ContentType != "image/png" {
+			t.Errorf("unexpected response %+v", body)
+		}
+		serveURL, err := url.Parse(body.ServeURL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := sign.VerifyURL(serveURL, "secret"); err != nil || serveURL.IsAbs() || serveURL.Path != "/serve/blob/a b.png" {
+			t.Errorf("expected a signed serve path of the key, got %s: %v", body.ServeURL, err)
+		}
+	}
+
+	kv.publicURL = "https://images.example.com"
+	req := httptest.NewRequest(http.MethodPut, "/blob/public.png?response=json", bytes.NewReader(content))
+	req.Host = "internal:8080"
+	var body UploadResponse
+	if res, err := app.Test(req); err != nil {
+		t.Fatal(err)
+	} else if err := json.NewDecoder(res.Body).Decode(&body); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(body.ServeURL, "https://images.example.com/serve/blob/public.png?") {
+		t.Errorf("expected a serve URL of the public URL, got %s", body.ServeURL)
+	}
+
+	// serve URLs can't be signed without a secret
+	kv.signSecret = ""
+	body = UploadResponse{}
+	if res, err := app.Test(httptest.NewRequest(http.MethodPut, "/blob/unsigned.png?response=json", bytes.NewReader(content))); err != nil {
+		t.Fatal(err)
+	} else if err := json.NewDecoder(res.Body).Decode(&body); err != nil {
+		t.Fatal(err)
+	}
+	if body.ServeURL != "" {
+		t.Errorf("expected no serve URL without a sign secret, got %s", body.ServeURL)
+	}
+}
+
+func TestKeyVal_MimeSniffBytes(t *testing.T) {
+	kv := newTestKeyVal(t)
+	kv.mimeSniffBytes = 8192
+	// content shorter and longer than the sniffed prefix is stored intact
+	for _, size := range []int{100, 8192, 20000} {
+		key := []byte(fmt.Sprintf("sniff-%d.png", size))
+		content := testPNG(size, byte(size))
+		if status := kv.Write(context.Background(), key, bytes.NewReader(content), len(content), WriteOptions{}); status != fiber.StatusCreated {
+			t.Fatalf("%d bytes: unexpected status %d", size, status)
+		}
+		rec := kv.GetRecord(context.Background(), key)
+		data, err := os.ReadFile(kv.FilePath(key, rec))
+		if err != nil {
+			t.Fatal(err)
+		}
+		sum := md5.Sum(content)
+		if !bytes.Equal(data, content) || rec.Hash != hex.EncodeToString(sum[:]) {
+			t.Errorf("%d bytes: expected the content and its hash to be stored intact", size)
+		}
+	}
+
+	if _, err := New(Config{MimeSniffBytes: -1}); err == nil {
+		t.Error("expected negative sniff bytes to be rejected")
+	}
+	if _, err := New(Config{MimeSniffBytes: MaxMimeSniffBytes + 1}); err == nil {
+		t.Error("expected sniff bytes over the max to be rejected")
+	}
+}
+
+func TestKeyVal_RequireFileExtension(t *testing.T) {
+	kv := newTestKeyVal(t)
+	kv.requireExtension = true
+	png := testPNG(64, 'p')
+
+	tests := []struct {
+		key  string
+		want int
+	}{
+		{"image.png", fiber.StatusCreated},
+		{"IMAGE.PNG", fiber.StatusCreated},
+		{"image", fiber.StatusBadRequest},
+		{"image.jpg", fiber.StatusBadRequest},
+		{"image.unknown", fiber.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		if status := kv.Write(context.Background(), []byte(tt.key), bytes.NewReader(png), len(png), WriteOptions{}); status != tt.want {
+			t.Errorf("%s: expected status %d, got %d", tt.key, tt.want, status)
+		}
+	}
+}
+
+func TestKeyVal_ExtractColor(t *testing.T) {
+	kv := newTestKeyVal(t)
+	kv.allowedMimeTypes = append(kv.allowedMimeTypes, "text/")
+	var extracted []string
+	kv.extractColor = func(path string) (string, error) {
+		extracted = append(extracted, path)
+		return "#1a2b3c", nil
+	}
+	kv.basePath = "/blob"
+	app := fiber.New()
+	app.Head("/blob/*", kv.ServeHTTP)
+
+	content := testPNG(64, 1)
+	if status := kv.Write(context.Background(), []byte("image.png"), bytes.NewReader(content), len(content), WriteOptions{}); status != fiber.StatusCreated {
+		t.Fatalf("unexpected status %d", status)
+	}
+	res, err := app.Test(httptest.NewRequest(http.MethodHead, "/blob/image.png", nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := res.Header.Get("x-dominant-color"); got != "#1a2b3c" {
+		t.Fatalf("expected the color header, got %q", got)
+	}
+
+	// the color of anything but images isn't computed
+	text := []byte("plain text")
+	if status := kv.Write(context.Background(), []byte("notes.txt"), bytes.NewReader(text), len(text), WriteOptions{}); status != fiber.StatusCreated {
+		t.Fatalf("unexpected status %d", status)
+	}
+	if len(extracted) != 1 {
+		t.Fatalf("expected the color of only the image to be extracted, got %d", len(extracted))
+	}
+	res, err = app.Test(httptest.NewRequest(http.MethodHead, "/blob/notes.txt", nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := res.Header.Get("x-dominant-color"); got != "" {
+		t.Fatalf("expected no color header, got %q", got)
+	}
+}
+
+func TestKeyVal_Sendfile(t *testing.T) {
+	kv := newTestKeyVal(t)
+	kv.basePath = "/blob"
+	kv.pathTemplate = "{key}"
+	kv.sendfileHeader = "X-Accel-Redirect"
+	kv.sendfilePrefix = "/internal/files/"
+	app := fiber.New()
+	app.Get("/blob/*", kv.ServeHTTP)
+
+	content := testPNG(1024, 'a')
+	if status := kv.Write(context.Background(), []byte("images/a b.png"), bytes.NewReader(content), len(content), WriteOptions{}); status != fiber.StatusCreated {
+		t.Fatalf("unexpected status %d", status)
+	}
+
+	get := func() *http.Response {
+		t.Helper()
+		res, err := app.Test(httptest.NewRequest(http.MethodGet, "/blob/images/a%20b.png", nil))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return res
+	}
+
+	res := get()
+	body, _ := io.ReadAll(res.Body)
+	if res.StatusCode != fiber.StatusOK || len(body) != 0 {
+		t.Fatalf("expected an empty 200, got %d with %d bytes", res.StatusCode, len(body))
+	}
+	if got := res.Header.Get("X-Accel-Redirect"); got != "/internal/files/images/a%20b.png" {
+		t.Errorf("unexpected location %q", got)
+	}
+	if got := res.Header.Get(fiber.HeaderContentType); got != "image/png" {
+		t.Errorf("expected content type image/png, got %q", got)
+	}
+
+	kv.downloadRateLimitBPS = 1024
+	if got := get().Header.Get(HeaderAccelLimitRate); got != "1024" {
+		t.Errorf("expected the rate limit to be passed on, got %q", got)
+	}
+
+	// X-Sendfile takes the absolute path, and can't be rate limited
+	kv.sendfileHeader = "X-Sendfile"
+	kv.sendfilePrefix = ""
+	kv.downloadRateLimitBPS = 0
+	if got := get().Header.Get("X-Sendfile"); got != filepath.Join(kv.volume, "images", "a b.png") {
+		t.Errorf("unexpected location %q", got)
+	}
+	kv.downloadRateLimitBPS = 1 << 20
+	res = get()
+	body, _ = io.ReadAll(res.Body)
+	if res.Header.Get("X-Sendfile") != "" || !bytes.Equal(body, content) {
+		t.Error("expected rate limited downloads to be streamed")
+	}
+}
+
+func BenchmarkKeyVal_Write(b *testing.B) {
+	content := testPNG(256*1024, 'a')
+	for _, fsync := range []bool{true, false} {
+		b.Run(fmt.Sprintf("fsync=%v", fsync), func(b *testing.B) {
+			dir := b.TempDir()
+			kv, err := New(Config{
+				UploadPath:       filepath.Join(dir, "uploads"),
+				LevelDBPath:      filepath.Join(dir, "db"),
+				MaxSize:          1 << 20,
+				AllowedMimeTypes: []string{"image/"},
+				FsyncOnWrite:     fsync,
+				Logger:           slog.New(slog.NewTextHandler(io.Discard, nil)),
+			})
+			if err != nil {
+				b.Fatal(err)
+			}
+			defer kv.Close()
+
+			b.SetBytes(int64(len(content)))
+			b.ResetTimer()
+			for n := 0; n < b.N; n++ {
+				key := []byte(fmt.Sprintf("bench/%d.png", n))
+				if status := kv.Write(context.Background(), key, bytes.NewReader(content), len(content), WriteOptions{}); status != fiber.StatusCreated {
+					b.Fatalf("unexpected status %d", status)
+				}
+			}
+		})
+	}
+}
+
+func TestKeyVal_CreateHandler(t *testing.T) {
+	kv := newTestKeyVal(t)
+	kv.basePath = "/blob"
+
+	app := fiber.New(fiber.Config{StreamRequestBody: true})
+	app.Post("/blob", kv.CreateHandler)
+
+	content := testPNG(1024, 'a')
+	sum := sha256.Sum256(content)
+	wantKey := hex.EncodeToString(sum[:]) + ".png"
+
+	for _, wantStatus := range []int{fiber.StatusCreated, fiber.StatusOK} {
+		res, err := app.Test(httptest.NewRequest(http.MethodPost, "/blob?key_strategy=content-hash", bytes.NewReader(content)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if res.StatusCode != wantStatus {
+			t.Fatalf("expected status %d, got %d", wantStatus, res.StatusCode)
+		}
+		var body CreateResponse
+		if err := json.NewDecoder(res.Body).Decode(&body); err != nil {
+			t.Fatal(err)
+		}
+		if body.Key != wantKey {
+			t.Errorf("expected key %s, got %s", wantKey, body.Key)
+		}
+		if loc := res.Header.Get("Location"); loc != "/blob/"+wantKey {
+			t.Errorf("expected Location /blob/%s, got %s", wantKey, loc)
+		}
+	}
+
+	data, err := os.ReadFile(filepath.Join(kv.volume, KeyToPath([]byte(wantKey))))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(data, content) {
+		t.Errorf("expected the upload to be stored under its content hash")
+	}
+
+	res, err := app.Test(httptest.NewRequest(http.MethodPost, "/blob?key_strategy=random", bytes.NewReader(content)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.StatusCode != fiber.StatusBadRequest {
+		t.Errorf("expected unknown key strategies to be rejected, got %d", res.StatusCode)
+	}
+}
+
+func TestKeyVal_TransformHandler(t *testing.T) {
+	kv := newTestKeyVal(t)
+	kv.basePath = "/blob"
+	transformed := testPNG(64, 't')
+	transform := func(ctx context.Context, transform, srcPath string) ([]byte, error) {
+		if transform != "fit-in/100x100" {
+			return nil, &TransformError{Status: fiber.StatusForbidden, Message: "transform not allowed"}
+		}
+		return transformed, nil
+	}
+
+	app := fiber.New(fiber.Config{StreamRequestBody: true})
+	app.Post("/blob/*", kv.TransformHandler(transform))
+	do := func(path string) int {
+		t.Helper()
+		res, err := app.Test(httptest.NewRequest(http.MethodPost, path, bytes.NewReader(testPNG(1024, 'o'))))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return res.StatusCode
+	}
+
+	for path, want := range map[string]int{
+		"/blob/missing.png":                                                   fiber.StatusBadRequest,
+		"/blob/denied.png?transform=fit-in/9000x9000":                         fiber.StatusForbidden,
+		"/blob/result.png?transform=fit-in/100x100":                           fiber.StatusCreated,
+		"/blob/both.png?transform=fit-in/100x100&original=originals/both.png": fiber.StatusCreated,
+	} {
+		if status := do(path); status != want {
+			t.Errorf("%s: expected status %d, got %d", path, want, status)
+		}
+	}
+	for _, key := range []string{"missing.png", "denied.png"} {
+		if kv.GetRecord(context.Background(), []byte(key)).Deleted == NO {
+			t.Errorf("expected nothing to be stored under %s", key)
+		}
+	}
+	for key, want := range map[string][]byte{
+		"result.png":         transformed,
+		"both.png":           transformed,
+		"originals/both.png": testPNG(1024, 'o'),
+	} {
+		data, err := os.ReadFile(filepath.Join(kv.volume, KeyToPath([]byte(key))))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(data, want) {
+			t.Errorf("unexpected content stored under %s", key)
+		}
+	}
+}
+
+func TestKeyVal_LocksHandler(t *testing.T) {
+	kv := newTestKeyVal(t)
+	handler := kv.LocksHandler("/admin/locks")
+	app := fiber.New()
+	app.Get("/admin/locks", handler)
+	app.Delete("/admin/locks/*", handler)
+
+	do := func(method, path string) (int, string) {
+		t.Helper()
+		res, err := app.Test(httptest.NewRequest(method, path, nil))
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := io.ReadAll(res.Body)
+		return res.StatusCode, string(body)
+	}
+	locks := func() []string {
+		t.Helper()
+		status, body := do(http.MethodGet, "/admin/locks")
+		var res LocksResponse
+		if status != fiber.StatusOK || json.Unmarshal([]byte(body), &res) != nil {
+			t.Fatalf("unexpected response %d %s", status, body)
+		}
+		return res.Locks
+	}
+
+	if got := locks(); len(got) != 0 {
+		t.Fatalf("expected no locks, got %v", got)
+	}
+	for _, key := range []string{"images/b.png", "images/a.png"} {
+		if !kv.LockKey([]byte(key)) {
+			t.Fatalf("failed to lock %s", key)
+		}
+	}
+	if got := locks(); !reflect.DeepEqual(got, []string{"images/a.png", "images/b.png"}) {
+		t.Fatalf("expected the locked keys in order, got %v", got)
+	}
+
+	if status, _ := do(http.MethodDelete, "/admin/locks/images/a.png"); status != fiber.StatusNoContent {
+		t.Errorf("expected the lock to be released, got %d", status)
+	}
+	if got := locks(); !reflect.DeepEqual(got, []string{"images/b.png"}) {
+		t.Errorf("expected only images/b.png to stay locked, got %v", got)
+	}
+	if !kv.LockKey([]byte("images/a.png")) {
+		t.Error("expected a released key to be lockable again")
+	}
+
+	tests := []struct {
+		path string
+		want int
+	}{
+		{"/admin/locks/images/c.png", fiber.StatusNotFound},
+		{"/admin/locks/", fiber.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		if status, _ := do(http.MethodDelete, tt.path); status != tt.want {
+			t.Errorf("%s: expected status %d, got %d", tt.path, tt.want, status)
+		}
+	}
+}
+
+func TestKeyVal_Popular(t *testing.T) {
+	kv := newTestKeyVal(t)
+	kv.accessSampleRate = 1
+	for _, key := range []string{"a.png", "b.png", "c.png"} {
+		content := testPNG(64, key[0])
+		if status := kv.Write(context.Background(), []byte(key), bytes.NewReader(content), len(content), WriteOptions{}); status != fiber.StatusCreated {
+			t.Fatalf("unexpected status %d", status)
+		}
+	}
+	reads := map[string]int{"a.png": 3, "b.png": 1, "c.png": 5}
+	for key, n := range reads {
+		for range n {
+			kv.RecordAccess([]byte(key))
+		}
+	}
+	if _, err := kv.FlushAccess(); err != nil {
+		t.Fatal(err)
+	}
+	kv.RecordAccess([]byte("a.png"))
+	if _, err := kv.FlushAccess(); err != nil {
+		t.Fatal(err)
+	}
+	if status := kv.Delete(context.Background(), []byte("c.png"), false); status != fiber.StatusNoContent {
+		t.Fatalf("unexpected status %d", status)
+	}
+	// a new file at a deleted key starts from zero
+	content := testPNG(64, 'c')
+	if status := kv.Write(context.Background(), []byte("c.png"), bytes.NewReader(content), len(content), WriteOptions{}); status != fiber.StatusCreated {
+		t.Fatalf("unexpected status %d", status)
+	}
+
+	popular, err := kv.Popular(context.Background(), 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []KeyAccess{{Key: "a.png", Count: 4}, {Key: "b.png", Count: 1}}
+	if !reflect.DeepEqual(popular, want) {
+		t.Errorf("expected %v, got %v", want, popular)
+	}
+	if popular, _ := kv.Popular(context.Background(), 1); len(popular) != 1 || popular[0].Key != "a.png" {
+		t.Errorf("expected only the most read key, got %v", popular)
+	}
+
+	// so does one at a key that was unlinked and collected
+	kv.softDelete = true
+	if status := kv.Delete(context.Background(), []byte("a.png"), true); status != fiber.StatusNoContent {
+		t.Fatalf("unexpected status %d", status)
+	}
+	if _, err := kv.CollectGarbage(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	content = testPNG(64, 'a')
+	if status := kv.Write(context.Background(), []byte("a.png"), bytes.NewReader(content), len(content), WriteOptions{}); status != fiber.StatusCreated {
+		t.Fatalf("unexpected status %d", status)
+	}
+	want = []KeyAccess{{Key: "b.png", Count: 1}}
+	if popular, _ := kv.Popular(context.Background(), 10); !reflect.DeepEqual(popular, want) {
+		t.Errorf("expected %v, got %v", want, popular)
+	}
+}
+
+func TestKeyVal_StoredContentType(t *testing.T) {
+	kv := newTestKeyVal(t)
+	kv.basePath = "/blob"
+	kv.compressAtRest = true
+	kv.allowedMimeTypes = []string{"image/", "text/"}
+	app := fiber.New(fiber.Config{StreamRequestBody: true})
+	app.Get("/blob/*", kv.ServeHTTP)
+	app.Head("/blob/*", kv.ServeHTTP)
+
+	png := testPNG(1024, 'a')
+	text := bytes.Repeat([]byte("hello, world\n"), 1024)
+	kv.Write(context.Background(), []byte("gopher"), bytes.NewReader(png), len(png), WriteOptions{})
+	kv.Write(context.Background(), []byte("notes"), bytes.NewReader(text), len(text), WriteOptions{})
+	if rec := kv.GetRecord(context.Background(), []byte("gopher")); rec.ContentType != "image/png" || rec.Size != int64(len(png)) {
+		t.Errorf("expected the content type and size in the record, got %+v", rec)
+	}
+
+	tests := []struct {
+		method, key, contentType string
+		size                     int
+	}{
+		{http.MethodHead, "gopher", "image/png", len(png)},
+		{http.MethodGet, "gopher", "image/png", len(png)},
+		{http.MethodHead, "notes", "text/plain", len(text)},
+		{http.MethodGet, "notes", "text/plain", len(text)},
+	}
+	for _, tt := range tests {
+		res, err := app.Test(httptest.NewRequest(tt.method, "/blob/"+tt.key, nil))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !strings.HasPrefix(res.Header.Get(fiber.HeaderContentType), tt.contentType) || res.Header.Get(fiber.HeaderContentLength) != strconv.Itoa(tt.size) {
+			t.Errorf("%s %s: expected %s of %d bytes, got %q of %q bytes", tt.method, tt.key, tt.contentType, tt.size,
+				res.Header.Get(fiber.HeaderContentType), res.Header.Get(fiber.HeaderContentLength))
+		}
+	}
+}
+
+func TestKeyVal_CompressedRange(t *testing.T) {
+	kv := newTestKeyVal(t)
+	kv.basePath = "/blob"
+	kv.compressAtRest = true
+	kv.allowedMimeTypes = []string{"text/"}
+	app := fiber.New()
+	app.Get("/blob/*", kv.ServeHTTP)
+	app.Head("/blob/*", kv.ServeHTTP)
+
+	text := bytes.Repeat([]byte("hello, world\n"), 1024)
+	kv.Write(context.Background(), []byte("notes.txt"), bytes.NewReader(text), len(text), WriteOptions{})
+	if rec := kv.GetRecord(context.Background(), []byte("notes.txt")); rec.Compression != CompressionGzip {
+		t.Fatalf("expected the file to be compressed, got %+v", rec)
+	}
+
+	res, err := app.Test(httptest.NewRequest(http.MethodHead, "/blob/notes.txt", nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Header.Get(fiber.HeaderAcceptRanges) != "bytes" {
+		t.Errorf("expected HEAD to advertise ranges, got %q", res.Header.Get(fiber.HeaderAcceptRanges))
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/blob/notes.txt", nil)
+	req.Header.Set("Range", "bytes=13-25")
+	res, err = app.Test(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(res.Body)
+	if res.StatusCode != fiber.StatusPartialContent || res.Header.Get("Content-Range") != fmt.Sprintf("bytes 13-25/%d", len(text)) || !bytes.Equal(body, text[13:26]) {
+		t.Errorf("expected a range of the decompressed content, got %d %q %q", res.StatusCode, res.Header.Get("Content-Range"), body)
+	}
+
+	// ranges of gzip responses are of the stored bytes
+	req = httptest.NewRequest(http.MethodGet, "/blob/notes.txt", nil)
+	req.Header.Set("Accept-Encoding", "gzip")
+	whole, err := app.Test(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stored, _ := io.ReadAll(whole.Body)
+	req.Header.Set("Range", "bytes=-10")
+	res, err = app.Test(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ = io.ReadAll(res.Body)
+	if res.StatusCode != fiber.StatusPartialContent || res.Header.Get("Content-Encoding") != "gzip" || !bytes.Equal(body, stored[len(stored)-10:]) {
+		t.Errorf("expected the last bytes of the gzip stream, got %d %x", res.StatusCode, body)
+	}
+}
+
+// the global tracer provider only delegates to the first one set, so it's
+// shared by every run of the test
+var (
+	spanRecorder      = tracetest.NewSpanRecorder()
+	setTracerProvider = sync.OnceValue(func() *sdktrace.TracerProvider {
+		provider := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(spanRecorder))
+		otel.SetTracerProvider(provider)
+		return provider
+	})
+)
+
+func TestKeyVal_Write_Spans(t *testing.T) {
+	provider := setTracerProvider()
+	spanRecorder.Reset()
+
+	kv := newTestKeyVal(t)
+	ctx, parent := provider.Tracer("test").Start(context.Background(), "request")
+	data := testPNG(1024, 'a')
+	if status := kv.Write(ctx, []byte("a.png"), bytes.NewReader(data), len(data), WriteOptions{}); status != fiber.StatusCreated {
+		t.Fatalf("expected status 201, got %d", status)
+	}
+	parent.End()
+
+	// the spans of the write, by name, and the names of their parents
+	parents := map[string]string{}
+	ids := map[trace.SpanID]string{}
+	for _, span := range spanRecorder.Ended() {
+		ids[span.SpanContext().SpanID()] = span.Name()
+	}
+	for _, span := range spanRecorder.Ended() {
+		parents[span.Name()] = ids[span.Parent().SpanID()]
+	}
+	want := map[string]string{
+		"request":           "",
+		"keyval.write":      "request",
+		"keyval.write.file": "keyval.write",
+		"leveldb.get":       "keyval.write",
+		"leveldb.put":       "keyval.write",
+	}
+	if !reflect.DeepEqual(parents, want) {
+		t.Errorf("expected spans %v, got %v", want, parents)
+	}
+}
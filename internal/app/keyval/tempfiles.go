@@ -0,0 +1,80 @@
+package keyval
+
+import (
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Uploads are written to a temporary file next to their destination and
+// renamed into place once they are complete. Temporary files are named
+// tempFilePrefix plus a random suffix, and resolvePath never lays out a stored
+// file with that prefix, so any file with it is an upload in progress or the
+// leftover of an interrupted one.
+const (
+	tempFilePrefix  = ".upload-"
+	tempFilePattern = tempFilePrefix + "*"
+	// Temporary files created before they were named deterministically. They
+	// are only unambiguous when stored files are never named after their keys.
+	legacyTempFilePrefix = "tmp-"
+)
+
+func (k *KeyVal) createTemp(dir string) (*os.File, error) {
+	return os.CreateTemp(dir, tempFilePattern)
+}
+
+// spoolDir returns the directory uploads are spooled to before they are
+// stored: the volume for the local backend, and the system's temporary
+// directory otherwise
+func (k *KeyVal) spoolDir() string {
+	if k.local == nil {
+		return os.TempDir()
+	}
+	return k.volume
+}
+
+// SweepTempFiles removes the temporary files of uploads that were interrupted
+// by a crash more than maxAge ago, returning the number of files removed
+func (k *KeyVal) SweepTempFiles(maxAge time.Duration) (int, error) {
+	if k.local == nil {
+		// remote backends spool uploads to the system's temporary directory
+		return 0, nil
+	}
+	cutoff := time.Now().Add(-maxAge)
+	legacy := !strings.Contains(k.pathTemplate, "{key}")
+	removed := 0
+	err := filepath.WalkDir(k.volume, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		if !d.Type().IsRegular() {
+			return nil
+		}
+		name := d.Name()
+		if !strings.HasPrefix(name, tempFilePrefix) && !(legacy && strings.HasPrefix(name, legacyTempFilePrefix)) {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		if info.ModTime().After(cutoff) {
+			return nil
+		}
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			k.log.Error("failed to remove temp file", "path", path, "error", err)
+			return nil
+		}
+		removed++
+		return nil
+	})
+	return removed, err
+}
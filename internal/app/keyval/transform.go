@@ -0,0 +1,128 @@
+package keyval
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"os"
+
+	"github.com/gofiber/fiber/v3"
+	"github.com/jaredLunde/railway-image-service/internal/pkg/httperr"
+	"github.com/jaredLunde/railway-image-service/internal/pkg/throttle"
+)
+
+// Transformer processes the content of an upload with a transform, e.g. the
+// image processing path fit-in/2000x2000, returning the processed content. The
+// upload is spooled to the file at srcPath. Failures that are the client's
+// fault are reported as a *TransformError.
+type Transformer func(ctx context.Context, transform, srcPath string) ([]byte, error)
+
+// TransformError is a failure of a Transformer with the status to respond with
+type TransformError struct {
+	Status  int
+	Message string
+}
+
+func (e *TransformError) Error() string {
+	return e.Message
+}
+
+// TransformHandler stores the result of running an upload through transform,
+// so ingest pipelines can store e.g. a canonical size of an image without a
+// separate upload and /serve round trip. The transform is the transform query
+// parameter. Only the result is stored, unless the original query parameter
+// names a key to store the upload under as well. Signatures cover both query
+// parameters, so a signed URL can't be used to write other keys.
+func (k *KeyVal) TransformHandler(transform Transformer) fiber.Handler {
+	return func(c fiber.Ctx) error {
+		spec := c.Query("transform")
+		if spec == "" {
+			return httperr.SendMessage(c, fiber.StatusBadRequest, "missing transform")
+		}
+		key, ok := k.requestKey(c)
+		if !ok || len(key) == 0 || bytes.HasPrefix(key, []byte(internalKeyPrefix)) {
+			return httperr.SendMessage(c, fiber.StatusBadRequest, "invalid key")
+		}
+		key, problem := k.variantKey(c, key)
+		if problem != "" {
+			return httperr.SendMessage(c, fiber.StatusBadRequest, problem)
+		}
+		var original []byte
+		if name := c.Query("original"); name != "" {
+			if original, ok = k.CleanKey([]byte(name)); !ok || len(original) == 0 ||
+				bytes.HasPrefix(original, []byte(internalKeyPrefix)) || bytes.Equal(original, key) {
+				return httperr.SendMessage(c, fiber.StatusBadRequest, "invalid original key")
+			}
+		}
+
+		for _, lock := range [][]byte{key, original} {
+			if lock == nil {
+				continue
+			}
+			if !k.LockKey(lock) {
+				return sendKeyLocked(c)
+			}
+			defer k.UnlockKey(lock)
+		}
+
+		// uploads are spooled rather than held in memory
+		if err := os.MkdirAll(k.spoolDir(), 0755); err != nil {
+			k.log.Error("failed to create directory", "error", err)
+			return httperr.SendStatus(c, fiber.StatusInternalServerError)
+		}
+		tmpFile, err := k.createTemp(k.spoolDir())
+		if err != nil {
+			k.log.Error("failed to create temp file", "error", err)
+			return httperr.SendStatus(c, fiber.StatusInternalServerError)
+		}
+		defer os.Remove(tmpFile.Name())
+		defer tmpFile.Close()
+
+		written, err := io.Copy(tmpFile, io.LimitReader(k.uploadBody(c), int64(k.maxFileSize+1)))
+		if errors.Is(err, throttle.ErrIdleTimeout) {
+			return httperr.SendStatus(c, fiber.StatusRequestTimeout)
+		}
+		if err != nil {
+			k.log.Error("failed to read upload", "error", err)
+			return httperr.SendMessage(c, fiber.StatusBadRequest, "failed to read upload")
+		}
+		if written == 0 {
+			return httperr.SendMessage(c, fiber.StatusBadRequest, "empty upload")
+		}
+		if written > int64(k.maxFileSize) {
+			return httperr.SendStatus(c, fiber.StatusRequestEntityTooLarge)
+		}
+
+		result, err := transform(c.Context(), spec, tmpFile.Name())
+		if err != nil {
+			var terr *TransformError
+			if errors.As(err, &terr) {
+				return httperr.SendMessage(c, terr.Status, terr.Message)
+			}
+			k.log.Error("failed to transform upload", "key", string(key), "transform", spec, "error", err)
+			return httperr.SendStatus(c, fiber.StatusInternalServerError)
+		}
+
+		opts := WriteOptions{Filename: uploadFilename(c.Get(fiber.HeaderContentDisposition))}
+		if original != nil {
+			opts.ContentType = c.Get(fiber.HeaderContentType)
+			if _, err := tmpFile.Seek(0, io.SeekStart); err != nil {
+				k.log.Error("failed to seek temp file", "error", err)
+				return httperr.SendStatus(c, fiber.StatusInternalServerError)
+			}
+			if status := k.Write(c.Context(), original, tmpFile, int(written), opts); status != fiber.StatusCreated {
+				return sendWriteStatus(c, status)
+			}
+			opts.ContentType = ""
+		}
+		res, status := k.WriteWithResult(c.Context(), key, bytes.NewReader(result), len(result), opts)
+		if status == fiber.StatusCreated && wantsUploadResponse(c) {
+			return k.sendUploadResponse(c, key, res)
+		}
+		if status >= fiber.StatusBadRequest {
+			return sendWriteStatus(c, status)
+		}
+		return c.SendStatus(status)
+	}
+}
@@ -0,0 +1,96 @@
+package keyval
+
+import (
+	"regexp"
+	"strings"
+
+	"github.com/gofiber/fiber/v3"
+	"github.com/jaredLunde/railway-image-service/internal/pkg/httperr"
+	"github.com/syndtr/goleveldb/leveldb/util"
+)
+
+// VariantSeparator joins a key and the name of one of its variants, so the
+// variant 2x of hero.png is stored under the key hero.png@2x
+const VariantSeparator = "@"
+
+var variantName = regexp.MustCompile(`^[A-Za-z0-9._-]{1,64}$`)
+
+// VariantKey returns the key a variant of a key is stored under, reporting
+// false for invalid variant names
+func VariantKey(key []byte, variant string) ([]byte, bool) {
+	if !variantName.MatchString(variant) || len(key) == 0 || strings.HasSuffix(string(key), "/") {
+		return nil, false
+	}
+	return append(append([]byte{}, key...), VariantSeparator+variant...), true
+}
+
+// VariantsResponse lists the variants stored for a key
+type VariantsResponse struct {
+	Key      string   `json:"key"`
+	Variants []string `json:"variants"`
+}
+
+// Variants returns the names of the live variants of a key in sorted order
+func (k *KeyVal) Variants(key []byte) ([]string, error) {
+	prefix := append(append([]byte{}, key...), VariantSeparator...)
+	db, release := k.database()
+	defer release()
+	iter := db.NewIterator(util.BytesPrefix(k.dbKey(prefix)), nil)
+	defer iter.Release()
+	variants := make([]string, 0)
+	for iter.Next() {
+		variant := string(iter.Key()[len(k.namespace)+len(prefix):])
+		// e.g. hero.png@2x/other.png is a key of its own
+		if !variantName.MatchString(variant) {
+			continue
+		}
+		rec, err := toRecord(iter.Value())
+		if err != nil {
+			k.log.Error("failed to decode record", "key", string(prefix)+variant, "error", err)
+			continue
+		}
+		if rec.Deleted == NO {
+			variants = append(variants, variant)
+		}
+	}
+	return variants, iter.Error()
+}
+
+const (
+	// ErrVariantsDisabled is the body of a 400 response to a variant request
+	// when variants are disabled
+	ErrVariantsDisabled = "variants are disabled"
+	// ErrInvalidVariant is the body of a 400 response to a variant request
+	// with an invalid variant name
+	ErrInvalidVariant = "invalid variant"
+)
+
+// variantKey resolves the variant query parameter of a request, returning the
+// key unchanged without one. It describes the problem if the variant can't be
+// resolved.
+func (k *KeyVal) variantKey(c fiber.Ctx, key []byte) ([]byte, string) {
+	variant := c.Query("variant")
+	if variant == "" {
+		return key, ""
+	}
+	if !k.variants {
+		return nil, ErrVariantsDisabled
+	}
+	vkey, ok := VariantKey(key, variant)
+	if !ok {
+		return nil, ErrInvalidVariant
+	}
+	return vkey, ""
+}
+
+func (k *KeyVal) sendVariants(c fiber.Ctx, key []byte) error {
+	if !k.variants {
+		return httperr.SendMessage(c, fiber.StatusBadRequest, ErrVariantsDisabled)
+	}
+	variants, err := k.Variants(key)
+	if err != nil {
+		k.log.Error("failed to list variants", "key", string(key), "error", err)
+		return httperr.SendStatus(c, fiber.StatusInternalServerError)
+	}
+	return c.JSON(VariantsResponse{Key: string(key), Variants: variants})
+}
@@ -0,0 +1,76 @@
+package signature
+
+import (
+	"errors"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v3"
+	"github.com/jaredLunde/railway-image-service/client/sign"
+	"github.com/jaredLunde/railway-image-service/internal/pkg/httperr"
+)
+
+// CheckResponse reports whether a signed URL is currently valid
+type CheckResponse struct {
+	Valid bool `json:"valid"`
+	// When a /blob signature expires. /serve signatures don't expire.
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+	// Why the URL isn't valid, one of the CheckReason constants
+	Reason string `json:"reason,omitempty"`
+}
+
+const (
+	CheckReasonExpired           = "expired"
+	CheckReasonSignatureMismatch = "signature_mismatch"
+	CheckReasonUnsupportedPrefix = "unsupported_prefix"
+	CheckReasonInvalidIP         = "invalid_ip"
+	CheckReasonInvalidMethod     = "invalid_method"
+	CheckReasonInvalidMaxSize    = "invalid_max_size"
+	CheckReasonMalformedURL      = "malformed_url"
+)
+
+// CheckHandler reports whether the signed URL in the url query parameter is
+// currently valid, without performing the operation it grants. The URL may be
+// absolute or a path. Only the signature and expiry are checked: it doesn't
+// tell whether a nonce was used, whether the request comes from the IP address
+// or uses the method the signature is bound to, or whether the blob exists.
+func (s *Signature) CheckHandler(c fiber.Ctx) error {
+	raw := c.Query("url")
+	if raw == "" {
+		return httperr.SendMessage(c, fiber.StatusBadRequest, "missing url")
+	}
+	u, err := url.Parse(raw)
+	if err != nil || !strings.HasPrefix(u.Path, "/") {
+		return c.JSON(CheckResponse{Reason: CheckReasonMalformedURL})
+	}
+
+	var res CheckResponse
+	if strings.HasPrefix(u.Path, "/blob") {
+		if millis, err := strconv.ParseInt(u.Query().Get("x-expire"), 10, 64); err == nil {
+			expiresAt := time.UnixMilli(millis).UTC()
+			res.ExpiresAt = &expiresAt
+		}
+	}
+	err = sign.VerifyURLWithOptions(u, s.secret, sign.Options{SignServeQuery: s.signServeQuery, ClockSkew: s.clockSkew, PreviousSecrets: s.previousSecrets})
+	switch {
+	case err == nil:
+		res.Valid = true
+	case errors.Is(err, sign.ErrSignatureExpired):
+		res.Reason = CheckReasonExpired
+	case errors.Is(err, sign.ErrSignatureMismatch):
+		res.Reason = CheckReasonSignatureMismatch
+	case errors.Is(err, sign.ErrUnsupportedPrefix):
+		res.Reason = CheckReasonUnsupportedPrefix
+	case errors.Is(err, sign.ErrInvalidIP):
+		res.Reason = CheckReasonInvalidIP
+	case errors.Is(err, sign.ErrInvalidMethod):
+		res.Reason = CheckReasonInvalidMethod
+	case errors.Is(err, sign.ErrInvalidMaxSize):
+		res.Reason = CheckReasonInvalidMaxSize
+	default:
+		res.Reason = CheckReasonMalformedURL
+	}
+	return c.JSON(res)
+}
@@ -0,0 +1,100 @@
+package signature
+
+import (
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v3"
+	"github.com/jaredLunde/railway-image-service/client/sign"
+	"github.com/jaredLunde/railway-image-service/internal/pkg/httperr"
+)
+
+// DebugResponse shows how the server signs a path, so a client implementation
+// can be compared against it step by step
+type DebugResponse struct {
+	// The path as it is signed, without the /sign prefix and unescaped
+	Path string `json:"path"`
+	// The exact string that is signed with HMAC-SHA256
+	Payload   string `json:"payload"`
+	Signature string `json:"signature"`
+	// The expiry of a /blob signature in Unix milliseconds
+	Expire string `json:"expire,omitempty"`
+	Nonce  string `json:"nonce,omitempty"`
+	// The IP address or CIDR a /blob signature is bound to
+	IP string `json:"ip,omitempty"`
+	// The HTTP method and max upload size a /blob signature is bound to
+	Method  string `json:"method,omitempty"`
+	MaxSize string `json:"max_size,omitempty"`
+	// The path with the signature query parameters the server expects
+	URL string `json:"url"`
+}
+
+// DebugHandler returns the canonical payload and signature of the path in the
+// path query parameter. /blob signatures expire at the expire query parameter
+// (Unix milliseconds) or after the default TTL, and include the nonce, ip,
+// method, and max_size query parameters if there are any. It signs any payload
+// it is given, so it must never be exposed in production.
+func (s *Signature) DebugHandler(c fiber.Ctx) error {
+	ref, err := url.Parse(c.Query("path"))
+	if err != nil || ref.IsAbs() || ref.Host != "" {
+		return httperr.SendMessage(c, fiber.StatusBadRequest, "invalid path")
+	}
+	path := strings.TrimPrefix(ref.Path, "/sign")
+	query := ref.Query()
+	res := DebugResponse{Path: path}
+
+	switch {
+	case strings.HasPrefix(path, "/serve"):
+		servePath, err := sign.CanonicalServePath(path, query)
+		if err != nil {
+			return httperr.SendMessage(c, fiber.StatusBadRequest, err.Error())
+		}
+		res.Payload = servePath
+		if s.signServeQuery {
+			res.Payload = sign.ServePayload(servePath, query)
+		}
+	case strings.HasPrefix(path, "/blob"):
+		res.Expire = c.Query("expire")
+		if res.Expire == "" {
+			res.Expire = strconv.FormatInt(time.Now().Add(s.defaultTTL).UnixMilli(), 10)
+		} else if _, err := strconv.ParseInt(res.Expire, 10, 64); err != nil {
+			return httperr.SendMessage(c, fiber.StatusBadRequest, "invalid expire, expected Unix milliseconds")
+		}
+		res.Nonce = c.Query("nonce")
+		res.IP = c.Query("ip")
+		if res.IP != "" && !sign.ValidIPScope(res.IP) {
+			return httperr.SendMessage(c, fiber.StatusBadRequest, "invalid ip, expected an IP address or CIDR")
+		}
+		res.Method = strings.ToUpper(c.Query("method"))
+		res.MaxSize = c.Query("max_size")
+		if err := sign.ValidBounds(res.Method, res.MaxSize); err != nil {
+			return httperr.SendMessage(c, fiber.StatusBadRequest, err.Error())
+		}
+		res.Payload = sign.ParamsBlobPayload(sign.BoundBlobPayload(path, res.Expire, res.Nonce, res.IP, res.Method, res.MaxSize), query)
+		query.Set("x-expire", res.Expire)
+		if res.Nonce != "" {
+			query.Set("x-nonce", res.Nonce)
+		}
+		if res.IP != "" {
+			query.Set("x-ip", res.IP)
+		}
+		if res.Method != "" {
+			query.Set("x-method", res.Method)
+		}
+		if res.MaxSize != "" {
+			query.Set("x-max-size", res.MaxSize)
+		}
+	default:
+		return httperr.SendMessage(c, fiber.StatusBadRequest, fmt.Sprintf("invalid path %q, expected a /blob or /serve path", path))
+	}
+
+	// Sign drops the leading slash of the payload
+	res.Payload = strings.TrimPrefix(res.Payload, "/")
+	res.Signature = sign.Sign(res.Payload, s.secret)
+	query.Set("x-signature", res.Signature)
+	res.URL = (&url.URL{Path: path, RawQuery: query.Encode()}).String()
+	return c.JSON(res)
+}
@@ -1,29 +1,227 @@
 package signature
 
 import (
+	"encoding/json"
+	"errors"
+	"fmt"
 	"net/url"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/gofiber/fiber/v3"
 	"github.com/jaredLunde/railway-image-service/client/sign"
+	"github.com/jaredLunde/railway-image-service/internal/pkg/httperr"
 )
 
-func New(secret string) *Signature {
-	return &Signature{secret}
+type Config struct {
+	// Signs URLs
+	Secret string
+	// Secrets that signatures are still accepted from, e.g. the keys Secret
+	// was rotated from
+	PreviousSecrets []string
+	// Include a single-use nonce in every signed /blob URL
+	Nonce bool
+	// Cover the query string of /serve URLs with the signature
+	SignServeQuery bool
+	// How long after they expire /blob signatures are still accepted
+	ClockSkew time.Duration
+	// How long /blob signatures are valid for when a request doesn't ask for a
+	// TTL. Defaults to sign.DefaultTTL.
+	DefaultTTL time.Duration
+	// The longest TTL a request can ask for. Defaults to DefaultMaxTTL.
+	MaxTTL time.Duration
+}
+
+// DefaultMaxTTL is the longest TTL a request can ask for by default
+const DefaultMaxTTL = 365 * 24 * time.Hour
+
+func New(cfg Config) *Signature {
+	if cfg.DefaultTTL <= 0 {
+		cfg.DefaultTTL = sign.DefaultTTL
+	}
+	if cfg.MaxTTL <= 0 {
+		cfg.MaxTTL = DefaultMaxTTL
+	}
+	return &Signature{secret: cfg.Secret, previousSecrets: cfg.PreviousSecrets, nonce: cfg.Nonce, signServeQuery: cfg.SignServeQuery, clockSkew: cfg.ClockSkew, defaultTTL: cfg.DefaultTTL, maxTTL: cfg.MaxTTL}
 }
 
 type Signature struct {
-	secret string
+	secret          string
+	previousSecrets []string
+	nonce           bool
+	signServeQuery  bool
+	clockSkew       time.Duration
+	defaultTTL      time.Duration
+	maxTTL          time.Duration
+}
+
+// validTTL reports whether a TTL in seconds is positive and at most the max
+// TTL. It's compared in seconds, so huge TTLs can't overflow a time.Duration.
+func (s *Signature) validTTL(ttl int) bool {
+	return ttl > 0 && int64(ttl) <= int64(s.maxTTL/time.Second)
+}
+
+// PathErrorDetails are the details of an error signing a path
+type PathErrorDetails struct {
+	// The path without the /sign prefix
+	Path            string   `json:"path"`
+	AllowedPrefixes []string `json:"allowed_prefixes,omitempty"`
 }
 
+const (
+	ErrCodeUnsupportedPrefix = "unsupported_prefix"
+	ErrCodeMalformedPath     = "malformed_path"
+	ErrCodeInvalidMethod     = "invalid_method"
+	ErrCodeInvalidMaxSize    = "invalid_max_size"
+	ErrCodeInvalidTTL        = "invalid_ttl"
+)
+
 func (s *Signature) ServeHTTP(c fiber.Ctx) error {
 	u, err := url.Parse(string(c.Request().URI().FullURI()))
 	if err != nil {
-		return c.Status(fiber.StatusBadRequest).SendString("invalid request")
+		return httperr.Send(c, fiber.StatusBadRequest, httperr.Error{
+			Code:    ErrCodeMalformedPath,
+			Message: "the path could not be parsed",
+			Details: PathErrorDetails{Path: strings.TrimPrefix(c.Path(), "/sign")},
+		})
+	}
+
+	// /blob signatures can expire in a number of seconds and be bound to a
+	// method and max upload size, e.g. ?expires_in=600&method=PUT&max_size=1048576
+	// for a browser upload
+	var item BatchItem
+	if strings.HasPrefix(strings.TrimPrefix(u.Path, "/sign"), "/blob") {
+		query := u.Query()
+		if v := query.Get("expires_in"); v != "" {
+			if item.TTL, err = strconv.Atoi(v); err != nil || !s.validTTL(item.TTL) {
+				return httperr.Send(c, fiber.StatusBadRequest, httperr.Error{
+					Code:    ErrCodeInvalidTTL,
+					Message: fmt.Sprintf("expires_in must be a positive number of seconds up to %d", int64(s.maxTTL/time.Second)),
+					Details: PathErrorDetails{Path: strings.TrimPrefix(u.Path, "/sign")},
+				})
+			}
+		}
+		item.Method = query.Get("method")
+		if v := query.Get("max_size"); v != "" {
+			if item.MaxSize, err = strconv.ParseInt(v, 10, 64); err != nil || item.MaxSize <= 0 {
+				return httperr.Send(c, fiber.StatusBadRequest, httperr.Error{
+					Code:    ErrCodeInvalidMaxSize,
+					Message: "max_size must be a positive number of bytes",
+					Details: PathErrorDetails{Path: strings.TrimPrefix(u.Path, "/sign")},
+				})
+			}
+		}
+		query.Del("expires_in")
+		query.Del("method")
+		query.Del("max_size")
+		u.RawQuery = query.Encode()
 	}
 
-	uri, err := sign.SignURL(u, s.secret)
+	uri, err := s.sign(u, item)
 	if err != nil {
-		return c.Status(fiber.StatusBadRequest).SendString("invalid request")
+		details := PathErrorDetails{Path: strings.TrimPrefix(u.Path, "/sign")}
+		if errors.Is(err, sign.ErrUnsupportedPrefix) {
+			details.AllowedPrefixes = sign.SignablePrefixes
+			return httperr.Send(c, fiber.StatusBadRequest, httperr.Error{
+				Code:    ErrCodeUnsupportedPrefix,
+				Message: fmt.Sprintf("paths must start with one of %s", strings.Join(sign.SignablePrefixes, ", ")),
+				Details: details,
+			})
+		}
+		if errors.Is(err, sign.ErrInvalidMethod) {
+			return httperr.Send(c, fiber.StatusBadRequest, httperr.Error{
+				Code:    ErrCodeInvalidMethod,
+				Message: fmt.Sprintf("method must be one of %s", strings.Join(sign.SignableMethods, ", ")),
+				Details: details,
+			})
+		}
+		if errors.Is(err, sign.ErrInvalidMaxSize) {
+			return httperr.Send(c, fiber.StatusBadRequest, httperr.Error{
+				Code:    ErrCodeInvalidMaxSize,
+				Message: "max_size requires the PUT or POST method",
+				Details: details,
+			})
+		}
+		return httperr.Send(c, fiber.StatusBadRequest, httperr.Error{
+			Code:    ErrCodeMalformedPath,
+			Message: err.Error(),
+			Details: details,
+		})
 	}
 	return c.SendString(*uri)
 }
+
+func (s *Signature) sign(u *url.URL, item BatchItem) (*string, error) {
+	ttl := s.defaultTTL
+	if item.TTL > 0 {
+		ttl = time.Duration(item.TTL) * time.Second
+	}
+	opts := sign.Options{
+		TTL:            ttl,
+		Method:         item.Method,
+		MaxSize:        item.MaxSize,
+		SignServeQuery: s.signServeQuery,
+	}
+	if s.nonce && strings.HasPrefix(strings.TrimPrefix(u.Path, "/sign"), "/blob") {
+		opts.Nonce = sign.NewNonce()
+	}
+	return sign.SignURLWithOptions(u, s.secret, opts)
+}
+
+// MaxBatchSize is the max number of paths that can be signed in one request
+const MaxBatchSize = 1000
+
+// BatchItem is a path to sign in a batch. In JSON, it is either a path string
+// or an object with a path, an optional TTL in seconds, and an optional method
+// and max upload size that a /blob signature is bound to.
+type BatchItem struct {
+	Path    string `json:"path"`
+	TTL     int    `json:"ttl,omitempty"`
+	Method  string `json:"method,omitempty"`
+	MaxSize int64  `json:"max_size,omitempty"`
+}
+
+func (b *BatchItem) UnmarshalJSON(data []byte) error {
+	if len(data) > 0 && data[0] == '"' {
+		return json.Unmarshal(data, &b.Path)
+	}
+	type batchItem BatchItem
+	return json.Unmarshal(data, (*batchItem)(b))
+}
+
+// BatchHandler signs a JSON array of paths, returning a JSON array of signed
+// URLs in the same order
+func (s *Signature) BatchHandler(c fiber.Ctx) error {
+	var items []BatchItem
+	if err := json.Unmarshal(c.Body(), &items); err != nil {
+		return httperr.SendMessage(c, fiber.StatusBadRequest, "invalid request body")
+	}
+	if len(items) > MaxBatchSize {
+		return httperr.SendMessage(c, fiber.StatusRequestEntityTooLarge, fmt.Sprintf("too many paths, the max is %d", MaxBatchSize))
+	}
+
+	base, err := url.Parse(c.BaseURL())
+	if err != nil {
+		return httperr.SendMessage(c, fiber.StatusBadRequest, "invalid request")
+	}
+	signed := make([]string, len(items))
+	for n, item := range items {
+		ref, err := url.Parse(item.Path)
+		if err != nil || ref.IsAbs() || ref.Host != "" || !strings.HasPrefix(ref.Path, "/") || item.MaxSize < 0 {
+			return httperr.SendMessage(c, fiber.StatusBadRequest, fmt.Sprintf("invalid path at index %d", n))
+		}
+		if item.TTL != 0 && !s.validTTL(item.TTL) {
+			return httperr.Send(c, fiber.StatusBadRequest, httperr.Error{
+				Code:    ErrCodeInvalidTTL,
+				Message: fmt.Sprintf("the ttl at index %d must be a positive number of seconds up to %d", n, int64(s.maxTTL/time.Second)),
+			})
+		}
+		uri, err := s.sign(base.ResolveReference(ref), item)
+		if err != nil {
+			return httperr.SendMessage(c, fiber.StatusBadRequest, fmt.Sprintf("invalid path at index %d", n))
+		}
+		signed[n] = *uri
+	}
+	return c.JSON(signed)
+}
@@ -0,0 +1,539 @@
+package signature_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gofiber/fiber/v3"
+	"github.com/jaredLunde/railway-image-service/client/sign"
+	"github.com/jaredLunde/railway-image-service/internal/app/keyval"
+	"github.com/jaredLunde/railway-image-service/internal/app/signature"
+	"github.com/jaredLunde/railway-image-service/internal/pkg/mw"
+)
+
+const (
+	apiKey     = "api-key"
+	signSecret = "sign-secret"
+)
+
+// newTestApp wires the blob and sign routes the same way the server does
+func newTestApp(t *testing.T) *fiber.App {
+	t.Helper()
+	dir := t.TempDir()
+	kv, err := keyval.New(keyval.Config{
+		BasePath:         "/blob",
+		UploadPath:       filepath.Join(dir, "uploads"),
+		LevelDBPath:      filepath.Join(dir, "db"),
+		SoftDelete:       true,
+		SignSecret:       signSecret,
+		MaxSize:          1 << 20,
+		AllowedMimeTypes: []string{"image/"},
+		Logger:           slog.New(slog.NewTextHandler(io.Discard, nil)),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { kv.Close() })
+
+	app := fiber.New(fiber.Config{StrictRouting: true, StreamRequestBody: true})
+	// app.Test requests come from 0.0.0.0
+	trustedProxies, _ := mw.ParseTrustedProxies([]string{"0.0.0.0"})
+	app.Use(mw.NewRealIP(trustedProxies))
+	keys := mw.APIKeys{apiKey: mw.Scopes}
+	app.Get("/blob/*", kv.ServeHTTP, mw.NewVerifyAccess(keys, mw.ScopeFilesRead, signSecret))
+	app.Put("/blob/*", kv.ServeHTTP, mw.NewVerifyAccess(keys, mw.ScopeFilesWrite, signSecret))
+	app.Post("/sign/batch", signature.New(signature.Config{Secret: signSecret}).BatchHandler, mw.NewVerifyAPIKey(keys, mw.ScopeSign))
+	app.Get("/sign/debug", signature.New(signature.Config{Secret: signSecret}).DebugHandler, mw.NewVerifyAPIKey(keys, mw.ScopeSign))
+	app.Get("/sign/check", signature.New(signature.Config{Secret: signSecret}).CheckHandler, mw.NewVerifyAPIKey(keys, mw.ScopeSign))
+	app.Get("/sign/*", signature.New(signature.Config{Secret: signSecret}).ServeHTTP, mw.NewVerifyAPIKey(keys, mw.ScopeSign))
+	return app
+}
+
+func TestSignedBlobURL(t *testing.T) {
+	content := append([]byte("\x89PNG\r\n\x1a\n"), bytes.Repeat([]byte{'a'}, 1024)...)
+
+	tests := []struct {
+		name string
+		key  string
+	}{
+		{name: "simple key", key: "images/photo.png"},
+		{name: "escaped key", key: "images/my photo (1).png"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			app := newTestApp(t)
+			blobPath := (&url.URL{Path: "/blob/" + tt.key}).EscapedPath()
+
+			req := httptest.NewRequest(http.MethodPut, blobPath, bytes.NewReader(content))
+			req.Header.Set("x-api-key", apiKey)
+			res, err := app.Test(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if res.StatusCode != http.StatusCreated {
+				t.Fatalf("expected upload to succeed, got %d", res.StatusCode)
+			}
+
+			req = httptest.NewRequest(http.MethodGet, "/sign"+blobPath, nil)
+			req.Header.Set("x-api-key", apiKey)
+			res, err = app.Test(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			body, _ := io.ReadAll(res.Body)
+			if res.StatusCode != http.StatusOK {
+				t.Fatalf("expected signing to succeed, got %d: %s", res.StatusCode, body)
+			}
+			signedURL, err := url.Parse(string(body))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			// only the signature, no API key
+			res, err = app.Test(httptest.NewRequest(http.MethodGet, signedURL.RequestURI(), nil))
+			if err != nil {
+				t.Fatal(err)
+			}
+			body, _ = io.ReadAll(res.Body)
+			if res.StatusCode != http.StatusOK {
+				t.Fatalf("expected signed GET to succeed, got %d: %s", res.StatusCode, body)
+			}
+			if !bytes.Equal(body, content) {
+				t.Errorf("expected the stored file to be returned")
+			}
+
+			// a signature is only valid for the path it was issued for
+			q := signedURL.Query()
+			other := &url.URL{Path: "/blob/images/other.png", RawQuery: q.Encode()}
+			res, err = app.Test(httptest.NewRequest(http.MethodGet, other.RequestURI(), nil))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if res.StatusCode != http.StatusUnauthorized {
+				t.Errorf("expected a signature for another path to be rejected, got %d", res.StatusCode)
+			}
+		})
+	}
+}
+
+func TestIPScopedBlobURL(t *testing.T) {
+	app := newTestApp(t)
+	content := append([]byte("\x89PNG\r\n\x1a\n"), bytes.Repeat([]byte{'a'}, 1024)...)
+	req := httptest.NewRequest(http.MethodPut, "/blob/a.png", bytes.NewReader(content))
+	req.Header.Set("x-api-key", apiKey)
+	if res, err := app.Test(req); err != nil || res.StatusCode != http.StatusCreated {
+		t.Fatalf("expected upload to succeed: %v", err)
+	}
+
+	req = httptest.NewRequest(http.MethodGet, "/sign/blob/a.png?x-ip=203.0.113.0/24", nil)
+	req.Header.Set("x-api-key", apiKey)
+	res, err := app.Test(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(res.Body)
+	signedURL, err := url.Parse(string(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if signedURL.Query().Get("x-ip") != "203.0.113.0/24" {
+		t.Fatalf("expected the signed URL to be bound to the CIDR, got %s", body)
+	}
+
+	unbound := signedURL.Query()
+	unbound.Del("x-ip")
+	widened := signedURL.Query()
+	widened.Set("x-ip", "0.0.0.0/0")
+	tests := []struct {
+		name  string
+		query string
+		ip    string
+		want  int
+	}{
+		{"in range", signedURL.RawQuery, "203.0.113.7", http.StatusOK},
+		{"out of range", signedURL.RawQuery, "198.51.100.1", http.StatusForbidden},
+		{"binding removed", unbound.Encode(), "198.51.100.1", http.StatusUnauthorized},
+		{"binding widened", widened.Encode(), "198.51.100.1", http.StatusUnauthorized},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest(http.MethodGet, "/blob/a.png?"+tt.query, nil)
+		req.Header.Set("X-Real-IP", tt.ip)
+		res, err := app.Test(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if res.StatusCode != tt.want {
+			t.Errorf("%s: expected status %d, got %d", tt.name, tt.want, res.StatusCode)
+		}
+	}
+
+	// the header of a client that isn't a trusted proxy is ignored
+	spoofed := fiber.New()
+	spoofed.Use(mw.NewRealIP(nil))
+	spoofed.Get("/blob/*", func(c fiber.Ctx) error { return c.SendStatus(fiber.StatusOK) },
+		mw.NewVerifyAccess(mw.APIKeys{apiKey: mw.Scopes}, mw.ScopeFilesRead, signSecret))
+	req = httptest.NewRequest(http.MethodGet, "/blob/a.png?"+signedURL.RawQuery, nil)
+	req.Header.Set("X-Real-IP", "203.0.113.7")
+	req.Header.Set("X-Forwarded-For", "203.0.113.7")
+	res, err = spoofed.Test(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.StatusCode != http.StatusForbidden {
+		t.Errorf("expected a spoofed IP header to be ignored, got status %d", res.StatusCode)
+	}
+}
+
+func TestPresignedUpload(t *testing.T) {
+	app := newTestApp(t)
+	req := httptest.NewRequest(http.MethodGet, "/sign/blob/upload.png?method=put&max_size=2048", nil)
+	req.Header.Set("x-api-key", apiKey)
+	res, err := app.Test(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(res.Body)
+	signedURL, err := url.Parse(string(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	q := signedURL.Query()
+	if q.Get("x-method") != http.MethodPut || q.Get("x-max-size") != "2048" || q.Has("method") || q.Has("max_size") {
+		t.Fatalf("expected the signed URL to be bound to PUT and 2048 bytes, got %s", body)
+	}
+
+	content := append([]byte("\x89PNG\r\n\x1a\n"), bytes.Repeat([]byte{'a'}, 1024)...)
+	tests := []struct {
+		name    string
+		method  string
+		content []byte
+		want    int
+	}{
+		{"upload", http.MethodPut, content, http.StatusCreated},
+		{"too large", http.MethodPut, append(content, bytes.Repeat([]byte{'a'}, 2048)...), http.StatusRequestEntityTooLarge},
+		{"read", http.MethodGet, nil, http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		res, err := app.Test(httptest.NewRequest(tt.method, "/blob/upload.png?"+signedURL.RawQuery, bytes.NewReader(tt.content)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if res.StatusCode != tt.want {
+			t.Errorf("%s: expected status %d, got %d", tt.name, tt.want, res.StatusCode)
+		}
+	}
+
+	for _, query := range []string{"method=PATCH", "method=GET&max_size=10", "method=PUT&max_size=-1"} {
+		req := httptest.NewRequest(http.MethodGet, "/sign/blob/upload.png?"+query, nil)
+		req.Header.Set("x-api-key", apiKey)
+		res, err := app.Test(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if res.StatusCode != http.StatusBadRequest {
+			t.Errorf("%s: expected status 400, got %d", query, res.StatusCode)
+		}
+	}
+}
+
+func TestSignTTL(t *testing.T) {
+	app := fiber.New()
+	app.Get("/sign/*", signature.New(signature.Config{Secret: signSecret, DefaultTTL: 5 * time.Minute, MaxTTL: 48 * time.Hour}).ServeHTTP)
+
+	tests := []struct {
+		query string
+		want  int
+		ttl   time.Duration
+	}{
+		{"", http.StatusOK, 5 * time.Minute},
+		{"?expires_in=60", http.StatusOK, time.Minute},
+		{"?expires_in=172800", http.StatusOK, 48 * time.Hour},
+		{"?expires_in=0", http.StatusBadRequest, 0},
+		{"?expires_in=soon", http.StatusBadRequest, 0},
+		{"?expires_in=172801", http.StatusBadRequest, 0},
+		// overflows a time.Duration
+		{"?expires_in=9223372036854775807", http.StatusBadRequest, 0},
+	}
+	for _, tt := range tests {
+		res, err := app.Test(httptest.NewRequest(http.MethodGet, "/sign/blob/a.png"+tt.query, nil))
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := io.ReadAll(res.Body)
+		if res.StatusCode != tt.want {
+			t.Errorf("%q: expected status %d, got %d", tt.query, tt.want, res.StatusCode)
+			continue
+		}
+		if tt.want != http.StatusOK {
+			if !strings.Contains(string(body), signature.ErrCodeInvalidTTL) {
+				t.Errorf("%q: expected the %s code, got %s", tt.query, signature.ErrCodeInvalidTTL, body)
+			}
+			continue
+		}
+		u, err := url.Parse(string(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if u.Query().Has("expires_in") {
+			t.Errorf("%q: expected expires_in to be removed, got %s", tt.query, body)
+		}
+		expire, _ := strconv.ParseInt(u.Query().Get("x-expire"), 10, 64)
+		if d := time.Until(time.UnixMilli(expire)); d <= tt.ttl-time.Minute || d > tt.ttl {
+			t.Errorf("%q: expected the URL to expire in %s, got %s", tt.query, tt.ttl, d)
+		}
+		if err := sign.VerifyURL(u, signSecret); err != nil {
+			t.Errorf("%q: expected a valid signature: %v", tt.query, err)
+		}
+	}
+}
+
+func TestSignErrors(t *testing.T) {
+	app := newTestApp(t)
+
+	tests := []struct {
+		name     string
+		path     string
+		wantCode string
+		wantPath string
+	}{
+		{"unsupported prefix", "/sign/files/photo.png", signature.ErrCodeUnsupportedPrefix, "/files/photo.png"},
+		{"malformed serve options", "/sign/serve/blob/photo.png?no_cache=maybe", signature.ErrCodeMalformedPath, "/serve/blob/photo.png"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, tt.path, nil)
+			req.Header.Set("x-api-key", apiKey)
+			res, err := app.Test(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if res.StatusCode != http.StatusBadRequest {
+				t.Fatalf("expected status 400, got %d", res.StatusCode)
+			}
+			var body struct {
+				Error struct {
+					Code    string                     `json:"code"`
+					Details signature.PathErrorDetails `json:"details"`
+				} `json:"error"`
+			}
+			if err := json.NewDecoder(res.Body).Decode(&body); err != nil {
+				t.Fatal(err)
+			}
+			if body.Error.Code != tt.wantCode {
+				t.Errorf("expected code %q, got %q", tt.wantCode, body.Error.Code)
+			}
+			if body.Error.Details.Path != tt.wantPath {
+				t.Errorf("expected path %q, got %q", tt.wantPath, body.Error.Details.Path)
+			}
+			if tt.wantCode == signature.ErrCodeUnsupportedPrefix && len(body.Error.Details.AllowedPrefixes) == 0 {
+				t.Errorf("expected the allowed prefixes")
+			}
+		})
+	}
+}
+
+func TestSignBatch(t *testing.T) {
+	app := newTestApp(t)
+
+	body := `["/blob/a.png", {"path": "/blob/b.png", "ttl": 60}, "/serve/100x100/blob/a.png"]`
+	req := httptest.NewRequest(http.MethodPost, "/sign/batch", strings.NewReader(body))
+	req.Header.Set("x-api-key", apiKey)
+	res, err := app.Test(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.StatusCode != http.StatusOK {
+		b, _ := io.ReadAll(res.Body)
+		t.Fatalf("expected batch signing to succeed, got %d: %s", res.StatusCode, b)
+	}
+	var signed []string
+	if err := json.NewDecoder(res.Body).Decode(&signed); err != nil {
+		t.Fatal(err)
+	}
+	if len(signed) != 3 {
+		t.Fatalf("expected 3 signed URLs, got %d", len(signed))
+	}
+	for n, want := range []string{"/blob/a.png", "/blob/b.png", "/serve/100x100/blob/a.png"} {
+		u, err := url.Parse(signed[n])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if u.Path != want {
+			t.Errorf("expected path %s, got %s", want, u.Path)
+		}
+		if err := sign.VerifyURL(u, signSecret); err != nil {
+			t.Errorf("expected a valid signature for %s: %v", signed[n], err)
+		}
+	}
+
+	u, _ := url.Parse(signed[1])
+	expireAt, _ := strconv.ParseInt(u.Query().Get("x-expire"), 10, 64)
+	if ttl := time.Until(time.UnixMilli(expireAt)); ttl > time.Minute || ttl < 50*time.Second {
+		t.Errorf("expected a TTL of about a minute, got %v", ttl)
+	}
+
+	for _, body := range []string{`{}`, `["https://example.com/blob/a.png"]`, `["/files/a.png"]`, `[{"path": "/blob/a.png", "ttl": -1}]`, `[{"path": "/blob/a.png", "ttl": 9223372036854775807}]`} {
+		req := httptest.NewRequest(http.MethodPost, "/sign/batch", strings.NewReader(body))
+		req.Header.Set("x-api-key", apiKey)
+		res, err := app.Test(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if res.StatusCode != http.StatusBadRequest {
+			t.Errorf("expected %s to be rejected, got %d", body, res.StatusCode)
+		}
+	}
+
+	res, err = app.Test(httptest.NewRequest(http.MethodPost, "/sign/batch", strings.NewReader(`["/blob/a.png"]`)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.StatusCode != http.StatusUnauthorized {
+		t.Errorf("expected requests without an API key to be rejected, got %d", res.StatusCode)
+	}
+}
+
+func TestSignDebug(t *testing.T) {
+	app := newTestApp(t)
+	expire := strconv.FormatInt(time.Now().Add(time.Minute).UnixMilli(), 10)
+
+	tests := []struct {
+		name        string
+		query       url.Values
+		wantPayload string
+	}{
+		{
+			name:        "blob",
+			query:       url.Values{"path": {"/blob/a b.png"}, "expire": {expire}, "nonce": {"abc"}},
+			wantPayload: "blob/a b.png:" + expire + ":abc",
+		},
+		{
+			name:        "sign prefix",
+			query:       url.Values{"path": {"/sign/blob/a.png"}, "expire": {expire}},
+			wantPayload: "blob/a.png:" + expire,
+		},
+		{
+			name:        "serve",
+			query:       url.Values{"path": {"/serve/100x100/blob/a.png?force_format=png"}},
+			wantPayload: "100x100/filters:format(png)/blob/a.png",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/sign/debug?"+tt.query.Encode(), nil)
+			req.Header.Set("x-api-key", apiKey)
+			res, err := app.Test(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if res.StatusCode != http.StatusOK {
+				body, _ := io.ReadAll(res.Body)
+				t.Fatalf("expected status 200, got %d: %s", res.StatusCode, body)
+			}
+			var got signature.DebugResponse
+			if err := json.NewDecoder(res.Body).Decode(&got); err != nil {
+				t.Fatal(err)
+			}
+			if got.Payload != tt.wantPayload {
+				t.Errorf("expected payload %q, got %q", tt.wantPayload, got.Payload)
+			}
+			u, err := url.Parse(got.URL)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := sign.VerifyURL(u, signSecret); err != nil {
+				t.Errorf("expected %s to verify: %v", got.URL, err)
+			}
+		})
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/sign/debug?path=/other/a.png", nil)
+	req.Header.Set("x-api-key", apiKey)
+	res, err := app.Test(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.StatusCode != http.StatusBadRequest {
+		t.Errorf("expected status 400 for an unsigned path, got %d", res.StatusCode)
+	}
+}
+
+func TestCheckHandler(t *testing.T) {
+	app := newTestApp(t)
+	signURL := func(path string, ttl time.Duration) *url.URL {
+		t.Helper()
+		uri, err := sign.SignURLWithOptions(&url.URL{Path: path}, signSecret, sign.Options{TTL: ttl})
+		if err != nil {
+			t.Fatal(err)
+		}
+		u, _ := url.Parse(*uri)
+		return u
+	}
+	valid := signURL("/blob/a.png", time.Hour)
+	expired := signURL("/blob/a.png", time.Hour)
+	q := expired.Query()
+	q.Set("x-expire", strconv.FormatInt(time.Now().Add(-time.Minute).UnixMilli(), 10))
+	expired.RawQuery = q.Encode()
+	forged := signURL("/blob/a.png", time.Hour)
+	forged.Path = "/blob/b.png"
+
+	tests := []struct {
+		name       string
+		url        string
+		wantValid  bool
+		wantReason string
+		wantExpiry bool
+	}{
+		{"valid blob URL", valid.String(), true, "", true},
+		{"absolute URL", "https://images.example.com" + valid.String(), true, "", true},
+		{"valid serve URL", signURL("/serve/100x100/blob/a.png", 0).String(), true, "", false},
+		{"expired", expired.String(), false, signature.CheckReasonExpired, true},
+		{"another path", forged.String(), false, signature.CheckReasonSignatureMismatch, true},
+		{"unsigned", "/blob/a.png", false, signature.CheckReasonSignatureMismatch, false},
+		{"unsupported prefix", "/admin/locks?x-signature=abc", false, signature.CheckReasonUnsupportedPrefix, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/sign/check?url="+url.QueryEscape(tt.url), nil)
+			req.Header.Set("x-api-key", apiKey)
+			res, err := app.Test(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if res.StatusCode != http.StatusOK {
+				t.Fatalf("unexpected status %d", res.StatusCode)
+			}
+			var body signature.CheckResponse
+			if err := json.NewDecoder(res.Body).Decode(&body); err != nil {
+				t.Fatal(err)
+			}
+			if body.Valid != tt.wantValid || body.Reason != tt.wantReason {
+				t.Errorf("expected valid %v and reason %q, got %+v", tt.wantValid, tt.wantReason, body)
+			}
+			if (body.ExpiresAt != nil) != tt.wantExpiry {
+				t.Errorf("unexpected expiry %v", body.ExpiresAt)
+			}
+		})
+	}
+
+	res, err := app.Test(httptest.NewRequest(http.MethodGet, "/sign/check?url="+url.QueryEscape(valid.String()), nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.StatusCode != http.StatusUnauthorized {
+		t.Errorf("expected the API key to be required, got %d", res.StatusCode)
+	}
+}
@@ -0,0 +1,352 @@
+package webhook
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gofiber/fiber/v3"
+	"github.com/jaredLunde/railway-image-service/client/sign"
+	"github.com/jaredLunde/railway-image-service/internal/app/keyval"
+)
+
+const (
+	DefaultMaxRetries     = 5
+	DefaultInitialBackoff = time.Second
+	DefaultMaxBackoff     = time.Minute
+	DefaultTimeout        = 10 * time.Second
+	DefaultQueueSize      = 1024
+	// the number of deliveries sent at once
+	workers = 4
+)
+
+// What Notify does when the delivery queue is full
+const (
+	// Dead letter the new delivery
+	QueuePolicyDeadLetter = "dead-letter"
+	// Dead letter the oldest queued delivery to make room for the new one
+	QueuePolicyDropOldest = "drop-oldest"
+	// Wait for room in the queue, holding up the write that caused the event
+	QueuePolicyBlock = "block"
+)
+
+type Config struct {
+	// Every event is POSTed to each of these URLs
+	URLs   []string
+	Secret string
+	// How many times a failed delivery is retried. Defaults to
+	// DefaultMaxRetries.
+	MaxRetries int
+	// The delay before the first retry, doubled on each retry after it up to
+	// MaxBackoff
+	InitialBackoff time.Duration
+	MaxBackoff     time.Duration
+	// How long each delivery attempt may take
+	Timeout time.Duration
+	// How many deliveries can wait to be sent. Defaults to DefaultQueueSize.
+	QueueSize int
+	// What to do with deliveries once the queue is full. Defaults to
+	// QueuePolicyDeadLetter.
+	QueuePolicy string
+	// Deliveries that failed for good are appended to this file as JSON lines.
+	// They are always logged.
+	DeadLetterPath string
+	Logger         *slog.Logger
+	Client         *http.Client
+}
+
+// Payload is the body of a webhook delivery
+type Payload struct {
+	// Unique per event, so receivers can ignore redeliveries
+	ID string `json:"id"`
+	keyval.Event
+}
+
+// Stats are counts of deliveries since the server started
+type Stats struct {
+	// How many deliveries are waiting to be sent
+	Queued    int   `json:"queued"`
+	QueueSize int   `json:"queue_size"`
+	Delivered int64 `json:"delivered"`
+	// Failed attempts that were retried
+	Retried int64 `json:"retried"`
+	// Deliveries that failed for good, including those dead lettered because
+	// the queue was full
+	Failed int64 `json:"failed"`
+	// How many times a delivery found the queue full
+	QueueFull int64 `json:"queue_full"`
+}
+
+// DeadLetter is a delivery that failed for good
+type DeadLetter struct {
+	URL      string    `json:"url"`
+	Payload  Payload   `json:"payload"`
+	Attempts int       `json:"attempts"`
+	Error    string    `json:"error"`
+	FailedAt time.Time `json:"failed_at"`
+}
+
+type delivery struct {
+	url     string
+	payload Payload
+}
+
+// Webhook sends HMAC-signed POSTs of keyval events to a list of URLs in the
+// background, retrying failed deliveries with exponential backoff
+type Webhook struct {
+	urls           []string
+	secret         string
+	maxRetries     int
+	initialBackoff time.Duration
+	maxBackoff     time.Duration
+	deadLetterPath string
+	deadLetterMu   sync.Mutex
+	queue          chan delivery
+	queuePolicy    string
+	stopped        chan struct{}
+	delivered      atomic.Int64
+	retried        atomic.Int64
+	failed         atomic.Int64
+	queueFull      atomic.Int64
+	log            *slog.Logger
+	client         *http.Client
+}
+
+func New(cfg Config) (*Webhook, error) {
+	if cfg.Secret == "" {
+		return nil, fmt.Errorf("webhooks require a secret")
+	}
+	if cfg.MaxRetries < 0 {
+		return nil, fmt.Errorf("invalid webhook max retries %d", cfg.MaxRetries)
+	}
+	if cfg.MaxRetries == 0 {
+		cfg.MaxRetries = DefaultMaxRetries
+	}
+	if cfg.InitialBackoff <= 0 {
+		cfg.InitialBackoff = DefaultInitialBackoff
+	}
+	if cfg.MaxBackoff <= 0 {
+		cfg.MaxBackoff = DefaultMaxBackoff
+	}
+	if cfg.Timeout <= 0 {
+		cfg.Timeout = DefaultTimeout
+	}
+	if cfg.QueueSize <= 0 {
+		cfg.QueueSize = DefaultQueueSize
+	}
+	switch cfg.QueuePolicy {
+	case "":
+		cfg.QueuePolicy = QueuePolicyDeadLetter
+	case QueuePolicyDeadLetter, QueuePolicyDropOldest, QueuePolicyBlock:
+	default:
+		return nil, fmt.Errorf("invalid webhook queue policy %q: must be %s, %s, or %s", cfg.QueuePolicy, QueuePolicyDeadLetter, QueuePolicyDropOldest, QueuePolicyBlock)
+	}
+	if cfg.Client == nil {
+		cfg.Client = &http.Client{Timeout: cfg.Timeout}
+	}
+	return &Webhook{
+		urls:           cfg.URLs,
+		secret:         cfg.Secret,
+		maxRetries:     cfg.MaxRetries,
+		initialBackoff: cfg.InitialBackoff,
+		maxBackoff:     cfg.MaxBackoff,
+		deadLetterPath: cfg.DeadLetterPath,
+		queue:          make(chan delivery, cfg.QueueSize),
+		queuePolicy:    cfg.QueuePolicy,
+		stopped:        make(chan struct{}),
+		log:            cfg.Logger,
+		client:         cfg.Client,
+	}, nil
+}
+
+// Notify queues an event for delivery to every URL, so it can be passed to
+// keyval.Config.Notify. It only blocks with QueuePolicyBlock.
+func (w *Webhook) Notify(e keyval.Event) {
+	payload := Payload{ID: newID(), Event: e}
+	for _, u := range w.urls {
+		w.enqueue(delivery{url: u, payload: payload})
+	}
+}
+
+func (w *Webhook) enqueue(d delivery) {
+	select {
+	case w.queue <- d:
+		return
+	default:
+	}
+	w.queueFull.Add(1)
+	errQueueFull := fmt.Errorf("delivery queue is full")
+	switch w.queuePolicy {
+	case QueuePolicyDropOldest:
+		for {
+			select {
+			case w.queue <- d:
+				return
+			default:
+			}
+			select {
+			case oldest := <-w.queue:
+				w.deadLetter(oldest, 0, errQueueFull)
+			default:
+			}
+		}
+	case QueuePolicyBlock:
+		select {
+		case w.queue <- d:
+		case <-w.stopped:
+			w.deadLetter(d, 0, context.Canceled)
+		}
+	default:
+		w.deadLetter(d, 0, errQueueFull)
+	}
+}
+
+// Stats returns counts of deliveries since the server started
+func (w *Webhook) Stats() Stats {
+	return Stats{
+		Queued:    len(w.queue),
+		QueueSize: cap(w.queue),
+		Delivered: w.delivered.Load(),
+		Retried:   w.retried.Load(),
+		Failed:    w.failed.Load(),
+		QueueFull: w.queueFull.Load(),
+	}
+}
+
+// StatsHandler responds with the webhook's Stats
+func (w *Webhook) StatsHandler(c fiber.Ctx) error {
+	return c.JSON(w.Stats())
+}
+
+// Run sends queued deliveries until ctx is done. Deliveries that are still
+// queued or being retried then are dead lettered.
+func (w *Webhook) Run(ctx context.Context) {
+	var wg sync.WaitGroup
+	for range workers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-ctx.Done():
+					return
+				case d := <-w.queue:
+					w.deliver(ctx, d)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	close(w.stopped)
+	for {
+		select {
+		case d := <-w.queue:
+			w.deadLetter(d, 0, ctx.Err())
+		default:
+			return
+		}
+	}
+}
+
+// deliver sends a delivery, retrying it until it succeeds, fails for good, or
+// runs out of retries
+func (w *Webhook) deliver(ctx context.Context, d delivery) {
+	body, err := json.Marshal(d.payload)
+	if err != nil {
+		w.deadLetter(d, 0, err)
+		return
+	}
+	backoff := w.initialBackoff
+	for attempt := 1; ; attempt++ {
+		retry, err := w.send(ctx, d.url, d.payload.ID, body)
+		if err == nil {
+			w.delivered.Add(1)
+			return
+		}
+		if !retry || attempt > w.maxRetries {
+			w.deadLetter(d, attempt, err)
+			return
+		}
+		w.retried.Add(1)
+		w.log.Warn("webhook delivery failed, retrying", "url", d.url, "id", d.payload.ID, "attempt", attempt, "backoff", backoff, "error", err)
+		select {
+		case <-ctx.Done():
+			w.deadLetter(d, attempt, err)
+			return
+		case <-time.After(backoff):
+		}
+		backoff = min(backoff*2, w.maxBackoff)
+	}
+}
+
+// send makes one delivery attempt, reporting whether a failure is worth
+// retrying
+func (w *Webhook) send(ctx context.Context, url, id string, body []byte) (bool, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(sign.HeaderWebhookID, id)
+	req.Header.Set(sign.HeaderWebhookTimestamp, timestamp)
+	req.Header.Set(sign.HeaderWebhookSignature, sign.SignWebhook(body, timestamp, w.secret))
+	res, err := w.client.Do(req)
+	if err != nil {
+		return true, err
+	}
+	io.Copy(io.Discard, io.LimitReader(res.Body, 64*1024))
+	res.Body.Close()
+	if res.StatusCode >= 200 && res.StatusCode <= 299 {
+		return false, nil
+	}
+	err = fmt.Errorf("unexpected status code %d", res.StatusCode)
+	// other client errors won't succeed on a retry
+	retry := res.StatusCode >= 500 || res.StatusCode == http.StatusRequestTimeout || res.StatusCode == http.StatusTooManyRequests
+	return retry, err
+}
+
+// deadLetter logs a delivery that failed for good and appends it to the dead
+// letter file, if any
+func (w *Webhook) deadLetter(d delivery, attempts int, err error) {
+	w.failed.Add(1)
+	letter := DeadLetter{URL: d.url, Payload: d.payload, Attempts: attempts, Error: err.Error(), FailedAt: time.Now().UTC()}
+	w.log.Error("webhook delivery failed", "url", d.url, "id", d.payload.ID, "type", d.payload.Type, "key", d.payload.Key, "attempts", attempts, "error", err)
+	if w.deadLetterPath == "" {
+		return
+	}
+	line, err := json.Marshal(letter)
+	if err != nil {
+		return
+	}
+	w.deadLetterMu.Lock()
+	defer w.deadLetterMu.Unlock()
+	f, err := os.OpenFile(w.deadLetterPath, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		w.log.Error("failed to open webhook dead letter file", "error", err)
+		return
+	}
+	defer f.Close()
+	if _, err := f.Write(append(line, '\n')); err != nil {
+		w.log.Error("failed to write webhook dead letter", "error", err)
+	}
+}
+
+func newID() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(b)
+}
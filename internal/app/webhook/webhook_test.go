@@ -0,0 +1,152 @@
+package webhook
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/jaredLunde/railway-image-service/client/sign"
+	"github.com/jaredLunde/railway-image-service/internal/app/keyval"
+)
+
+func TestWebhook_Deliver(t *testing.T) {
+	var attempts atomic.Int32
+	received := make(chan Payload, 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		if err := sign.VerifyWebhook(body, r.Header.Get(sign.HeaderWebhookTimestamp), r.Header.Get(sign.HeaderWebhookSignature), "secret", 0); err != nil {
+			t.Errorf("expected a valid signature, got %v", err)
+		}
+		switch {
+		case r.URL.Path == "/gone":
+			w.WriteHeader(http.StatusGone)
+		case attempts.Add(1) < 3:
+			w.WriteHeader(http.StatusServiceUnavailable)
+		default:
+			var p Payload
+			json.Unmarshal(body, &p)
+			received <- p
+		}
+	}))
+	defer srv.Close()
+
+	deadLetters := filepath.Join(t.TempDir(), "dead-letters.jsonl")
+	w, err := New(Config{
+		URLs:           []string{srv.URL + "/ok", srv.URL + "/gone"},
+		Secret:         "secret",
+		InitialBackoff: time.Millisecond,
+		DeadLetterPath: deadLetters,
+		Logger:         slog.New(slog.NewTextHandler(io.Discard, nil)),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go w.Run(ctx)
+
+	w.Notify(keyval.Event{Type: keyval.EventUploaded, Key: "a.png", Hash: "abc", Size: 3})
+	select {
+	case p := <-received:
+		if p.Type != keyval.EventUploaded || p.Key != "a.png" || p.ID == "" {
+			t.Errorf("unexpected payload %+v", p)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected the delivery to succeed after retries")
+	}
+	if n := attempts.Load(); n != 3 {
+		t.Errorf("expected 3 attempts, got %d", n)
+	}
+
+	// a 410 isn't retried
+	var letter DeadLetter
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		if data, err := os.ReadFile(deadLetters); err == nil && len(data) > 0 {
+			if err := json.Unmarshal(data, &letter); err != nil {
+				t.Fatal(err)
+			}
+			break
+		}
+	}
+	if letter.URL != srv.URL+"/gone" || letter.Attempts != 1 || letter.Payload.Key != "a.png" {
+		t.Errorf("unexpected dead letter %+v", letter)
+	}
+
+	// the delivery is counted once the receiver's response is read
+	stats := w.Stats()
+	for deadline := time.Now().Add(5 * time.Second); stats.Delivered == 0 && time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		stats = w.Stats()
+	}
+	if stats.Delivered != 1 || stats.Retried != 2 || stats.Failed != 1 {
+		t.Errorf("unexpected stats %+v", stats)
+	}
+}
+
+func TestWebhook_QueuePolicy(t *testing.T) {
+	newWebhook := func(policy string) *Webhook {
+		w, err := New(Config{
+			URLs:        []string{"http://localhost"},
+			Secret:      "secret",
+			QueueSize:   1,
+			QueuePolicy: policy,
+			Logger:      slog.New(slog.NewTextHandler(io.Discard, nil)),
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return w
+	}
+	if _, err := New(Config{Secret: "secret", QueuePolicy: "drop-newest"}); err == nil {
+		t.Error("expected an unknown policy to be rejected")
+	}
+
+	// nothing is running, so only the first event fits in the queue
+	w := newWebhook(QueuePolicyDeadLetter)
+	w.Notify(keyval.Event{Key: "a.png"})
+	w.Notify(keyval.Event{Key: "b.png"})
+	if d := <-w.queue; d.payload.Key != "a.png" {
+		t.Errorf("expected the new event to be dead lettered, got %s queued", d.payload.Key)
+	}
+	if stats := w.Stats(); stats.Failed != 1 || stats.QueueFull != 1 || stats.QueueSize != 1 {
+		t.Errorf("unexpected stats %+v", stats)
+	}
+
+	w = newWebhook(QueuePolicyDropOldest)
+	w.Notify(keyval.Event{Key: "a.png"})
+	w.Notify(keyval.Event{Key: "b.png"})
+	if stats := w.Stats(); stats.Queued != 1 || stats.Failed != 1 {
+		t.Errorf("unexpected stats %+v", stats)
+	}
+	if d := <-w.queue; d.payload.Key != "b.png" {
+		t.Errorf("expected the oldest event to be dead lettered, got %s queued", d.payload.Key)
+	}
+
+	w = newWebhook(QueuePolicyBlock)
+	w.Notify(keyval.Event{Key: "a.png"})
+	notified := make(chan struct{})
+	go func() {
+		w.Notify(keyval.Event{Key: "b.png"})
+		close(notified)
+	}()
+	select {
+	case <-notified:
+		t.Fatal("expected Notify to block while the queue is full")
+	case <-time.After(50 * time.Millisecond):
+	}
+	<-w.queue
+	<-notified
+	if d := <-w.queue; d.payload.Key != "b.png" {
+		t.Errorf("expected the blocked event to be queued, got %s", d.payload.Key)
+	}
+	if stats := w.Stats(); stats.Failed != 0 || stats.QueueFull != 1 {
+		t.Errorf("unexpected stats %+v", stats)
+	}
+}
@@ -0,0 +1,115 @@
+package httperr
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+
+	"github.com/gofiber/fiber/v3"
+	"github.com/gofiber/fiber/v3/middleware/requestid"
+)
+
+// Response is the JSON envelope of an error response
+type Response struct {
+	Error Error `json:"error"`
+}
+
+type Error struct {
+	// A stable, machine-readable identifier of the error, e.g. "malformed_path"
+	Code    string `json:"code"`
+	Message string `json:"message"`
+	// The ID of the request, for correlating errors with logs
+	RequestID string `json:"request_id,omitempty"`
+	// Additional context about the error, specific to its code
+	Details any `json:"details,omitempty"`
+}
+
+// Send responds with a JSON error envelope. The request ID is filled in when
+// err doesn't have one.
+func Send(c fiber.Ctx, status int, err Error) error {
+	if err.RequestID == "" {
+		err.RequestID = requestid.FromContext(c)
+	}
+	return c.Status(status).JSON(Response{Error: err})
+}
+
+// SendMessage responds with message and the code of status
+func SendMessage(c fiber.Ctx, status int, message string) error {
+	return Send(c, status, Error{Code: StatusCode(status), Message: message})
+}
+
+// SendStatus responds with the code and text of status, e.g. "not_found" and
+// "not found" for a 404
+func SendStatus(c fiber.Ctx, status int) error {
+	return SendMessage(c, status, strings.ToLower(http.StatusText(status)))
+}
+
+// StatusCode returns the error code of a status, e.g. "not_found" for a 404
+func StatusCode(status int) string {
+	text := http.StatusText(status)
+	if text == "" {
+		return "error"
+	}
+	var b strings.Builder
+	for _, r := range strings.ToLower(text) {
+		switch {
+		case r >= 'a' && r <= 'z' || r >= '0' && r <= '9':
+			b.WriteRune(r)
+		case r == ' ' || r == '-':
+			b.WriteByte('_')
+		}
+	}
+	return b.String()
+}
+
+// ErrorHandler responds to errors returned by handlers with the error envelope.
+// The messages of errors other than *fiber.Error aren't exposed.
+func ErrorHandler(c fiber.Ctx, err error) error {
+	var ferr *fiber.Error
+	if errors.As(err, &ferr) {
+		return SendMessage(c, ferr.Code, ferr.Message)
+	}
+	return SendStatus(c, fiber.StatusInternalServerError)
+}
+
+// Wrap rewrites the error responses of a handler that doesn't use the
+// envelope, like imagor's, into the envelope. Responses that aren't JSON or
+// text, e.g. error images, are left alone.
+func Wrap(h fiber.Handler) fiber.Handler {
+	return func(c fiber.Ctx) error {
+		if err := h(c); err != nil {
+			return err
+		}
+		status := c.Response().StatusCode()
+		if status < fiber.StatusBadRequest {
+			return nil
+		}
+		contentType := string(c.Response().Header.ContentType())
+		body := c.Response().Body()
+		var message string
+		switch {
+		case strings.HasPrefix(contentType, fiber.MIMEApplicationJSON):
+			var e struct {
+				Message string           `json:"message"`
+				Error   *json.RawMessage `json:"error"`
+			}
+			if json.Unmarshal(body, &e) != nil || e.Error != nil {
+				return nil
+			}
+			message = e.Message
+		case strings.HasPrefix(contentType, fiber.MIMETextPlain), len(body) == 0:
+			message = strings.TrimSpace(string(body))
+		default:
+			return nil
+		}
+		if c.Method() == fiber.MethodHead {
+			return nil
+		}
+		if message == "" {
+			message = strings.ToLower(http.StatusText(status))
+		}
+		c.Response().ResetBody()
+		return SendMessage(c, status, message)
+	}
+}
@@ -0,0 +1,77 @@
+package httperr
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gofiber/fiber/v3"
+	"github.com/gofiber/fiber/v3/middleware/requestid"
+)
+
+func TestStatusCode(t *testing.T) {
+	tests := map[int]string{
+		fiber.StatusNotFound:                      "not_found",
+		fiber.StatusRequestURITooLong:             "request_uri_too_long",
+		fiber.StatusTeapot:                        "im_a_teapot",
+		fiber.StatusTooManyRequests:               "too_many_requests",
+		fiber.StatusRequestEntityTooLarge:         "request_entity_too_large",
+		fiber.StatusNetworkAuthenticationRequired: "network_authentication_required",
+		599: "error",
+	}
+	for status, want := range tests {
+		if got := StatusCode(status); got != want {
+			t.Errorf("%d: expected %q, got %q", status, want, got)
+		}
+	}
+}
+
+func TestWrap(t *testing.T) {
+	app := fiber.New(fiber.Config{ErrorHandler: ErrorHandler})
+	app.Use(requestid.New(requestid.Config{Generator: func() string { return "abc" }}))
+	app.Get("/imagor", Wrap(func(c fiber.Ctx) error {
+		c.Set(fiber.HeaderContentType, fiber.MIMEApplicationJSON)
+		return c.Status(fiber.StatusUnprocessableEntity).SendString(`{"message":"bad filter","status":422}`)
+	}))
+	app.Get("/text", Wrap(func(c fiber.Ctx) error {
+		return c.Status(fiber.StatusUnauthorized).SendString("unauthorized")
+	}))
+	app.Get("/image", Wrap(func(c fiber.Ctx) error {
+		c.Set(fiber.HeaderContentType, "image/png")
+		return c.Status(fiber.StatusInternalServerError).SendString("png")
+	}))
+
+	tests := []struct {
+		path    string
+		code    string
+		message string
+	}{
+		{"/imagor", "unprocessable_entity", "bad filter"},
+		{"/text", "unauthorized", "unauthorized"},
+		{"/missing", "not_found", "Cannot GET /missing"},
+	}
+	for _, tt := range tests {
+		res, err := app.Test(httptest.NewRequest(http.MethodGet, tt.path, nil))
+		if err != nil {
+			t.Fatal(err)
+		}
+		var body Response
+		if err := json.NewDecoder(res.Body).Decode(&body); err != nil {
+			t.Fatalf("%s: %v", tt.path, err)
+		}
+		want := Error{Code: tt.code, Message: tt.message, RequestID: "abc"}
+		if body.Error != want {
+			t.Errorf("%s: expected %+v, got %+v", tt.path, want, body.Error)
+		}
+	}
+
+	res, err := app.Test(httptest.NewRequest(http.MethodGet, "/image", nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if body, _ := io.ReadAll(res.Body); string(body) != "png" {
+		t.Errorf("expected error images to be left alone, got %q", body)
+	}
+}
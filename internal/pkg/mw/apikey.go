@@ -1,45 +1,257 @@
 package mw
 
 import (
-	"crypto/subtle"
-	"fmt"
+	"net/url"
+	"slices"
 	"strconv"
 	"time"
 
 	"github.com/gofiber/fiber/v3"
 	"github.com/jaredLunde/railway-image-service/client/sign"
+	"github.com/jaredLunde/railway-image-service/internal/pkg/httperr"
 )
 
-func NewVerifyAPIKey(secretKey string) func(c fiber.Ctx) error {
+type apiKeyLocal struct{}
+
+type signatureLocal struct{}
+
+const (
+	ErrCodeMissingScope     = "missing_scope"
+	ErrCodeSignatureExpired = "signature_expired"
+	ErrCodeSignatureUsed    = "signature_used"
+)
+
+// HasAPIKey reports whether a request was authorized with an API key rather
+// than a signature
+func HasAPIKey(c fiber.Ctx) bool {
+	ok, _ := c.Locals(apiKeyLocal{}).(bool)
+	return ok
+}
+
+// hasVerifiedSignature reports whether NewVerifyAccess authorized a request
+// with its signature
+func hasVerifiedSignature(c fiber.Ctx) bool {
+	ok, _ := c.Locals(signatureLocal{}).(bool)
+	return ok
+}
+
+// NewVerifyAPIKey requires an API key that is granted scope. An empty scope
+// accepts any valid key.
+func NewVerifyAPIKey(keys APIKeys, scope string) func(c fiber.Ctx) error {
 	return func(c fiber.Ctx) error {
-		apiKey := c.Get("x-api-key")
-		if subtle.ConstantTimeCompare([]byte(apiKey), []byte(secretKey)) != 1 {
-			return c.Status(fiber.StatusUnauthorized).SendString("unauthorized")
+		scopes, ok := keys.Lookup(c.Get("x-api-key"))
+		if !ok {
+			return httperr.SendMessage(c, fiber.StatusUnauthorized, "unauthorized")
 		}
+		if scope != "" && !slices.Contains(scopes, scope) {
+			return sendMissingScope(c, scope)
+		}
+		c.Locals(apiKeyLocal{}, true)
 		return c.Next()
 	}
 }
 
-func NewVerifyAccess(secretKey, signSecret string) func(c fiber.Ctx) error {
+func sendMissingScope(c fiber.Ctx, scope string) error {
+	return httperr.Send(c, fiber.StatusForbidden, httperr.Error{
+		Code:    ErrCodeMissingScope,
+		Message: "api key lacks the " + scope + " scope",
+	})
+}
+
+// NonceStore records signature nonces so that a signed URL can only be used once
+type NonceStore interface {
+	// UseNonce marks a nonce as used until expireAt, returning false if it
+	// had already been used
+	UseNonce(nonce string, expireAt time.Time) (bool, error)
+}
+
+type VerifyAccessOption func(*verifyAccessConfig)
+
+type verifyAccessConfig struct {
+	nonces          NonceStore
+	verifications   chan struct{}
+	clockSkew       time.Duration
+	previousSecrets []string
+	rateLimit       *rateLimiter
+}
+
+// WithRequiredNonce requires signed URLs to carry a nonce that has not been
+// used before. API key requests are unaffected.
+func WithRequiredNonce(store NonceStore) VerifyAccessOption {
+	return func(cfg *verifyAccessConfig) {
+		cfg.nonces = store
+	}
+}
+
+// WithMaxConcurrentVerifications caps how many signatures are verified at
+// once. Requests over the cap are rejected with a 503 instead of queueing, so
+// a flood of bogus signatures can't monopolize the CPU. Middleware created with
+// the same option shares the cap.
+func WithMaxConcurrentVerifications(n int) VerifyAccessOption {
+	var verifications chan struct{}
+	if n > 0 {
+		verifications = make(chan struct{}, n)
+	}
+	return func(cfg *verifyAccessConfig) {
+		cfg.verifications = verifications
+	}
+}
+
+// WithClockSkew accepts signatures for up to d after they expire, so URLs
+// signed on a machine whose clock is behind aren't rejected early
+func WithClockSkew(d time.Duration) VerifyAccessOption {
+	return func(cfg *verifyAccessConfig) {
+		cfg.clockSkew = max(d, 0)
+	}
+}
+
+// WithPreviousSecrets also accepts signatures made with these secrets, so
+// URLs signed before the signing secret was rotated keep working
+func WithPreviousSecrets(secrets ...string) VerifyAccessOption {
+	return func(cfg *verifyAccessConfig) {
+		cfg.previousSecrets = secrets
+	}
+}
+
+// WithSignatureRateLimit limits each signed URL to rps requests per second,
+// with bursts of up to burst requests, once its signature has been verified.
+// This takes the place of NewRateLimit's limit on the IP address, so clients
+// sharing an address don't share a limit. Middleware created with the same
+// option shares the limit.
+func WithSignatureRateLimit(rps float64, burst int) VerifyAccessOption {
+	l := newRateLimiter(rps, burst)
+	return func(cfg *verifyAccessConfig) {
+		cfg.rateLimit = l
+	}
+}
+
+const (
+	// The length of an unpadded base64 HMAC-SHA256 signature
+	signatureLength = 43
+	// The number of digits in the largest int64
+	maxExpireLength = 19
+)
+
+// wellFormedExpire reports whether an expiry could possibly be valid, so that
+// garbage is rejected before doing any parsing or HMAC work
+func wellFormedExpire(expireAt string) bool {
+	if len(expireAt) > maxExpireLength {
+		return false
+	}
+	for i := 0; i < len(expireAt); i++ {
+		if expireAt[i] < '0' || expireAt[i] > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+// NewVerifyAccess requires either an API key that is granted scope or a valid
+// /blob signature
+func NewVerifyAccess(keys APIKeys, scope, signSecret string, opts ...VerifyAccessOption) func(c fiber.Ctx) error {
+	var cfg verifyAccessConfig
+	for _, opt := range opts {
+		opt(&cfg)
+	}
+	secrets := append([]string{signSecret}, cfg.previousSecrets...)
+
 	return func(c fiber.Ctx) error {
-		apiKey := c.Get("x-api-key")
-		hasValidAPIKey := subtle.ConstantTimeCompare([]byte(apiKey), []byte(secretKey)) == 1
+		scopes, isAPIKey := keys.Lookup(c.Get("x-api-key"))
+		hasValidAPIKey := isAPIKey && slices.Contains(scopes, scope)
 		signature := c.Query("x-signature")
 		expireAt := c.Query("x-expire")
+		nonce := c.Query("x-nonce")
+		ipScope := c.Query("x-ip")
+		boundMethod := c.Query("x-method")
+		maxSize := c.Query("x-max-size")
 		hasValidSignature := signSecret == ""
-		if signature != "" && expireAt != "" {
-			expireAtMillis, err := strconv.ParseInt(expireAt, 10, 64)
+		var expireAtMillis int64
+		if signature != "" && expireAt != "" && !hasValidAPIKey {
+			if !wellFormedExpire(expireAt) {
+				return httperr.SendMessage(c, fiber.StatusBadRequest, "invalid expire time")
+			}
+			if ipScope != "" && !sign.ValidIPScope(ipScope) {
+				return httperr.SendMessage(c, fiber.StatusBadRequest, "invalid ip")
+			}
+			if err := sign.ValidBounds(boundMethod, maxSize); err != nil {
+				return httperr.SendMessage(c, fiber.StatusBadRequest, err.Error())
+			}
+			if len(signature) != signatureLength {
+				return httperr.SendMessage(c, fiber.StatusUnauthorized, "unauthorized")
+			}
+			var err error
+			expireAtMillis, err = strconv.ParseInt(expireAt, 10, 64)
+			if err != nil {
+				return httperr.SendMessage(c, fiber.StatusBadRequest, "invalid expire time")
+			}
+			if time.Now().Add(-cfg.clockSkew).UnixMilli() > expireAtMillis {
+				return httperr.Send(c, fiber.StatusUnauthorized, httperr.Error{Code: ErrCodeSignatureExpired, Message: "signature expired"})
+			}
+			// Signers sign the decoded path, whereas c.Path() is still escaped
+			path, err := url.PathUnescape(c.Path())
 			if err != nil {
-				return c.Status(fiber.StatusBadRequest).SendString("invalid expire time")
+				return httperr.SendMessage(c, fiber.StatusBadRequest, "invalid path")
 			}
-			if time.Now().UnixMilli() > expireAtMillis {
-				return c.Status(fiber.StatusUnauthorized).SendString("signature expired")
+			query, err := url.ParseQuery(string(c.Request().URI().QueryString()))
+			if err != nil {
+				return httperr.SendMessage(c, fiber.StatusBadRequest, "invalid query")
+			}
+			if cfg.verifications != nil {
+				select {
+				case cfg.verifications <- struct{}{}:
+				default:
+					c.Set(fiber.HeaderRetryAfter, "1")
+					return httperr.SendMessage(c, fiber.StatusServiceUnavailable, "too many signature verifications")
+				}
+			}
+			payload := sign.ParamsBlobPayload(sign.BoundBlobPayload(path, expireAt, nonce, ipScope, boundMethod, maxSize), query)
+			hasValidSignature = sign.MatchSignature(signature, payload, secrets...)
+			if cfg.verifications != nil {
+				<-cfg.verifications
 			}
-			signatureB := sign.Sign(fmt.Sprintf("%s:%s", c.Path(), expireAt), signSecret)
-			hasValidSignature = subtle.ConstantTimeCompare([]byte(signature), []byte(signatureB)) == 1
 		}
 		if !hasValidAPIKey && !hasValidSignature {
-			return c.Status(fiber.StatusUnauthorized).SendString("unauthorized")
+			if isAPIKey {
+				return sendMissingScope(c, scope)
+			}
+			return httperr.SendMessage(c, fiber.StatusUnauthorized, "unauthorized")
+		}
+		if !hasValidAPIKey && signSecret != "" && ipScope != "" && !sign.MatchIP(ipScope, GetRealIP(c)) {
+			return httperr.SendMessage(c, fiber.StatusForbidden, "signature not valid from this ip")
+		}
+		if !hasValidAPIKey && signSecret != "" && !sign.MatchMethod(boundMethod, c.Method()) {
+			return httperr.SendMessage(c, fiber.StatusForbidden, "signature not valid for this method")
+		}
+		if !hasValidAPIKey && signSecret != "" && maxSize != "" {
+			// fasthttp doesn't read past the Content-Length, so it bounds the upload
+			limit, _ := strconv.ParseInt(maxSize, 10, 64)
+			contentLength := c.Request().Header.ContentLength()
+			if contentLength < 0 {
+				return httperr.SendMessage(c, fiber.StatusLengthRequired, "content length required")
+			}
+			if int64(contentLength) > limit {
+				return httperr.SendMessage(c, fiber.StatusRequestEntityTooLarge, "upload exceeds the signed max size")
+			}
+		}
+		if !hasValidAPIKey && signSecret != "" && cfg.nonces != nil {
+			if nonce == "" {
+				return httperr.SendMessage(c, fiber.StatusUnauthorized, "signature nonce required")
+			}
+			// the nonce must be kept for as long as the signature is accepted
+			fresh, err := cfg.nonces.UseNonce(nonce, time.UnixMilli(expireAtMillis).Add(cfg.clockSkew))
+			if err != nil {
+				return httperr.SendMessage(c, fiber.StatusInternalServerError, "failed to verify nonce")
+			}
+			if !fresh {
+				return httperr.Send(c, fiber.StatusUnauthorized, httperr.Error{Code: ErrCodeSignatureUsed, Message: "signature already used"})
+			}
+		}
+		c.Locals(apiKeyLocal{}, hasValidAPIKey)
+		c.Locals(signatureLocal{}, !hasValidAPIKey && signSecret != "")
+		if !hasValidAPIKey && signSecret != "" && cfg.rateLimit != nil {
+			if ok, wait := cfg.rateLimit.allow("sig:"+signature, time.Now()); !ok {
+				return sendRateLimited(c, wait)
+			}
 		}
 		return c.Next()
 	}
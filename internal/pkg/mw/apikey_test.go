@@ -0,0 +1,304 @@
+package mw
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gofiber/fiber/v3"
+	"github.com/jaredLunde/railway-image-service/client/sign"
+	"github.com/valyala/fasthttp"
+)
+
+const (
+	testSecretKey  = "api-key"
+	testSignSecret = "secret"
+)
+
+var testKeys = APIKeys{testSecretKey: Scopes}
+
+func newTestApp(opts ...VerifyAccessOption) *fiber.App {
+	app := fiber.New()
+	app.Get("/blob/*", func(c fiber.Ctx) error {
+		return c.SendStatus(fiber.StatusOK)
+	}, NewVerifyAccess(testKeys, ScopeFilesRead, testSignSecret, opts...))
+	return app
+}
+
+func signedPath(t testing.TB, path string) string {
+	u, err := sign.SignURL(&url.URL{Path: path}, testSignSecret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return *u
+}
+
+func TestVerifyAccess_Malformed(t *testing.T) {
+	app := newTestApp()
+	signature := strings.Repeat("a", signatureLength)
+	expire := fmt.Sprint(time.Now().Add(time.Hour).UnixMilli())
+
+	tests := []struct {
+		name  string
+		query string
+		want  int
+	}{
+		{"non-numeric expire", "x-signature=" + signature + "&x-expire=soon", fiber.StatusBadRequest},
+		{"absurd expire", "x-signature=" + signature + "&x-expire=" + strings.Repeat("9", 1000), fiber.StatusBadRequest},
+		{"short signature", "x-signature=abc&x-expire=" + expire, fiber.StatusUnauthorized},
+		{"wrong signature", "x-signature=" + signature + "&x-expire=" + expire, fiber.StatusUnauthorized},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			res, err := app.Test(httptest.NewRequest(http.MethodGet, "/blob/photo.png?"+tt.query, nil))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if res.StatusCode != tt.want {
+				t.Errorf("expected status %d, got %d", tt.want, res.StatusCode)
+			}
+		})
+	}
+
+	res, err := app.Test(httptest.NewRequest(http.MethodGet, signedPath(t, "/blob/photo.png"), nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.StatusCode != fiber.StatusOK {
+		t.Errorf("expected a valid signature to be accepted, got %d", res.StatusCode)
+	}
+}
+
+func TestVerifyAccess_MaxConcurrentVerifications(t *testing.T) {
+	opt := WithMaxConcurrentVerifications(1)
+	app := newTestApp(opt)
+	var cfg verifyAccessConfig
+	opt(&cfg)
+
+	// occupy the only slot
+	cfg.verifications <- struct{}{}
+	res, err := app.Test(httptest.NewRequest(http.MethodGet, signedPath(t, "/blob/photo.png"), nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.StatusCode != fiber.StatusServiceUnavailable {
+		t.Fatalf("expected status 503, got %d", res.StatusCode)
+	}
+
+	// API key requests don't verify signatures
+	req := httptest.NewRequest(http.MethodGet, "/blob/photo.png", nil)
+	req.Header.Set("x-api-key", testSecretKey)
+	if res, err = app.Test(req); err != nil {
+		t.Fatal(err)
+	}
+	if res.StatusCode != fiber.StatusOK {
+		t.Fatalf("expected status 200, got %d", res.StatusCode)
+	}
+
+	<-cfg.verifications
+	res, err = app.Test(httptest.NewRequest(http.MethodGet, signedPath(t, "/blob/photo.png"), nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.StatusCode != fiber.StatusOK {
+		t.Fatalf("expected status 200, got %d", res.StatusCode)
+	}
+}
+
+func TestVerifyAccess_MaxConcurrentVerifications_MalformedQuery(t *testing.T) {
+	app := newTestApp(WithMaxConcurrentVerifications(2))
+	signed := signedPath(t, "/blob/photo.png")
+
+	// queries Go's parser rejects mustn't keep their verification slot
+	for _, extra := range []string{"&q=%zz", "&a=1;b=2", "&q=%zz", "&a=1;b=2"} {
+		res, err := app.Test(httptest.NewRequest(http.MethodGet, signed+extra, nil))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if res.StatusCode != fiber.StatusBadRequest {
+			t.Fatalf("%s: expected status 400, got %d", extra, res.StatusCode)
+		}
+	}
+
+	res, err := app.Test(httptest.NewRequest(http.MethodGet, signed, nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.StatusCode != fiber.StatusOK {
+		t.Fatalf("expected a valid signature to be accepted, got %d", res.StatusCode)
+	}
+}
+
+func TestVerifyAccess_ClockSkew(t *testing.T) {
+	// a signature that expired 5s ago by the server's clock
+	expired := func() string {
+		expire := fmt.Sprint(time.Now().Add(-5 * time.Second).UnixMilli())
+		signature := sign.Sign(sign.BlobPayload("/blob/photo.png", expire, ""), testSignSecret)
+		return "/blob/photo.png?x-signature=" + signature + "&x-expire=" + expire
+	}
+
+	tests := []struct {
+		skew time.Duration
+		want int
+	}{
+		{0, fiber.StatusUnauthorized},
+		{time.Second, fiber.StatusUnauthorized},
+		{30 * time.Second, fiber.StatusOK},
+	}
+	for _, tt := range tests {
+		app := newTestApp(WithClockSkew(tt.skew))
+		res, err := app.Test(httptest.NewRequest(http.MethodGet, expired(), nil))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if res.StatusCode != tt.want {
+			t.Errorf("skew %s: expected status %d, got %d", tt.skew, tt.want, res.StatusCode)
+		}
+	}
+}
+
+func TestVerifyAccess_PreviousSecrets(t *testing.T) {
+	app := newTestApp(WithPreviousSecrets("old"))
+	signed := func(secret string) string {
+		u, err := sign.SignURL(&url.URL{Path: "/blob/photo.png"}, secret)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return *u
+	}
+
+	tests := []struct {
+		secret string
+		want   int
+	}{
+		{testSignSecret, fiber.StatusOK},
+		{"old", fiber.StatusOK},
+		{"unknown", fiber.StatusUnauthorized},
+	}
+	for _, tt := range tests {
+		res, err := app.Test(httptest.NewRequest(http.MethodGet, signed(tt.secret), nil))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if res.StatusCode != tt.want {
+			t.Errorf("%s: expected status %d, got %d", tt.secret, tt.want, res.StatusCode)
+		}
+	}
+}
+
+func TestVerifyAccess_BoundMethod(t *testing.T) {
+	app := fiber.New()
+	ok := func(c fiber.Ctx) error { return c.SendStatus(fiber.StatusOK) }
+	verify := NewVerifyAccess(testKeys, ScopeFilesRead, testSignSecret)
+	app.Get("/blob/*", ok, verify)
+	app.Put("/blob/*", ok, verify)
+	app.Delete("/blob/*", ok, verify)
+
+	u, err := sign.SignURLWithOptions(&url.URL{Path: "/blob/photo.png"}, testSignSecret, sign.Options{Method: http.MethodPut, MaxSize: 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+	upload := *u
+
+	tests := []struct {
+		name   string
+		method string
+		uri    string
+		body   string
+		want   int
+	}{
+		{"upload", http.MethodPut, upload, "hello", fiber.StatusOK},
+		{"too large", http.MethodPut, upload, "hello, world", fiber.StatusRequestEntityTooLarge},
+		{"other method", http.MethodDelete, upload, "", fiber.StatusForbidden},
+		{"read", http.MethodGet, upload, "", fiber.StatusForbidden},
+		{"unbound max size", http.MethodPut, strings.Replace(upload, "x-max-size=10", "x-max-size=100", 1), "hello", fiber.StatusUnauthorized},
+		{"max size of another method", http.MethodDelete, strings.Replace(upload, "x-method=PUT", "x-method=DELETE", 1), "", fiber.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			res, err := app.Test(httptest.NewRequest(tt.method, tt.uri, strings.NewReader(tt.body)))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if res.StatusCode != tt.want {
+				t.Errorf("expected status %d, got %d", tt.want, res.StatusCode)
+			}
+		})
+	}
+}
+
+func benchmarkVerifyAccess(b *testing.B, uri string) {
+	app := fiber.New()
+	app.Get("/blob/*", func(c fiber.Ctx) error {
+		return c.SendStatus(fiber.StatusOK)
+	}, NewVerifyAccess(testKeys, ScopeFilesRead, testSignSecret))
+	h := app.Handler()
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		var ctx fasthttp.RequestCtx
+		ctx.Request.SetRequestURI(uri)
+		h(&ctx)
+	}
+}
+
+func BenchmarkVerifyAccess_Valid(b *testing.B) {
+	benchmarkVerifyAccess(b, signedPath(b, "/blob/photo.png"))
+}
+
+func BenchmarkVerifyAccess_WrongSignature(b *testing.B) {
+	expire := fmt.Sprint(time.Now().Add(time.Hour).UnixMilli())
+	benchmarkVerifyAccess(b, "/blob/photo.png?x-signature="+strings.Repeat("a", signatureLength)+"&x-expire="+expire)
+}
+
+func BenchmarkVerifyAccess_MalformedExpire(b *testing.B) {
+	benchmarkVerifyAccess(b, "/blob/photo.png?x-signature="+strings.Repeat("a", signatureLength)+"&x-expire="+strings.Repeat("9", 1000))
+}
+
+func TestVerifyAccess_EncodedPath(t *testing.T) {
+	app := newTestApp()
+	// signatures cover the path decoded once, like the key it refers to
+	for _, path := range []string{"/blob/a b.png", "/blob/a+b.png", "/blob/100%.png", "/blob/a%20b.png", "/blob/café.png"} {
+		res, err := app.Test(httptest.NewRequest(http.MethodGet, signedPath(t, path), nil))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if res.StatusCode != fiber.StatusOK {
+			t.Errorf("%s: expected a valid signature to be accepted, got %d", path, res.StatusCode)
+		}
+	}
+}
+
+func TestVerifyAccess_BlobParams(t *testing.T) {
+	app := newTestApp()
+	u, err := sign.SignURL(&url.URL{Path: "/blob/result.png", RawQuery: "transform=fit-in/100x100&original=originals/a.png"}, testSignSecret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signed, _ := url.Parse(*u)
+	changed := signed.Query()
+	changed.Set("original", "originals/b.png")
+	added, _ := url.Parse(signedPath(t, "/blob/result.png"))
+	addedQuery := added.Query()
+	addedQuery.Set("original", "originals/b.png")
+
+	for uri, want := range map[string]int{
+		signed.RequestURI():                       fiber.StatusOK,
+		"/blob/result.png?" + changed.Encode():    fiber.StatusUnauthorized,
+		"/blob/result.png?" + addedQuery.Encode(): fiber.StatusUnauthorized,
+	} {
+		res, err := app.Test(httptest.NewRequest(http.MethodGet, uri, nil))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if res.StatusCode != want {
+			t.Errorf("%s: expected status %d, got %d", uri, want, res.StatusCode)
+		}
+	}
+}
@@ -0,0 +1,74 @@
+package mw
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"slices"
+	"strings"
+)
+
+const (
+	// Download, list, and process files
+	ScopeFilesRead = "files:read"
+	// Upload and delete files, and warm processed images
+	ScopeFilesWrite = "files:write"
+	// Create signed URLs
+	ScopeSign = "sign"
+	// Use the /admin endpoints
+	ScopeAdmin = "admin"
+)
+
+// Scopes are every scope an API key can be granted
+var Scopes = []string{ScopeFilesRead, ScopeFilesWrite, ScopeSign, ScopeAdmin}
+
+// APIKeys maps API keys to the scopes they are granted
+type APIKeys map[string][]string
+
+// ParseAPIKeys parses API keys from a JSON object of keys and their scopes,
+// e.g. {"analytics-key": ["files:read"]}. "*" grants every scope.
+func ParseAPIKeys(data []byte) (APIKeys, error) {
+	keys := APIKeys{}
+	if len(strings.TrimSpace(string(data))) == 0 {
+		return keys, nil
+	}
+	if err := json.Unmarshal(data, &keys); err != nil {
+		return nil, fmt.Errorf("invalid API keys: %w", err)
+	}
+	for key, scopes := range keys {
+		if key == "" {
+			return nil, fmt.Errorf("invalid API keys: keys can't be empty")
+		}
+		if slices.Contains(scopes, "*") {
+			keys[key] = Scopes
+			continue
+		}
+		for _, scope := range scopes {
+			if !slices.Contains(Scopes, scope) {
+				return nil, fmt.Errorf("invalid scope %q: must be one of %s or *", scope, strings.Join(Scopes, ", "))
+			}
+		}
+	}
+	return keys, nil
+}
+
+// Lookup returns the scopes of an API key, reporting false if it isn't one.
+// The key is compared against every key, so the time it takes doesn't tell how
+// many keys there are or which one matched.
+func (k APIKeys) Lookup(key string) ([]string, bool) {
+	var scopes []string
+	found := false
+	for candidate, granted := range k {
+		if subtle.ConstantTimeCompare([]byte(key), []byte(candidate)) == 1 {
+			scopes, found = granted, true
+		}
+	}
+	return scopes, found
+}
+
+// Allows reports whether an API key is granted scope. An empty scope only
+// requires a valid key.
+func (k APIKeys) Allows(key, scope string) bool {
+	scopes, ok := k.Lookup(key)
+	return ok && (scope == "" || slices.Contains(scopes, scope))
+}
@@ -0,0 +1,65 @@
+package mw
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gofiber/fiber/v3"
+)
+
+func TestParseAPIKeys(t *testing.T) {
+	keys, err := ParseAPIKeys([]byte(`{"analytics": ["files:read"], "ops": ["*"]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !keys.Allows("analytics", ScopeFilesRead) || keys.Allows("analytics", ScopeFilesWrite) {
+		t.Errorf("expected analytics to only read files, got %v", keys["analytics"])
+	}
+	if len(keys["ops"]) != len(Scopes) {
+		t.Errorf("expected * to grant every scope, got %v", keys["ops"])
+	}
+
+	for _, data := range []string{`{"a": ["files:delete"]}`, `{"": ["admin"]}`, `["admin"]`} {
+		if _, err := ParseAPIKeys([]byte(data)); err == nil {
+			t.Errorf("expected %s to be rejected", data)
+		}
+	}
+}
+
+func TestVerifyAPIKey_Scopes(t *testing.T) {
+	keys := APIKeys{testSecretKey: Scopes, "analytics": {ScopeFilesRead}}
+	app := fiber.New()
+	ok := func(c fiber.Ctx) error { return c.SendStatus(fiber.StatusOK) }
+	app.Get("/blob/*", ok, NewVerifyAccess(keys, ScopeFilesRead, testSignSecret))
+	app.Put("/blob/*", ok, NewVerifyAccess(keys, ScopeFilesWrite, testSignSecret))
+	app.Get("/admin/gc", ok, NewVerifyAPIKey(keys, ScopeAdmin))
+	app.Get("/ping", ok, NewVerifyAPIKey(keys, ""))
+
+	tests := []struct {
+		method string
+		path   string
+		key    string
+		want   int
+	}{
+		{http.MethodGet, "/blob/a.png", "analytics", fiber.StatusOK},
+		{http.MethodPut, "/blob/a.png", "analytics", fiber.StatusForbidden},
+		{http.MethodGet, "/admin/gc", "analytics", fiber.StatusForbidden},
+		{http.MethodGet, "/ping", "analytics", fiber.StatusOK},
+		{http.MethodPut, "/blob/a.png", testSecretKey, fiber.StatusOK},
+		{http.MethodGet, "/admin/gc", testSecretKey, fiber.StatusOK},
+		{http.MethodGet, "/admin/gc", "unknown", fiber.StatusUnauthorized},
+		{http.MethodPut, "/blob/a.png", "unknown", fiber.StatusUnauthorized},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest(tt.method, tt.path, nil)
+		req.Header.Set("x-api-key", tt.key)
+		res, err := app.Test(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if res.StatusCode != tt.want {
+			t.Errorf("%s %s with %s: expected status %d, got %d", tt.method, tt.path, tt.key, tt.want, res.StatusCode)
+		}
+	}
+}
@@ -0,0 +1,18 @@
+package mw
+
+import (
+	"github.com/gofiber/fiber/v3"
+	"github.com/gofiber/fiber/v3/middleware/compress"
+)
+
+// NewCompress compresses responses for clients that accept it. Unlike
+// compress.New, it sets Vary: Accept-Encoding on every response, not only on
+// those it compressed, so caches don't serve an uncompressed response to
+// clients that would get a compressed one or the other way around.
+func NewCompress(level compress.Level) fiber.Handler {
+	handler := compress.New(compress.Config{Level: level})
+	return func(c fiber.Ctx) error {
+		c.Vary(fiber.HeaderAcceptEncoding)
+		return handler(c)
+	}
+}
@@ -0,0 +1,47 @@
+package mw
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gofiber/fiber/v3"
+	"github.com/gofiber/fiber/v3/middleware/compress"
+)
+
+func TestNewCompress(t *testing.T) {
+	app := fiber.New()
+	app.Get("/", func(c fiber.Ctx) error {
+		return c.SendString(c.Query("body"))
+	}, NewCompress(compress.LevelBestSpeed))
+
+	tests := []struct {
+		name     string
+		encoding string
+		body     string
+		want     string
+	}{
+		{"compressed", "gzip", strings.Repeat("a", 1024), "gzip"},
+		{"not accepted", "", strings.Repeat("a", 1024), ""},
+		{"too short", "gzip", "a", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/?body="+tt.body, nil)
+			if tt.encoding != "" {
+				req.Header.Set(fiber.HeaderAcceptEncoding, tt.encoding)
+			}
+			res, err := app.Test(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := res.Header.Get(fiber.HeaderContentEncoding); got != tt.want {
+				t.Errorf("expected encoding %q, got %q", tt.want, got)
+			}
+			if got := res.Header.Values(fiber.HeaderVary); len(got) != 1 || got[0] != fiber.HeaderAcceptEncoding {
+				t.Errorf("expected Vary: Accept-Encoding once, got %q", got)
+			}
+		})
+	}
+}
@@ -0,0 +1,84 @@
+package mw
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+
+	"github.com/gofiber/fiber/v3"
+)
+
+// protectedHeaders describe the framing or content of a response, so
+// overriding them would corrupt it
+var protectedHeaders = map[string]bool{
+	"Connection":        true,
+	"Content-Encoding":  true,
+	"Content-Length":    true,
+	"Content-Range":     true,
+	"Content-Type":      true,
+	"Date":              true,
+	"Etag":              true,
+	"Keep-Alive":        true,
+	"Last-Modified":     true,
+	"Location":          true,
+	"Set-Cookie":        true,
+	"Trailer":           true,
+	"Transfer-Encoding": true,
+	"Upgrade":           true,
+}
+
+var headerName = regexp.MustCompile("^[!#$%&'*+.^_`|~0-9A-Za-z-]+$")
+
+// ParseResponseHeaders parses a map of response headers, either as a JSON
+// object or as a comma-separated list of name:value pairs, e.g.
+// "X-Content-Type-Options:nosniff,Server:images". Headers that describe the
+// framing or content of a response, e.g. Content-Length, are rejected.
+func ParseResponseHeaders(s string) (map[string]string, error) {
+	headers := map[string]string{}
+	s = strings.TrimSpace(s)
+	if strings.HasPrefix(s, "{") {
+		if err := json.Unmarshal([]byte(s), &headers); err != nil {
+			return nil, fmt.Errorf("invalid response headers: %w", err)
+		}
+	} else {
+		for _, pair := range strings.Split(s, ",") {
+			if strings.TrimSpace(pair) == "" {
+				continue
+			}
+			name, value, ok := strings.Cut(pair, ":")
+			if !ok {
+				return nil, fmt.Errorf("invalid response header %q: must be name:value", pair)
+			}
+			headers[strings.TrimSpace(name)] = strings.TrimSpace(value)
+		}
+	}
+
+	canonical := make(map[string]string, len(headers))
+	for name, value := range headers {
+		if !headerName.MatchString(name) {
+			return nil, fmt.Errorf("invalid response header name %q", name)
+		}
+		if strings.ContainsAny(value, "\r\n\x00") {
+			return nil, fmt.Errorf("invalid value of response header %s", name)
+		}
+		name = http.CanonicalHeaderKey(name)
+		if protectedHeaders[name] {
+			return nil, fmt.Errorf("response header %s can't be overridden", name)
+		}
+		canonical[name] = value
+	}
+	return canonical, nil
+}
+
+// NewResponseHeaders returns a middleware that adds headers to every response.
+// They are defaults: a handler that sets the same header overrides them.
+func NewResponseHeaders(headers map[string]string) func(c fiber.Ctx) error {
+	return func(c fiber.Ctx) error {
+		for name, value := range headers {
+			c.Set(name, value)
+		}
+		return c.Next()
+	}
+}
@@ -0,0 +1,68 @@
+package mw
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gofiber/fiber/v3"
+)
+
+func TestParseResponseHeaders(t *testing.T) {
+	tests := []struct {
+		name    string
+		value   string
+		want    map[string]string
+		wantErr bool
+	}{
+		{"empty", "", map[string]string{}, false},
+		{"pairs", "x-content-type-options: nosniff, Server:images", map[string]string{"X-Content-Type-Options": "nosniff", "Server": "images"}, false},
+		{"json", `{"Cache-Control": "public, max-age=60"}`, map[string]string{"Cache-Control": "public, max-age=60"}, false},
+		{"protected", "content-length:0", nil, true},
+		{"protected json", `{"Transfer-Encoding": "chunked"}`, nil, true},
+		{"missing value", "X-Frame-Options", nil, true},
+		{"invalid name", `{"X Bad": "1"}`, nil, true},
+		{"header injection", `{"X-Bad": "1\r\nSet-Cookie: a=b"}`, nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ParseResponseHeaders(tt.value)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("unexpected error %v", err)
+			}
+			if len(got) != len(tt.want) {
+				t.Fatalf("expected %v, got %v", tt.want, got)
+			}
+			for name, value := range tt.want {
+				if got[name] != value {
+					t.Errorf("expected %s: %q, got %q", name, value, got[name])
+				}
+			}
+		})
+	}
+}
+
+func TestResponseHeaders(t *testing.T) {
+	app := fiber.New()
+	app.Use(NewResponseHeaders(map[string]string{"Server": "images", "Cache-Control": "no-store"}))
+	app.Get("/", func(c fiber.Ctx) error {
+		return c.SendStatus(fiber.StatusOK)
+	})
+	app.Get("/cached", func(c fiber.Ctx) error {
+		c.Set(fiber.HeaderCacheControl, "public, max-age=60")
+		return c.SendStatus(fiber.StatusOK)
+	})
+
+	for path, want := range map[string]string{"/": "no-store", "/cached": "public, max-age=60", "/missing": "no-store"} {
+		res, err := app.Test(httptest.NewRequest(http.MethodGet, path, nil))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := res.Header.Get(fiber.HeaderCacheControl); got != want {
+			t.Errorf("%s: expected Cache-Control %q, got %q", path, want, got)
+		}
+		if got := res.Header.Get(fiber.HeaderServer); got != "images" {
+			t.Errorf("%s: expected Server images, got %q", path, got)
+		}
+	}
+}
@@ -0,0 +1,58 @@
+package mw
+
+import (
+	"net"
+	"strings"
+
+	"github.com/gofiber/fiber/v3"
+	"github.com/jaredLunde/railway-image-service/internal/pkg/httperr"
+)
+
+// NewAllowedHosts returns a middleware that rejects requests with a 400 unless
+// their Host header is in hosts. Hosts match case-insensitively, and a host
+// without a port matches any port. "*.example.com" matches every subdomain of
+// example.com, but not example.com itself. An empty list allows every host.
+func NewAllowedHosts(hosts []string) func(c fiber.Ctx) error {
+	allowed := make([]string, 0, len(hosts))
+	for _, h := range hosts {
+		if h = normalizeHost(h); h != "" {
+			allowed = append(allowed, h)
+		}
+	}
+	return func(c fiber.Ctx) error {
+		if len(allowed) == 0 || hostAllowed(allowed, string(c.Request().Host())) {
+			return c.Next()
+		}
+		return httperr.SendMessage(c, fiber.StatusBadRequest, "host not allowed")
+	}
+}
+
+func hostAllowed(allowed []string, host string) bool {
+	host = normalizeHost(host)
+	if host == "" {
+		return false
+	}
+	hostname := host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		hostname = h
+	}
+	for _, pattern := range allowed {
+		name := hostname
+		if _, _, err := net.SplitHostPort(pattern); err == nil {
+			// the port has to match too
+			name = host
+		}
+		if pattern == "*" || pattern == name {
+			return true
+		}
+		if suffix, ok := strings.CutPrefix(pattern, "*"); ok && strings.HasPrefix(suffix, ".") &&
+			len(name) > len(suffix) && strings.HasSuffix(name, suffix) {
+			return true
+		}
+	}
+	return false
+}
+
+func normalizeHost(host string) string {
+	return strings.TrimSuffix(strings.ToLower(strings.TrimSpace(host)), ".")
+}
@@ -0,0 +1,50 @@
+package mw
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gofiber/fiber/v3"
+)
+
+func TestAllowedHosts(t *testing.T) {
+	tests := []struct {
+		name    string
+		allowed []string
+		host    string
+		want    int
+	}{
+		{"no allowlist", nil, "evil.com", fiber.StatusOK},
+		{"exact", []string{"images.example.com"}, "images.example.com", fiber.StatusOK},
+		{"case and port", []string{"Images.Example.com"}, "images.example.COM:8080", fiber.StatusOK},
+		{"not listed", []string{"images.example.com"}, "evil.com", fiber.StatusBadRequest},
+		{"suffix of a listed host", []string{"example.com"}, "evilexample.com", fiber.StatusBadRequest},
+		{"wildcard subdomain", []string{"*.example.com"}, "tenant.example.com", fiber.StatusOK},
+		{"wildcard nested subdomain", []string{"*.example.com"}, "a.b.example.com", fiber.StatusOK},
+		{"wildcard apex", []string{"*.example.com"}, "example.com", fiber.StatusBadRequest},
+		{"wildcard lookalike", []string{"*.example.com"}, "tenant.example.com.evil.com", fiber.StatusBadRequest},
+		{"port must match", []string{"localhost:3000"}, "localhost:4000", fiber.StatusBadRequest},
+		{"port matches", []string{"localhost:3000"}, "localhost:3000", fiber.StatusOK},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			app := fiber.New()
+			app.Use(NewAllowedHosts(tt.allowed))
+			app.Get("/", func(c fiber.Ctx) error {
+				return c.SendStatus(fiber.StatusOK)
+			})
+
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			req.Host = tt.host
+			res, err := app.Test(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if res.StatusCode != tt.want {
+				t.Errorf("expected status %d, got %d", tt.want, res.StatusCode)
+			}
+		})
+	}
+}
@@ -24,12 +24,17 @@ func NewLogger(logger *slog.Logger, level ...slog.Level) func(fiber.Ctx) error {
 			return err
 		}
 
-		logger.Log(c.Context(), logLevel,
-			fmt.Sprintf("%s %s", c.Method(), c.Path()),
+		attrs := []any{
 			"status", c.Response().StatusCode(),
 			"ip", GetRealIP(c),
+			"request_id", RequestID(c),
 			"duration", time.Since(c.Context().Time()).String(),
-		)
+		}
+		// the result cache outcome of image processing requests
+		if cache := c.GetRespHeader("X-Imagor-Cache"); cache != "" {
+			attrs = append(attrs, "cache", cache)
+		}
+		logger.Log(c.Context(), logLevel, fmt.Sprintf("%s %s", c.Method(), c.Path()), attrs...)
 
 		return nil
 	}
@@ -0,0 +1,23 @@
+package mw
+
+import (
+	"strings"
+
+	"github.com/gofiber/fiber/v3"
+	"github.com/jaredLunde/railway-image-service/internal/pkg/httperr"
+)
+
+// NewMethodNotAllowed returns a handler that should be registered for all
+// methods after a route's real handlers. It responds with a 405 and an Allow
+// header listing the methods the route supports. OPTIONS requests that were not
+// handled as CORS preflights get the Allow header and a 204.
+func NewMethodNotAllowed(methods ...string) func(c fiber.Ctx) error {
+	allow := strings.Join(append(methods, fiber.MethodOptions), ", ")
+	return func(c fiber.Ctx) error {
+		c.Set(fiber.HeaderAllow, allow)
+		if c.Method() == fiber.MethodOptions {
+			return c.SendStatus(fiber.StatusNoContent)
+		}
+		return httperr.SendMessage(c, fiber.StatusMethodNotAllowed, "method not allowed")
+	}
+}
@@ -0,0 +1,61 @@
+package mw
+
+import (
+	"encoding/json"
+	"io"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gofiber/fiber/v3"
+	"github.com/jaredLunde/railway-image-service/internal/pkg/httperr"
+)
+
+func TestNewMethodNotAllowed(t *testing.T) {
+	app := fiber.New()
+	app.Get("/blob", func(c fiber.Ctx) error {
+		return c.SendStatus(fiber.StatusOK)
+	})
+	app.All("/blob", NewMethodNotAllowed(fiber.MethodGet, fiber.MethodPost))
+
+	tests := []struct {
+		method string
+		want   int
+	}{
+		{fiber.MethodGet, fiber.StatusOK},
+		{fiber.MethodOptions, fiber.StatusNoContent},
+		{fiber.MethodDelete, fiber.StatusMethodNotAllowed},
+		{fiber.MethodPut, fiber.StatusMethodNotAllowed},
+	}
+	for _, tt := range tests {
+		t.Run(tt.method, func(t *testing.T) {
+			res, err := app.Test(httptest.NewRequest(tt.method, "/blob", nil))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if res.StatusCode != tt.want {
+				t.Fatalf("expected status %d, got %d", tt.want, res.StatusCode)
+			}
+			allow := res.Header.Get(fiber.HeaderAllow)
+			if tt.want == fiber.StatusOK {
+				if allow != "" {
+					t.Errorf("expected no Allow header from the real handler, got %q", allow)
+				}
+				return
+			}
+			if allow != "GET, POST, OPTIONS" {
+				t.Errorf("expected Allow: GET, POST, OPTIONS, got %q", allow)
+			}
+			body, _ := io.ReadAll(res.Body)
+			if tt.want == fiber.StatusNoContent {
+				if len(body) != 0 {
+					t.Errorf("expected no body, got %q", body)
+				}
+				return
+			}
+			var e httperr.Response
+			if err := json.Unmarshal(body, &e); err != nil || e.Error.Code != "method_not_allowed" {
+				t.Errorf("expected the error envelope, got %q", body)
+			}
+		})
+	}
+}
@@ -0,0 +1,125 @@
+package mw
+
+import (
+	"math"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gofiber/fiber/v3"
+	"github.com/jaredLunde/railway-image-service/internal/pkg/httperr"
+)
+
+// How often buckets that refilled completely are forgotten
+const rateLimitSweepInterval = time.Minute
+
+// NewRateLimit limits each client to rps requests per second with a token
+// bucket that allows bursts of up to burst requests. Clients are told apart by
+// their API key or else by their IP address. Unknown API keys count against
+// the IP address, as do signed URLs unless NewVerifyAccess verified them, so
+// made-up keys and signatures can't get around the limit. Verified signatures
+// are limited by WithSignatureRateLimit instead. Limited requests are rejected
+// with a 429 and a Retry-After header. A burst < 1 defaults to rps, rounded up.
+func NewRateLimit(rps float64, burst int, keys APIKeys) fiber.Handler {
+	l := newRateLimiter(rps, burst)
+	return func(c fiber.Ctx) error {
+		subject, known := rateLimitSubject(c, keys)
+		if known || c.Query("x-signature") == "" {
+			if ok, wait := l.allow(subject, time.Now()); !ok {
+				return sendRateLimited(c, wait)
+			}
+			return c.Next()
+		}
+		// whether the signature counts against the IP address isn't known
+		// until it has been verified, so it's only charged afterwards
+		if ok, wait := l.peek(subject, time.Now()); !ok {
+			return sendRateLimited(c, wait)
+		}
+		err := c.Next()
+		if !hasVerifiedSignature(c) {
+			l.allow(subject, time.Now())
+		}
+		return err
+	}
+}
+
+func sendRateLimited(c fiber.Ctx, wait time.Duration) error {
+	c.Set(fiber.HeaderRetryAfter, strconv.Itoa(max(int(math.Ceil(wait.Seconds())), 1)))
+	return httperr.SendMessage(c, fiber.StatusTooManyRequests, "rate limit exceeded")
+}
+
+// rateLimitSubject returns who a request counts against, and whether it
+// carries a known API key
+func rateLimitSubject(c fiber.Ctx, keys APIKeys) (string, bool) {
+	if key := c.Get("x-api-key"); key != "" {
+		if _, ok := keys.Lookup(key); ok {
+			return "key:" + key, true
+		}
+	}
+	return "ip:" + GetRealIP(c), false
+}
+
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+type rateLimiter struct {
+	mu        sync.Mutex
+	rate      float64
+	burst     float64
+	buckets   map[string]*bucket
+	lastSweep time.Time
+}
+
+func newRateLimiter(rps float64, burst int) *rateLimiter {
+	if burst < 1 {
+		burst = max(int(math.Ceil(rps)), 1)
+	}
+	return &rateLimiter{rate: rps, burst: float64(burst), buckets: map[string]*bucket{}, lastSweep: time.Now()}
+}
+
+// allow takes a token from the bucket of subject, returning how long until
+// the next one if it's empty
+func (l *rateLimiter) allow(subject string, now time.Time) (bool, time.Duration) {
+	return l.take(subject, now, true)
+}
+
+// peek is like allow, but leaves the token in the bucket
+func (l *rateLimiter) peek(subject string, now time.Time) (bool, time.Duration) {
+	return l.take(subject, now, false)
+}
+
+func (l *rateLimiter) take(subject string, now time.Time, consume bool) (bool, time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if now.Sub(l.lastSweep) >= rateLimitSweepInterval {
+		l.sweep(now)
+	}
+
+	b, ok := l.buckets[subject]
+	if !ok {
+		b = &bucket{tokens: l.burst, last: now}
+		l.buckets[subject] = b
+	}
+	b.tokens = min(l.burst, b.tokens+now.Sub(b.last).Seconds()*l.rate)
+	b.last = now
+	if b.tokens >= 1 {
+		if consume {
+			b.tokens--
+		}
+		return true, 0
+	}
+	return false, time.Duration((1 - b.tokens) / l.rate * float64(time.Second))
+}
+
+// sweep forgets buckets that refilled completely, since a new bucket is the
+// same as a full one
+func (l *rateLimiter) sweep(now time.Time) {
+	for subject, b := range l.buckets {
+		if b.tokens+now.Sub(b.last).Seconds()*l.rate >= l.burst {
+			delete(l.buckets, subject)
+		}
+	}
+	l.lastSweep = now
+}
@@ -0,0 +1,122 @@
+package mw
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gofiber/fiber/v3"
+)
+
+func TestRateLimit(t *testing.T) {
+	keys := APIKeys{testSecretKey: Scopes}
+	app := fiber.New()
+	app.Use(NewRateLimit(1, 2, keys))
+	app.Get("/serve/*", func(c fiber.Ctx) error { return c.SendStatus(fiber.StatusOK) })
+
+	get := func(path, key string) *http.Response {
+		req := httptest.NewRequest(http.MethodGet, path, nil)
+		if key != "" {
+			req.Header.Set("x-api-key", key)
+		}
+		res, err := app.Test(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return res
+	}
+
+	for n := 0; n < 2; n++ {
+		if res := get("/serve/a.png", testSecretKey); res.StatusCode != fiber.StatusOK {
+			t.Fatalf("expected request %d within the burst to succeed, got %d", n, res.StatusCode)
+		}
+	}
+	res := get("/serve/a.png", testSecretKey)
+	if res.StatusCode != fiber.StatusTooManyRequests {
+		t.Fatalf("expected status %d, got %d", fiber.StatusTooManyRequests, res.StatusCode)
+	}
+	if res.Header.Get(fiber.HeaderRetryAfter) != "1" {
+		t.Errorf("expected Retry-After 1, got %q", res.Header.Get(fiber.HeaderRetryAfter))
+	}
+
+	// other clients have buckets of their own, and unknown keys and
+	// unverified signatures count against the IP address
+	if res := get("/serve/a.png?x-signature=abc", ""); res.StatusCode != fiber.StatusOK {
+		t.Errorf("expected the IP address to have its own limit, got %d", res.StatusCode)
+	}
+	get("/serve/a.png?x-signature=def", "")
+	if res := get("/serve/a.png", "made-up"); res.StatusCode != fiber.StatusTooManyRequests {
+		t.Errorf("expected signatures and unknown keys to share a limit, got %d", res.StatusCode)
+	}
+}
+
+func TestRateLimit_Signatures(t *testing.T) {
+	app := fiber.New()
+	app.Use(NewRateLimit(1, 2, testKeys))
+	app.Get("/blob/*", func(c fiber.Ctx) error {
+		return c.SendStatus(fiber.StatusOK)
+	}, NewVerifyAccess(testKeys, ScopeFilesRead, testSignSecret, WithSignatureRateLimit(1, 2)))
+
+	get := func(uri string) int {
+		res, err := app.Test(httptest.NewRequest(http.MethodGet, uri, nil))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return res.StatusCode
+	}
+
+	// verified signatures each have a limit of their own rather than sharing
+	// the IP address's
+	a, b := signedPath(t, "/blob/a.png"), signedPath(t, "/blob/b.png")
+	for n := 0; n < 2; n++ {
+		if status := get(a); status != fiber.StatusOK {
+			t.Fatalf("expected request %d within the burst to succeed, got %d", n, status)
+		}
+	}
+	if status := get(a); status != fiber.StatusTooManyRequests {
+		t.Fatalf("expected status %d, got %d", fiber.StatusTooManyRequests, status)
+	}
+	if status := get(b); status != fiber.StatusOK {
+		t.Fatalf("expected another signature to have its own limit, got %d", status)
+	}
+
+	// whereas unverified ones count against the IP address
+	expire := fmt.Sprint(time.Now().Add(time.Hour).UnixMilli())
+	bogus := "/blob/a.png?x-signature=" + strings.Repeat("a", signatureLength) + "&x-expire=" + expire
+	for n := 0; n < 2; n++ {
+		if status := get(bogus); status != fiber.StatusUnauthorized {
+			t.Fatalf("expected status %d, got %d", fiber.StatusUnauthorized, status)
+		}
+	}
+	if status := get(bogus); status != fiber.StatusTooManyRequests {
+		t.Fatalf("expected status %d, got %d", fiber.StatusTooManyRequests, status)
+	}
+	if status := get("/blob/c.png"); status != fiber.StatusTooManyRequests {
+		t.Errorf("expected the IP address to be limited, got %d", status)
+	}
+}
+
+func TestRateLimiter_Refill(t *testing.T) {
+	l := &rateLimiter{rate: 2, burst: 1, buckets: map[string]*bucket{}}
+	now := time.Now()
+	l.lastSweep = now
+	if ok, _ := l.allow("a", now); !ok {
+		t.Fatal("expected the first request to be allowed")
+	}
+	ok, wait := l.allow("a", now)
+	if ok || wait != 500*time.Millisecond {
+		t.Fatalf("expected to wait 500ms, got %v %v", ok, wait)
+	}
+	if ok, _ := l.allow("a", now.Add(500*time.Millisecond)); !ok {
+		t.Fatal("expected a token after 500ms")
+	}
+
+	l.allow("b", now)
+	l.allow("a", now.Add(rateLimitSweepInterval))
+	if _, ok := l.buckets["b"]; ok {
+		t.Error("expected full buckets to be swept")
+	}
+}
@@ -1,8 +1,10 @@
 package mw
 
 import (
+	"fmt"
 	"net"
 	"net/http"
+	"net/netip"
 	"strings"
 
 	"github.com/gofiber/fiber/v3"
@@ -17,6 +19,32 @@ var (
 	xRealIP                 = http.CanonicalHeaderKey("X-Real-IP")
 )
 
+// ParseTrustedProxies parses a list of proxy IP addresses and CIDRs, e.g.
+// "10.0.0.0/8". Empty entries are skipped.
+func ParseTrustedProxies(proxies []string) ([]netip.Prefix, error) {
+	prefixes := make([]netip.Prefix, 0, len(proxies))
+	for _, p := range proxies {
+		if p = strings.TrimSpace(p); p == "" {
+			continue
+		}
+		if strings.Contains(p, "/") {
+			prefix, err := netip.ParsePrefix(p)
+			if err != nil {
+				return nil, fmt.Errorf("invalid trusted proxy %q: %w", p, err)
+			}
+			prefixes = append(prefixes, prefix.Masked())
+			continue
+		}
+		addr, err := netip.ParseAddr(p)
+		if err != nil {
+			return nil, fmt.Errorf("invalid trusted proxy %q: %w", p, err)
+		}
+		addr = addr.Unmap()
+		prefixes = append(prefixes, netip.PrefixFrom(addr, addr.BitLen()))
+	}
+	return prefixes, nil
+}
+
 // RealIP is a middleware that sets a request's real IP address to fiber Locals.
 // This is guaranteed to return the correct IP address if the request has passed
 // through CloudFront or Cloudflare.
@@ -24,22 +52,40 @@ var (
 // This middleware should be inserted fairly early in the middleware stack to
 // ensure that subsequent layers will be able to use the intended value.
 //
-// You should only use this middleware if you can trust the headers passed to
-// you (in particular, the headers this middleware uses), for example
-// because you have placed a reverse proxy like HAProxy or nginx in front of
-// of the server.
-func NewRealIP() func(fiber.Ctx) error {
+// The headers this middleware uses can be set by anyone, so they are only
+// honored for requests whose peer is one of trustedProxies, e.g. a reverse
+// proxy like HAProxy or nginx in front of the server. Other requests get the
+// IP of the peer.
+func NewRealIP(trustedProxies []netip.Prefix) func(fiber.Ctx) error {
 	return func(c fiber.Ctx) error {
-		if rip := realIP(c); rip != "" {
+		peer := c.IP()
+		if !trusted(trustedProxies, peer) {
+			c.Locals(RealIPKey, peer)
+		} else if rip := realIP(c, trustedProxies); rip != "" {
 			c.Locals(RealIPKey, rip)
 		} else {
-			c.Locals(RealIPKey, c.IP())
+			c.Locals(RealIPKey, peer)
 		}
 		return c.Next()
 	}
 }
 
-func realIP(c fiber.Ctx) string {
+// trusted reports whether ip is one of the trusted proxies
+func trusted(proxies []netip.Prefix, ip string) bool {
+	addr, err := netip.ParseAddr(ip)
+	if err != nil {
+		return false
+	}
+	addr = addr.Unmap()
+	for _, p := range proxies {
+		if p.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+func realIP(c fiber.Ctx, proxies []netip.Prefix) string {
 	var ip string
 
 	if cip := c.Get(cloudfrontViewerAddress); cip != "" {
@@ -56,11 +102,15 @@ func realIP(c fiber.Ctx) string {
 	} else if xrip := c.Get(xRealIP); xrip != "" {
 		ip = xrip
 	} else if xff := c.Get(xForwardedFor); xff != "" {
-		i := strings.Index(xff, ",")
-		if i == -1 {
-			i = len(xff)
+		// every proxy appends the address it got the request from, so the
+		// client is the last address that isn't a trusted proxy
+		hops := strings.Split(xff, ",")
+		for i := len(hops) - 1; i >= 0; i-- {
+			ip = strings.TrimSpace(hops[i])
+			if !trusted(proxies, ip) {
+				break
+			}
 		}
-		ip = xff[:i]
 	} else if f := c.Get(forwarded); f != "" {
 		i := strings.Split(f, ",")
 		for _, v := range i {
@@ -0,0 +1,49 @@
+package mw
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gofiber/fiber/v3"
+)
+
+func TestRealIP(t *testing.T) {
+	tests := []struct {
+		name    string
+		trusted []string
+		header  string
+		value   string
+		want    string
+	}{
+		{"untrusted peer", nil, "X-Real-IP", "203.0.113.7", "0.0.0.0"},
+		{"untrusted peer forwarded", []string{"10.0.0.0/8"}, "X-Forwarded-For", "203.0.113.7", "0.0.0.0"},
+		{"trusted peer", []string{"0.0.0.0"}, "X-Real-IP", "203.0.113.7", "203.0.113.7"},
+		{"trusted peer forwarded", []string{"0.0.0.0", "10.0.0.0/8"}, "X-Forwarded-For", "198.51.100.1, 203.0.113.7, 10.0.0.2", "203.0.113.7"},
+		{"invalid header", []string{"0.0.0.0"}, "X-Real-IP", "nope", "0.0.0.0"},
+	}
+	for _, tt := range tests {
+		proxies, err := ParseTrustedProxies(tt.trusted)
+		if err != nil {
+			t.Fatal(err)
+		}
+		app := fiber.New()
+		app.Use(NewRealIP(proxies))
+		app.Get("/", func(c fiber.Ctx) error { return c.SendString(GetRealIP(c)) })
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.Header.Set(tt.header, tt.value)
+		res, err := app.Test(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body := make([]byte, 64)
+		n, _ := res.Body.Read(body)
+		if got := string(body[:n]); got != tt.want {
+			t.Errorf("%s: expected %q, got %q", tt.name, tt.want, got)
+		}
+	}
+
+	if _, err := ParseTrustedProxies([]string{"not-an-ip"}); err == nil {
+		t.Error("expected an invalid proxy to be rejected")
+	}
+}
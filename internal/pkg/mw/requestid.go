@@ -0,0 +1,40 @@
+package mw
+
+import (
+	"github.com/gofiber/fiber/v3"
+	"github.com/gofiber/fiber/v3/middleware/requestid"
+)
+
+// maxRequestIDLength bounds inbound request IDs, which end up in every log line
+const maxRequestIDLength = 128
+
+// NewRequestID assigns each request an ID in header and echoes it on the
+// response. With trustInbound, an ID sent by an upstream proxy is reused so
+// traces stay continuous, as long as it is a short, printable token.
+func NewRequestID(header string, trustInbound bool) fiber.Handler {
+	h := requestid.New(requestid.Config{Header: header})
+	return func(c fiber.Ctx) error {
+		if !trustInbound || !validRequestID(c.Get(header)) {
+			c.Request().Header.Del(header)
+		}
+		return h(c)
+	}
+}
+
+// RequestID returns the ID assigned to a request by NewRequestID
+func RequestID(c fiber.Ctx) string {
+	return requestid.FromContext(c)
+}
+
+func validRequestID(id string) bool {
+	if id == "" || len(id) > maxRequestIDLength {
+		return false
+	}
+	for i := 0; i < len(id); i++ {
+		// visible ASCII only, so IDs can't forge log lines
+		if id[i] <= ' ' || id[i] > '~' {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,53 @@
+package mw
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gofiber/fiber/v3"
+)
+
+func TestRequestID(t *testing.T) {
+	tests := []struct {
+		name         string
+		trustInbound bool
+		inbound      string
+		reused       bool
+	}{
+		{"trusted inbound id", true, "trace-123", true},
+		{"untrusted inbound id", false, "trace-123", false},
+		{"no inbound id", true, "", false},
+		{"inbound id with spaces", true, "trace 123", false},
+		{"inbound id too long", true, strings.Repeat("a", maxRequestIDLength+1), false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			app := fiber.New()
+			app.Use(NewRequestID("X-Trace-ID", tt.trustInbound))
+			var seen string
+			app.Get("/", func(c fiber.Ctx) error {
+				seen = RequestID(c)
+				return c.SendStatus(fiber.StatusOK)
+			})
+
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			if tt.inbound != "" {
+				req.Header.Set("X-Trace-ID", tt.inbound)
+			}
+			res, err := app.Test(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got := res.Header.Get("X-Trace-ID")
+			if got == "" || got != seen {
+				t.Fatalf("expected the request ID %q to be echoed, got %q", seen, got)
+			}
+			if (got == tt.inbound) != tt.reused {
+				t.Errorf("expected reused to be %v, got ID %q", tt.reused, got)
+			}
+		})
+	}
+}
@@ -0,0 +1,79 @@
+package mw
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gofiber/fiber/v3"
+	"github.com/gofiber/fiber/v3/middleware/adaptor"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/propagation"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+func TestTrace(t *testing.T) {
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+	recorder := tracetest.NewSpanRecorder()
+	tracer := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder)).Tracer("test")
+
+	app := fiber.New()
+	app.Use(NewRequestID("X-Request-ID", true))
+	app.Use(NewTrace(tracer))
+	app.Get("/blob/*", func(c fiber.Ctx) error {
+		_, span := tracer.Start(c.Context(), "child")
+		span.End()
+		return c.SendStatus(fiber.StatusOK)
+	})
+	// net/http handlers see the span through the request's context too
+	app.Get("/serve/*", adaptor.HTTPHandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, span := tracer.Start(r.Context(), "child")
+		span.End()
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+
+	const traceID = "4bf92f3577b34da6a3ce929d0e0e4736"
+	tests := []struct {
+		path   string
+		name   string
+		status int
+	}{
+		{"/blob/a.png", "GET /blob/*", fiber.StatusOK},
+		{"/serve/a.png", "GET /serve/*", fiber.StatusServiceUnavailable},
+	}
+	for _, tt := range tests {
+		t.Run(tt.path, func(t *testing.T) {
+			recorder.Reset()
+			req := httptest.NewRequest(http.MethodGet, tt.path, nil)
+			req.Header.Set("traceparent", "00-"+traceID+"-00f067aa0ba902b7-01")
+			req.Header.Set("X-Request-ID", "req-123")
+			if _, err := app.Test(req); err != nil {
+				t.Fatal(err)
+			}
+
+			spans := recorder.Ended()
+			if len(spans) != 2 {
+				t.Fatalf("expected 2 spans, got %d", len(spans))
+			}
+			child, server := spans[0], spans[1]
+			if server.Name() != tt.name {
+				t.Errorf("expected span %q, got %q", tt.name, server.Name())
+			}
+			if got := server.SpanContext().TraceID().String(); got != traceID {
+				t.Errorf("expected the inbound trace to continue, got trace %s", got)
+			}
+			if child.Parent().SpanID() != server.SpanContext().SpanID() {
+				t.Error("expected the handler's span to be a child of the request's")
+			}
+			attrs := attribute.NewSet(server.Attributes()...)
+			if v, _ := attrs.Value("http.request.id"); v.AsString() != "req-123" {
+				t.Errorf("expected the request ID on the span, got %q", v.AsString())
+			}
+			if v, _ := attrs.Value("http.response.status_code"); v.AsInt64() != int64(tt.status) {
+				t.Errorf("expected status %d on the span, got %d", tt.status, v.AsInt64())
+			}
+		})
+	}
+}
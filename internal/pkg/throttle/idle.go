@@ -0,0 +1,62 @@
+package throttle
+
+import (
+	"errors"
+	"io"
+	"net"
+	"time"
+)
+
+// ErrIdleTimeout is returned by an idle timeout reader when no bytes arrive
+// within the timeout
+var ErrIdleTimeout = errors.New("read idle timeout")
+
+// ReadDeadliner is the part of a net.Conn an idle timeout reader needs
+type ReadDeadliner interface {
+	SetReadDeadline(t time.Time) error
+}
+
+// NewIdleTimeoutReader fails reads from r, which reads from conn, with
+// ErrIdleTimeout once a read blocks for longer than timeout, so a client that
+// stalls mid-upload is cut off long before the request times out. Each read
+// gets a read deadline on conn, which is put back to deadline between reads,
+// so time spent elsewhere doesn't count and deadline still applies. A zero
+// deadline means none. A timeout <= 0 or a nil conn returns r unchanged.
+func NewIdleTimeoutReader(r io.Reader, conn ReadDeadliner, timeout time.Duration, deadline time.Time) io.Reader {
+	if timeout <= 0 || conn == nil {
+		return r
+	}
+	return &idleReader{r: r, conn: conn, timeout: timeout, deadline: deadline}
+}
+
+type idleReader struct {
+	r        io.Reader
+	conn     ReadDeadliner
+	timeout  time.Duration
+	deadline time.Time
+	err      error
+}
+
+func (t *idleReader) Read(p []byte) (int, error) {
+	if t.err != nil {
+		return 0, t.err
+	}
+	idle := time.Now().Add(t.timeout)
+	if !t.deadline.IsZero() && t.deadline.Before(idle) {
+		// the request times out first
+		return t.r.Read(p)
+	}
+	if err := t.conn.SetReadDeadline(idle); err != nil {
+		return 0, err
+	}
+	n, err := t.r.Read(p)
+	if derr := t.conn.SetReadDeadline(t.deadline); derr != nil && err == nil {
+		err = derr
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		t.err = ErrIdleTimeout
+		return n, t.err
+	}
+	return n, err
+}
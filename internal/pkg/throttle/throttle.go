@@ -0,0 +1,62 @@
+package throttle
+
+import (
+	"io"
+	"time"
+)
+
+// minChunk is the smallest read a throttled reader makes, so slow rates
+// don't turn into many tiny reads
+const minChunk = 32 * 1024
+
+// NewReader limits reads from r to bytesPerSecond with a token bucket that
+// allows bursts of up to one second's worth of bytes. Reads are made in chunks
+// of at least a tenth of that, or 32KiB for slow rates, waiting once before
+// each chunk. A limit <= 0 returns r unchanged.
+func NewReader(r io.Reader, bytesPerSecond int) io.Reader {
+	if bytesPerSecond <= 0 {
+		return r
+	}
+	chunk := max(bytesPerSecond/10, minChunk)
+	return &reader{
+		r:      r,
+		rate:   float64(bytesPerSecond),
+		burst:  float64(max(bytesPerSecond, chunk)),
+		chunk:  chunk,
+		tokens: float64(bytesPerSecond),
+		last:   time.Now(),
+	}
+}
+
+type reader struct {
+	r    io.Reader
+	rate float64
+	// the most tokens the bucket holds, which fits at least one chunk
+	burst  float64
+	chunk  int
+	tokens float64
+	last   time.Time
+}
+
+func (t *reader) Read(p []byte) (int, error) {
+	if len(p) == 0 {
+		return t.r.Read(p)
+	}
+	if len(p) > t.chunk {
+		p = p[:t.chunk]
+	}
+	t.refill()
+	if need := float64(len(p)) - t.tokens; need > 0 {
+		time.Sleep(time.Duration(need / t.rate * float64(time.Second)))
+		t.refill()
+	}
+	n, err := t.r.Read(p)
+	t.tokens -= float64(n)
+	return n, err
+}
+
+func (t *reader) refill() {
+	now := time.Now()
+	t.tokens = min(t.burst, t.tokens+now.Sub(t.last).Seconds()*t.rate)
+	t.last = now
+}
@@ -0,0 +1,108 @@
+package throttle
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestReader(t *testing.T) {
+	data := bytes.Repeat([]byte("a"), 3000)
+	start := time.Now()
+	got, err := io.ReadAll(NewReader(bytes.NewReader(data), 1000))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Fatalf("expected %d bytes, got %d", len(data), len(got))
+	}
+	// The first second's worth is a burst, the rest is paced
+	if elapsed := time.Since(start); elapsed < 1900*time.Millisecond {
+		t.Fatalf("expected reads to be throttled, took %s", elapsed)
+	}
+}
+
+// sizeRecorder records the size of every read
+type sizeRecorder struct {
+	r     io.Reader
+	sizes []int
+}
+
+func (r *sizeRecorder) Read(p []byte) (int, error) {
+	r.sizes = append(r.sizes, len(p))
+	return r.r.Read(p)
+}
+
+func TestReader_Chunks(t *testing.T) {
+	rec := &sizeRecorder{r: bytes.NewReader(make([]byte, 5*minChunk))}
+	// the burst covers three chunks, the rest are waited for
+	r := NewReader(rec, 3*minChunk+minChunk/8)
+	buf := make([]byte, 2*minChunk)
+	for {
+		if _, err := r.Read(buf); err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatal(err)
+		}
+	}
+	for n, size := range rec.sizes {
+		if size != minChunk {
+			t.Fatalf("expected read %d to be of %d bytes, got %d", n, minChunk, size)
+		}
+	}
+}
+
+func TestReader_Unlimited(t *testing.T) {
+	r := bytes.NewReader(nil)
+	if NewReader(r, 0) != io.Reader(r) {
+		t.Fatal("expected reader to be returned unchanged")
+	}
+}
+
+// stallingConn returns its data, then blocks until its read deadline passes
+type stallingConn struct {
+	data      []byte
+	deadline  time.Time
+	deadlines []time.Time
+}
+
+func (c *stallingConn) SetReadDeadline(t time.Time) error {
+	c.deadline = t
+	c.deadlines = append(c.deadlines, t)
+	return nil
+}
+
+func (c *stallingConn) Read(p []byte) (int, error) {
+	if len(c.data) > 0 {
+		n := copy(p, c.data)
+		c.data = c.data[n:]
+		return n, nil
+	}
+	time.Sleep(time.Until(c.deadline))
+	return 0, os.ErrDeadlineExceeded
+}
+
+func TestIdleTimeoutReader(t *testing.T) {
+	deadline := time.Now().Add(time.Hour)
+	conn := &stallingConn{data: []byte("partial upload")}
+	got, err := io.ReadAll(NewIdleTimeoutReader(conn, conn, 50*time.Millisecond, deadline))
+	if !errors.Is(err, ErrIdleTimeout) {
+		t.Fatalf("expected %v, got %v", ErrIdleTimeout, err)
+	}
+	if string(got) != "partial upload" {
+		t.Fatalf("expected the data before the stall, got %q", got)
+	}
+	if last := conn.deadlines[len(conn.deadlines)-1]; !last.Equal(deadline) {
+		t.Errorf("expected the request deadline to be restored, got %v", last)
+	}
+
+	// the request deadline isn't extended
+	conn = &stallingConn{}
+	_, err = io.ReadAll(NewIdleTimeoutReader(conn, conn, time.Hour, time.Now().Add(-time.Second)))
+	if !errors.Is(err, os.ErrDeadlineExceeded) || len(conn.deadlines) != 0 {
+		t.Errorf("expected the request deadline to apply, got %v after %d deadlines", err, len(conn.deadlines))
+	}
+}